@@ -2,32 +2,250 @@ package main
 
 import (
 	"balance-server/server"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/onatm/clockwerk"
 )
 
 var (
-	router = gin.Default()
-	db     = server.NewDatabase()
-	accRep = server.NewAccountRepository(db)
-	acc    = server.NewAccountController(accRep)
+	command, args = parseCommand(os.Args[1:])
+
+	cfg    = loadConfig()
+	logger = server.NewLogger(logOutput(), cfg.Log.Level)
+	router = gin.New()
+	db     = server.NewDatabase(cfg.Database, logger)
+	accRep = server.NewAccountRepository(db, cfg.Ledger, logger)
+	accSrv = server.NewAccountService(accRep, cfg, logger)
+	acc    = server.NewAccountControllerFromService(accSrv, logger)
+	keyRep = server.NewApiKeyRepository(db)
+	keys   = server.NewApiKeyService(keyRep)
+	admRep = server.NewAdminRepository(db)
+	admSrv = server.NewAdminService(admRep)
+	adm    = server.NewAdminController(admRep, logger)
+	ledRep = server.NewLedgerRepository(db)
+	ledSrv = server.NewLedgerService(ledRep)
+	ledger = server.NewLedgerController(ledRep, cfg.Ledger, logger)
+
+	// commands lists commands of the binary, serve runs when no command is given.
+	commands = []string{
+		server.COMMAND_SERVE, server.COMMAND_BALANCE, server.COMMAND_CREDIT, server.COMMAND_DEBIT,
+		server.COMMAND_TRANSFER, server.COMMAND_HISTORY, server.COMMAND_EXPORT,
+		server.COMMAND_BENCH, server.COMMAND_API_KEY, server.COMMAND_LEDGER, server.COMMAND_MIGRATE,
+	}
 )
 
 func main() {
 	defer db.Close()
 
-	txVR := server.NewTransactionViewsRefresher(db)
-	c := clockwerk.New()
-	c.Every(3 * time.Minute).Do(txVR)
+	if command == server.COMMAND_SERVE {
+		serve()
+		return
+	}
+	if err := runCommand(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		db.Close()
+		os.Exit(1)
+	}
+}
+
+func runCommand() error {
+	switch command {
+	case server.COMMAND_API_KEY:
+		return server.ApiKeyCommand(keys, args, os.Stdout)
+	case server.COMMAND_LEDGER:
+		return server.LedgerCommand(ledSrv, cfg.Ledger, args, os.Stdout)
+	case server.COMMAND_MIGRATE:
+		return server.MigrateCommand(server.NewMigrator(db, server.MIGRATIONS, logger), args, os.Stdout)
+	case server.COMMAND_BENCH:
+		return server.BenchCommand(db, cfg, logger, args, os.Stdout)
+	default:
+		return server.AccountCommand(accSrv, admSrv, command, args, os.Stdout)
+	}
+}
+
+func serve() {
+	migrator := server.NewMigrator(db, server.MIGRATIONS, logger)
+	if cfg.Database.MigrateOnStart {
+		if _, err := migrator.Up(context.Background()); err != nil {
+			logger.Error().Err(err).Msg("migration failed")
+			db.Close()
+			os.Exit(1)
+		}
+	}
+	if err := migrator.Check(context.Background()); err != nil {
+		logger.Error().Err(err).Msg("refusing to serve on this schema")
+		db.Close()
+		os.Exit(1)
+	}
+
+	if err := server.ERROR_REGISTRY.Validate(server.Messages); err != nil {
+		panic(err)
+	}
+
+	tracer, err := server.NewTracerProviderFromConfig(context.Background(), cfg.Tracing)
+	if err != nil {
+		panic(err)
+	}
+	defer tracer.Shutdown(context.Background())
+	server.InitTracing(tracer)
+
+	tokens, err := server.NewJwtVerifierFromConfig(cfg.Jwt)
+	if err != nil {
+		panic(err)
+	}
+	auth := server.NewAuthenticator(keys, tokens)
+	partners, err := server.LoadPartnerSecretsFromConfig(cfg.Signature)
+	if err != nil {
+		panic(err)
+	}
+	signatures := server.NewSignatureVerifier(partners, server.NewMemoryNonceStore(cfg.Signature.Window.Duration()), cfg.Signature.Window.Duration())
+	limits, err := server.NewRateLimitStoreFromConfig(cfg.RateLimit, db)
+	if err != nil {
+		panic(err)
+	}
+	limiter := server.NewRateLimiter(limits)
+	policies := cfg.RateLimit.Policies()
+	accRpc := server.NewAccountGrpcServer(accSrv, auth, logger)
+	accRpc.LimitRates(limiter, policies)
+	accRpc.RejectPartners(partners)
+	timeouts := cfg.Http.RequestTimeouts()
+
+	txVR := server.NewTransactionViewsRefresher(db, logger)
+	scheduler := server.NewScheduler()
+	scheduler.Every(cfg.Ledger.ViewRefreshInterval.Duration(), txVR)
+	checkpointer, err := server.NewLedgerCheckpointerFromConfig(ledSrv, cfg.Ledger, logger)
+	if err != nil {
+		panic(err)
+	}
+	if checkpointer != nil {
+		scheduler.Every(cfg.Ledger.CheckpointInterval.Duration(), checkpointer)
+	}
+	if pgLimits, ok := limits.(*server.PostgresRateLimitStore); ok {
+		scheduler.Every(cfg.RateLimit.PurgeInterval.Duration(), pgLimits)
+	}
+
+	scheduler.Start()
 
-	c.Start()
+	readiness := server.NewReadinessFromConfig(db, cfg.Currency)
 
+	server.METRICS_REGISTRY.MustRegister(server.NewPoolCollector(db.Conn))
+	router.Use(server.RequestId(), server.AccessLog(logger), gin.Recovery(), server.Tracing(), server.HttpMetrics())
 	router.NoRoute(server.NoRoute)
-	router.POST(server.URL_TRANSACTION, acc.Transaction)
-	router.POST(server.URL_TRANSFER, acc.Transfer)
-	router.GET(server.URL_BALANCE, acc.Balance)
-	router.GET(server.URL_TRANSACTIONS, acc.Transactions)
-	router.Run()
+	write := router.Group("/", server.Timeout(timeouts[server.RATE_LIMIT_GROUP_WRITE]), server.Authenticate(auth), server.RateLimited(limiter, policies[server.RATE_LIMIT_GROUP_WRITE]))
+	write.POST(server.URL_TRANSACTION, server.VerifySignature(signatures), acc.Transaction)
+	write.POST(server.URL_TRANSFER, server.VerifySignature(signatures), acc.Transfer)
+	read := router.Group("/", server.Timeout(timeouts[server.RATE_LIMIT_GROUP_READ]), server.Authenticate(auth), server.RateLimited(limiter, policies[server.RATE_LIMIT_GROUP_READ]))
+	read.GET(server.URL_BALANCE, server.Deprecated(server.URL_ACCOUNT_BALANCE), acc.Balance)
+	read.GET(server.URL_TRANSACTIONS, server.Deprecated(server.URL_ACCOUNT_TRANSACTIONS), acc.Transactions)
+	read.GET(server.URL_ACCOUNT_BALANCE, acc.AccountBalance)
+	read.GET(server.URL_ACCOUNT_TRANSACTIONS, acc.AccountTransactions)
+	admin := router.Group("/", server.Timeout(timeouts[server.RATE_LIMIT_GROUP_ADMIN]), server.Authenticate(auth), server.RateLimited(limiter, policies[server.RATE_LIMIT_GROUP_ADMIN]))
+	admin.GET(server.URL_ADMIN_TRANSACTIONS, adm.SearchTransactions)
+	admin.POST(server.URL_ADMIN_ADJUSTMENTS, adm.Adjust)
+	admin.POST(server.URL_ADMIN_FREEZE, adm.Freeze)
+	admin.POST(server.URL_ADMIN_UNFREEZE, adm.Unfreeze)
+	admin.GET(server.URL_ADMIN_AUDIT, adm.AuditLog)
+	admin.GET(server.URL_ADMIN_LEDGER_VERIFY, ledger.Verify)
+	admin.GET(server.URL_ADMIN_CONFIG, server.ConfigHandler(cfg))
+	router.GET(server.URL_OPENAPI, server.OpenApi)
+	router.GET(server.URL_METRICS, server.Metrics())
+	router.GET(server.URL_HEALTHZ, server.Healthz)
+	router.GET(server.URL_READYZ, readiness.Ready)
+
+	httpSrv := server.NewHttpServer(cfg.HttpAddress(), router)
+	stopped := make(chan error, 2)
+	go func() {
+		stopped <- accRpc.Serve(cfg.GrpcAddress())
+	}()
+	go func() {
+		stopped <- httpSrv.ListenAndServe()
+	}()
+	logger.Info().Str("address", cfg.HttpAddress()).Str("grpc_address", cfg.GrpcAddress()).Msg("serving")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		logger.Info().Str("signal", sig.String()).Msg("shutting down")
+	case err := <-stopped:
+		logger.Error().Err(err).Msg("server stopped, shutting down")
+	}
+	shutdown(readiness, httpSrv, accRpc, scheduler, cfg.Http.ShutdownDelay.Duration(), cfg.Http.ShutdownTimeout.Duration())
+}
+
+// shutdown marks the server not ready and keeps serving for delay, so load balancers stop routing to it,
+// then drains HTTP and gRPC requests and waits for running jobs. Requests and jobs not finished in timeout
+// are canceled and roll back. The pool is closed after that by deferred db.Close.
+func shutdown(readiness *server.Readiness, httpSrv *server.HttpServer, accRpc *server.AccountGrpcServer, scheduler *server.Scheduler, delay time.Duration, timeout time.Duration) {
+	readiness.Shutdown()
+	if delay > 0 {
+		logger.Info().Dur("delay", delay).Msg("not ready, waiting before drain")
+		time.Sleep(delay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := httpSrv.Shutdown(ctx); err != nil {
+			logger.Warn().Err(err).Msg("http requests canceled on shutdown")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := accRpc.Shutdown(ctx); err != nil {
+			logger.Warn().Err(err).Msg("grpc calls canceled on shutdown")
+		}
+	}()
+	if err := scheduler.Stop(ctx); err != nil {
+		logger.Warn().Err(err).Msg("background jobs canceled on shutdown")
+	}
+	wg.Wait()
+	logger.Info().Msg("shutdown complete")
+}
+
+// parseCommand splits command from its arguments. Arguments without command are flags of serve.
+func parseCommand(argv []string) (string, []string) {
+	if len(argv) == 0 || strings.HasPrefix(argv[0], "-") {
+		return server.COMMAND_SERVE, argv
+	}
+	for _, c := range commands {
+		if argv[0] == c {
+			return c, argv[1:]
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\nusage: balance-server [command] [flags]\ncommands: %s\n", argv[0], strings.Join(commands, ", "))
+	os.Exit(2)
+	return "", nil
+}
+
+// loadConfig reads config flags only for serve, other commands have their own flags.
+func loadConfig() *server.Config {
+	var flags []string
+	if command == server.COMMAND_SERVE {
+		flags = args
+	}
+	c, err := server.LoadConfig(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	return c
+}
+
+// logOutput keeps stdout of commands for their output.
+func logOutput() io.Writer {
+	if command == server.COMMAND_SERVE {
+		return os.Stdout
+	}
+	return os.Stderr
 }
@@ -0,0 +1,459 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
+)
+
+const (
+	ERROR_ACCOUNT_FROZEN  int = 116
+	ERROR_STATE_UNCHANGED int = 117
+
+	URL_ADMIN_TRANSACTIONS string = "/admin/transactions"
+	URL_ADMIN_ADJUSTMENTS  string = "/admin/adjustments"
+	URL_ADMIN_FREEZE       string = "/admin/accounts/:id/freeze"
+	URL_ADMIN_UNFREEZE     string = "/admin/accounts/:id/unfreeze"
+	URL_ADMIN_AUDIT        string = "/admin/audit"
+	URL_ADMIN_CONFIG       string = "/admin/config"
+
+	ROLE_VIEWER   string = "admin:viewer"
+	ROLE_OPERATOR string = "admin:operator"
+	ROLE_AUDITOR  string = "admin:auditor"
+
+	SCOPE_ADMIN_TRANSACTIONS_READ string = "admin:transactions:read"
+	SCOPE_ADMIN_ADJUST            string = "admin:adjust"
+	SCOPE_ADMIN_FREEZE            string = "admin:freeze"
+	SCOPE_ADMIN_AUDIT_READ        string = "admin:audit:read"
+	SCOPE_ADMIN_CONFIG_READ       string = "admin:config:read"
+
+	AUDIT_ACTION_ADJUST   string = "adjust"
+	AUDIT_ACTION_FREEZE   string = "freeze"
+	AUDIT_ACTION_UNFREEZE string = "unfreeze"
+
+	ADMIN_PAGE_SIZE int = 50
+
+	OPERATION_ADJUSTMENT_DESC string = "Adjustment: %s"
+
+	SEARCH_TRANSACTIONS string = "SELECT id, account, sum, operation, date, description, key_id FROM transactions WHERE ($1 = 0 OR account = $1) AND date >= $2 AND date <= $3 AND ($4 = 0 OR key_id = $4) AND ($5 = 0 OR id <= $5) ORDER BY id DESC LIMIT $6"
+	CREATE_AUDIT_RECORD string = "INSERT INTO admin_audit(actor, action, account, before, after, reason) VALUES($1, $2, $3, $4, $5, $6) RETURNING id, date"
+	GET_AUDIT_RECORDS   string = "SELECT id, actor, action, account, before, after, reason, date FROM admin_audit WHERE ($1 = 0 OR account = $1) AND ($2 = 0 OR id <= $2) ORDER BY id DESC LIMIT $3"
+	FREEZE_ACCOUNT      string = "INSERT INTO frozen_accounts(account, reason, actor) VALUES($1, $2, $3) ON CONFLICT DO NOTHING"
+	UNFREEZE_ACCOUNT    string = "DELETE FROM frozen_accounts WHERE account = $1"
+)
+
+var (
+	ADMIN_ROLES = []string{ROLE_VIEWER, ROLE_OPERATOR, ROLE_AUDITOR}
+
+	// ADMIN_ROLE_SCOPES lists scopes granted by admin role.
+	ADMIN_ROLE_SCOPES = map[string][]string{
+		ROLE_VIEWER:   {SCOPE_ADMIN_TRANSACTIONS_READ},
+		ROLE_OPERATOR: {SCOPE_ADMIN_TRANSACTIONS_READ, SCOPE_ADMIN_ADJUST, SCOPE_ADMIN_FREEZE},
+		ROLE_AUDITOR:  {SCOPE_ADMIN_TRANSACTIONS_READ, SCOPE_ADMIN_AUDIT_READ, SCOPE_ADMIN_CONFIG_READ},
+	}
+)
+
+type AdminTransactionsQuery struct {
+	Account int   `form:"account" binding:"gte=0"`
+	From    int64 `form:"start"`
+	To      int64 `form:"end"`
+	KeyId   int   `form:"key_id" binding:"gte=0"`
+	Cursor  int   `form:"cursor" binding:"gte=0"`
+}
+
+type AdjustmentRequest struct {
+	Account int     `json:"account" binding:"required,gt=0"`
+	Sum     float64 `json:"sum" binding:"required"`
+	Reason  string  `json:"reason" binding:"required,max=200"`
+}
+
+type FreezeRequest struct {
+	Reason string `json:"reason" binding:"required,max=200"`
+}
+
+type AuditQuery struct {
+	Account int `form:"account" binding:"gte=0"`
+	Cursor  int `form:"cursor" binding:"gte=0"`
+}
+
+type AdminTransaction struct {
+	Id        int     `json:"id"`
+	Account   int     `json:"account"`
+	Sum       float64 `json:"sum"`
+	Operation int     `json:"operation"`
+	Date      int64   `json:"date"`
+	Desc      string  `json:"desc"`
+	KeyId     *int    `json:"key_id"`
+}
+
+type AdminTransactionsData struct {
+	Last int                `json:"next"`
+	Trxs []AdminTransaction `json:"transactions"`
+}
+
+// AuditRecord is a row of append-only admin_audit table.
+type AuditRecord struct {
+	Id      int                    `json:"id"`
+	Actor   string                 `json:"actor"`
+	Action  string                 `json:"action"`
+	Account int                    `json:"account"`
+	Before  map[string]interface{} `json:"before"`
+	After   map[string]interface{} `json:"after"`
+	Reason  string                 `json:"reason"`
+	Date    int64                  `json:"date"`
+}
+
+type AuditData struct {
+	Last    int           `json:"next"`
+	Records []AuditRecord `json:"records"`
+}
+
+type TransactionsSearchData struct {
+	Account int
+	From    int64
+	To      int64
+	KeyId   int
+	Cursor  int
+}
+
+type AdjustmentData struct {
+	Account int
+	Sum     float64
+	Reason  string
+	Actor   string
+	KeyId   int
+}
+
+type FreezeData struct {
+	Account int
+	Frozen  bool
+	Reason  string
+	Actor   string
+}
+
+type AdminRepositoryI interface {
+	SearchTransactions(ctx context.Context, sData TransactionsSearchData, limit int) ([]AdminTransaction, error)
+	Adjust(ctx context.Context, aData AdjustmentData) (AuditRecord, error)
+	SetFrozen(ctx context.Context, fData FreezeData) (AuditRecord, error)
+	GetAuditRecords(ctx context.Context, account int, cursor int, limit int) ([]AuditRecord, error)
+}
+
+type AdminRepository struct {
+	db DatabaseI
+}
+
+func NewAdminRepository(db DatabaseI) *AdminRepository {
+	return &AdminRepository{db}
+}
+
+func (rep *AdminRepository) SearchTransactions(ctx context.Context, sData TransactionsSearchData, limit int) ([]AdminTransaction, error) {
+	trxs := []AdminTransaction{}
+	_, err := rep.db.ExecuteInTransaction(ctx, func(tx *pgx.Tx) (interface{}, error) {
+		rows, err := (*tx).Query(ctx, SEARCH_TRANSACTIONS, sData.Account, sData.From, sData.To, sData.KeyId, sData.Cursor, limit)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var trx AdminTransaction
+			if err := rows.Scan(&trx.Id, &trx.Account, &trx.Sum, &trx.Operation, &trx.Date, &trx.Desc, &trx.KeyId); err != nil {
+				return nil, err
+			}
+			trxs = append(trxs, trx)
+		}
+		return nil, rows.Err()
+	})
+	return trxs, err
+}
+
+// Adjust appends adjustment to the ledger and its audit record in one transaction.
+// Negative adjustments take the same lock as debits and are refused for frozen accounts.
+func (rep *AdminRepository) Adjust(ctx context.Context, aData AdjustmentData) (AuditRecord, error) {
+	c := rep.db.Concurrency()
+	res, err := c.Execute(ctx, rep.db, func(tx *pgx.Tx) (interface{}, error) {
+		if aData.Sum < 0 {
+			if err := c.Lock(ctx, tx, aData.Account, OPERATION_OUTCOME_CODE); err != nil {
+				return nil, err
+			}
+			if err := checkNotFrozen(ctx, tx, aData.Account); err != nil {
+				return nil, err
+			}
+		}
+		trxData := TransactionData{Id: aData.Account, Sum: aData.Sum, Desc: fmt.Sprintf(OPERATION_ADJUSTMENT_DESC, aData.Reason), KeyId: aData.KeyId}
+		before, err := appendTransaction(ctx, tx, c, trxData, OPERATION_ADJUSTMENT_CODE)
+		if err != nil {
+			return nil, err
+		}
+		return rep.createAuditRecord(ctx, tx, AuditRecord{
+			Actor:   aData.Actor,
+			Action:  AUDIT_ACTION_ADJUST,
+			Account: aData.Account,
+			Before:  map[string]interface{}{"balance": before},
+			After:   map[string]interface{}{"balance": before + aData.Sum},
+			Reason:  aData.Reason,
+		})
+	})
+	observeLedgerOperation(OPERATION_ADJUSTMENT_CODE, err)
+	if err != nil {
+		return AuditRecord{}, err
+	}
+	return res.(AuditRecord), nil
+}
+
+// SetFrozen freezes or unfreezes account under the debit lock, so no debit is in progress meanwhile.
+func (rep *AdminRepository) SetFrozen(ctx context.Context, fData FreezeData) (AuditRecord, error) {
+	c := rep.db.Concurrency()
+	res, err := c.Execute(ctx, rep.db, func(tx *pgx.Tx) (interface{}, error) {
+		if err := c.Lock(ctx, tx, fData.Account, OPERATION_OUTCOME_CODE); err != nil {
+			return nil, err
+		}
+		var frozen bool
+		if err := (*tx).QueryRow(ctx, SELECT_ACCOUNT_FROZEN, fData.Account).Scan(&frozen); err != nil {
+			return nil, err
+		}
+		if frozen == fData.Frozen {
+			return nil, &OperationError{Code: ERROR_STATE_UNCHANGED}
+		}
+		action := AUDIT_ACTION_UNFREEZE
+		var err error
+		if fData.Frozen {
+			action = AUDIT_ACTION_FREEZE
+			_, err = (*tx).Exec(ctx, FREEZE_ACCOUNT, fData.Account, fData.Reason, fData.Actor)
+		} else {
+			_, err = (*tx).Exec(ctx, UNFREEZE_ACCOUNT, fData.Account)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return rep.createAuditRecord(ctx, tx, AuditRecord{
+			Actor:   fData.Actor,
+			Action:  action,
+			Account: fData.Account,
+			Before:  map[string]interface{}{"frozen": frozen},
+			After:   map[string]interface{}{"frozen": fData.Frozen},
+			Reason:  fData.Reason,
+		})
+	})
+	if err != nil {
+		return AuditRecord{}, err
+	}
+	return res.(AuditRecord), nil
+}
+
+func (rep *AdminRepository) GetAuditRecords(ctx context.Context, account int, cursor int, limit int) ([]AuditRecord, error) {
+	records := []AuditRecord{}
+	_, err := rep.db.ExecuteInTransaction(ctx, func(tx *pgx.Tx) (interface{}, error) {
+		rows, err := (*tx).Query(ctx, GET_AUDIT_RECORDS, account, cursor, limit)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var rec AuditRecord
+			var before, after []byte
+			if err := rows.Scan(&rec.Id, &rec.Actor, &rec.Action, &rec.Account, &before, &after, &rec.Reason, &rec.Date); err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(before, &rec.Before); err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(after, &rec.After); err != nil {
+				return nil, err
+			}
+			records = append(records, rec)
+		}
+		return nil, rows.Err()
+	})
+	return records, err
+}
+
+func (rep *AdminRepository) createAuditRecord(ctx context.Context, tx *pgx.Tx, rec AuditRecord) (AuditRecord, error) {
+	before, err := json.Marshal(rec.Before)
+	if err != nil {
+		return rec, err
+	}
+	after, err := json.Marshal(rec.After)
+	if err != nil {
+		return rec, err
+	}
+	err = (*tx).QueryRow(ctx, CREATE_AUDIT_RECORD, rec.Actor, rec.Action, rec.Account, string(before), string(after), rec.Reason).Scan(&rec.Id, &rec.Date)
+	return rec, err
+}
+
+type AdminService struct {
+	admRep AdminRepositoryI
+}
+
+func NewAdminService(r AdminRepositoryI) *AdminService {
+	return &AdminService{r}
+}
+
+func (s *AdminService) SearchTransactions(ctx context.Context, sData *TransactionsSearchData) (AdminTransactionsData, error) {
+	trxs, err := s.admRep.SearchTransactions(ctx, *sData, ADMIN_PAGE_SIZE+1)
+	if err != nil {
+		return AdminTransactionsData{}, ConvertError(err)
+	}
+	last := -1
+	if len(trxs) > ADMIN_PAGE_SIZE {
+		last = trxs[ADMIN_PAGE_SIZE].Id
+		trxs = trxs[:ADMIN_PAGE_SIZE]
+	}
+	return AdminTransactionsData{last, trxs}, nil
+}
+
+func (s *AdminService) Adjust(ctx context.Context, aData *AdjustmentData) (AuditRecord, error) {
+	rec, err := s.admRep.Adjust(ctx, *aData)
+	if err != nil {
+		return AuditRecord{}, ConvertError(err)
+	}
+	return rec, nil
+}
+
+func (s *AdminService) SetFrozen(ctx context.Context, fData *FreezeData) (AuditRecord, error) {
+	rec, err := s.admRep.SetFrozen(ctx, *fData)
+	if err != nil {
+		return AuditRecord{}, ConvertError(err)
+	}
+	return rec, nil
+}
+
+func (s *AdminService) GetAuditRecords(ctx context.Context, account int, cursor int) (AuditData, error) {
+	records, err := s.admRep.GetAuditRecords(ctx, account, cursor, ADMIN_PAGE_SIZE+1)
+	if err != nil {
+		return AuditData{}, ConvertError(err)
+	}
+	last := -1
+	if len(records) > ADMIN_PAGE_SIZE {
+		last = records[ADMIN_PAGE_SIZE].Id
+		records = records[:ADMIN_PAGE_SIZE]
+	}
+	return AuditData{last, records}, nil
+}
+
+type AdminController struct {
+	admSrv *AdminService
+	log    zerolog.Logger
+}
+
+func NewAdminController(admRep AdminRepositoryI, log zerolog.Logger) *AdminController {
+	return &AdminController{NewAdminService(admRep), componentLogger(log, "admin")}
+}
+
+// fail logs operation error of the request and writes it to response, like AccountController.fail.
+func (adm *AdminController) fail(r *Result, err error) {
+	logOperationError(r.ctx.Request.Context(), adm.log, "request failed", err)
+	r.Err(&err, &AccountExpectedResult)
+}
+
+func (adm *AdminController) SearchTransactions(c *gin.Context) {
+	r := Result{c, STATUS_CODE_OK, map[string]interface{}{}}
+	if err := authorize(c, SCOPE_ADMIN_TRANSACTIONS_READ); err != nil {
+		adm.fail(&r, err)
+		return
+	}
+	var q AdminTransactionsQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		r.BadRequest(err)
+		return
+	}
+	if q.To == 0 {
+		q.To = time.Now().Unix()
+	}
+	if q.From > q.To {
+		r.BadRequest(RequestErrors{NewValidationError("start", RULE_LTEFIELD, "end")})
+		return
+	}
+	sData := TransactionsSearchData{Account: q.Account, From: q.From, To: q.To, KeyId: q.KeyId, Cursor: q.Cursor}
+	trxs, err := adm.admSrv.SearchTransactions(c.Request.Context(), &sData)
+	if err != nil {
+		adm.fail(&r, err)
+		return
+	}
+	r.Give(trxs)
+}
+
+func (adm *AdminController) Adjust(c *gin.Context) {
+	r := Result{c, STATUS_CODE_OK, map[string]interface{}{}}
+	if err := authorize(c, SCOPE_ADMIN_ADJUST); err != nil {
+		adm.fail(&r, err)
+		return
+	}
+	var aReq AdjustmentRequest
+	if err := c.ShouldBindJSON(&aReq); err != nil {
+		r.BadRequest(err)
+		return
+	}
+	if strings.TrimSpace(aReq.Reason) == "" {
+		r.BadRequest(RequestErrors{NewValidationError("reason", RULE_REQUIRED, "")})
+		return
+	}
+	aData := AdjustmentData{Account: aReq.Account, Sum: aReq.Sum, Reason: strings.TrimSpace(aReq.Reason), Actor: principalActor(c), KeyId: principalKeyId(c)}
+	rec, err := adm.admSrv.Adjust(c.Request.Context(), &aData)
+	if err != nil {
+		adm.fail(&r, err)
+		return
+	}
+	r.Give(rec)
+}
+
+func (adm *AdminController) Freeze(c *gin.Context) {
+	adm.setFrozen(c, true)
+}
+
+func (adm *AdminController) Unfreeze(c *gin.Context) {
+	adm.setFrozen(c, false)
+}
+
+func (adm *AdminController) AuditLog(c *gin.Context) {
+	r := Result{c, STATUS_CODE_OK, map[string]interface{}{}}
+	if err := authorize(c, SCOPE_ADMIN_AUDIT_READ); err != nil {
+		adm.fail(&r, err)
+		return
+	}
+	var q AuditQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		r.BadRequest(err)
+		return
+	}
+	records, err := adm.admSrv.GetAuditRecords(c.Request.Context(), q.Account, q.Cursor)
+	if err != nil {
+		adm.fail(&r, err)
+		return
+	}
+	r.Give(records)
+}
+
+func (adm *AdminController) setFrozen(c *gin.Context, frozen bool) {
+	r := Result{c, STATUS_CODE_OK, map[string]interface{}{}}
+	if err := authorize(c, SCOPE_ADMIN_FREEZE); err != nil {
+		adm.fail(&r, err)
+		return
+	}
+	var uri AccountUri
+	var fReq FreezeRequest
+	if err := c.ShouldBindUri(&uri); err != nil {
+		r.BadRequest(err)
+		return
+	}
+	if err := c.ShouldBindJSON(&fReq); err != nil {
+		r.BadRequest(err)
+		return
+	}
+	if strings.TrimSpace(fReq.Reason) == "" {
+		r.BadRequest(RequestErrors{NewValidationError("reason", RULE_REQUIRED, "")})
+		return
+	}
+	fData := FreezeData{Account: uri.Id, Frozen: frozen, Reason: strings.TrimSpace(fReq.Reason), Actor: principalActor(c)}
+	rec, err := adm.admSrv.SetFrozen(c.Request.Context(), &fData)
+	if err != nil {
+		adm.fail(&r, err)
+		return
+	}
+	r.Give(rec)
+}
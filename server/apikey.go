@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	ERROR_UNAUTHORIZED int = 108
+	ERROR_FORBIDDEN    int = 109
+
+	SCOPE_BALANCE_READ       string = "balance:read"
+	SCOPE_TRANSACTIONS_READ  string = "transactions:read"
+	SCOPE_TRANSACTION_CREDIT string = "transaction:credit"
+	SCOPE_TRANSACTION_DEBIT  string = "transaction:debit"
+	SCOPE_TRANSFER           string = "transfer"
+
+	API_KEY_PREFIX string = "bsk_"
+	API_KEY_BYTES  int    = 32
+
+	CREATE_API_KEY      string = "INSERT INTO api_keys(name, hash, scopes, accounts) VALUES($1, $2, $3, $4) RETURNING id, created"
+	GET_API_KEY_BY_HASH string = "SELECT id, name, scopes, accounts, created, revoked FROM api_keys WHERE hash = $1"
+	LIST_API_KEYS       string = "SELECT id, name, scopes, accounts, created, revoked FROM api_keys ORDER BY id"
+	REVOKE_API_KEY      string = "UPDATE api_keys SET revoked = EXTRACT(EPOCH FROM (now() AT TIME ZONE 'UTC')) WHERE id = $1 AND revoked = 0"
+)
+
+var (
+	API_KEY_SCOPES = []string{
+		SCOPE_BALANCE_READ,
+		SCOPE_TRANSACTIONS_READ,
+		SCOPE_TRANSACTION_CREDIT,
+		SCOPE_TRANSACTION_DEBIT,
+		SCOPE_TRANSFER,
+		ROLE_VIEWER,
+		ROLE_OPERATOR,
+		ROLE_AUDITOR,
+	}
+)
+
+// ApiKey is a client credential. Empty Accounts list allows any account.
+type ApiKey struct {
+	Id       int      `json:"id"`
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	Accounts []int    `json:"accounts"`
+	Created  int64    `json:"created"`
+	Revoked  int64    `json:"revoked,omitempty"`
+}
+
+// HasScope checks scope granted directly or by one of key admin roles.
+func (k *ApiKey) HasScope(scope string) bool {
+	if containsString(k.Scopes, scope) {
+		return true
+	}
+	for _, s := range k.Scopes {
+		if containsString(ADMIN_ROLE_SCOPES[s], scope) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *ApiKey) AllowsAccount(id int) bool {
+	if len(k.Accounts) == 0 {
+		return true
+	}
+	for _, a := range k.Accounts {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *ApiKey) Authorize(scope string, accounts ...int) error {
+	if !k.HasScope(scope) {
+		return &OperationError{Code: ERROR_FORBIDDEN}
+	}
+	for _, id := range accounts {
+		if !k.AllowsAccount(id) {
+			return &OperationError{Code: ERROR_FORBIDDEN}
+		}
+	}
+	return nil
+}
+
+func (k *ApiKey) GetKeyId() int {
+	return k.Id
+}
+
+func (k *ApiKey) GetActor() string {
+	return fmt.Sprintf("apikey:%d:%s", k.Id, k.Name)
+}
+
+type ApiKeyRepositoryI interface {
+	CreateApiKey(ctx context.Context, key ApiKey, hash string) (ApiKey, error)
+	GetApiKeyByHash(ctx context.Context, hash string) (ApiKey, error)
+	ListApiKeys(ctx context.Context) ([]ApiKey, error)
+	RevokeApiKey(ctx context.Context, id int) error
+}
+
+type ApiKeyRepository struct {
+	db DatabaseI
+}
+
+func NewApiKeyRepository(db DatabaseI) *ApiKeyRepository {
+	return &ApiKeyRepository{db}
+}
+
+func (rep *ApiKeyRepository) CreateApiKey(ctx context.Context, key ApiKey, hash string) (ApiKey, error) {
+	_, err := rep.db.ExecuteInTransaction(ctx, func(tx *pgx.Tx) (interface{}, error) {
+		return nil, (*tx).QueryRow(ctx, CREATE_API_KEY, key.Name, hash, key.Scopes, key.Accounts).Scan(&key.Id, &key.Created)
+	})
+	return key, err
+}
+
+func (rep *ApiKeyRepository) GetApiKeyByHash(ctx context.Context, hash string) (ApiKey, error) {
+	var key ApiKey
+	_, err := rep.db.ExecuteInTransaction(ctx, func(tx *pgx.Tx) (interface{}, error) {
+		return nil, (*tx).QueryRow(ctx, GET_API_KEY_BY_HASH, hash).Scan(&key.Id, &key.Name, &key.Scopes, &key.Accounts, &key.Created, &key.Revoked)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return key, &OperationError{Code: ERROR_UNAUTHORIZED}
+	}
+	return key, err
+}
+
+func (rep *ApiKeyRepository) ListApiKeys(ctx context.Context) ([]ApiKey, error) {
+	keys := []ApiKey{}
+	_, err := rep.db.ExecuteInTransaction(ctx, func(tx *pgx.Tx) (interface{}, error) {
+		rows, err := (*tx).Query(ctx, LIST_API_KEYS)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var key ApiKey
+			if err := rows.Scan(&key.Id, &key.Name, &key.Scopes, &key.Accounts, &key.Created, &key.Revoked); err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		return nil, rows.Err()
+	})
+	return keys, err
+}
+
+func (rep *ApiKeyRepository) RevokeApiKey(ctx context.Context, id int) error {
+	_, err := rep.db.ExecuteInTransaction(ctx, func(tx *pgx.Tx) (interface{}, error) {
+		tag, err := (*tx).Exec(ctx, REVOKE_API_KEY, id)
+		if err != nil {
+			return nil, err
+		}
+		if tag.RowsAffected() == 0 {
+			return nil, fmt.Errorf("api key %d not found or already revoked", id)
+		}
+		return nil, nil
+	})
+	return err
+}
+
+type ApiKeyService struct {
+	keyRep ApiKeyRepositoryI
+}
+
+func NewApiKeyService(r ApiKeyRepositoryI) *ApiKeyService {
+	return &ApiKeyService{r}
+}
+
+// Issue creates a key and returns its secret. Only the hash of the secret is stored.
+func (s *ApiKeyService) Issue(ctx context.Context, name string, scopes []string, accounts []int) (string, ApiKey, error) {
+	for _, scope := range scopes {
+		if !containsString(API_KEY_SCOPES, scope) {
+			return "", ApiKey{}, fmt.Errorf("unknown scope %q, expected one of %v", scope, API_KEY_SCOPES)
+		}
+	}
+	if len(scopes) == 0 {
+		return "", ApiKey{}, fmt.Errorf("at least one scope is required")
+	}
+	for _, role := range ADMIN_ROLES {
+		if containsString(scopes, role) && len(accounts) > 0 {
+			return "", ApiKey{}, fmt.Errorf("admin role %s can not be limited to accounts", role)
+		}
+	}
+	if accounts == nil {
+		accounts = []int{}
+	}
+	b := make([]byte, API_KEY_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return "", ApiKey{}, err
+	}
+	secret := API_KEY_PREFIX + hex.EncodeToString(b)
+	key, err := s.keyRep.CreateApiKey(ctx, ApiKey{Name: name, Scopes: scopes, Accounts: accounts}, HashApiKey(secret))
+	if err != nil {
+		return "", ApiKey{}, err
+	}
+	return secret, key, nil
+}
+
+func (s *ApiKeyService) Authenticate(ctx context.Context, secret string) (ApiKey, error) {
+	if secret == "" {
+		return ApiKey{}, &OperationError{Code: ERROR_UNAUTHORIZED}
+	}
+	key, err := s.keyRep.GetApiKeyByHash(ctx, HashApiKey(secret))
+	if err != nil {
+		return ApiKey{}, ConvertError(err)
+	}
+	if key.Revoked != 0 {
+		return ApiKey{}, &OperationError{Code: ERROR_UNAUTHORIZED}
+	}
+	return key, nil
+}
+
+func (s *ApiKeyService) List(ctx context.Context) ([]ApiKey, error) {
+	return s.keyRep.ListApiKeys(ctx)
+}
+
+func (s *ApiKeyService) Revoke(ctx context.Context, id int) error {
+	return s.keyRep.RevokeApiKey(ctx, id)
+}
+
+func HashApiKey(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HEADER_AUTHORIZATION    string = "Authorization"
+	HEADER_WWW_AUTHENTICATE string = "WWW-Authenticate"
+
+	AUTH_SCHEME_API_KEY string = "ApiKey"
+	AUTH_SCHEME_BEARER  string = "Bearer"
+
+	CONTEXT_PRINCIPAL string = "principal"
+)
+
+// Principal is an authenticated caller.
+type Principal interface {
+	// Authorize checks that caller has scope and may operate on every given account.
+	Authorize(scope string, accounts ...int) error
+	// GetKeyId returns API key id recorded on ledger rows, 0 for other credentials.
+	GetKeyId() int
+	// GetActor identifies caller in admin audit log.
+	GetActor() string
+}
+
+// Authenticator resolves Authorization header to Principal. Nil service disables its scheme.
+type Authenticator struct {
+	keys   *ApiKeyService
+	tokens *JwtVerifier
+}
+
+func NewAuthenticator(keys *ApiKeyService, tokens *JwtVerifier) *Authenticator {
+	return &Authenticator{keys, tokens}
+}
+
+func (a *Authenticator) Authenticate(ctx context.Context, header string) (Principal, error) {
+	if a.keys != nil {
+		if secret := authToken(header, AUTH_SCHEME_API_KEY); secret != "" {
+			key, err := a.keys.Authenticate(ctx, secret)
+			if err != nil {
+				return nil, err
+			}
+			return &key, nil
+		}
+	}
+	if a.tokens != nil {
+		if token := authToken(header, AUTH_SCHEME_BEARER); token != "" {
+			p, err := a.tokens.Authenticate(token)
+			if err != nil {
+				return nil, err
+			}
+			return p, nil
+		}
+	}
+	return nil, &OperationError{Code: ERROR_UNAUTHORIZED}
+}
+
+// Schemes lists enabled schemes for WWW-Authenticate header.
+func (a *Authenticator) Schemes() string {
+	schemes := []string{}
+	if a.keys != nil {
+		schemes = append(schemes, AUTH_SCHEME_API_KEY)
+	}
+	if a.tokens != nil {
+		schemes = append(schemes, AUTH_SCHEME_BEARER)
+	}
+	return strings.Join(schemes, ", ")
+}
+
+// Authenticate rejects requests without valid credentials in Authorization header.
+// Scopes and accounts are checked by handlers, see authorize.
+func Authenticate(auth *Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, err := auth.Authenticate(c.Request.Context(), c.GetHeader(HEADER_AUTHORIZATION))
+		if err != nil {
+			c.Header(HEADER_WWW_AUTHENTICATE, auth.Schemes())
+			NewResult(c).Err(&err, &AccountExpectedResult)
+			c.Abort()
+			return
+		}
+		c.Set(CONTEXT_PRINCIPAL, p)
+		c.Next()
+	}
+}
+
+func GetPrincipal(c *gin.Context) (Principal, bool) {
+	v, ok := c.Get(CONTEXT_PRINCIPAL)
+	if !ok {
+		return nil, false
+	}
+	p, ok := v.(Principal)
+	return p, ok
+}
+
+// authorize checks scope and accounts of the request principal.
+// Requests without principal are denied, so routes must be mounted after Authenticate.
+func authorize(c *gin.Context, scope string, accounts ...int) error {
+	p, ok := GetPrincipal(c)
+	if !ok {
+		return &OperationError{Code: ERROR_UNAUTHORIZED}
+	}
+	return p.Authorize(scope, accounts...)
+}
+
+func principalKeyId(c *gin.Context) int {
+	p, ok := GetPrincipal(c)
+	if !ok {
+		return 0
+	}
+	return p.GetKeyId()
+}
+
+func principalActor(c *gin.Context) string {
+	p, ok := GetPrincipal(c)
+	if !ok {
+		return ""
+	}
+	return p.GetActor()
+}
+
+// authToken extracts credentials of the given scheme from Authorization header value.
+func authToken(header string, scheme string) string {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], scheme) {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
@@ -0,0 +1,432 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
+)
+
+const (
+	ANALYZE_TRANSACTIONS string = "ANALYZE transactions"
+	CREATE_BENCH_SCHEMA  string = "CREATE SCHEMA %s"
+	DROP_BENCH_SCHEMA    string = "DROP SCHEMA IF EXISTS %s CASCADE"
+
+	PG_DUPLICATE_SCHEMA string = "42P06"
+
+	BENCH_OP_TRANSFER string = "transfer"
+	BENCH_OP_DEBIT    string = "debit"
+	BENCH_OP_HISTORY  string = "history"
+
+	BENCH_SEED_DESC string = "bench seed"
+	// BENCH_DROP_TIMEOUT bounds dropping of bench schema after the run, ctx may already be canceled.
+	BENCH_DROP_TIMEOUT time.Duration = time.Minute
+	// BENCH_SEED_PERIOD is how far back seeded history starts.
+	BENCH_SEED_PERIOD time.Duration = 365 * 24 * time.Hour
+	// BENCH_MAX_SUM bounds seeded and workload sums, workload sums are ten times smaller
+	// than seeded ones, so most operations have money to spend.
+	BENCH_MAX_SUM float64 = 1000
+	// BENCH_OUTCOME_SHARE is the share of seeded rows that are outcomes.
+	BENCH_OUTCOME_SHARE float64 = 0.3
+)
+
+var (
+	BENCH_OPERATIONS = []string{BENCH_OP_TRANSFER, BENCH_OP_DEBIT, BENCH_OP_HISTORY}
+
+	benchSeedColumns = []string{"account", "sum", "operation", "description", "date", "prev_hash", "hash"}
+)
+
+// BenchConfig describes seeded data and workload. Bench runs in Schema which must not exist,
+// it is created with the service tables and dropped after the run, so live ledger is never touched.
+// Accounts are FirstAccount..FirstAccount+Accounts-1. Skew 0 picks accounts uniformly, skew above 1
+// is the zipf exponent: the larger it is, the more seeded rows and operations go to the first accounts.
+type BenchConfig struct {
+	Schema       string         `json:"schema"`
+	Accounts     int            `json:"accounts"`
+	Transactions int            `json:"transactions"`
+	Skew         float64        `json:"skew"`
+	FirstAccount int            `json:"first_account"`
+	Workers      int            `json:"workers"`
+	Duration     Duration       `json:"duration"`
+	Mix          map[string]int `json:"mix"`
+	HistorySort  string         `json:"history_sort"`
+	RandomSeed   int64          `json:"random_seed"`
+}
+
+func DefaultBenchConfig() BenchConfig {
+	return BenchConfig{
+		Schema:       "balance_bench",
+		Accounts:     1000,
+		Transactions: 100000,
+		Skew:         1.1,
+		FirstAccount: 1000000,
+		Workers:      16,
+		Duration:     Duration(30 * time.Second),
+		Mix:          map[string]int{BENCH_OP_TRANSFER: 40, BENCH_OP_DEBIT: 40, BENCH_OP_HISTORY: 20},
+		HistorySort:  "sum",
+		RandomSeed:   1,
+	}
+}
+
+// ParseBenchMix reads operation weights like "transfer=40,debit=40,history=20".
+// Operations not listed get weight 0.
+func ParseBenchMix(s string) (map[string]int, error) {
+	mix := map[string]int{}
+	for _, v := range splitList(s) {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("wrong mix entry %q, expected operation=weight", v)
+		}
+		w, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("wrong weight of %q", kv[0])
+		}
+		mix[strings.TrimSpace(kv[0])] = w
+	}
+	return mix, nil
+}
+
+func (cfg BenchConfig) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	check(cfg.Schema != "", "schema: should not be empty")
+	check(cfg.Accounts >= 2, "accounts: transfers need at least 2 accounts")
+	check(cfg.Transactions >= 0, "transactions: should not be negative")
+	check(cfg.Skew == 0 || cfg.Skew > 1, "skew: should be 0 or above 1")
+	check(cfg.FirstAccount > 0, "first_account: should be positive")
+	check(cfg.Workers > 0, "workers: should be positive")
+	check(cfg.Duration > 0, "duration: should be positive")
+	check(cfg.HistorySort == "date" || cfg.HistorySort == "sum", "history_sort: %q is not date or sum", cfg.HistorySort)
+	total := 0
+	for op, w := range cfg.Mix {
+		found := false
+		for _, known := range BENCH_OPERATIONS {
+			found = found || op == known
+		}
+		check(found, "mix: unknown operation %q", op)
+		total += w
+	}
+	check(total > 0, "mix: at least one operation should have weight")
+	if len(errs) > 0 {
+		return fmt.Errorf("bench: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+type BenchSeedReport struct {
+	Transactions       int     `json:"transactions"`
+	Seconds            float64 `json:"seconds"`
+	ViewRefreshSeconds float64 `json:"view_refresh_seconds"`
+}
+
+// BenchStats are results of one operation kind. Lock timeouts and insufficient funds are
+// expected outcomes under contention and are not counted as errors. Latencies are in milliseconds.
+type BenchStats struct {
+	Count                 int     `json:"count"`
+	Throughput            float64 `json:"throughput"`
+	P50                   float64 `json:"p50_ms"`
+	P99                   float64 `json:"p99_ms"`
+	LockTimeouts          int     `json:"lock_timeouts"`
+	LockTimeoutRate       float64 `json:"lock_timeout_rate"`
+	InsufficientFunds     int     `json:"insufficient_funds"`
+	InsufficientFundsRate float64 `json:"insufficient_funds_rate"`
+	Errors                int     `json:"errors"`
+}
+
+type BenchReport struct {
+	Config      BenchConfig           `json:"config"`
+	Concurrency string                `json:"concurrency"`
+	Seed        BenchSeedReport       `json:"seed"`
+	Seconds     float64               `json:"seconds"`
+	Total       BenchStats            `json:"total"`
+	Operations  map[string]BenchStats `json:"operations"`
+}
+
+// Bench seeds accounts and drives concurrent workload through AccountService,
+// so results include everything HTTP and gRPC requests go through below the transport.
+// db only creates and drops bench schema, the bench itself connects to the schema with cfg.Database.
+type Bench struct {
+	db   *Database
+	cfg  *Config
+	bcfg BenchConfig
+	log  zerolog.Logger
+}
+
+func NewBench(db *Database, cfg *Config, bcfg BenchConfig, log zerolog.Logger) *Bench {
+	return &Bench{db, cfg, bcfg, log}
+}
+
+// Run creates bench schema, seeds it and runs workload for configured duration.
+// The schema is dropped when the run ends, also on failure.
+func (b *Bench) Run(ctx context.Context) (BenchReport, error) {
+	report := BenchReport{Config: b.bcfg}
+	if err := b.bcfg.Validate(); err != nil {
+		return report, err
+	}
+	schema := pgx.Identifier{b.bcfg.Schema}.Sanitize()
+	if _, err := b.db.Conn.Exec(ctx, fmt.Sprintf(CREATE_BENCH_SCHEMA, schema)); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == PG_DUPLICATE_SCHEMA {
+			return report, fmt.Errorf("schema %s already exists, drop it or choose other schema", schema)
+		}
+		return report, err
+	}
+	defer func() {
+		dCtx, cancel := context.WithTimeout(context.Background(), BENCH_DROP_TIMEOUT)
+		defer cancel()
+		if _, err := b.db.Conn.Exec(dCtx, fmt.Sprintf(DROP_BENCH_SCHEMA, schema)); err != nil {
+			b.log.Error().Err(err).Str("schema", b.bcfg.Schema).Msg("bench schema drop failed")
+		}
+	}()
+	bdb := NewSchemaDatabase(b.cfg.Database, b.bcfg.Schema, b.log)
+	defer bdb.Close()
+	if _, err := NewMigrator(bdb, MIGRATIONS, b.log).Up(ctx); err != nil {
+		return report, err
+	}
+	srv := NewAccountService(NewAccountRepository(bdb, b.cfg.Ledger, b.log), b.cfg, b.log)
+	report.Concurrency = bdb.Concurrency().Name()
+	seed, err := b.seed(ctx, bdb)
+	if err != nil {
+		return report, err
+	}
+	report.Seed = seed
+	start := time.Now()
+	samples, err := b.workload(ctx, srv)
+	if err != nil {
+		return report, err
+	}
+	report.Seconds = time.Since(start).Seconds()
+	report.Total, report.Operations = summarizeBench(samples, report.Seconds)
+	return report, nil
+}
+
+// seed bulk loads configured number of rows with valid hash chains, refreshes sum ordered view
+// and reports how long both took.
+func (b *Bench) seed(ctx context.Context, db *Database) (BenchSeedReport, error) {
+	rnd := rand.New(rand.NewSource(b.bcfg.RandomSeed))
+	pick := newBenchPicker(rnd, b.bcfg)
+	counts := make([]int, b.bcfg.Accounts)
+	for i := 0; i < b.bcfg.Transactions; i++ {
+		counts[pick()]++
+	}
+	start := time.Now()
+	src := &benchSeedSource{cfg: b.bcfg, rnd: rnd, counts: counts, from: start.Add(-BENCH_SEED_PERIOD).Unix(), account: -1}
+	n, err := db.Conn.CopyFrom(ctx, pgx.Identifier{"transactions"}, benchSeedColumns, src)
+	if err != nil {
+		return BenchSeedReport{}, err
+	}
+	if _, err := db.Conn.Exec(ctx, ANALYZE_TRANSACTIONS); err != nil {
+		return BenchSeedReport{}, err
+	}
+	report := BenchSeedReport{Transactions: int(n), Seconds: time.Since(start).Seconds()}
+	start = time.Now()
+	if _, err := db.Conn.Exec(ctx, UPDATE_ORDERED_SUM_VIEW); err != nil {
+		return report, err
+	}
+	report.ViewRefreshSeconds = time.Since(start).Seconds()
+	return report, nil
+}
+
+// benchSeedSource generates rows account by account: dates grow with ids and outcomes never
+// exceed the balance, as if the rows were appended by AccountRepository.
+type benchSeedSource struct {
+	cfg     BenchConfig
+	rnd     *rand.Rand
+	counts  []int
+	from    int64
+	account int
+	row     int
+	balance float64
+	prev    string
+	values  []interface{}
+}
+
+func (s *benchSeedSource) Next() bool {
+	for s.account < 0 || s.row >= s.counts[s.account] {
+		s.account++
+		if s.account >= len(s.counts) {
+			return false
+		}
+		s.row, s.balance, s.prev = 0, 0, ""
+	}
+	count := s.counts[s.account]
+	sum := benchSum(s.rnd, BENCH_MAX_SUM)
+	oCode := OPERATION_INCOME_CODE
+	if s.rnd.Float64() < BENCH_OUTCOME_SHARE && s.balance >= sum {
+		sum, oCode = -sum, OPERATION_OUTCOME_CODE
+	}
+	s.balance += sum
+	row := ChainRow{
+		Account:   s.cfg.FirstAccount + s.account,
+		Sum:       FormatLedgerSum(sum),
+		Operation: oCode,
+		Date:      s.from + int64(BENCH_SEED_PERIOD.Seconds())*int64(s.row+1)/int64(count+1),
+		Desc:      BENCH_SEED_DESC,
+		PrevHash:  s.prev,
+	}
+	row.Hash = HashChainRow(row)
+	s.prev = row.Hash
+	s.row++
+	s.values = []interface{}{row.Account, row.Sum, row.Operation, row.Desc, row.Date, row.PrevHash, row.Hash}
+	return true
+}
+
+func (s *benchSeedSource) Values() ([]interface{}, error) {
+	return s.values, nil
+}
+
+func (s *benchSeedSource) Err() error {
+	return nil
+}
+
+type benchSample struct {
+	op      string
+	latency time.Duration
+	code    int
+}
+
+// workload runs workers until duration passes. Operations started before that finish normally.
+func (b *Bench) workload(ctx context.Context, srv *AccountService) ([]benchSample, error) {
+	deadline := time.Now().Add(b.bcfg.Duration.Duration())
+	results := make([][]benchSample, b.bcfg.Workers)
+	var wg sync.WaitGroup
+	for w := 0; w < b.bcfg.Workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(b.bcfg.RandomSeed + int64(w) + 1))
+			pick := newBenchPicker(rnd, b.bcfg)
+			for time.Now().Before(deadline) && ctx.Err() == nil {
+				op := benchOperation(rnd, b.bcfg.Mix)
+				start := time.Now()
+				err := b.execute(ctx, srv, rnd, op, pick)
+				code := STATUS_CODE_OK
+				if err != nil {
+					code = ConvertError(err).Code
+				}
+				results[w] = append(results[w], benchSample{op, time.Since(start), code})
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var samples []benchSample
+	for _, r := range results {
+		samples = append(samples, r...)
+	}
+	return samples, nil
+}
+
+func (b *Bench) execute(ctx context.Context, srv *AccountService, rnd *rand.Rand, op string, pick func() int) error {
+	account := b.bcfg.FirstAccount + pick()
+	switch op {
+	case BENCH_OP_TRANSFER:
+		to := b.bcfg.FirstAccount + pick()
+		for to == account {
+			to = b.bcfg.FirstAccount + rnd.Intn(b.bcfg.Accounts)
+		}
+		return srv.TransferMoney(ctx, &TransferData{From: account, To: to, Sum: benchSum(rnd, BENCH_MAX_SUM/10)})
+	case BENCH_OP_DEBIT:
+		return srv.DoTransaction(ctx, &TransactionData{Id: account, Sum: -benchSum(rnd, BENCH_MAX_SUM/10), Desc: BENCH_OP_DEBIT})
+	default:
+		_, err := srv.GetUserTransactions(ctx, &TransactionsListData{Id: account, To: time.Now().Unix(), Sort: b.bcfg.HistorySort})
+		return err
+	}
+}
+
+// newBenchPicker returns account index picker, uniform for skew 0 and zipf distributed otherwise.
+func newBenchPicker(rnd *rand.Rand, cfg BenchConfig) func() int {
+	if cfg.Skew == 0 {
+		return func() int {
+			return rnd.Intn(cfg.Accounts)
+		}
+	}
+	zipf := rand.NewZipf(rnd, cfg.Skew, 1, uint64(cfg.Accounts-1))
+	return func() int {
+		return int(zipf.Uint64())
+	}
+}
+
+func benchOperation(rnd *rand.Rand, mix map[string]int) string {
+	total := 0
+	for _, op := range BENCH_OPERATIONS {
+		total += mix[op]
+	}
+	n := rnd.Intn(total)
+	for _, op := range BENCH_OPERATIONS {
+		if n < mix[op] {
+			return op
+		}
+		n -= mix[op]
+	}
+	return BENCH_OP_HISTORY
+}
+
+// benchSum returns random sum in cents from 0.01 to max.
+func benchSum(rnd *rand.Rand, max float64) float64 {
+	return float64(rnd.Intn(int(max*100))+1) / 100
+}
+
+func summarizeBench(samples []benchSample, seconds float64) (BenchStats, map[string]BenchStats) {
+	byOp := map[string][]benchSample{}
+	for _, s := range samples {
+		byOp[s.op] = append(byOp[s.op], s)
+	}
+	ops := map[string]BenchStats{}
+	for op, list := range byOp {
+		ops[op] = benchStats(list, seconds)
+	}
+	return benchStats(samples, seconds), ops
+}
+
+func benchStats(samples []benchSample, seconds float64) BenchStats {
+	st := BenchStats{Count: len(samples)}
+	if len(samples) == 0 {
+		return st
+	}
+	latencies := make([]time.Duration, len(samples))
+	for i, s := range samples {
+		latencies[i] = s.latency
+		switch s.code {
+		case STATUS_CODE_OK:
+		case ERROR_LOCK_TIMEOUT:
+			st.LockTimeouts++
+		case ERROR_NOT_ENOUGH_MONEY:
+			st.InsufficientFunds++
+		default:
+			st.Errors++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	st.Throughput = float64(st.Count) / seconds
+	st.P50 = percentileMs(latencies, 0.50)
+	st.P99 = percentileMs(latencies, 0.99)
+	st.LockTimeoutRate = float64(st.LockTimeouts) / float64(st.Count)
+	st.InsufficientFundsRate = float64(st.InsufficientFunds) / float64(st.Count)
+	return st
+}
+
+// percentileMs uses nearest rank of sorted latencies.
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return float64(sorted[i].Microseconds()) / 1000
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+const (
+	HEADER_ACCEPT_LANGUAGE string = "Accept-Language"
+
+	LOCALES_DIR    string = "locales"
+	DEFAULT_LOCALE string = "en"
+
+	MESSAGE_TRANSACTION_COMPLETED MessageKey = "transaction_completed"
+	MESSAGE_TRANSFER_COMPLETED    MessageKey = "transfer_completed"
+	MESSAGE_NO_ROUTE              MessageKey = "no_route"
+	MESSAGE_VALUE                 MessageKey = "value"
+)
+
+//go:embed locales/*.json
+var localesFS embed.FS
+
+var (
+	Messages = MustLoadMessageCatalog(localesFS, LOCALES_DIR, DEFAULT_LOCALE)
+)
+
+// MessageKey is a key of the message in catalog. Result localizes data of this type.
+type MessageKey string
+
+type MessageCatalog struct {
+	bundles  map[string]map[string]string
+	locales  []string
+	fallback string
+	matcher  language.Matcher
+}
+
+// LoadMessageCatalog reads <locale>.json bundles from dir.
+func LoadMessageCatalog(fsys fs.FS, dir string, fallback string) (*MessageCatalog, error) {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	c := &MessageCatalog{bundles: map[string]map[string]string{}, fallback: fallback}
+	for _, f := range files {
+		data, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, err
+		}
+		var bundle map[string]string
+		if err := json.Unmarshal(data, &bundle); err != nil {
+			return nil, fmt.Errorf("locale bundle %s: %w", f, err)
+		}
+		c.bundles[strings.TrimSuffix(path.Base(f), ".json")] = bundle
+	}
+	if _, ok := c.bundles[fallback]; !ok {
+		return nil, fmt.Errorf("no bundle for fallback locale %s", fallback)
+	}
+	c.locales = []string{fallback}
+	for l := range c.bundles {
+		if l != fallback {
+			c.locales = append(c.locales, l)
+		}
+	}
+	sort.Strings(c.locales[1:])
+	tags := make([]language.Tag, 0, len(c.locales))
+	for _, l := range c.locales {
+		tags = append(tags, language.Make(l))
+	}
+	c.matcher = language.NewMatcher(tags)
+	return c, nil
+}
+
+func MustLoadMessageCatalog(fsys fs.FS, dir string, fallback string) *MessageCatalog {
+	c, err := LoadMessageCatalog(fsys, dir, fallback)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func (c *MessageCatalog) Locales() []string {
+	return c.locales
+}
+
+// Locale picks supported locale from Accept-Language header value.
+func (c *MessageCatalog) Locale(acceptLanguage string) string {
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(tags) == 0 {
+		return c.fallback
+	}
+	_, idx, conf := c.matcher.Match(tags...)
+	if conf == language.No {
+		return c.fallback
+	}
+	return c.locales[idx]
+}
+
+func (c *MessageCatalog) Message(locale string, key MessageKey) string {
+	if m, ok := c.bundles[locale][string(key)]; ok {
+		return m
+	}
+	return c.bundles[c.fallback][string(key)]
+}
+
+func (c *MessageCatalog) Status(locale string, code int) string {
+	return c.Message(locale, MessageKey(strconv.Itoa(code)))
+}
+
+func (c *MessageCatalog) Keys(locale string) []string {
+	keys := make([]string, 0, len(c.bundles[locale]))
+	for k := range c.bundles[locale] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
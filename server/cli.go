@@ -0,0 +1,740 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os/user"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	COMMAND_API_KEY        string = "apikey"
+	COMMAND_API_KEY_ISSUE  string = "issue"
+	COMMAND_API_KEY_LIST   string = "list"
+	COMMAND_API_KEY_REVOKE string = "revoke"
+
+	COMMAND_LEDGER            string = "ledger"
+	COMMAND_LEDGER_VERIFY     string = "verify"
+	COMMAND_LEDGER_CHECKPOINT string = "checkpoint"
+
+	COMMAND_SERVE    string = "serve"
+	COMMAND_BALANCE  string = "balance"
+	COMMAND_CREDIT   string = "credit"
+	COMMAND_DEBIT    string = "debit"
+	COMMAND_TRANSFER string = "transfer"
+	COMMAND_HISTORY  string = "history"
+	COMMAND_EXPORT   string = "export"
+
+	OUTPUT_TABLE string = "table"
+	OUTPUT_JSON  string = "json"
+	OUTPUT_CSV   string = "csv"
+
+	COMMAND_MIGRATE        string = "migrate"
+	COMMAND_MIGRATE_UP     string = "up"
+	COMMAND_MIGRATE_DOWN   string = "down"
+	COMMAND_MIGRATE_STATUS string = "status"
+
+	COMMAND_BENCH string = "bench"
+
+	// EXPORT_PAGE_SIZE is the number of operations export reads per query by default.
+	EXPORT_PAGE_SIZE int = 1000
+	// COMMAND_ACTOR_PREFIX marks admin audit records of credit and debit commands.
+	COMMAND_ACTOR_PREFIX string = "cli:"
+)
+
+// ApiKeyCommand runs "apikey issue|list|revoke" admin command.
+func ApiKeyCommand(keys *ApiKeyService, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s %s|%s|%s [flags]", COMMAND_API_KEY, COMMAND_API_KEY_ISSUE, COMMAND_API_KEY_LIST, COMMAND_API_KEY_REVOKE)
+	}
+	fs := flag.NewFlagSet(COMMAND_API_KEY+" "+args[0], flag.ContinueOnError)
+	fs.SetOutput(out)
+	switch args[0] {
+	case COMMAND_API_KEY_ISSUE:
+		name := fs.String("name", "", "key owner description")
+		scopes := fs.String("scopes", "", "comma separated scopes: "+strings.Join(API_KEY_SCOPES, ", "))
+		accounts := fs.String("accounts", "", "comma separated account ids the key may operate on, empty for any")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		ids, err := parseAccountIds(*accounts)
+		if err != nil {
+			return err
+		}
+		secret, key, err := keys.Issue(context.Background(), *name, splitList(*scopes), ids)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Issued key %d. Store the secret, it will not be shown again:\n%s\n", key.Id, secret)
+		return nil
+	case COMMAND_API_KEY_LIST:
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		list, err := keys.List(context.Background())
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tACCOUNTS\tCREATED\tREVOKED")
+		for _, k := range list {
+			revoked := "-"
+			if k.Revoked != 0 {
+				revoked = time.Unix(k.Revoked, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", k.Id, k.Name, strings.Join(k.Scopes, ","), formatAccountIds(k.Accounts),
+				time.Unix(k.Created, 0).UTC().Format(time.RFC3339), revoked)
+		}
+		return w.Flush()
+	case COMMAND_API_KEY_REVOKE:
+		id := fs.Int("id", 0, "key id")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *id <= 0 {
+			return fmt.Errorf("key id is required")
+		}
+		if err := keys.Revoke(context.Background(), *id); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Revoked key %d\n", *id)
+		return nil
+	default:
+		return fmt.Errorf("unknown %s command %q", COMMAND_API_KEY, args[0])
+	}
+}
+
+// LedgerCommand runs "ledger verify|checkpoint" audit command, checkpoint key and directory default to cfg.
+func LedgerCommand(ledger *LedgerService, cfg LedgerConfig, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s %s|%s [flags]", COMMAND_LEDGER, COMMAND_LEDGER_VERIFY, COMMAND_LEDGER_CHECKPOINT)
+	}
+	fs := flag.NewFlagSet(COMMAND_LEDGER+" "+args[0], flag.ContinueOnError)
+	fs.SetOutput(out)
+	switch args[0] {
+	case COMMAND_LEDGER_VERIFY:
+		account := fs.Int("account", 0, "account id, 0 for all accounts")
+		checkpoint := fs.String("checkpoint", "", "signed checkpoint file the chain must extend")
+		publicKey := fs.String("public-key", "", "PEM Ed25519 public key of checkpoint signer")
+		output := outputFlag(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		o, err := newCommandOutput(out, *output)
+		if err != nil {
+			return err
+		}
+		var cp *LedgerCheckpoint
+		if *checkpoint != "" {
+			if *publicKey == "" {
+				return fmt.Errorf("public key is required to verify checkpoint")
+			}
+			pub, err := LoadCheckpointPublicKey(*publicKey)
+			if err != nil {
+				return err
+			}
+			if cp, err = LoadCheckpoint(*checkpoint); err != nil {
+				return err
+			}
+			if err := VerifyCheckpoint(pub, cp); err != nil {
+				return err
+			}
+		}
+		report, err := ledger.Verify(context.Background(), *account, cp)
+		if err != nil {
+			return o.fail(err)
+		}
+		if err := o.write(report, func(w io.Writer) {
+			if !report.Ok {
+				fmt.Fprintf(w, "Chain is broken at account %d row %d: %s\n", report.Break.Account, report.Break.Id, report.Break.Reason)
+				return
+			}
+			fmt.Fprintf(w, "Chain is intact: %d rows in %d accounts\n", report.Rows, report.Accounts)
+		}); err != nil {
+			return err
+		}
+		if !report.Ok {
+			return ErrChainBroken
+		}
+		return nil
+	case COMMAND_LEDGER_CHECKPOINT:
+		keyFile := fs.String("key", cfg.CheckpointKeyFile, "PEM Ed25519 private key")
+		dir := fs.String("dir", cfg.CheckpointDir, "directory for checkpoint files")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *keyFile == "" {
+			return fmt.Errorf("checkpoint key is required")
+		}
+		key, err := LoadCheckpointKey(*keyFile)
+		if err != nil {
+			return err
+		}
+		path, err := ledger.WriteCheckpoint(context.Background(), key, *dir)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Checkpoint exported to %s\n", path)
+		return nil
+	default:
+		return fmt.Errorf("unknown %s command %q", COMMAND_LEDGER, args[0])
+	}
+}
+
+// MigrateCommand runs "migrate up|down|status" schema command.
+func MigrateCommand(m *Migrator, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s %s|%s|%s [flags]", COMMAND_MIGRATE, COMMAND_MIGRATE_UP, COMMAND_MIGRATE_DOWN, COMMAND_MIGRATE_STATUS)
+	}
+	fs := flag.NewFlagSet(COMMAND_MIGRATE+" "+args[0], flag.ContinueOnError)
+	fs.SetOutput(out)
+	switch args[0] {
+	case COMMAND_MIGRATE_UP:
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		done, err := m.Up(context.Background())
+		for _, mg := range done {
+			fmt.Fprintf(out, "Applied %d %s\n", mg.Version, mg.Name)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Schema is at version %d\n", m.Latest())
+		return nil
+	case COMMAND_MIGRATE_DOWN:
+		steps := fs.Int("steps", 1, "number of migrations to revert")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *steps <= 0 {
+			return fmt.Errorf("steps should be positive")
+		}
+		done, err := m.Down(context.Background(), *steps)
+		for _, mg := range done {
+			fmt.Fprintf(out, "Reverted %d %s\n", mg.Version, mg.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Fprintln(out, "No applied migrations")
+		}
+		return nil
+	case COMMAND_MIGRATE_STATUS:
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		list, err := m.Status(context.Background())
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tAPPLIED")
+		for _, st := range list {
+			applied := "-"
+			if st.Applied != 0 {
+				applied = time.Unix(st.Applied, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", st.Version, st.Name, st.State, applied)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown %s command %q", COMMAND_MIGRATE, args[0])
+	}
+}
+
+// BenchCommand seeds bench accounts in a separate schema, runs workload and prints BenchReport as JSON.
+func BenchCommand(db *Database, srvCfg *Config, log zerolog.Logger, args []string, out io.Writer) error {
+	cfg := DefaultBenchConfig()
+	fs := flag.NewFlagSet(COMMAND_BENCH, flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.StringVar(&cfg.Schema, "schema", cfg.Schema, "schema created for the bench and dropped after it, should not exist")
+	fs.IntVar(&cfg.Accounts, "accounts", cfg.Accounts, "number of bench accounts")
+	fs.IntVar(&cfg.Transactions, "transactions", cfg.Transactions, "number of seeded transactions")
+	fs.Float64Var(&cfg.Skew, "skew", cfg.Skew, "zipf exponent above 1 of account popularity, 0 for uniform")
+	fs.IntVar(&cfg.FirstAccount, "first-account", cfg.FirstAccount, "id of the first bench account")
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "concurrent workers")
+	duration := fs.Duration("duration", cfg.Duration.Duration(), "workload duration")
+	mix := fs.String("mix", "transfer=40,debit=40,history=20", "operation weights")
+	fs.StringVar(&cfg.HistorySort, "history-sort", cfg.HistorySort, "history sort: date or sum")
+	fs.Int64Var(&cfg.RandomSeed, "random-seed", cfg.RandomSeed, "seed of generated data and workload")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg.Duration = Duration(*duration)
+	var err error
+	if cfg.Mix, err = ParseBenchMix(*mix); err != nil {
+		return err
+	}
+	report, err := NewBench(db, srvCfg, cfg, log).Run(context.Background())
+	if err != nil {
+		return err
+	}
+	return commandOutput{out, OUTPUT_JSON}.encode(report)
+}
+
+// CommandResult is JSON output of commands, the same envelope HTTP API responds with.
+type CommandResult struct {
+	Status int         `json:"status"`
+	Data   interface{} `json:"data"`
+}
+
+// CommandError is a failed command with status and message HTTP API would respond with.
+// Err keeps the cause, operator sees it in the error text.
+type CommandError struct {
+	Status  int
+	Message interface{}
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("status %d: %v", e.Status, e.Message)
+	if errs, ok := e.Message.(RequestErrors); ok {
+		fields := make([]string, len(errs))
+		for i, v := range errs {
+			fields[i] = v.Field + ": " + v.Message
+		}
+		msg = fmt.Sprintf("status %d: %s", e.Status, strings.Join(fields, "; "))
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// commandOutput writes command result as table or as JSON CommandResult.
+type commandOutput struct {
+	out    io.Writer
+	format string
+}
+
+func outputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", OUTPUT_TABLE, "output format: table or json")
+}
+
+func newCommandOutput(out io.Writer, format string, formats ...string) (commandOutput, error) {
+	for _, f := range append([]string{OUTPUT_TABLE, OUTPUT_JSON}, formats...) {
+		if format == f {
+			return commandOutput{out, format}, nil
+		}
+	}
+	return commandOutput{}, fmt.Errorf("unknown output format %q", format)
+}
+
+func (o commandOutput) write(data interface{}, table func(w io.Writer)) error {
+	if o.format == OUTPUT_JSON {
+		return o.encode(CommandResult{STATUS_CODE_OK, data})
+	}
+	w := tabwriter.NewWriter(o.out, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+// fail reports operation error with its code and message, JSON output gets error result too.
+func (o commandOutput) fail(err error) error {
+	opErr := ConvertError(err)
+	return o.failWith(&CommandError{opErr.Code, AccountExpectedResult.GetStatus(opErr.Code, DEFAULT_LOCALE), opErr.Err})
+}
+
+func (o commandOutput) invalid(errs RequestErrors) error {
+	return o.failWith(&CommandError{ERROR_WRONG_REQUEST, errs.Localize(Messages, DEFAULT_LOCALE), nil})
+}
+
+func (o commandOutput) failWith(err *CommandError) error {
+	if o.format == OUTPUT_JSON {
+		if encErr := o.encode(CommandResult{err.Status, err.Message}); encErr != nil {
+			return encErr
+		}
+	}
+	return err
+}
+
+func (o commandOutput) encode(v interface{}) error {
+	enc := json.NewEncoder(o.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+type BalanceOutput struct {
+	Account  int     `json:"account"`
+	Balance  float64 `json:"balance"`
+	Currency string  `json:"currency"`
+}
+
+type OperationOutput struct {
+	Account int     `json:"account"`
+	Sum     float64 `json:"sum"`
+	Balance float64 `json:"balance"`
+	AuditId int     `json:"audit_id"`
+}
+
+type TransferOutput struct {
+	From int     `json:"from"`
+	To   int     `json:"to"`
+	Sum  float64 `json:"sum"`
+}
+
+// AccountCommand runs balance, transfer, history and export commands through AccountService,
+// so they follow the rules and report the operation errors of HTTP API. Credit and debit are
+// admin adjustments of AdminService, recorded in admin audit log with the reason.
+func AccountCommand(s *AccountService, adm *AdminService, command string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(out)
+	output := outputFlag(fs)
+	ctx := context.Background()
+	switch command {
+	case COMMAND_BALANCE:
+		account := fs.Int("account", 0, "account id")
+		currency := fs.String("currency", "", "currency code, base currency by default")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		o, err := newCommandOutput(out, *output)
+		if err != nil {
+			return err
+		}
+		if errs := validateAccount("account", *account); len(errs) > 0 {
+			return o.invalid(errs)
+		}
+		bData := BalanceData{Id: *account, Cur: strings.ToUpper(*currency)}
+		bal, err := s.GetUserBalance(ctx, &bData)
+		if err != nil {
+			return o.fail(err)
+		}
+		return o.write(BalanceOutput{bData.Id, bal, bData.Cur}, func(w io.Writer) {
+			fmt.Fprintln(w, "ACCOUNT\tBALANCE\tCURRENCY")
+			fmt.Fprintf(w, "%d\t%.2f\t%s\n", bData.Id, bal, bData.Cur)
+		})
+	case COMMAND_CREDIT, COMMAND_DEBIT:
+		account := fs.Int("account", 0, "account id")
+		sum := fs.Float64("sum", 0, "positive amount in base currency")
+		reason := fs.String("reason", "", "reason recorded in admin audit log")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		o, err := newCommandOutput(out, *output)
+		if err != nil {
+			return err
+		}
+		errs := validateAccount("account", *account)
+		if *sum <= 0 {
+			errs = append(errs, NewValidationError("sum", RULE_GT, "0"))
+		}
+		if strings.TrimSpace(*reason) == "" {
+			errs = append(errs, NewValidationError("reason", RULE_REQUIRED, ""))
+		}
+		if len(errs) > 0 {
+			return o.invalid(errs)
+		}
+		aData := AdjustmentData{Account: *account, Sum: *sum, Reason: strings.TrimSpace(*reason), Actor: commandActor()}
+		if command == COMMAND_DEBIT {
+			aData.Sum = -*sum
+		}
+		rec, err := adm.Adjust(ctx, &aData)
+		if err != nil {
+			return o.fail(err)
+		}
+		bal, err := s.GetUserBalance(ctx, &BalanceData{Id: *account})
+		if err != nil {
+			return o.fail(err)
+		}
+		return o.write(OperationOutput{aData.Account, aData.Sum, bal, rec.Id}, func(w io.Writer) {
+			fmt.Fprintln(w, "ACCOUNT\tSUM\tBALANCE\tAUDIT")
+			fmt.Fprintf(w, "%d\t%+.2f\t%.2f\t%d\n", aData.Account, aData.Sum, bal, rec.Id)
+		})
+	case COMMAND_TRANSFER:
+		from := fs.Int("from", 0, "sender account id")
+		to := fs.Int("to", 0, "receiver account id")
+		sum := fs.Float64("sum", 0, "positive amount in base currency")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		o, err := newCommandOutput(out, *output)
+		if err != nil {
+			return err
+		}
+		errs := append(validateAccount("from", *from), validateAccount("to", *to)...)
+		if *from == *to && *from > 0 {
+			errs = append(errs, NewValidationError("to", RULE_NEFIELD, "from"))
+		}
+		if *sum <= 0 {
+			errs = append(errs, NewValidationError("sum", RULE_GT, "0"))
+		}
+		if len(errs) > 0 {
+			return o.invalid(errs)
+		}
+		tData := TransferData{From: *from, To: *to, Sum: *sum}
+		if err := s.TransferMoney(ctx, &tData); err != nil {
+			return o.fail(err)
+		}
+		return o.write(TransferOutput{tData.From, tData.To, tData.Sum}, func(w io.Writer) {
+			fmt.Fprintln(w, "FROM\tTO\tSUM")
+			fmt.Fprintf(w, "%d\t%d\t%.2f\n", tData.From, tData.To, tData.Sum)
+		})
+	case COMMAND_HISTORY:
+		account := fs.Int("account", 0, "account id")
+		sort := fs.String("sort", "date", "date or sum")
+		start := fs.Int64("start", 0, "unix time of the first operation")
+		end := fs.Int64("end", 0, "unix time of the last operation, now by default")
+		cursor := fs.Int("cursor", 0, "next page cursor from previous output")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		o, err := newCommandOutput(out, *output)
+		if err != nil {
+			return err
+		}
+		trxData, errs := commandTransactionsData(*account, *start, *end)
+		if len(errs) > 0 {
+			return o.invalid(errs)
+		}
+		trxData.Page, trxData.Sort = *cursor, *sort
+		trxs, err := s.GetUserTransactions(ctx, &trxData)
+		if err != nil {
+			return o.fail(err)
+		}
+		return o.write(trxs, func(w io.Writer) {
+			writeTransactions(w, trxs.Trxs)
+			if trxs.Last != -1 {
+				fmt.Fprintf(w, "Next page: -cursor %d\n", trxs.Last)
+			}
+		})
+	case COMMAND_EXPORT:
+		fs.Lookup("output").Usage = "output format: table, json or csv"
+		account := fs.Int("account", 0, "account id")
+		start := fs.Int64("start", 0, "unix time of the first operation")
+		end := fs.Int64("end", 0, "unix time of the last operation, now by default")
+		pageSize := fs.Int("page-size", EXPORT_PAGE_SIZE, "operations read per query")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		o, err := newCommandOutput(out, *output, OUTPUT_CSV)
+		if err != nil {
+			return err
+		}
+		trxData, errs := commandTransactionsData(*account, *start, *end)
+		if *pageSize <= 0 {
+			errs = append(errs, NewValidationError("page-size", RULE_GT, "0"))
+		}
+		if len(errs) > 0 {
+			return o.invalid(errs)
+		}
+		trxData.Limit = *pageSize
+		if err := exportTransactions(ctx, s, trxData, newTransactionsWriter(out, o.format)); err != nil {
+			return o.fail(err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+func validateAccount(field string, id int) RequestErrors {
+	if id <= 0 {
+		return RequestErrors{NewValidationError(field, RULE_GT, "0")}
+	}
+	return nil
+}
+
+// commandTransactionsData applies HTTP API defaults and checks: end is now by default and can not precede start.
+func commandTransactionsData(account int, start int64, end int64) (TransactionsListData, RequestErrors) {
+	errs := validateAccount("account", account)
+	if end == 0 {
+		end = time.Now().Unix()
+	}
+	if start > end {
+		errs = append(errs, NewValidationError("start", RULE_LTEFIELD, "end"))
+	}
+	return TransactionsListData{Id: account, From: start, To: end}, errs
+}
+
+// exportTransactions reads pages of date sorted history and writes each page as soon as it is read,
+// so memory does not grow with the history. Output of a failed export is cut after the last written page.
+func exportTransactions(ctx context.Context, s *AccountService, trxData TransactionsListData, w transactionsWriter) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	for {
+		page, err := s.GetUserTransactions(ctx, &trxData)
+		if err != nil {
+			return err
+		}
+		if err := w.page(page.Trxs); err != nil {
+			return err
+		}
+		if page.Last == -1 {
+			return w.end()
+		}
+		trxData.Page = page.Last
+	}
+}
+
+// transactionsWriter streams exported transactions in one of output formats.
+type transactionsWriter interface {
+	begin() error
+	page(trxs []map[string]interface{}) error
+	end() error
+}
+
+func newTransactionsWriter(out io.Writer, format string) transactionsWriter {
+	switch format {
+	case OUTPUT_CSV:
+		return &csvTransactionsWriter{w: csv.NewWriter(out)}
+	case OUTPUT_JSON:
+		return &jsonTransactionsWriter{out: out}
+	default:
+		return &tableTransactionsWriter{w: tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)}
+	}
+}
+
+// tableTransactionsWriter aligns columns within a page.
+type tableTransactionsWriter struct {
+	w *tabwriter.Writer
+}
+
+func (t *tableTransactionsWriter) begin() error {
+	fmt.Fprintln(t.w, "DATE\tSUM\tOPERATION\tDESCRIPTION")
+	return nil
+}
+
+func (t *tableTransactionsWriter) page(trxs []map[string]interface{}) error {
+	for _, trx := range trxs {
+		writeTransaction(t.w, trx)
+	}
+	return t.w.Flush()
+}
+
+func (t *tableTransactionsWriter) end() error {
+	return nil
+}
+
+type csvTransactionsWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvTransactionsWriter) begin() error {
+	c.w.Write([]string{"date", "sum", "operation", "description"})
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvTransactionsWriter) page(trxs []map[string]interface{}) error {
+	for _, t := range trxs {
+		c.w.Write([]string{
+			t["date"].(time.Time).UTC().Format(time.RFC3339),
+			strconv.FormatFloat(t["sum"].(float64), 'f', 2, 64),
+			strconv.Itoa(t["operation"].(int)),
+			t["desc"].(string),
+		})
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvTransactionsWriter) end() error {
+	return nil
+}
+
+// jsonTransactionsWriter writes CommandResult envelope with transactions list as data.
+type jsonTransactionsWriter struct {
+	out   io.Writer
+	count int
+}
+
+func (j *jsonTransactionsWriter) begin() error {
+	_, err := fmt.Fprintf(j.out, "{\n  \"status\": %d,\n  \"data\": [", STATUS_CODE_OK)
+	return err
+}
+
+func (j *jsonTransactionsWriter) page(trxs []map[string]interface{}) error {
+	for _, t := range trxs {
+		data, err := json.MarshalIndent(t, "    ", "  ")
+		if err != nil {
+			return err
+		}
+		sep := ",\n    "
+		if j.count == 0 {
+			sep = "\n    "
+		}
+		if _, err := fmt.Fprintf(j.out, "%s%s", sep, data); err != nil {
+			return err
+		}
+		j.count++
+	}
+	return nil
+}
+
+func (j *jsonTransactionsWriter) end() error {
+	closing := "\n  ]\n}\n"
+	if j.count == 0 {
+		closing = "]\n}\n"
+	}
+	_, err := io.WriteString(j.out, closing)
+	return err
+}
+
+func writeTransactions(w io.Writer, trxs []map[string]interface{}) {
+	fmt.Fprintln(w, "DATE\tSUM\tOPERATION\tDESCRIPTION")
+	for _, t := range trxs {
+		writeTransaction(w, t)
+	}
+}
+
+func writeTransaction(w io.Writer, t map[string]interface{}) {
+	fmt.Fprintf(w, "%s\t%+.2f\t%d\t%s\n", t["date"].(time.Time).UTC().Format(time.RFC3339), t["sum"], t["operation"], t["desc"])
+}
+
+// commandActor identifies operator of the command in admin audit log by OS user.
+func commandActor() string {
+	if u, err := user.Current(); err == nil {
+		return COMMAND_ACTOR_PREFIX + u.Username
+	}
+	return COMMAND_ACTOR_PREFIX + "unknown"
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func parseAccountIds(s string) ([]int, error) {
+	ids := []int{}
+	for _, v := range splitList(s) {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("wrong account id %q", v)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func formatAccountIds(ids []int) string {
+	if len(ids) == 0 {
+		return "*"
+	}
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ",")
+}
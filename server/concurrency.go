@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	CONCURRENCY_ADVISORY     string = "advisory"
+	CONCURRENCY_ROW_LOCK     string = "row_lock"
+	CONCURRENCY_SERIALIZABLE string = "serializable"
+
+	SERIALIZABLE_RETRIES int = 5
+	// SERIALIZABLE_BACKOFF is the first retry delay, it doubles with every retry up to SERIALIZABLE_MAX_BACKOFF.
+	// The actual delay is random from zero to it, so conflicting transactions do not retry in step.
+	SERIALIZABLE_BACKOFF     time.Duration = 10 * time.Millisecond
+	SERIALIZABLE_MAX_BACKOFF time.Duration = 500 * time.Millisecond
+
+	INSERT_ACCOUNT            string = "INSERT INTO accounts(id) VALUES($1) ON CONFLICT DO NOTHING"
+	SELECT_ACCOUNT_FOR_UPDATE string = "SELECT id FROM accounts WHERE id = $1 FOR UPDATE"
+	// SET_LOCAL_LOCK_TIMEOUT limits lock waits of the current transaction only, in milliseconds.
+	SET_LOCAL_LOCK_TIMEOUT string = "SET LOCAL lock_timeout = %d"
+)
+
+var (
+	CONCURRENCY_STRATEGIES = []string{CONCURRENCY_ADVISORY, CONCURRENCY_ROW_LOCK, CONCURRENCY_SERIALIZABLE}
+)
+
+// ConcurrencyStrategy keeps concurrent ledger writes of one account from overspending the balance
+// and from forking its hash chain. Every instance of the service should use the same strategy.
+type ConcurrencyStrategy interface {
+	Name() string
+	// Execute runs ledger write actn in transaction, retrying it when the strategy expects conflicts.
+	Execute(ctx context.Context, db DatabaseI, actn func(tx *pgx.Tx) (interface{}, error)) (interface{}, error)
+	// Lock guards operation oCode of account, LEDGER_CHAIN_LOCK guards append to its chain.
+	Lock(ctx context.Context, tx *pgx.Tx, id int, oCode int) error
+	// LockTransfer guards both accounts of transfer in order that does not deadlock with opposite transfer.
+	LockTransfer(ctx context.Context, tx *pgx.Tx, from int, to int) error
+}
+
+func NewConcurrencyStrategy(cfg DatabaseConfig) (ConcurrencyStrategy, error) {
+	switch cfg.Concurrency {
+	case CONCURRENCY_ADVISORY, "":
+		return AdvisoryLocks{LockTimeout: cfg.LockTimeout.Duration()}, nil
+	case CONCURRENCY_ROW_LOCK:
+		return RowLocks{LockTimeout: cfg.LockTimeout.Duration()}, nil
+	case CONCURRENCY_SERIALIZABLE:
+		return SerializableIsolation{
+			Retries:     cfg.SerializableRetries,
+			Backoff:     SERIALIZABLE_BACKOFF,
+			MaxBackoff:  SERIALIZABLE_MAX_BACKOFF,
+			LockTimeout: cfg.LockTimeout.Duration(),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown concurrency strategy %q", cfg.Concurrency)
+	}
+}
+
+// AdvisoryLocks takes pg_advisory_xact_lock on account and operation code. Operations listed
+// in LOCKED_OPERATIONS exclude each other, every append takes the chain lock of the account.
+// Lock waits of the transaction end with ERROR_LOCK_TIMEOUT after LockTimeout, zero does not limit them.
+type AdvisoryLocks struct {
+	LockTimeout time.Duration
+}
+
+func (AdvisoryLocks) Name() string {
+	return CONCURRENCY_ADVISORY
+}
+
+func (a AdvisoryLocks) Execute(ctx context.Context, db DatabaseI, actn func(tx *pgx.Tx) (interface{}, error)) (interface{}, error) {
+	return db.ExecuteInTransaction(ctx, withLockTimeout(ctx, a.LockTimeout, actn))
+}
+
+func (AdvisoryLocks) Lock(ctx context.Context, tx *pgx.Tx, id int, oCode int) error {
+	return lockAccount(ctx, tx, id, oCode)
+}
+
+// LockTransfer takes outcome lock of the sender first, then chain locks of both accounts in ascending order.
+func (AdvisoryLocks) LockTransfer(ctx context.Context, tx *pgx.Tx, from int, to int) error {
+	if err := lockAccount(ctx, tx, from, OPERATION_OUTCOME_CODE); err != nil {
+		return err
+	}
+	for _, id := range ascending(from, to) {
+		if err := lockAccount(ctx, tx, id, LEDGER_CHAIN_LOCK); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RowLocks locks the account row with SELECT ... FOR UPDATE for any operation, so all writes
+// of an account are serialized regardless of operation code. Missing rows are created on first use.
+// Lock waits are limited by LockTimeout like in AdvisoryLocks.
+type RowLocks struct {
+	LockTimeout time.Duration
+}
+
+func (RowLocks) Name() string {
+	return CONCURRENCY_ROW_LOCK
+}
+
+func (r RowLocks) Execute(ctx context.Context, db DatabaseI, actn func(tx *pgx.Tx) (interface{}, error)) (interface{}, error) {
+	return db.ExecuteInTransaction(ctx, withLockTimeout(ctx, r.LockTimeout, actn))
+}
+
+func (RowLocks) Lock(ctx context.Context, tx *pgx.Tx, id int, oCode int) error {
+	return lockAccountRow(ctx, tx, id)
+}
+
+func (RowLocks) LockTransfer(ctx context.Context, tx *pgx.Tx, from int, to int) error {
+	for _, id := range ascending(from, to) {
+		if err := lockAccountRow(ctx, tx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockAccountRow waits for the account row up to lock_timeout of the transaction, like lockAccount.
+func lockAccountRow(ctx context.Context, tx *pgx.Tx, id int) error {
+	if _, err := (*tx).Exec(ctx, INSERT_ACCOUNT, id); err != nil {
+		return contextErrorOr(ctx, ClassifyPgError(err))
+	}
+	if _, err := (*tx).Exec(ctx, SELECT_ACCOUNT_FOR_UPDATE, id); err != nil {
+		return contextErrorOr(ctx, ClassifyPgError(err))
+	}
+	return nil
+}
+
+// SerializableIsolation takes no locks and runs ledger writes in SERIALIZABLE transactions.
+// PostgreSQL aborts one of two transactions that read the balance or chain head the other
+// one changes, the aborted transaction is retried up to Retries times with jittered backoff.
+// When retries are exhausted ERROR_TRANSACTION_CONFLICT is returned. Row lock waits of writes
+// are limited by LockTimeout like in AdvisoryLocks.
+type SerializableIsolation struct {
+	Retries     int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	LockTimeout time.Duration
+}
+
+func (SerializableIsolation) Name() string {
+	return CONCURRENCY_SERIALIZABLE
+}
+
+func (s SerializableIsolation) Execute(ctx context.Context, db DatabaseI, actn func(tx *pgx.Tx) (interface{}, error)) (interface{}, error) {
+	backoff := s.Backoff
+	for attempt := 0; ; attempt++ {
+		res, err := db.ExecuteInTransactionWith(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable}, withLockTimeout(ctx, s.LockTimeout, actn))
+		if !IsSerializationFailure(err) || attempt >= s.Retries {
+			return res, err
+		}
+		observeTransactionRetry()
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(backoff) + 1))):
+		case <-ctx.Done():
+			return nil, contextErrorOr(ctx, err)
+		}
+		if backoff *= 2; backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+func (SerializableIsolation) Lock(ctx context.Context, tx *pgx.Tx, id int, oCode int) error {
+	return nil
+}
+
+func (SerializableIsolation) LockTransfer(ctx context.Context, tx *pgx.Tx, from int, to int) error {
+	return nil
+}
+
+// IsSerializationFailure reports SQLSTATE 40001, transaction that failed with it can be retried as is.
+func IsSerializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == PG_SERIALIZATION_FAILURE
+}
+
+// withLockTimeout sets lock_timeout of the transaction before actn runs, so it ends with the
+// transaction and does not leak to other users of the pooled connection.
+func withLockTimeout(ctx context.Context, timeout time.Duration, actn func(tx *pgx.Tx) (interface{}, error)) func(tx *pgx.Tx) (interface{}, error) {
+	return func(tx *pgx.Tx) (interface{}, error) {
+		if timeout > 0 {
+			if _, err := (*tx).Exec(ctx, fmt.Sprintf(SET_LOCAL_LOCK_TIMEOUT, timeout.Milliseconds())); err != nil {
+				return nil, err
+			}
+		}
+		return actn(tx)
+	}
+}
+
+func ascending(a int, b int) []int {
+	if a > b {
+		return []int{b, a}
+	}
+	return []int{a, b}
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ENV_CONFIG_FILE  string = "CONFIG_FILE"
+	FLAG_CONFIG_FILE string = "config"
+
+	HTTP_PORT int = 8080
+	GRPC_PORT int = 9090
+	// LOCK_TIMEOUT is how long an operation waits for account lock before ERROR_LOCK_TIMEOUT.
+	LOCK_TIMEOUT          time.Duration = 10 * time.Second
+	VIEW_REFRESH_INTERVAL time.Duration = 3 * time.Minute
+
+	CONFIG_REDACTED string = "[REDACTED]"
+)
+
+// Config is the effective server configuration. Values are applied in order: defaults,
+// JSON file, environment variables, command line flags; every source overrides only
+// the values it sets. Field tags name environment variable and flag of the value,
+// values tagged secret are hidden by Redacted.
+type Config struct {
+	Http      HttpConfig      `json:"http"`
+	Grpc      GrpcConfig      `json:"grpc"`
+	Database  DatabaseConfig  `json:"database"`
+	Ledger    LedgerConfig    `json:"ledger"`
+	Currency  CurrencyConfig  `json:"currency"`
+	Log       LogConfig       `json:"log"`
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	Signature SignatureConfig `json:"signature"`
+	Jwt       JwtConfig       `json:"jwt"`
+	Tracing   TracingConfig   `json:"tracing"`
+}
+
+type HttpConfig struct {
+	Port            int      `json:"port" env:"PORT" flag:"port" usage:"HTTP listen port"`
+	ShutdownTimeout Duration `json:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"time to drain requests and jobs on shutdown"`
+	ShutdownDelay   Duration `json:"shutdown_delay" env:"SHUTDOWN_DELAY" flag:"shutdown-delay" usage:"time to keep serving after readiness is lost on shutdown"`
+	// Request timeouts are deadlines of route groups, zero disables the deadline.
+	RequestTimeoutRead  Duration `json:"request_timeout_read" env:"REQUEST_TIMEOUT_READ" flag:"request-timeout-read" usage:"deadline of read requests"`
+	RequestTimeoutWrite Duration `json:"request_timeout_write" env:"REQUEST_TIMEOUT_WRITE" flag:"request-timeout-write" usage:"deadline of write requests"`
+	RequestTimeoutAdmin Duration `json:"request_timeout_admin" env:"REQUEST_TIMEOUT_ADMIN" flag:"request-timeout-admin" usage:"deadline of admin requests"`
+}
+
+type GrpcConfig struct {
+	Port int `json:"port" env:"GRPC_PORT" flag:"grpc-port" usage:"gRPC listen port"`
+}
+
+type DatabaseConfig struct {
+	Url         string   `json:"url" env:"DATABASE_URL" flag:"database-url" usage:"PostgreSQL connection string" secret:"true"`
+	LockTimeout Duration `json:"lock_timeout" env:"LOCK_TIMEOUT" flag:"lock-timeout" usage:"account lock wait timeout"`
+	// MigrateOnStart applies pending migrations before the server starts instead of refusing to start.
+	MigrateOnStart bool `json:"migrate_on_start" env:"MIGRATE_ON_START" flag:"migrate-on-start" usage:"apply pending migrations on start"`
+	// Concurrency selects ConcurrencyStrategy of ledger writes, SerializableRetries applies to serializable strategy only.
+	Concurrency         string `json:"concurrency" env:"CONCURRENCY" flag:"concurrency" usage:"ledger concurrency strategy: advisory, row_lock or serializable"`
+	SerializableRetries int    `json:"serializable_retries" env:"SERIALIZABLE_RETRIES" flag:"serializable-retries" usage:"retries of serializable transaction after serialization failure"`
+}
+
+type LedgerConfig struct {
+	PageSize            int      `json:"page_size" env:"PAGE_SIZE" flag:"page-size" usage:"transactions per page"`
+	ViewRefreshInterval Duration `json:"view_refresh_interval" env:"VIEW_REFRESH_INTERVAL" flag:"view-refresh-interval" usage:"period of sum ordered view refresh"`
+	// CheckpointKeyFile enables scheduled checkpoint export, without it checkpoints are exported by command only.
+	CheckpointKeyFile  string   `json:"checkpoint_key_file" env:"CHECKPOINT_KEY_FILE" flag:"checkpoint-key-file" usage:"PEM Ed25519 key signing ledger checkpoints" secret:"true"`
+	CheckpointDir      string   `json:"checkpoint_dir" env:"CHECKPOINT_DIR" flag:"checkpoint-dir" usage:"directory for checkpoint files"`
+	CheckpointInterval Duration `json:"checkpoint_interval" env:"CHECKPOINT_INTERVAL" flag:"checkpoint-interval" usage:"period of checkpoint export"`
+}
+
+type CurrencyConfig struct {
+	Base     string   `json:"base" env:"BASE_CURRENCY" flag:"base-currency" usage:"currency balances are stored in"`
+	RatesUrl string   `json:"rates_url" env:"CURRENCY_RATES_URL" flag:"rates-url" usage:"currency rates provider url"`
+	Timeout  Duration `json:"timeout" env:"CURRENCY_TIMEOUT" flag:"currency-timeout" usage:"timeout of rates provider requests"`
+	// PropagateTrace sends traceparent to the provider, it is meant for providers inside the traced system only.
+	PropagateTrace bool `json:"propagate_trace" env:"CURRENCY_PROPAGATE_TRACE" flag:"currency-propagate-trace" usage:"send trace context to rates provider"`
+	// CheckReadiness adds non-critical rates provider check to /readyz.
+	CheckReadiness bool `json:"check_readiness" env:"READYZ_CHECK_CURRENCY" flag:"readyz-check-currency" usage:"check rates provider in readiness probe"`
+}
+
+type LogConfig struct {
+	Level LogLevel `json:"level" env:"LOG_LEVEL" flag:"log-level" usage:"debug, info, warn or error"`
+}
+
+// RateLimitConfig sets limits of route groups by client and by target account, see RATE_LIMIT_POLICIES.
+type RateLimitConfig struct {
+	Store string `json:"store" env:"RATE_LIMIT_STORE" flag:"rate-limit-store" usage:"rate limit store: memory or postgres"`
+	// PurgeInterval is period of idle buckets cleanup in postgres store.
+	PurgeInterval Duration  `json:"purge_interval" env:"RATE_LIMIT_PURGE_INTERVAL" flag:"rate-limit-purge-interval" usage:"period of idle rate limits cleanup"`
+	ReadClient    RateLimit `json:"read_client" env:"RATE_LIMIT_READ_CLIENT" flag:"rate-limit-read-client" usage:"read limit of client as \"rate,burst\", 0 disables it"`
+	ReadAccount   RateLimit `json:"read_account" env:"RATE_LIMIT_READ_ACCOUNT" flag:"rate-limit-read-account" usage:"read limit of account as \"rate,burst\", 0 disables it"`
+	WriteClient   RateLimit `json:"write_client" env:"RATE_LIMIT_WRITE_CLIENT" flag:"rate-limit-write-client" usage:"write limit of client as \"rate,burst\", 0 disables it"`
+	WriteAccount  RateLimit `json:"write_account" env:"RATE_LIMIT_WRITE_ACCOUNT" flag:"rate-limit-write-account" usage:"write limit of account as \"rate,burst\", 0 disables it"`
+	AdminClient   RateLimit `json:"admin_client" env:"RATE_LIMIT_ADMIN_CLIENT" flag:"rate-limit-admin-client" usage:"admin limit of client as \"rate,burst\", 0 disables it"`
+	AdminAccount  RateLimit `json:"admin_account" env:"RATE_LIMIT_ADMIN_ACCOUNT" flag:"rate-limit-admin-account" usage:"admin limit of account as \"rate,burst\", 0 disables it"`
+}
+
+type SignatureConfig struct {
+	// SecretsFile is JSON file of partner secrets, without it no key has to sign requests.
+	SecretsFile string   `json:"secrets_file" env:"SIGNATURE_SECRETS_FILE" flag:"signature-secrets-file" usage:"JSON file of partner HMAC secrets" secret:"true"`
+	Window      Duration `json:"window" env:"SIGNATURE_WINDOW" flag:"signature-window" usage:"allowed clock skew of signed requests"`
+}
+
+// JwtConfig enables JWT authentication when Secret or JwksFile is set.
+type JwtConfig struct {
+	Secret       string `json:"secret" env:"JWT_SECRET" flag:"jwt-secret" usage:"HS256 secret" secret:"true"`
+	JwksFile     string `json:"jwks_file" env:"JWT_JWKS_FILE" flag:"jwt-jwks-file" usage:"JWKS file of RS256 and HS256 keys" secret:"true"`
+	AccountClaim string `json:"account_claim" env:"JWT_ACCOUNT_CLAIM" flag:"jwt-account-claim" usage:"claim with account id"`
+}
+
+type TracingConfig struct {
+	// Exporter of spans, OTLP endpoint is configured by standard OTEL_EXPORTER_OTLP_* variables.
+	Exporter string `json:"exporter" env:"OTEL_TRACES_EXPORTER" flag:"traces-exporter" usage:"span exporter: none, otlp or stdout"`
+}
+
+// Duration is time.Duration written as Go duration string, e.g. "10s", in config file and admin endpoint.
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration().String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"10s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+var (
+	durationType  = reflect.TypeOf(Duration(0))
+	rateLimitType = reflect.TypeOf(RateLimit{})
+)
+
+func DefaultConfig() *Config {
+	return &Config{
+		Http: HttpConfig{
+			Port:                HTTP_PORT,
+			ShutdownTimeout:     Duration(SHUTDOWN_TIMEOUT),
+			ShutdownDelay:       Duration(SHUTDOWN_DELAY),
+			RequestTimeoutRead:  Duration(REQUEST_TIMEOUTS[RATE_LIMIT_GROUP_READ]),
+			RequestTimeoutWrite: Duration(REQUEST_TIMEOUTS[RATE_LIMIT_GROUP_WRITE]),
+			RequestTimeoutAdmin: Duration(REQUEST_TIMEOUTS[RATE_LIMIT_GROUP_ADMIN]),
+		},
+		Grpc:     GrpcConfig{Port: GRPC_PORT},
+		Database: DatabaseConfig{LockTimeout: Duration(LOCK_TIMEOUT), Concurrency: CONCURRENCY_ADVISORY, SerializableRetries: SERIALIZABLE_RETRIES},
+		Ledger: LedgerConfig{
+			PageSize:            PAGINATION_PAGE_SIZE,
+			ViewRefreshInterval: Duration(VIEW_REFRESH_INTERVAL),
+			CheckpointDir:       CHECKPOINT_DEFAULT_DIR,
+			CheckpointInterval:  Duration(CHECKPOINT_INTERVAL),
+		},
+		Currency: CurrencyConfig{Base: BASE_CURRENCY, RatesUrl: CURRENCY_RATES_API, Timeout: Duration(CURRENCY_RATES_TIMEOUT)},
+		Log:      LogConfig{Level: LOG_LEVEL_INFO},
+		RateLimit: RateLimitConfig{
+			Store:         RATE_LIMIT_STORE_MEMORY,
+			PurgeInterval: Duration(RATE_LIMIT_PURGE_INTERVAL),
+			ReadClient:    RATE_LIMIT_POLICIES[RATE_LIMIT_GROUP_READ].Client,
+			ReadAccount:   RATE_LIMIT_POLICIES[RATE_LIMIT_GROUP_READ].Account,
+			WriteClient:   RATE_LIMIT_POLICIES[RATE_LIMIT_GROUP_WRITE].Client,
+			WriteAccount:  RATE_LIMIT_POLICIES[RATE_LIMIT_GROUP_WRITE].Account,
+			AdminClient:   RATE_LIMIT_POLICIES[RATE_LIMIT_GROUP_ADMIN].Client,
+			AdminAccount:  RATE_LIMIT_POLICIES[RATE_LIMIT_GROUP_ADMIN].Account,
+		},
+		Signature: SignatureConfig{Window: Duration(SIGNATURE_WINDOW)},
+		Jwt:       JwtConfig{AccountClaim: JWT_DEFAULT_ACCOUNT_CLAIM},
+		Tracing:   TracingConfig{Exporter: TRACES_EXPORTER_NONE},
+	}
+}
+
+// RequestTimeouts returns deadlines by route group, zero disables the deadline.
+func (c HttpConfig) RequestTimeouts() map[string]time.Duration {
+	return map[string]time.Duration{
+		RATE_LIMIT_GROUP_READ:  c.RequestTimeoutRead.Duration(),
+		RATE_LIMIT_GROUP_WRITE: c.RequestTimeoutWrite.Duration(),
+		RATE_LIMIT_GROUP_ADMIN: c.RequestTimeoutAdmin.Duration(),
+	}
+}
+
+// Policies returns rate limit policies by route group.
+func (c RateLimitConfig) Policies() map[string]RateLimitPolicy {
+	return map[string]RateLimitPolicy{
+		RATE_LIMIT_GROUP_READ:  {Group: RATE_LIMIT_GROUP_READ, Client: c.ReadClient, Account: c.ReadAccount},
+		RATE_LIMIT_GROUP_WRITE: {Group: RATE_LIMIT_GROUP_WRITE, Client: c.WriteClient, Account: c.WriteAccount},
+		RATE_LIMIT_GROUP_ADMIN: {Group: RATE_LIMIT_GROUP_ADMIN, Client: c.AdminClient, Account: c.AdminAccount},
+	}
+}
+
+// LoadConfig builds config from defaults, the file given by -config flag or CONFIG_FILE,
+// environment and flags in args, then validates it. Nil args skip flags.
+func LoadConfig(args []string) (*Config, error) {
+	cfg := DefaultConfig()
+	flags := map[string]string{}
+	file := os.Getenv(ENV_CONFIG_FILE)
+	if args != nil {
+		fs := flag.NewFlagSet("balance-server", flag.ContinueOnError)
+		fs.StringVar(&file, FLAG_CONFIG_FILE, file, "JSON config file")
+		for _, f := range cfg.fields() {
+			name := f.tag.Get("flag")
+			fs.Var(flagValue{f.value.Kind() == reflect.Bool, func(s string) error {
+				flags[name] = s
+				return nil
+			}}, name, f.tag.Get("usage"))
+		}
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+	}
+	if file != "" {
+		if err := cfg.loadFile(file); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range cfg.fields() {
+		if v, ok := os.LookupEnv(f.tag.Get("env")); ok {
+			if err := f.set(v); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.tag.Get("env"), err)
+			}
+		}
+		if v, ok := flags[f.tag.Get("flag")]; ok {
+			if err := f.set(v); err != nil {
+				return nil, fmt.Errorf("-%s: %w", f.tag.Get("flag"), err)
+			}
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports all wrong values at once.
+func (cfg *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	check(validPort(cfg.Http.Port), "http.port: %d is not a port", cfg.Http.Port)
+	check(validPort(cfg.Grpc.Port), "grpc.port: %d is not a port", cfg.Grpc.Port)
+	check(cfg.Http.Port != cfg.Grpc.Port, "grpc.port: %d is used by http", cfg.Grpc.Port)
+	check(cfg.Http.ShutdownTimeout > 0, "http.shutdown_timeout: should be positive")
+	check(cfg.Http.ShutdownDelay >= 0, "http.shutdown_delay: should not be negative")
+	check(cfg.Http.RequestTimeoutRead >= 0, "http.request_timeout_read: should not be negative")
+	check(cfg.Http.RequestTimeoutWrite >= 0, "http.request_timeout_write: should not be negative")
+	check(cfg.Http.RequestTimeoutAdmin >= 0, "http.request_timeout_admin: should not be negative")
+	check(cfg.Database.Url != "", "database.url: required")
+	check(cfg.Database.LockTimeout > 0, "database.lock_timeout: should be positive")
+	_, err := NewConcurrencyStrategy(cfg.Database)
+	check(err == nil && cfg.Database.Concurrency != "", "database.concurrency: %q is not %s", cfg.Database.Concurrency, strings.Join(CONCURRENCY_STRATEGIES, ", "))
+	check(cfg.Database.SerializableRetries >= 0, "database.serializable_retries: should not be negative")
+	check(cfg.Ledger.PageSize > 0, "ledger.page_size: should be positive")
+	check(cfg.Ledger.ViewRefreshInterval > 0, "ledger.view_refresh_interval: should be positive")
+	check(cfg.Ledger.CheckpointDir != "", "ledger.checkpoint_dir: required")
+	check(cfg.Ledger.CheckpointInterval > 0, "ledger.checkpoint_interval: should be positive")
+	check(len(cfg.Currency.Base) == 3 && strings.ToUpper(cfg.Currency.Base) == cfg.Currency.Base, "currency.base: %q is not a currency code", cfg.Currency.Base)
+	u, err := url.Parse(cfg.Currency.RatesUrl)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "currency.rates_url: %q is not a http url", cfg.Currency.RatesUrl)
+	check(cfg.Currency.Timeout > 0, "currency.timeout: should be positive")
+	switch cfg.Log.Level {
+	case LOG_LEVEL_DEBUG, LOG_LEVEL_INFO, LOG_LEVEL_WARN, LOG_LEVEL_ERROR:
+	default:
+		errs = append(errs, fmt.Sprintf("log.level: unknown level %q", cfg.Log.Level))
+	}
+	check(cfg.RateLimit.Store == RATE_LIMIT_STORE_MEMORY || cfg.RateLimit.Store == RATE_LIMIT_STORE_POSTGRES, "rate_limit.store: %q is not %s or %s", cfg.RateLimit.Store, RATE_LIMIT_STORE_MEMORY, RATE_LIMIT_STORE_POSTGRES)
+	check(cfg.RateLimit.PurgeInterval > 0, "rate_limit.purge_interval: should be positive")
+	check(cfg.Signature.Window > 0, "signature.window: should be positive")
+	check(cfg.Jwt.AccountClaim != "", "jwt.account_claim: required")
+	switch cfg.Tracing.Exporter {
+	case TRACES_EXPORTER_NONE, TRACES_EXPORTER_OTLP, TRACES_EXPORTER_STDOUT:
+	default:
+		errs = append(errs, fmt.Sprintf("tracing.exporter: unknown exporter %q", cfg.Tracing.Exporter))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func validPort(p int) bool {
+	return p > 0 && p <= 65535
+}
+
+func (cfg *Config) HttpAddress() string {
+	return ":" + strconv.Itoa(cfg.Http.Port)
+}
+
+func (cfg *Config) GrpcAddress() string {
+	return ":" + strconv.Itoa(cfg.Grpc.Port)
+}
+
+// Redacted returns copy of config with secret values hidden. Password of URL is replaced,
+// so the host stays visible, other secrets are replaced completely.
+func (cfg *Config) Redacted() *Config {
+	c := *cfg
+	for _, f := range c.fields() {
+		if f.tag.Get("secret") != "true" || f.value.String() == "" {
+			continue
+		}
+		v := CONFIG_REDACTED
+		if u, err := url.Parse(f.value.String()); err == nil && u.Scheme != "" && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				v = u.Redacted()
+			}
+		}
+		f.value.SetString(v)
+	}
+	return &c
+}
+
+// ConfigHandler shows effective config with secrets redacted.
+func ConfigHandler(cfg *Config) gin.HandlerFunc {
+	redacted := cfg.Redacted()
+	return func(c *gin.Context) {
+		r := Result{c, STATUS_CODE_OK, map[string]interface{}{}}
+		if err := authorize(c, SCOPE_ADMIN_CONFIG_READ); err != nil {
+			r.Err(&err, &AccountExpectedResult)
+			return
+		}
+		r.Give(redacted)
+	}
+}
+
+// flagValue collects raw flag value, it is applied after file and environment.
+type flagValue struct {
+	isBool bool
+	set    func(string) error
+}
+
+func (v flagValue) String() string {
+	return ""
+}
+
+func (v flagValue) Set(s string) error {
+	return v.set(s)
+}
+
+func (v flagValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+type configField struct {
+	value reflect.Value
+	tag   reflect.StructTag
+}
+
+// fields lists settable values of config sections.
+func (cfg *Config) fields() []configField {
+	var res []configField
+	sections := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		s := sections.Field(i)
+		for j := 0; j < s.NumField(); j++ {
+			res = append(res, configField{s.Field(j), s.Type().Field(j).Tag})
+		}
+	}
+	return res
+}
+
+func (f configField) set(s string) error {
+	s = strings.TrimSpace(s)
+	switch {
+	case f.value.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(d))
+	case f.value.Type() == reflect.TypeOf(LogLevel("")):
+		f.value.SetString(strings.ToLower(s))
+	case f.value.Type() == rateLimitType:
+		l, err := ParseRateLimit(s)
+		if err != nil {
+			return err
+		}
+		f.value.Set(reflect.ValueOf(l))
+	case f.value.Kind() == reflect.String:
+		f.value.SetString(s)
+	case f.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetBool(b)
+	case f.value.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(n))
+	default:
+		return fmt.Errorf("unsupported config value %s", f.value.Type())
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ERROR_REQUEST_CANCELED int = 119
+	ERROR_REQUEST_TIMEOUT  int = 120
+
+	// HTTP_CLIENT_CLOSED_REQUEST is logged for requests the client abandoned, it never reaches the client.
+	// Requests canceled by server shutdown are reported as retryable ERROR_NOT_READY instead.
+	HTTP_CLIENT_CLOSED_REQUEST int = 499
+
+	// ROLLBACK_TIMEOUT bounds rollback of transaction whose request context is already done.
+	ROLLBACK_TIMEOUT time.Duration = 5 * time.Second
+)
+
+var (
+	// REQUEST_TIMEOUTS are default deadlines of route groups, see HttpConfig.
+	REQUEST_TIMEOUTS = map[string]time.Duration{
+		RATE_LIMIT_GROUP_READ:  5 * time.Second,
+		RATE_LIMIT_GROUP_WRITE: 15 * time.Second,
+		RATE_LIMIT_GROUP_ADMIN: 60 * time.Second,
+	}
+)
+
+// Timeout sets deadline on request context. The context is also canceled when
+// the client disconnects, queries and locks of the request are aborted then.
+func Timeout(d time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if d <= 0 {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), d)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+type shutdownCtx struct{}
+
+// withShutdown marks request context of server whose context srv is canceled on shutdown.
+func withShutdown(ctx context.Context, srv context.Context) context.Context {
+	return context.WithValue(ctx, shutdownCtx{}, srv)
+}
+
+// canceledByShutdown reports that ctx was canceled by server shutdown rather than by the client.
+func canceledByShutdown(ctx context.Context) bool {
+	srv, ok := ctx.Value(shutdownCtx{}).(context.Context)
+	return ok && errors.Is(ctx.Err(), context.Canceled) && srv.Err() != nil
+}
+
+// shutdownErrorOr reports ERROR_REQUEST_CANCELED caused by server shutdown as ERROR_NOT_READY,
+// so clients retry the request on another instance.
+func shutdownErrorOr(ctx context.Context, opErr *OperationError) *OperationError {
+	if opErr.Code == ERROR_REQUEST_CANCELED && canceledByShutdown(ctx) {
+		return &OperationError{Code: ERROR_NOT_READY, Err: opErr.Err}
+	}
+	return opErr
+}
+
+// contextError returns ERROR_REQUEST_CANCELED, ERROR_NOT_READY when canceled by shutdown, or ERROR_REQUEST_TIMEOUT
+// wrapping cause when ctx is done, nil otherwise.
+func contextError(ctx context.Context, cause error) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return &OperationError{Code: ERROR_REQUEST_TIMEOUT, Err: cause}
+	default:
+		return shutdownErrorOr(ctx, &OperationError{Code: ERROR_REQUEST_CANCELED, Err: cause})
+	}
+}
+
+// contextErrorOr prefers error of done ctx over err, as failures after
+// cancellation are caused by it. err is kept as the cause.
+func contextErrorOr(ctx context.Context, err error) error {
+	if cErr := contextError(ctx, err); cErr != nil {
+		return cErr
+	}
+	return err
+}
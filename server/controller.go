@@ -1,9 +1,14 @@
 package server
 
 import (
+	"crypto/sha1"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
 )
 
 const (
@@ -12,48 +17,25 @@ const (
 	URL_TRANSACTIONS string = "/transactions"
 	URL_TRANSFER     string = "/transfer"
 
-	STATUS_CODE_OK int = 0
+	URL_ACCOUNT_BALANCE      string = "/accounts/:id/balance"
+	URL_ACCOUNT_TRANSACTIONS string = "/accounts/:id/transactions"
 
-	STATUS_NOT_ENOUGHT_MONEY       string = "Not enought money"
-	STATUS_TRANSACTION_COMPLETED   string = "Transaction completed"
-	STATUS_INTERNAL_ERROR          string = "Internal server error"
-	STATUS_TRANSFER_COMPLETED      string = "Transfer completed"
-	STATUS_WRONG_CURRENCY_CODE     string = "Wrong currency code"
-	STATUS_WRONG_SORT              string = "Wrong sorting key"
-	STATUS_WRONG_PAGE              string = "Wrong page number"
-	STATUS_WRONG_ID                string = "user id must be positive"
-	STATUS_WRONG_IDS_NOT_UNIQUE    string = "user ids must be different"
-	STATUS_WRONG_SUM_NOT_POSITIVE  string = "sum must be positive number"
-	STATUS_WRONG_SUM               string = "sum must be a number"
-	STATUS_WRONG_START_DATE_FUTURE string = "start date must less than end date"
-	STATUS_TIMEOUT                 string = "try again later"
-	STATUS_NO_BALANCE              string = "This account has no balance"
+	HEADER_ETAG          string = "ETag"
+	HEADER_IF_NONE_MATCH string = "If-None-Match"
+	HEADER_DEPRECATION   string = "Deprecation"
+	HEADER_LINK          string = "Link"
 
-	PAGINATION_PAGE_SIZE int = 2
-)
+	CONTEXT_SUCCESSOR string = "successor"
 
-var (
-	ACCOUNT_OPERATION_STATUS = map[int]string{
-		ERROR_NOT_ENOUGH_MONEY:            STATUS_NOT_ENOUGHT_MONEY,
-		ERROR_BALANCE_WRONG_CURRENCY_CODE: STATUS_WRONG_CURRENCY_CODE,
-		ERROR_TRANSACTIONS_WRONG_PAGE:     STATUS_WRONG_PAGE,
-		ERROR_TRANSACTIONS_WRONG_SORT:     STATUS_WRONG_SORT,
-		ERROR_LOCK_TIMEOUT:                STATUS_TIMEOUT,
-		ERROR_NO_BALANCE:                  STATUS_NO_BALANCE,
-	}
+	STATUS_CODE_OK int = 0
 
-	ACCOUNT_OPERATION_RESPONSE_CODE = map[int]int{
-		ERROR_TRANSACTIONS_WRONG_PAGE:     400,
-		ERROR_TRANSACTIONS_WRONG_SORT:     400,
-		ERROR_BALANCE_WRONG_CURRENCY_CODE: 400,
-		ERROR_LOCK_TIMEOUT:                408,
-	}
+	PAGINATION_PAGE_SIZE int = 2
 )
 
 var (
 	AccountExpectedResult = ExpectedResult{
-		ACCOUNT_OPERATION_STATUS,
-		ACCOUNT_OPERATION_RESPONSE_CODE,
+		Messages,
+		ERROR_REGISTRY,
 	}
 )
 
@@ -80,53 +62,90 @@ type BalanceRequest struct {
 }
 
 type TransactionsRequest struct {
-	Id   int    `form:"id" json:"id" binding:"required,numeric,gte=0`
+	Id   int    `form:"id" json:"id" binding:"required,numeric,gte=0"`
 	From int64  `form:"start" json:"start"`
 	To   int64  `form:"end" json:"end"`
 	Sort string `form:"sort" json:"sort"`
 	Page int    `form:"from" json:"from" binding:"gte=0"`
 }
 
+type AccountUri struct {
+	Id int `uri:"id" binding:"required,numeric,gte=0"`
+}
+
+type BalanceQuery struct {
+	Cur string `form:"currency"`
+}
+
+type TransactionsQuery struct {
+	From   int64  `form:"start"`
+	To     int64  `form:"end"`
+	Sort   string `form:"sort"`
+	Cursor int    `form:"cursor" binding:"gte=0"`
+}
+
 type AccountController struct {
 	accSrv *AccountService
+	log    zerolog.Logger
+}
+
+// NewAccountController creates controller with service using default config.
+func NewAccountController(accRep AccountRepositoryI, log zerolog.Logger) *AccountController {
+	s := NewAccountService(accRep, DefaultConfig(), log)
+	return NewAccountControllerFromService(s, log)
 }
 
-func NewAccountController(accRep AccountRepositoryI) *AccountController {
-	s := NewAccountService(accRep)
-	return &AccountController{s}
+func NewAccountControllerFromService(accSrv *AccountService, log zerolog.Logger) *AccountController {
+	return &AccountController{accSrv, componentLogger(log, "controller")}
 }
 
 func (acc *AccountController) Transaction(c *gin.Context) {
+	ctx, span := startSpan(c.Request.Context(), "AccountController.Transaction")
+	defer span.End()
 	var trxReq TransactionRequest
-	r := Result{c, STATUS_CODE_OK, STATUS_TRANSACTION_COMPLETED}
+	r := Result{c, STATUS_CODE_OK, MESSAGE_TRANSACTION_COMPLETED}
 	if err := c.ShouldBindJSON(&trxReq); err != nil {
-		r.BadRequest(STATUS_WRONG_ID + ", " + STATUS_WRONG_SUM)
+		r.BadRequest(err)
+		return
+	}
+	scope := SCOPE_TRANSACTION_CREDIT
+	if trxReq.Sum < 0 {
+		scope = SCOPE_TRANSACTION_DEBIT
+	}
+	if err := authorize(c, scope, trxReq.Id); err != nil {
+		acc.fail(&r, err)
 		return
 	}
-	trxData := TransactionData{trxReq.Id, trxReq.Sum, trxReq.Desc}
-	err := acc.accSrv.DoTransaction(&trxData)
+	trxData := TransactionData{Id: trxReq.Id, Sum: trxReq.Sum, Desc: trxReq.Desc, KeyId: principalKeyId(c)}
+	err := acc.accSrv.DoTransaction(ctx, &trxData)
 	if err != nil {
-		r.Err(&err, &AccountExpectedResult)
+		acc.fail(&r, err)
 		return
 	}
 	r.Ok()
 }
 
 func (acc *AccountController) Transfer(c *gin.Context) {
+	ctx, span := startSpan(c.Request.Context(), "AccountController.Transfer")
+	defer span.End()
 	var sReq SendRequest
-	r := Result{c, STATUS_CODE_OK, STATUS_TRANSFER_COMPLETED}
+	r := Result{c, STATUS_CODE_OK, MESSAGE_TRANSFER_COMPLETED}
 	if err := c.ShouldBindJSON(&sReq); err != nil {
-		r.BadRequest(STATUS_WRONG_ID + ", " + STATUS_WRONG_SUM_NOT_POSITIVE)
+		r.BadRequest(err)
 		return
 	}
 	if sReq.From == sReq.To {
-		r.BadRequest(STATUS_WRONG_IDS_NOT_UNIQUE)
+		r.BadRequest(RequestErrors{NewValidationError("to", RULE_NEFIELD, "id")})
 		return
 	}
-	tData := TransferData{sReq.From, sReq.To, sReq.Sum}
-	err := acc.accSrv.TransferMoney(&tData)
+	if err := authorize(c, SCOPE_TRANSFER, sReq.From); err != nil {
+		acc.fail(&r, err)
+		return
+	}
+	tData := TransferData{From: sReq.From, To: sReq.To, Sum: sReq.Sum, KeyId: principalKeyId(c)}
+	err := acc.accSrv.TransferMoney(ctx, &tData)
 	if err != nil {
-		r.Err(&err, &AccountExpectedResult)
+		acc.fail(&r, err)
 		return
 	}
 	r.Ok()
@@ -134,41 +153,158 @@ func (acc *AccountController) Transfer(c *gin.Context) {
 
 func (acc *AccountController) Balance(c *gin.Context) {
 	r := Result{c, STATUS_CODE_OK, 0}
-	blncReq := BalanceRequest{0, BASE_CURRENCY}
+	blncReq := BalanceRequest{}
 	if err := c.ShouldBindJSON(&blncReq); err != nil {
-		r.BadRequest(STATUS_WRONG_ID)
+		r.BadRequest(err)
 		return
 	}
-	bData := BalanceData{blncReq.Id, blncReq.Cur}
-	curBal, err := acc.accSrv.GetUserBalance(&bData)
-	if err != nil {
-		r.Err(&err, &AccountExpectedResult)
+	successorLink(c, blncReq.Id)
+	bData := BalanceData{Id: blncReq.Id, Cur: blncReq.Cur}
+	acc.giveBalance(&r, &bData)
+}
+
+func (acc *AccountController) AccountBalance(c *gin.Context) {
+	r := Result{c, STATUS_CODE_OK, 0}
+	var uri AccountUri
+	var blncQry BalanceQuery
+	if err := c.ShouldBindUri(&uri); err != nil {
+		r.BadRequest(err)
 		return
 	}
-	r.Give(curBal)
+	if err := c.ShouldBindQuery(&blncQry); err != nil {
+		r.BadRequest(err)
+		return
+	}
+	bData := BalanceData{Id: uri.Id, Cur: blncQry.Cur}
+	acc.giveBalance(&r, &bData)
 }
 
 func (acc *AccountController) Transactions(c *gin.Context) {
 	r := Result{c, STATUS_CODE_OK, map[string]interface{}{}}
 	var trxsReq TransactionsRequest
 	if err := c.ShouldBindJSON(&trxsReq); err != nil {
-		r.BadRequest(STATUS_WRONG_ID)
+		r.BadRequest(err)
 		return
 	}
-	to := trxsReq.To
-	if to == 0 {
-		to = time.Now().Unix()
+	successorLink(c, trxsReq.Id)
+	trxData := TransactionsListData{Id: trxsReq.Id, From: trxsReq.From, To: trxsReq.To, Page: trxsReq.Page, Sort: trxsReq.Sort}
+	acc.giveTransactions(&r, &trxData)
+}
+
+func (acc *AccountController) AccountTransactions(c *gin.Context) {
+	r := Result{c, STATUS_CODE_OK, map[string]interface{}{}}
+	var uri AccountUri
+	var trxsQry TransactionsQuery
+	if err := c.ShouldBindUri(&uri); err != nil {
+		r.BadRequest(err)
+		return
 	}
-	if trxsReq.From > to {
-		r.BadRequest(STATUS_WRONG_START_DATE_FUTURE)
+	if err := c.ShouldBindQuery(&trxsQry); err != nil {
+		r.BadRequest(err)
 		return
 	}
-	trxData := TransactionsListData{trxsReq.Id, trxsReq.From, to, trxsReq.Page, trxsReq.Sort}
-	trxs, err := acc.accSrv.GetUserTransactions(&trxData)
+	trxData := TransactionsListData{Id: uri.Id, From: trxsQry.From, To: trxsQry.To, Page: trxsQry.Cursor, Sort: trxsQry.Sort}
+	acc.giveTransactions(&r, &trxData)
+}
+
+// giveBalance answers with balance and ETag of the ledger state it was read from. The version is read
+// before the balance, so unchanged ledger is answered with 304 without balance query and currency conversion.
+func (acc *AccountController) giveBalance(r *Result, bData *BalanceData) {
+	ctx, span := startSpan(r.ctx.Request.Context(), "AccountController.Balance")
+	defer span.End()
+	if err := authorize(r.ctx, SCOPE_BALANCE_READ, bData.Id); err != nil {
+		acc.fail(r, err)
+		return
+	}
+	version, err := acc.accSrv.GetBalanceVersion(ctx, bData.Id)
 	if err != nil {
-		r.Err(&err, &AccountExpectedResult)
+		acc.fail(r, err)
+		return
+	}
+	cur := bData.Cur
+	if cur == "" {
+		cur = acc.accSrv.BaseCurrency()
+	}
+	etag := fmt.Sprintf("\"%x\"", sha1.Sum([]byte(fmt.Sprintf("%d:%s:%d", bData.Id, cur, version))))
+	if version > 0 && matchETag(r.ctx.GetHeader(HEADER_IF_NONE_MATCH), etag) {
+		r.ctx.Header(HEADER_ETAG, etag)
+		r.ctx.Status(304)
 		return
 	}
+	curBal, err := acc.accSrv.GetUserBalance(ctx, bData)
+	if err != nil {
+		acc.fail(r, err)
+		return
+	}
+	r.ctx.Header(HEADER_ETAG, etag)
+	r.Give(curBal)
+}
 
+func (acc *AccountController) giveTransactions(r *Result, trxData *TransactionsListData) {
+	ctx, span := startSpan(r.ctx.Request.Context(), "AccountController.Transactions")
+	defer span.End()
+	if err := authorize(r.ctx, SCOPE_TRANSACTIONS_READ, trxData.Id); err != nil {
+		acc.fail(r, err)
+		return
+	}
+	if trxData.To == 0 {
+		trxData.To = time.Now().Unix()
+	}
+	if trxData.From > trxData.To {
+		r.BadRequest(RequestErrors{NewValidationError("start", RULE_LTEFIELD, "end")})
+		return
+	}
+	trxs, err := acc.accSrv.GetUserTransactions(ctx, trxData)
+	if err != nil {
+		acc.fail(r, err)
+		return
+	}
 	r.Give(trxs)
 }
+
+// fail logs operation error of the request and writes it to response.
+func (acc *AccountController) fail(r *Result, err error) {
+	logOperationError(r.ctx.Request.Context(), acc.log, "request failed", err)
+	r.Err(&err, &AccountExpectedResult)
+}
+
+// Deprecated marks route as deprecated alias of successor route. The successor is linked by
+// the handler once it knows the account, see successorLink.
+func Deprecated(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header(HEADER_DEPRECATION, "true")
+		c.Set(CONTEXT_SUCCESSOR, successor)
+		c.Next()
+	}
+}
+
+// successorLink links successor route of deprecated request for account id.
+func successorLink(c *gin.Context, id int) {
+	successor := c.GetString(CONTEXT_SUCCESSOR)
+	if successor == "" {
+		return
+	}
+	path := strings.Replace(successor, ":id", strconv.Itoa(id), 1)
+	c.Header(HEADER_LINK, fmt.Sprintf("<%s>; rel=\"successor-version\"", path))
+}
+
+func matchETag(ifNoneMatch string, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// uriTemplate converts gin path parameters (:id) to URI template form ({id}).
+func uriTemplate(path string) string {
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ":") {
+			parts[i] = "{" + strings.TrimPrefix(p, ":") + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
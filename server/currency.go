@@ -1,29 +1,54 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	CURRENCY_RATES_API           string = "https://api.exchangerate.host/latest"
-	CURRENCY_RATES_API_CONVERTER string = CURRENCY_RATES_API + "?base=%s&symbols=%s"
+	CURRENCY_RATES_API_CONVERTER string = "%s?base=%s&symbols=%s"
 	BASE_CURRENCY                string = "RUB"
+	// CURRENCY_RATES_TIMEOUT bounds rates provider requests, so a slow provider does not hold balance requests.
+	CURRENCY_RATES_TIMEOUT time.Duration = 5 * time.Second
 )
 
-func GetCurrencyRate(base string, to string) (float64, error) {
-	client := http.Client{}
-	apiUrl := fmt.Sprintf(CURRENCY_RATES_API_CONVERTER, base, to)
-	request, err := http.NewRequest("GET", apiUrl, nil)
+// GetCurrencyRate requests rate of to currency against base from rates provider of cfg.
+// Trace context is sent only when cfg.PropagateTrace is set, external providers do not get it.
+func GetCurrencyRate(ctx context.Context, cfg CurrencyConfig, base string, to string) (rate float64, err error) {
+	ctx, span := otel.Tracer(TRACER_NAME).Start(ctx, "GET "+cfg.RatesUrl,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPMethodKey.String("GET"), attribute.String("currency.base", base), attribute.String("currency.to", to)),
+	)
+	defer func(start time.Time) {
+		observeCurrencyRequest(start, err)
+		endSpan(span, err)
+	}(time.Now())
+	client := http.Client{Timeout: cfg.Timeout.Duration()}
+	apiUrl := fmt.Sprintf(CURRENCY_RATES_API_CONVERTER, cfg.RatesUrl, base, to)
+	request, err := http.NewRequestWithContext(ctx, "GET", apiUrl, nil)
 	if err != nil {
 		return 0, err
 	}
+	if cfg.PropagateTrace {
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
+	}
 
 	resp, err := client.Do(request)
 	if err != nil {
 		return 0, err
 	}
+	defer resp.Body.Close()
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
 
 	var result map[string]interface{}
 	err = json.NewDecoder(resp.Body).Decode(&result)
@@ -32,11 +57,11 @@ func GetCurrencyRate(base string, to string) (float64, error) {
 	}
 	rates, ok := result["rates"].(map[string]interface{})
 	if !ok {
-		return 0, &OperationError{ERROR_INTERNAL}
+		return 0, &OperationError{Code: ERROR_INTERNAL}
 	}
-	rate, ok := rates[to].(float64)
+	rate, ok = rates[to].(float64)
 	if !ok {
-		return 0, &OperationError{ERROR_BALANCE_WRONG_CURRENCY_CODE}
+		return 0, &OperationError{Code: ERROR_BALANCE_WRONG_CURRENCY_CODE}
 	}
 	return rate, nil
 }
@@ -2,64 +2,166 @@ package server
 
 import (
 	"context"
-	"fmt"
-	"os"
+	"errors"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rs/zerolog"
+)
+
+const (
+	ERROR_TRANSACTION_CONFLICT int = 121
+	ERROR_DUPLICATE            int = 122
+	ERROR_CONSTRAINT_VIOLATION int = 123
+
+	PG_UNIQUE_VIOLATION      string = "23505"
+	PG_CHECK_VIOLATION       string = "23514"
+	PG_SERIALIZATION_FAILURE string = "40001"
+	PG_DEADLOCK_DETECTED     string = "40P01"
+	PG_LOCK_NOT_AVAILABLE    string = "55P03"
+
+	PG_PARAM_SEARCH_PATH string = "search_path"
+)
+
+var (
+	// PG_ERROR_CODES maps SQLSTATE of PostgreSQL errors to operation error codes, see ClassifyPgError.
+	PG_ERROR_CODES = map[string]int{
+		PG_UNIQUE_VIOLATION:      ERROR_DUPLICATE,
+		PG_CHECK_VIOLATION:       ERROR_CONSTRAINT_VIOLATION,
+		PG_SERIALIZATION_FAILURE: ERROR_TRANSACTION_CONFLICT,
+		PG_DEADLOCK_DETECTED:     ERROR_TRANSACTION_CONFLICT,
+		PG_LOCK_NOT_AVAILABLE:    ERROR_LOCK_TIMEOUT,
+	}
 )
 
 type DatabaseI interface {
-	Open()
+	Open(ctx context.Context)
 	Close()
-	ExecuteInTransaction(actn func(tx *pgx.Tx) (interface{}, error)) (interface{}, error)
-	GetCtx() context.Context
+	ExecuteInTransaction(ctx context.Context, actn func(tx *pgx.Tx) (interface{}, error)) (interface{}, error)
+	ExecuteInTransactionWith(ctx context.Context, opts pgx.TxOptions, actn func(tx *pgx.Tx) (interface{}, error)) (interface{}, error)
+	Concurrency() ConcurrencyStrategy
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
 }
 
 type Database struct {
 	Conn *pgxpool.Pool
-	Ctx  context.Context
+
+	cfg         DatabaseConfig
+	schema      string
+	concurrency ConcurrencyStrategy
+	log         zerolog.Logger
 }
 
-func NewDatabase() *Database {
-	db := Database{}
-	db.Open()
+func NewDatabase(cfg DatabaseConfig, log zerolog.Logger) *Database {
+	return NewSchemaDatabase(cfg, "", log)
+}
+
+// NewSchemaDatabase connects with search_path of schema, so tables of another schema
+// can not be touched. Empty schema keeps search_path of the server.
+func NewSchemaDatabase(cfg DatabaseConfig, schema string, log zerolog.Logger) *Database {
+	db := Database{cfg: cfg, schema: schema, log: componentLogger(log, "database")}
+	concurrency, err := NewConcurrencyStrategy(cfg)
+	if err != nil {
+		db.log.Error().Err(err).Msg("wrong concurrency strategy")
+		panic(err)
+	}
+	db.concurrency = concurrency
+	db.Open(context.Background())
 	return &db
 }
 
-func (db *Database) Open() {
-	conn, err := pgxpool.Connect(context.Background(), os.Getenv("DATABASE_URL"))
+// Concurrency returns strategy of ledger writes, advisory locks unless configured otherwise.
+func (db *Database) Concurrency() ConcurrencyStrategy {
+	if db.concurrency == nil {
+		return AdvisoryLocks{}
+	}
+	return db.concurrency
+}
+
+// Open connects the pool. Sessions keep lock_timeout of the server, ledger writes limit
+// their lock waits by the configured lock timeout, see ConcurrencyStrategy.
+func (db *Database) Open(ctx context.Context) {
+	pCfg, err := pgxpool.ParseConfig(db.cfg.Url)
+	if err != nil {
+		db.log.Error().Err(err).Msg("wrong database url")
+		panic(err)
+	}
+	if db.schema != "" {
+		pCfg.ConnConfig.RuntimeParams[PG_PARAM_SEARCH_PATH] = pgx.Identifier{db.schema}.Sanitize()
+	}
+	conn, err := pgxpool.ConnectConfig(ctx, pCfg)
 	if err != nil {
-		fmt.Print("Error on db connection: ")
-		fmt.Println(err.Error())
+		db.log.Error().Err(err).Msg("database connection failed")
 		panic(err)
 	}
-	db.Ctx = context.Background()
 	db.Conn = conn
-	fmt.Println("Connected to database")
+	db.log.Info().Msg("connected to database")
 }
 
 func (db *Database) Close() {
 	db.Conn.Close()
-	fmt.Println("Disconnected from database")
+	db.log.Info().Msg("disconnected from database")
+}
+
+// ExecuteInTransaction runs actn in transaction, statements executed through tx are traced.
+// Transaction is committed only if actn succeeds and ctx is not done. When ctx is canceled
+// the transaction is rolled back and ERROR_REQUEST_CANCELED or ERROR_REQUEST_TIMEOUT is returned.
+func (db *Database) ExecuteInTransaction(ctx context.Context, actn func(tx *pgx.Tx) (interface{}, error)) (interface{}, error) {
+	return db.ExecuteInTransactionWith(ctx, pgx.TxOptions{}, actn)
 }
 
-func (db *Database) ExecuteInTransaction(actn func(tx *pgx.Tx) (interface{}, error)) (interface{}, error) {
-	tx, err := db.Conn.BeginTx(db.Ctx, pgx.TxOptions{})
+// ExecuteInTransactionWith is ExecuteInTransaction with isolation level and access mode of opts.
+func (db *Database) ExecuteInTransactionWith(ctx context.Context, opts pgx.TxOptions, actn func(tx *pgx.Tx) (interface{}, error)) (interface{}, error) {
+	tx, err := db.Conn.BeginTx(ctx, opts)
 	if err != nil {
-		return nil, &OperationError{ERROR_INTERNAL}
+		db.log.Error().Ctx(ctx).Err(err).Msg("begin transaction failed")
+		return nil, contextErrorOr(ctx, &OperationError{Code: ERROR_INTERNAL, Err: err})
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback(db.Ctx)
-		} else {
-			tx.Commit(db.Ctx)
-		}
-	}()
-	res, err := actn(&tx)
-	return res, err
+	var traced pgx.Tx = tracedTx{tx}
+	res, err := actn(&traced)
+	if err != nil {
+		db.rollback(ctx, tx)
+		return res, contextErrorOr(ctx, ClassifyPgError(err))
+	}
+	if err := tx.Commit(ctx); err != nil {
+		db.log.Warn().Ctx(ctx).Err(err).Msg("commit failed")
+		db.rollback(ctx, tx)
+		return nil, contextErrorOr(ctx, ClassifyPgError(err))
+	}
+	return res, nil
 }
 
-func (db *Database) GetCtx() context.Context {
-	return db.Ctx
+// Query runs read-only query outside of transaction. Connection returns to the pool when rows are closed.
+func (db *Database) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	ctx, span := startSqlSpan(ctx, sql)
+	rows, err := db.Conn.Query(ctx, sql, args...)
+	endSpan(span, err)
+	if err != nil {
+		return nil, contextErrorOr(ctx, ClassifyPgError(err))
+	}
+	return rows, nil
+}
+
+// rollback does not use request context, it may already be canceled. ctx only binds log record to the request.
+func (db *Database) rollback(ctx context.Context, tx pgx.Tx) {
+	rCtx, cancel := context.WithTimeout(context.Background(), ROLLBACK_TIMEOUT)
+	defer cancel()
+	if err := tx.Rollback(rCtx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+		db.log.Warn().Ctx(ctx).Err(err).Msg("rollback failed")
+	}
+}
+
+// ClassifyPgError wraps PostgreSQL error into OperationError by its SQLSTATE, see PG_ERROR_CODES.
+// Errors already classified and errors with other SQLSTATE are returned as is.
+func ClassifyPgError(err error) error {
+	var opErr *OperationError
+	var pgErr *pgconn.PgError
+	if errors.As(err, &opErr) || !errors.As(err, &pgErr) {
+		return err
+	}
+	if code, ok := PG_ERROR_CODES[pgErr.Code]; ok {
+		return &OperationError{Code: code, Err: err}
+	}
+	return err
 }
@@ -1,23 +1,29 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/gin-gonic/gin"
 )
 
 const (
-	BAD_REQUEST_BINDING string = "Wrong request data: %s"
-
 	ERROR_INTERNAL      int = 900
 	ERROR_WRONG_REQUEST int = 901
 )
 
+// OperationError is an error reported to clients by Code. Err keeps the cause for logs
+// and is reachable with errors.Is and errors.As.
 type OperationError struct {
 	Code int
+	Err  error
 }
 
 func (opErr *OperationError) Error() string {
+	if opErr.Err != nil {
+		return fmt.Sprintf("Operation completed with code: %d: %v", opErr.Code, opErr.Err)
+	}
 	return fmt.Sprintf("Operation completed with code: %d", opErr.Code)
 }
 
@@ -25,16 +31,35 @@ func (opErr *OperationError) GetCode() int {
 	return opErr.Code
 }
 
+func (opErr *OperationError) Unwrap() error {
+	return opErr.Err
+}
+
+// Is matches OperationError with the same code, so errors.Is(err, &OperationError{Code: ERROR_LOCK_TIMEOUT})
+// works regardless of the cause.
+func (opErr *OperationError) Is(target error) bool {
+	t, ok := target.(*OperationError)
+	return ok && t.Code == opErr.Code
+}
+
+// ConvertError returns OperationError found in err chain. Other errors are wrapped
+// into ERROR_REQUEST_TIMEOUT, ERROR_REQUEST_CANCELED or ERROR_INTERNAL keeping err as the cause.
 func ConvertError(err error) *OperationError {
-	switch err.(type) {
-	case *OperationError:
-		return err.(*OperationError)
+	var opErr *OperationError
+	if errors.As(err, &opErr) {
+		return opErr
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &OperationError{Code: ERROR_REQUEST_TIMEOUT, Err: err}
+	case errors.Is(err, context.Canceled):
+		return &OperationError{Code: ERROR_REQUEST_CANCELED, Err: err}
 	default:
-		return &OperationError{ERROR_INTERNAL}
+		return &OperationError{Code: ERROR_INTERNAL, Err: err}
 	}
 }
 
 func NoRoute(c *gin.Context) {
-	r := Result{c, 0, "There is nothing here"}
+	r := Result{c, 0, MESSAGE_NO_ROUTE}
 	r.Response(404)
 }
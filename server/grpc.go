@@ -0,0 +1,518 @@
+package server
+
+import (
+	"balance-server/pb"
+	"context"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	GRPC_ERROR_DOMAIN string = "balance-server"
+	// GRPC_FLUSH_TIMEOUT bounds sending responses of calls canceled by shutdown before connections are closed.
+	GRPC_FLUSH_TIMEOUT time.Duration = time.Second
+
+	GRPC_METHOD_BALANCE             string = "/balance.BalanceService/Balance"
+	GRPC_METHOD_TRANSACTION         string = "/balance.BalanceService/Transaction"
+	GRPC_METHOD_TRANSFER            string = "/balance.BalanceService/Transfer"
+	GRPC_METHOD_LIST_TRANSACTIONS   string = "/balance.BalanceService/ListTransactions"
+	GRPC_METHOD_STREAM_TRANSACTIONS string = "/balance.BalanceService/StreamTransactions"
+)
+
+var (
+	// GRPC_RATE_LIMIT_GROUPS maps methods to rate limit group of the HTTP routes they mirror.
+	GRPC_RATE_LIMIT_GROUPS = map[string]string{
+		GRPC_METHOD_BALANCE:             RATE_LIMIT_GROUP_READ,
+		GRPC_METHOD_TRANSACTION:         RATE_LIMIT_GROUP_WRITE,
+		GRPC_METHOD_TRANSFER:            RATE_LIMIT_GROUP_WRITE,
+		GRPC_METHOD_LIST_TRANSACTIONS:   RATE_LIMIT_GROUP_READ,
+		GRPC_METHOD_STREAM_TRANSACTIONS: RATE_LIMIT_GROUP_READ,
+	}
+	// GRPC_SIGNED_METHODS are methods whose HTTP routes verify partner signature.
+	GRPC_SIGNED_METHODS = map[string]bool{
+		GRPC_METHOD_TRANSACTION: true,
+		GRPC_METHOD_TRANSFER:    true,
+	}
+)
+
+type grpcPrincipalCtx struct{}
+
+type AccountGrpcServer struct {
+	pb.UnimplementedBalanceServiceServer
+
+	accSrv   *AccountService
+	auth     *Authenticator
+	log      zerolog.Logger
+	limiter  *RateLimiter
+	policies map[string]RateLimitPolicy
+	partners PartnerSecretStoreI
+
+	mu       sync.Mutex
+	srv      *grpc.Server
+	ctx      context.Context
+	cancel   context.CancelFunc
+	inFlight sync.WaitGroup
+}
+
+// NewAccountGrpcServer creates gRPC server. With nil auth calls carry no principal and are denied.
+func NewAccountGrpcServer(accSrv *AccountService, auth *Authenticator, log zerolog.Logger) *AccountGrpcServer {
+	s := &AccountGrpcServer{accSrv: accSrv, auth: auth, log: log}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// LimitRates limits calls like RateLimited limits HTTP routes of the group the method
+// belongs to, see GRPC_RATE_LIMIT_GROUPS. Must be called before ServerOptions.
+func (s *AccountGrpcServer) LimitRates(l *RateLimiter, policies map[string]RateLimitPolicy) {
+	s.limiter = l
+	s.policies = policies
+}
+
+// RejectPartners refuses GRPC_SIGNED_METHODS calls of API keys with partner secret.
+// Partners must sign such requests, and gRPC calls can not carry the signature,
+// so partners use HTTP API for them. Must be called before ServerOptions.
+func (s *AccountGrpcServer) RejectPartners(partners PartnerSecretStoreI) {
+	s.partners = partners
+}
+
+// ServerOptions returns interceptors that log and trace calls, authenticate them by authorization metadata,
+// limit their rate and reject unsigned partner calls.
+func (s *AccountGrpcServer) ServerOptions() []grpc.ServerOption {
+	unary := []grpc.UnaryServerInterceptor{logUnary(s.log), traceUnary, s.drainUnary}
+	stream := []grpc.StreamServerInterceptor{logStream(s.log), traceStream, s.drainStream}
+	if s.auth != nil {
+		unary = append(unary, s.authenticateUnary)
+		stream = append(stream, s.authenticateStream)
+	}
+	if s.limiter != nil {
+		unary = append(unary, s.limitUnary)
+		stream = append(stream, s.limitStream)
+	}
+	if s.partners != nil {
+		unary = append(unary, s.rejectPartnersUnary)
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	}
+}
+
+func (s *AccountGrpcServer) Register(srv *grpc.Server) {
+	pb.RegisterBalanceServiceServer(srv, s)
+}
+
+func (s *AccountGrpcServer) Serve(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeListener(lis)
+}
+
+func (s *AccountGrpcServer) ServeListener(lis net.Listener) error {
+	srv := grpc.NewServer(s.ServerOptions()...)
+	s.Register(srv)
+	s.mu.Lock()
+	s.srv = srv
+	s.mu.Unlock()
+	return srv.Serve(lis)
+}
+
+// Shutdown stops accepting calls and waits for in-flight calls until ctx is done.
+// Then it cancels unfinished calls, waits until they respond with ERROR_NOT_READY and closes connections.
+func (s *AccountGrpcServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.srv
+	s.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		s.inFlight.Wait()
+		select {
+		case <-done:
+		case <-time.After(GRPC_FLUSH_TIMEOUT):
+			srv.Stop()
+			<-done
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *AccountGrpcServer) drainUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, done := s.track(ctx)
+	defer done()
+	return handler(ctx, req)
+}
+
+func (s *AccountGrpcServer) drainStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, done := s.track(stream.Context())
+	defer done()
+	return handler(srv, &contextStream{stream, ctx})
+}
+
+// track counts in-flight call and returns its context canceled by Shutdown, done must be called when call returns.
+func (s *AccountGrpcServer) track(ctx context.Context) (context.Context, func()) {
+	s.inFlight.Add(1)
+	ctx, cancel := context.WithCancel(withShutdown(ctx, s.ctx))
+	returned := make(chan struct{})
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-returned:
+		}
+	}()
+	return ctx, func() {
+		close(returned)
+		cancel()
+		s.inFlight.Done()
+	}
+}
+
+func (s *AccountGrpcServer) Balance(ctx context.Context, req *pb.BalanceRequest) (*pb.BalanceResponse, error) {
+	if req.Id <= 0 {
+		return nil, badRequestStatus(ctx, RequestErrors{NewValidationError("id", RULE_GT, "0")})
+	}
+	if err := grpcAuthorize(ctx, SCOPE_BALANCE_READ, int(req.Id)); err != nil {
+		return nil, GrpcStatus(ctx, err, &AccountExpectedResult)
+	}
+	bData := BalanceData{Id: int(req.Id), Cur: req.Currency}
+	curBal, err := s.accSrv.GetUserBalance(ctx, &bData)
+	if err != nil {
+		return nil, GrpcStatus(ctx, err, &AccountExpectedResult)
+	}
+	return &pb.BalanceResponse{Balance: curBal, Currency: bData.Cur}, nil
+}
+
+func (s *AccountGrpcServer) Transaction(ctx context.Context, req *pb.TransactionRequest) (*pb.OperationResponse, error) {
+	errs := RequestErrors{}
+	if req.Id <= 0 {
+		errs = append(errs, NewValidationError("id", RULE_GT, "0"))
+	}
+	if req.Sum == 0 {
+		errs = append(errs, NewValidationError("sum", RULE_REQUIRED, ""))
+	}
+	if len(errs) > 0 {
+		return nil, badRequestStatus(ctx, errs)
+	}
+	scope := SCOPE_TRANSACTION_CREDIT
+	if req.Sum < 0 {
+		scope = SCOPE_TRANSACTION_DEBIT
+	}
+	if err := grpcAuthorize(ctx, scope, int(req.Id)); err != nil {
+		return nil, GrpcStatus(ctx, err, &AccountExpectedResult)
+	}
+	trxData := TransactionData{Id: int(req.Id), Sum: req.Sum, Desc: req.Desc, KeyId: grpcKeyId(ctx)}
+	err := s.accSrv.DoTransaction(ctx, &trxData)
+	if err != nil {
+		return nil, GrpcStatus(ctx, err, &AccountExpectedResult)
+	}
+	return &pb.OperationResponse{Status: int32(STATUS_CODE_OK), Message: Messages.Message(grpcLocale(ctx), MESSAGE_TRANSACTION_COMPLETED)}, nil
+}
+
+func (s *AccountGrpcServer) Transfer(ctx context.Context, req *pb.TransferRequest) (*pb.OperationResponse, error) {
+	errs := RequestErrors{}
+	if req.From <= 0 {
+		errs = append(errs, NewValidationError("from", RULE_GT, "0"))
+	}
+	if req.To <= 0 {
+		errs = append(errs, NewValidationError("to", RULE_GT, "0"))
+	}
+	if req.Sum <= 0 {
+		errs = append(errs, NewValidationError("sum", RULE_GT, "0"))
+	}
+	if req.From == req.To {
+		errs = append(errs, NewValidationError("to", RULE_NEFIELD, "from"))
+	}
+	if len(errs) > 0 {
+		return nil, badRequestStatus(ctx, errs)
+	}
+	if err := grpcAuthorize(ctx, SCOPE_TRANSFER, int(req.From)); err != nil {
+		return nil, GrpcStatus(ctx, err, &AccountExpectedResult)
+	}
+	tData := TransferData{From: int(req.From), To: int(req.To), Sum: req.Sum, KeyId: grpcKeyId(ctx)}
+	err := s.accSrv.TransferMoney(ctx, &tData)
+	if err != nil {
+		return nil, GrpcStatus(ctx, err, &AccountExpectedResult)
+	}
+	return &pb.OperationResponse{Status: int32(STATUS_CODE_OK), Message: Messages.Message(grpcLocale(ctx), MESSAGE_TRANSFER_COMPLETED)}, nil
+}
+
+func (s *AccountGrpcServer) ListTransactions(ctx context.Context, req *pb.ListTransactionsRequest) (*pb.ListTransactionsResponse, error) {
+	trxData, err := transactionsListData(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := grpcAuthorize(ctx, SCOPE_TRANSACTIONS_READ, trxData.Id); err != nil {
+		return nil, GrpcStatus(ctx, err, &AccountExpectedResult)
+	}
+	trxs, err := s.accSrv.GetUserTransactions(ctx, trxData)
+	if err != nil {
+		return nil, GrpcStatus(ctx, err, &AccountExpectedResult)
+	}
+	return &pb.ListTransactionsResponse{Next: int32(trxs.Last), Transactions: transactionRecords(trxs.Trxs)}, nil
+}
+
+func (s *AccountGrpcServer) StreamTransactions(req *pb.ListTransactionsRequest, stream pb.BalanceService_StreamTransactionsServer) error {
+	ctx := stream.Context()
+	trxData, err := transactionsListData(ctx, req)
+	if err != nil {
+		return err
+	}
+	if err := grpcAuthorize(ctx, SCOPE_TRANSACTIONS_READ, trxData.Id); err != nil {
+		return GrpcStatus(ctx, err, &AccountExpectedResult)
+	}
+	for {
+		trxs, err := s.accSrv.GetUserTransactions(ctx, trxData)
+		if err != nil {
+			return GrpcStatus(ctx, err, &AccountExpectedResult)
+		}
+		for _, trx := range transactionRecords(trxs.Trxs) {
+			if err := stream.Send(trx); err != nil {
+				return err
+			}
+		}
+		if trxs.Last < 0 {
+			return nil
+		}
+		trxData.Page = trxs.Last
+	}
+}
+
+func GrpcStatus(ctx context.Context, err error, er ExpectedResultI) error {
+	opErr := shutdownErrorOr(ctx, ConvertError(err))
+	observeOperationError(opErr.Code, METRICS_TRANSPORT_GRPC)
+	errCode := er.GetError(opErr.Code)
+	var details []protoiface.MessageV1
+	if errCode.Retryable {
+		details = append(details, &errdetails.RetryInfo{
+			RetryDelay: durationpb.New(time.Duration(RETRY_AFTER_SECONDS) * time.Second),
+		})
+	}
+	return operationStatus(errCode.GrpcCode, opErr.Code, er.GetStatus(opErr.Code, grpcLocale(ctx)), details...)
+}
+
+func (s *AccountGrpcServer) authenticateUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *AccountGrpcServer) authenticateStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{stream, ctx})
+}
+
+func (s *AccountGrpcServer) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	p, err := s.auth.Authenticate(ctx, strings.Join(md.Get(HEADER_AUTHORIZATION), ","))
+	if err != nil {
+		return nil, GrpcStatus(ctx, err, &AccountExpectedResult)
+	}
+	return context.WithValue(ctx, grpcPrincipalCtx{}, p), nil
+}
+
+func (s *AccountGrpcServer) limitUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.limit(ctx, info.FullMethod, grpcAccountId(req)); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// limitStream limits streams by client only, account is known after the request is received.
+func (s *AccountGrpcServer) limitStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.limit(stream.Context(), info.FullMethod, 0); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+func (s *AccountGrpcServer) limit(ctx context.Context, method string, account int) error {
+	p, ok := s.policies[GRPC_RATE_LIMIT_GROUPS[method]]
+	if !ok {
+		return nil
+	}
+	if !p.Account.Enabled() {
+		account = 0
+	}
+	wait, err := s.limiter.AllowRequest(ctx, p, grpcClient(ctx), account)
+	if err != nil {
+		return rateLimitedStatus(ctx, wait)
+	}
+	return nil
+}
+
+func (s *AccountGrpcServer) rejectPartnersUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if GRPC_SIGNED_METHODS[info.FullMethod] {
+		if _, partner := s.partners.GetSecret(grpcKeyId(ctx)); partner {
+			return nil, GrpcStatus(ctx, &OperationError{Code: ERROR_SIGNATURE_MISSING}, &AccountExpectedResult)
+		}
+	}
+	return handler(ctx, req)
+}
+
+// rateLimitedStatus is ERROR_RATE_LIMITED status with retry delay of the empty bucket.
+func rateLimitedStatus(ctx context.Context, wait time.Duration) error {
+	observeOperationError(ERROR_RATE_LIMITED, METRICS_TRANSPORT_GRPC)
+	delay := time.Duration(math.Ceil(wait.Seconds())) * time.Second
+	return operationStatus(AccountExpectedResult.GetError(ERROR_RATE_LIMITED).GrpcCode, ERROR_RATE_LIMITED,
+		AccountExpectedResult.GetStatus(ERROR_RATE_LIMITED, grpcLocale(ctx)), &errdetails.RetryInfo{RetryDelay: durationpb.New(delay)})
+}
+
+// grpcClient identifies caller for rate limits like RateLimited does, by principal or by peer IP.
+func grpcClient(ctx context.Context) string {
+	if p, ok := ctx.Value(grpcPrincipalCtx{}).(Principal); ok {
+		return p.GetActor()
+	}
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return "ip:"
+	}
+	host, _, err := net.SplitHostPort(pr.Addr.String())
+	if err != nil {
+		host = pr.Addr.String()
+	}
+	return "ip:" + host
+}
+
+// grpcAccountId returns account the call operates on, for transfers it is the sender.
+func grpcAccountId(req interface{}) int {
+	switch r := req.(type) {
+	case *pb.TransferRequest:
+		return int(r.GetFrom())
+	case interface{ GetId() int32 }:
+		return int(r.GetId())
+	}
+	return 0
+}
+
+// contextStream replaces context of server stream.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcKeyId(ctx context.Context) int {
+	p, ok := ctx.Value(grpcPrincipalCtx{}).(Principal)
+	if !ok {
+		return 0
+	}
+	return p.GetKeyId()
+}
+
+// grpcAuthorize is gRPC counterpart of authorize.
+func grpcAuthorize(ctx context.Context, scope string, accounts ...int) error {
+	p, ok := ctx.Value(grpcPrincipalCtx{}).(Principal)
+	if !ok {
+		return &OperationError{Code: ERROR_UNAUTHORIZED}
+	}
+	return p.Authorize(scope, accounts...)
+}
+
+// grpcLocale picks message locale from accept-language metadata.
+func grpcLocale(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return Messages.Locale(strings.Join(md.Get(HEADER_ACCEPT_LANGUAGE), ","))
+}
+
+func badRequestStatus(ctx context.Context, errs RequestErrors) error {
+	observeOperationError(ERROR_WRONG_REQUEST, METRICS_TRANSPORT_GRPC)
+	locale := grpcLocale(ctx)
+	br := &errdetails.BadRequest{}
+	for _, e := range errs.Localize(Messages, locale) {
+		br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       e.Field,
+			Description: e.Message,
+		})
+	}
+	return operationStatus(AccountExpectedResult.GetError(ERROR_WRONG_REQUEST).GrpcCode, ERROR_WRONG_REQUEST, AccountExpectedResult.GetStatus(ERROR_WRONG_REQUEST, locale), br)
+}
+
+func operationStatus(code codes.Code, opCode int, msg string, details ...protoiface.MessageV1) error {
+	st := status.New(code, msg)
+	info := &errdetails.ErrorInfo{
+		Reason:   strconv.Itoa(opCode),
+		Domain:   GRPC_ERROR_DOMAIN,
+		Metadata: map[string]string{"status": strconv.Itoa(opCode)},
+	}
+	if det, err := st.WithDetails(append([]protoiface.MessageV1{info}, details...)...); err == nil {
+		st = det
+	}
+	return st.Err()
+}
+
+func transactionsListData(ctx context.Context, req *pb.ListTransactionsRequest) (*TransactionsListData, error) {
+	errs := RequestErrors{}
+	if req.Id <= 0 {
+		errs = append(errs, NewValidationError("id", RULE_GT, "0"))
+	}
+	if req.From < 0 {
+		errs = append(errs, NewValidationError("from", RULE_GTE, "0"))
+	}
+	to := req.End
+	if to == 0 {
+		to = time.Now().Unix()
+	}
+	if req.Start > to {
+		errs = append(errs, NewValidationError("start", RULE_LTEFIELD, "end"))
+	}
+	if len(errs) > 0 {
+		return nil, badRequestStatus(ctx, errs)
+	}
+	return &TransactionsListData{Id: int(req.Id), From: req.Start, To: to, Page: int(req.From), Sort: req.Sort}, nil
+}
+
+func transactionRecords(trxs []map[string]interface{}) []*pb.TransactionRecord {
+	records := make([]*pb.TransactionRecord, 0, len(trxs))
+	for _, trx := range trxs {
+		rec := &pb.TransactionRecord{}
+		if sum, ok := trx["sum"].(float64); ok {
+			rec.Sum = sum
+		}
+		if op, ok := trx["operation"].(int); ok {
+			rec.Operation = int32(op)
+		}
+		if date, ok := trx["date"].(time.Time); ok {
+			rec.Date = timestamppb.New(date)
+		}
+		if desc, ok := trx["desc"].(string); ok {
+			rec.Desc = desc
+		}
+		records = append(records, rec)
+	}
+	return records
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	URL_HEALTHZ string = "/healthz"
+	URL_READYZ  string = "/readyz"
+
+	ERROR_NOT_READY int = 124
+
+	HEALTH_STATUS_OK   string = "ok"
+	HEALTH_STATUS_FAIL string = "fail"
+
+	HEALTH_CHECK_DATABASE string = "database"
+	HEALTH_CHECK_SCHEMA   string = "schema"
+	HEALTH_CHECK_CURRENCY string = "currency"
+	HEALTH_CHECK_SHUTDOWN string = "shutdown"
+
+	// HEALTH_CHECK_TIMEOUT bounds every readiness check, probes should not hang on dead dependency.
+	HEALTH_CHECK_TIMEOUT time.Duration = 2 * time.Second
+)
+
+// HealthCheck is a dependency check of readiness probe. Failed non-critical
+// check is reported, but the server stays ready.
+type HealthCheck struct {
+	Name     string
+	Critical bool
+	Check    func(ctx context.Context) error
+}
+
+type CheckResult struct {
+	Status   string  `json:"status"`
+	Critical bool    `json:"critical"`
+	Duration float64 `json:"duration_ms"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type ReadinessReport struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Readiness runs dependency checks for /readyz. After Shutdown it reports
+// not ready without running checks, so load balancer stops sending requests.
+type Readiness struct {
+	checks       []HealthCheck
+	shuttingDown int32
+}
+
+func NewReadiness(checks ...HealthCheck) *Readiness {
+	return &Readiness{checks: checks}
+}
+
+func (r *Readiness) Shutdown() {
+	atomic.StoreInt32(&r.shuttingDown, 1)
+}
+
+func (r *Readiness) ShuttingDown() bool {
+	return atomic.LoadInt32(&r.shuttingDown) == 1
+}
+
+// Report runs all checks concurrently, each with HEALTH_CHECK_TIMEOUT.
+func (r *Readiness) Report(ctx context.Context) ReadinessReport {
+	if r.ShuttingDown() {
+		return ReadinessReport{false, map[string]CheckResult{
+			HEALTH_CHECK_SHUTDOWN: {Status: HEALTH_STATUS_FAIL, Critical: true, Error: "server is shutting down"},
+		}}
+	}
+	report := ReadinessReport{true, map[string]CheckResult{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, hc := range r.checks {
+		wg.Add(1)
+		go func(hc HealthCheck) {
+			defer wg.Done()
+			res := runCheck(ctx, hc)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[hc.Name] = res
+			if res.Status != HEALTH_STATUS_OK && hc.Critical {
+				report.Ready = false
+			}
+		}(hc)
+	}
+	wg.Wait()
+	return report
+}
+
+func runCheck(ctx context.Context, hc HealthCheck) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+	start := time.Now()
+	err := hc.Check(ctx)
+	res := CheckResult{
+		Status:   HEALTH_STATUS_OK,
+		Critical: hc.Critical,
+		Duration: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Status = HEALTH_STATUS_FAIL
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Ready handles /readyz, it answers 503 with ERROR_NOT_READY when a critical check fails.
+func (r *Readiness) Ready(c *gin.Context) {
+	report := r.Report(c.Request.Context())
+	res := Result{c, STATUS_CODE_OK, report}
+	if !report.Ready {
+		res.SetStatus(ERROR_NOT_READY)
+		res.Response(ERROR_REGISTRY.Get(ERROR_NOT_READY).HttpCode)
+		return
+	}
+	res.Ok()
+}
+
+// Healthz handles liveness probe, it checks only that the process serves requests.
+func Healthz(c *gin.Context) {
+	r := Result{c, STATUS_CODE_OK, HEALTH_STATUS_OK}
+	r.Ok()
+}
+
+// DatabaseCheck acquires connection from the pool and pings the database.
+func DatabaseCheck(db *Database) HealthCheck {
+	return HealthCheck{HEALTH_CHECK_DATABASE, true, func(ctx context.Context) error {
+		conn, err := db.Conn.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Release()
+		return conn.Conn().Ping(ctx)
+	}}
+}
+
+// SchemaCheck fails when the latest applied schema version is not the one the binary expects.
+func SchemaCheck(db DatabaseI, version int) HealthCheck {
+	return HealthCheck{HEALTH_CHECK_SCHEMA, true, func(ctx context.Context) error {
+		rows, err := db.Query(ctx, SELECT_SCHEMA_VERSION)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		var current int
+		if rows.Next() {
+			if err := rows.Scan(&current); err != nil {
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if current != version {
+			return fmt.Errorf("schema version %d, expected %d", current, version)
+		}
+		return nil
+	}}
+}
+
+// CurrencyCheck requests currency rates provider. It is not critical: balances in
+// base currency and money operations work without the provider.
+func CurrencyCheck(ratesUrl string) HealthCheck {
+	return HealthCheck{HEALTH_CHECK_CURRENCY, false, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", ratesUrl, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("currency provider answered %d", resp.StatusCode)
+		}
+		return nil
+	}}
+}
+
+// NewReadinessFromConfig checks database and schema, rates provider is checked when cfg.CheckReadiness is set.
+func NewReadinessFromConfig(db *Database, cfg CurrencyConfig) *Readiness {
+	checks := []HealthCheck{DatabaseCheck(db), SchemaCheck(db, SchemaVersion())}
+	if cfg.CheckReadiness {
+		checks = append(checks, CurrencyCheck(cfg.RatesUrl))
+	}
+	return NewReadiness(checks...)
+}
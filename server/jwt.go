@@ -0,0 +1,239 @@
+package server
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	ERROR_ACCOUNT_MISMATCH int = 110
+
+	JWT_DEFAULT_ACCOUNT_CLAIM string = "sub"
+	// JWT_SCOPE_CLAIM lists scopes granted to the token, space separated as in OAuth 2.0 or as an array.
+	JWT_SCOPE_CLAIM string = "scope"
+
+	JWK_TYPE_RSA  string = "RSA"
+	JWK_TYPE_OCT  string = "oct"
+	JWT_ALG_HS256 string = "HS256"
+	JWT_ALG_RS256 string = "RS256"
+)
+
+var (
+	// JWT_SCOPES are the most account owners authenticated with JWT can be granted.
+	JWT_SCOPES = []string{
+		SCOPE_BALANCE_READ,
+		SCOPE_TRANSACTIONS_READ,
+		SCOPE_TRANSFER,
+	}
+)
+
+// JwtPrincipal is account owner authenticated with JWT. Scopes are scopes of the token
+// which are also in JWT_SCOPES.
+type JwtPrincipal struct {
+	Account int
+	Scopes  []string
+}
+
+func (p *JwtPrincipal) Authorize(scope string, accounts ...int) error {
+	if !containsString(p.Scopes, scope) {
+		return &OperationError{Code: ERROR_FORBIDDEN}
+	}
+	for _, id := range accounts {
+		if id != p.Account {
+			return &OperationError{Code: ERROR_ACCOUNT_MISMATCH}
+		}
+	}
+	return nil
+}
+
+func (p *JwtPrincipal) GetKeyId() int {
+	return 0
+}
+
+func (p *JwtPrincipal) GetActor() string {
+	return fmt.Sprintf("account:%d", p.Account)
+}
+
+type Jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	K   string `json:"k"`
+}
+
+// Jwks is JSON Web Key Set with RSA public keys for RS256 and symmetric keys for HS256.
+type Jwks struct {
+	Keys []Jwk `json:"keys"`
+
+	rsa  map[string]*rsa.PublicKey
+	hmac map[string][]byte
+}
+
+func LoadJwks(path string) (*Jwks, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJwks(data)
+}
+
+func ParseJwks(data []byte) (*Jwks, error) {
+	set := &Jwks{rsa: map[string]*rsa.PublicKey{}, hmac: map[string][]byte{}}
+	if err := json.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case JWK_TYPE_RSA:
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("jwks key %s: %w", k.Kid, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("jwks key %s: %w", k.Kid, err)
+			}
+			set.rsa[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case JWK_TYPE_OCT:
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return nil, fmt.Errorf("jwks key %s: %w", k.Kid, err)
+			}
+			set.hmac[k.Kid] = secret
+		default:
+			return nil, fmt.Errorf("jwks key %s: unsupported key type %s", k.Kid, k.Kty)
+		}
+	}
+	return set, nil
+}
+
+// JwtVerifier validates HS256 and RS256 tokens and maps account claim to JwtPrincipal.
+type JwtVerifier struct {
+	secret       []byte
+	jwks         *Jwks
+	accountClaim string
+	parser       *jwt.Parser
+}
+
+// NewJwtVerifier creates verifier. HS256 tokens are checked with secret or JWKS
+// symmetric keys, RS256 tokens with JWKS RSA keys.
+func NewJwtVerifier(secret []byte, jwks *Jwks, accountClaim string) *JwtVerifier {
+	if jwks == nil {
+		jwks = &Jwks{rsa: map[string]*rsa.PublicKey{}, hmac: map[string][]byte{}}
+	}
+	if accountClaim == "" {
+		accountClaim = JWT_DEFAULT_ACCOUNT_CLAIM
+	}
+	return &JwtVerifier{secret, jwks, accountClaim, jwt.NewParser(jwt.WithValidMethods([]string{JWT_ALG_HS256, JWT_ALG_RS256}))}
+}
+
+// NewJwtVerifierFromConfig returns nil verifier if neither secret nor JWKS file is set.
+func NewJwtVerifierFromConfig(cfg JwtConfig) (*JwtVerifier, error) {
+	if cfg.Secret == "" && cfg.JwksFile == "" {
+		return nil, nil
+	}
+	var jwks *Jwks
+	if cfg.JwksFile != "" {
+		var err error
+		if jwks, err = LoadJwks(cfg.JwksFile); err != nil {
+			return nil, err
+		}
+	}
+	return NewJwtVerifier([]byte(cfg.Secret), jwks, cfg.AccountClaim), nil
+}
+
+func (v *JwtVerifier) Authenticate(token string) (*JwtPrincipal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(token, claims, v.key); err != nil {
+		return nil, &OperationError{Code: ERROR_UNAUTHORIZED}
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, &OperationError{Code: ERROR_UNAUTHORIZED}
+	}
+	account, ok := claimAccountId(claims[v.accountClaim])
+	if !ok {
+		return nil, &OperationError{Code: ERROR_UNAUTHORIZED}
+	}
+	return &JwtPrincipal{Account: account, Scopes: claimScopes(claims[JWT_SCOPE_CLAIM])}, nil
+}
+
+func (v *JwtVerifier) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	switch token.Method.Alg() {
+	case JWT_ALG_HS256:
+		if k, ok := v.jwks.hmac[kid]; ok {
+			return k, nil
+		}
+		if kid == "" && len(v.secret) > 0 {
+			return v.secret, nil
+		}
+	case JWT_ALG_RS256:
+		if k, ok := v.jwks.rsa[kid]; ok {
+			return k, nil
+		}
+		if kid == "" && len(v.jwks.rsa) == 1 {
+			for _, k := range v.jwks.rsa {
+				return k, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no key %q for %s", kid, token.Method.Alg())
+}
+
+// claimAccountId accepts positive integer claim as JSON number or numeric string.
+func claimAccountId(v interface{}) (int, bool) {
+	switch id := v.(type) {
+	case float64:
+		if id > 0 && id == math.Trunc(id) && id <= math.MaxInt32 {
+			return int(id), true
+		}
+	case string:
+		if n, err := strconv.Atoi(id); err == nil && n > 0 {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// claimScopes intersects scope claim with JWT_SCOPES. Token without the claim is granted no scopes.
+func claimScopes(v interface{}) []string {
+	var requested []string
+	switch s := v.(type) {
+	case string:
+		requested = strings.Fields(s)
+	case []interface{}:
+		for _, item := range s {
+			if scope, ok := item.(string); ok {
+				requested = append(requested, scope)
+			}
+		}
+	}
+	scopes := []string{}
+	for _, scope := range requested {
+		if containsString(JWT_SCOPES, scope) && !containsString(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
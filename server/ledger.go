@@ -0,0 +1,504 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
+)
+
+const (
+	URL_ADMIN_LEDGER_VERIFY string = "/admin/ledger/verify"
+
+	// LEDGER_CHAIN_LOCK is advisory lock key serializing appends to account chain.
+	LEDGER_CHAIN_LOCK int = -1
+
+	CHAIN_BREAK_HASH               string = "hash_mismatch"
+	CHAIN_BREAK_LINK               string = "prev_hash_mismatch"
+	CHAIN_BREAK_CHECKPOINT         string = "checkpoint_hash_mismatch"
+	CHAIN_BREAK_CHECKPOINT_MISSING string = "checkpoint_row_missing"
+
+	// CHECKPOINT_DEFAULT_DIR and CHECKPOINT_INTERVAL are defaults, see LedgerConfig.
+	CHECKPOINT_DEFAULT_DIR string        = "checkpoints"
+	CHECKPOINT_FILE        string        = "checkpoint-%d.json"
+	CHECKPOINT_GLOB        string        = "checkpoint-*.json"
+	CHECKPOINT_INTERVAL    time.Duration = time.Hour
+
+	PEM_PRIVATE_KEY string = "PRIVATE KEY"
+	PEM_PUBLIC_KEY  string = "PUBLIC KEY"
+
+	WALK_CHAIN         string = "SELECT id, account, sum::text, operation, date, description, COALESCE(key_id, 0), prev_hash, hash FROM transactions WHERE ($1 = 0 OR account = $1) ORDER BY account, id"
+	SELECT_CHAIN_HEADS string = "SELECT DISTINCT ON (account) account, id, hash FROM transactions ORDER BY account, id DESC"
+	UPDATE_CHAIN_HASH  string = "UPDATE transactions SET prev_hash = $2, hash = $3 WHERE id = $1"
+)
+
+var (
+	// ErrChainBroken is returned by ledger verify command for broken chain.
+	ErrChainBroken = errors.New("ledger hash chain is broken")
+)
+
+// ChainRow is a ledger row as covered by the hash chain.
+// Sum is kept in the database text form, so the hash does not depend on float formatting.
+type ChainRow struct {
+	Id        int
+	Account   int
+	Sum       string
+	Operation int
+	Date      int64
+	Desc      string
+	KeyId     int
+	PrevHash  string
+	Hash      string
+}
+
+// ChainHead is the last row of account chain.
+type ChainHead struct {
+	Account int    `json:"account"`
+	Id      int    `json:"id"`
+	Hash    string `json:"hash"`
+}
+
+type ChainBreak struct {
+	Account int    `json:"account"`
+	Id      int    `json:"id"`
+	Reason  string `json:"reason"`
+}
+
+type ChainReport struct {
+	Ok       bool        `json:"ok"`
+	Rows     int         `json:"rows"`
+	Accounts int         `json:"accounts"`
+	Break    *ChainBreak `json:"break,omitempty"`
+	// Checkpoint is the date of checkpoint the chain was compared with, zero without checkpoint.
+	Checkpoint int64 `json:"checkpoint,omitempty"`
+}
+
+// LedgerCheckpoint is a signed snapshot of chain heads. Rows deleted from the tail
+// of a chain leave it consistent, so they are detected against a checkpoint.
+type LedgerCheckpoint struct {
+	Date      int64       `json:"date"`
+	Heads     []ChainHead `json:"heads"`
+	Signature string      `json:"signature"`
+}
+
+type LedgerQuery struct {
+	Account int `form:"account" binding:"gte=0"`
+}
+
+// FormatLedgerSum formats sum the way NUMERIC(16, 2) column prints it.
+func FormatLedgerSum(sum float64) string {
+	s := strconv.FormatFloat(sum, 'f', 2, 64)
+	if s == "-0.00" {
+		return "0.00"
+	}
+	return s
+}
+
+// HashChainRow returns hex SHA-256 of the row content and the previous row hash.
+func HashChainRow(row ChainRow) string {
+	content, _ := json.Marshal([]interface{}{row.Account, row.Sum, row.Operation, row.Date, row.Desc, row.KeyId, row.PrevHash})
+	h := sha256.Sum256(content)
+	return hex.EncodeToString(h[:])
+}
+
+// backfillChainHashes links rows without hash, written before the chain existed, into account chains
+// in id order. It is the hook of the first migration, which adds chain columns to old tables.
+func backfillChainHashes(ctx context.Context, tx pgx.Tx) error {
+	rows, err := tx.Query(ctx, WALK_CHAIN, 0)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	last := map[int]string{}
+	batch := &pgx.Batch{}
+	for rows.Next() {
+		var row ChainRow
+		if err := rows.Scan(&row.Id, &row.Account, &row.Sum, &row.Operation, &row.Date, &row.Desc, &row.KeyId, &row.PrevHash, &row.Hash); err != nil {
+			return err
+		}
+		if row.Hash == "" {
+			row.PrevHash = last[row.Account]
+			row.Hash = HashChainRow(row)
+			batch.Queue(UPDATE_CHAIN_HASH, row.Id, row.PrevHash, row.Hash)
+		}
+		last[row.Account] = row.Hash
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	if batch.Len() == 0 {
+		return nil
+	}
+	return tx.SendBatch(ctx, batch).Close()
+}
+
+// ChainVerifier checks rows ordered by account and id and stops on the first broken link.
+type ChainVerifier struct {
+	last     map[int]string
+	expected map[int]ChainHead
+	report   ChainReport
+}
+
+// NewChainVerifier creates verifier. Rows listed in expected checkpoint heads must be present unchanged.
+func NewChainVerifier(expected []ChainHead) *ChainVerifier {
+	v := &ChainVerifier{last: map[int]string{}, expected: map[int]ChainHead{}, report: ChainReport{Ok: true}}
+	for _, h := range expected {
+		v.expected[h.Account] = h
+	}
+	return v
+}
+
+// Add checks next row and returns false once the chain is broken.
+func (v *ChainVerifier) Add(row ChainRow) bool {
+	if !v.report.Ok {
+		return false
+	}
+	prev, seen := v.last[row.Account]
+	if !seen {
+		v.report.Accounts++
+	}
+	if exp, ok := v.expected[row.Account]; ok && row.Id >= exp.Id {
+		if row.Id > exp.Id {
+			return v.fail(exp.Account, exp.Id, CHAIN_BREAK_CHECKPOINT_MISSING)
+		}
+		if row.Hash != exp.Hash {
+			return v.fail(row.Account, row.Id, CHAIN_BREAK_CHECKPOINT)
+		}
+		delete(v.expected, row.Account)
+	}
+	if row.PrevHash != prev {
+		return v.fail(row.Account, row.Id, CHAIN_BREAK_LINK)
+	}
+	if HashChainRow(row) != row.Hash {
+		return v.fail(row.Account, row.Id, CHAIN_BREAK_HASH)
+	}
+	v.last[row.Account] = row.Hash
+	v.report.Rows++
+	return true
+}
+
+// Report returns result after all rows were added.
+func (v *ChainVerifier) Report() ChainReport {
+	if v.report.Ok {
+		for _, exp := range v.expected {
+			if v.report.Break == nil || exp.Account < v.report.Break.Account {
+				v.report.Break = &ChainBreak{Account: exp.Account, Id: exp.Id, Reason: CHAIN_BREAK_CHECKPOINT_MISSING}
+			}
+		}
+		v.report.Ok = v.report.Break == nil
+	}
+	return v.report
+}
+
+func (v *ChainVerifier) fail(account int, id int, reason string) bool {
+	v.report.Ok = false
+	v.report.Break = &ChainBreak{Account: account, Id: id, Reason: reason}
+	return false
+}
+
+func (cp *LedgerCheckpoint) payload() []byte {
+	p, _ := json.Marshal(LedgerCheckpoint{Date: cp.Date, Heads: cp.Heads})
+	return p
+}
+
+func SignCheckpoint(key ed25519.PrivateKey, cp *LedgerCheckpoint) {
+	cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, cp.payload()))
+}
+
+func VerifyCheckpoint(pub ed25519.PublicKey, cp *LedgerCheckpoint) error {
+	sig, err := base64.StdEncoding.DecodeString(cp.Signature)
+	if err != nil || !ed25519.Verify(pub, cp.payload(), sig) {
+		return fmt.Errorf("checkpoint signature is invalid")
+	}
+	return nil
+}
+
+func LoadCheckpoint(path string) (*LedgerCheckpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cp LedgerCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %w", path, err)
+	}
+	return &cp, nil
+}
+
+// LoadCheckpointKey reads PKCS #8 PEM Ed25519 private key, as written by "openssl genpkey -algorithm ed25519".
+func LoadCheckpointKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPem(path, PEM_PRIVATE_KEY)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint key %s: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("checkpoint key %s: not an ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+// LoadCheckpointPublicKey reads PKIX PEM Ed25519 public key.
+func LoadCheckpointPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPem(path, PEM_PUBLIC_KEY)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint public key %s: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("checkpoint public key %s: not an ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+func readPem(path string, blockType string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s: no %s PEM block", path, blockType)
+	}
+	return block.Bytes, nil
+}
+
+type LedgerRepositoryI interface {
+	WalkChain(ctx context.Context, account int, fn func(row ChainRow) bool) error
+	GetChainHeads(ctx context.Context) ([]ChainHead, error)
+}
+
+type LedgerRepository struct {
+	db DatabaseI
+}
+
+func NewLedgerRepository(db DatabaseI) *LedgerRepository {
+	return &LedgerRepository{db}
+}
+
+// WalkChain streams rows of the account, or of all accounts for 0, until fn returns false.
+func (rep *LedgerRepository) WalkChain(ctx context.Context, account int, fn func(row ChainRow) bool) error {
+	_, err := rep.db.ExecuteInTransaction(ctx, func(tx *pgx.Tx) (interface{}, error) {
+		rows, err := (*tx).Query(ctx, WALK_CHAIN, account)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var row ChainRow
+			if err := rows.Scan(&row.Id, &row.Account, &row.Sum, &row.Operation, &row.Date, &row.Desc, &row.KeyId, &row.PrevHash, &row.Hash); err != nil {
+				return nil, err
+			}
+			if !fn(row) {
+				return nil, nil
+			}
+		}
+		return nil, rows.Err()
+	})
+	return err
+}
+
+func (rep *LedgerRepository) GetChainHeads(ctx context.Context) ([]ChainHead, error) {
+	heads := []ChainHead{}
+	_, err := rep.db.ExecuteInTransaction(ctx, func(tx *pgx.Tx) (interface{}, error) {
+		rows, err := (*tx).Query(ctx, SELECT_CHAIN_HEADS)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var h ChainHead
+			if err := rows.Scan(&h.Account, &h.Id, &h.Hash); err != nil {
+				return nil, err
+			}
+			heads = append(heads, h)
+		}
+		return nil, rows.Err()
+	})
+	return heads, err
+}
+
+type LedgerService struct {
+	ledRep LedgerRepositoryI
+}
+
+func NewLedgerService(r LedgerRepositoryI) *LedgerService {
+	return &LedgerService{r}
+}
+
+// Verify walks the chain of the account, or of all accounts for 0, comparing it with optional checkpoint.
+func (s *LedgerService) Verify(ctx context.Context, account int, cp *LedgerCheckpoint) (ChainReport, error) {
+	var expected []ChainHead
+	if cp != nil {
+		for _, h := range cp.Heads {
+			if account == 0 || h.Account == account {
+				expected = append(expected, h)
+			}
+		}
+	}
+	v := NewChainVerifier(expected)
+	if err := s.ledRep.WalkChain(ctx, account, v.Add); err != nil {
+		return ChainReport{}, ConvertError(err)
+	}
+	report := v.Report()
+	if cp != nil {
+		report.Checkpoint = cp.Date
+	}
+	return report, nil
+}
+
+// LatestCheckpoint loads the newest checkpoint of cfg.CheckpointDir and checks it is signed by
+// the configured checkpoint key. Without the key or checkpoint files it returns nil.
+func (s *LedgerService) LatestCheckpoint(cfg LedgerConfig) (*LedgerCheckpoint, error) {
+	if cfg.CheckpointKeyFile == "" {
+		return nil, nil
+	}
+	key, err := LoadCheckpointKey(cfg.CheckpointKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(cfg.CheckpointDir, CHECKPOINT_GLOB))
+	if err != nil {
+		return nil, err
+	}
+	latest, path := int64(0), ""
+	for _, f := range files {
+		var date int64
+		if _, err := fmt.Sscanf(filepath.Base(f), CHECKPOINT_FILE, &date); err == nil && date > latest {
+			latest, path = date, f
+		}
+	}
+	if path == "" {
+		return nil, nil
+	}
+	cp, err := LoadCheckpoint(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyCheckpoint(key.Public().(ed25519.PublicKey), cp); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cp, nil
+}
+
+func (s *LedgerService) Checkpoint(ctx context.Context, key ed25519.PrivateKey) (*LedgerCheckpoint, error) {
+	heads, err := s.ledRep.GetChainHeads(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cp := &LedgerCheckpoint{Date: time.Now().Unix(), Heads: heads}
+	SignCheckpoint(key, cp)
+	return cp, nil
+}
+
+// WriteCheckpoint exports signed checkpoint to a new file in dir and returns its path.
+func (s *LedgerService) WriteCheckpoint(ctx context.Context, key ed25519.PrivateKey, dir string) (string, error) {
+	cp, err := s.Checkpoint(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf(CHECKPOINT_FILE, cp.Date))
+	return path, ioutil.WriteFile(path, data, 0644)
+}
+
+// LedgerCheckpointer is a scheduled job exporting signed checkpoints.
+type LedgerCheckpointer struct {
+	ledSrv *LedgerService
+	key    ed25519.PrivateKey
+	dir    string
+	log    zerolog.Logger
+}
+
+// NewLedgerCheckpointerFromConfig returns nil job if checkpoint key file is not set.
+func NewLedgerCheckpointerFromConfig(ledSrv *LedgerService, cfg LedgerConfig, log zerolog.Logger) (*LedgerCheckpointer, error) {
+	if cfg.CheckpointKeyFile == "" {
+		return nil, nil
+	}
+	key, err := LoadCheckpointKey(cfg.CheckpointKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &LedgerCheckpointer{ledSrv, key, cfg.CheckpointDir, componentLogger(log, "scheduler")}, nil
+}
+
+func (j *LedgerCheckpointer) Run(ctx context.Context) {
+	path, err := j.ledSrv.WriteCheckpoint(ctx, j.key, j.dir)
+	if err != nil {
+		j.log.Error().Err(err).Msg("ledger checkpoint failed")
+		return
+	}
+	j.log.Info().Str("path", path).Msg("ledger checkpoint exported")
+}
+
+type LedgerController struct {
+	ledSrv *LedgerService
+	cfg    LedgerConfig
+	log    zerolog.Logger
+}
+
+func NewLedgerController(ledRep LedgerRepositoryI, cfg LedgerConfig, log zerolog.Logger) *LedgerController {
+	return &LedgerController{NewLedgerService(ledRep), cfg, componentLogger(log, "ledger")}
+}
+
+// fail logs operation error of the request and writes it to response, like AccountController.fail.
+func (l *LedgerController) fail(r *Result, err error) {
+	logOperationError(r.ctx.Request.Context(), l.log, "request failed", err)
+	r.Err(&err, &AccountExpectedResult)
+}
+
+// Verify checks the chain against the latest signed checkpoint, so rows deleted from the tail
+// of a chain are reported too.
+func (l *LedgerController) Verify(c *gin.Context) {
+	r := Result{c, STATUS_CODE_OK, map[string]interface{}{}}
+	if err := authorize(c, SCOPE_ADMIN_AUDIT_READ); err != nil {
+		l.fail(&r, err)
+		return
+	}
+	var q LedgerQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		r.BadRequest(err)
+		return
+	}
+	cp, err := l.ledSrv.LatestCheckpoint(l.cfg)
+	if err != nil {
+		l.fail(&r, err)
+		return
+	}
+	report, err := l.ledSrv.Verify(c.Request.Context(), q.Account, cp)
+	if err != nil {
+		l.fail(&r, err)
+		return
+	}
+	r.Give(report)
+}
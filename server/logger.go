@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	LOG_FIELD_REQUEST_ID string = "request_id"
+	LOG_FIELD_COMPONENT  string = "component"
+	LOG_FIELD_ACCOUNT    string = "account"
+	LOG_FIELD_STATUS     string = "status"
+
+	HEADER_REQUEST_ID  string = "X-Request-ID"
+	CONTEXT_REQUEST_ID string = "request_id"
+
+	REQUEST_ID_BYTES int = 16
+)
+
+type requestIdCtx struct{}
+
+// NewLogger creates logger writing JSON lines to w, records below level are dropped.
+// Records bound to request context with Ctx get request_id field.
+func NewLogger(w io.Writer, level LogLevel) zerolog.Logger {
+	return zerolog.New(w).
+		Level(zerologLevel(level)).
+		Hook(requestIdHook{}).
+		With().Timestamp().Logger()
+}
+
+// componentLogger marks records of the component, e.g. "repository".
+func componentLogger(log zerolog.Logger, component string) zerolog.Logger {
+	return log.With().Str(LOG_FIELD_COMPONENT, component).Logger()
+}
+
+func zerologLevel(level LogLevel) zerolog.Level {
+	switch level {
+	case LOG_LEVEL_DEBUG:
+		return zerolog.DebugLevel
+	case LOG_LEVEL_WARN:
+		return zerolog.WarnLevel
+	case LOG_LEVEL_ERROR:
+		return zerolog.ErrorLevel
+	default:
+		return zerolog.InfoLevel
+	}
+}
+
+// logOperationError logs cause of operation error with level declared for its code in ERROR_REGISTRY.
+func logOperationError(ctx context.Context, log zerolog.Logger, msg string, err error) {
+	opErr := ConvertError(err)
+	log.WithLevel(zerologLevel(ERROR_REGISTRY.Get(opErr.Code).LogLevel)).
+		Ctx(ctx).
+		Err(err).
+		Int(LOG_FIELD_STATUS, opErr.Code).
+		Msg(msg)
+}
+
+// ContextWithRequestId binds request id to ctx, it is added to log records of the request.
+func ContextWithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdCtx{}, id)
+}
+
+func RequestIdFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIdCtx{}).(string)
+	return id
+}
+
+// RequestId propagates X-Request-ID header or generates new id for the request.
+// The id is echoed in response and bound to request context for logging.
+func RequestId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(HEADER_REQUEST_ID)
+		if id == "" {
+			id = NewRequestId()
+		}
+		c.Set(CONTEXT_REQUEST_ID, id)
+		c.Header(HEADER_REQUEST_ID, id)
+		c.Request = c.Request.WithContext(ContextWithRequestId(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+func NewRequestId() string {
+	b := make([]byte, REQUEST_ID_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func GetRequestId(c *gin.Context) string {
+	return c.GetString(CONTEXT_REQUEST_ID)
+}
+
+type requestIdHook struct{}
+
+func (requestIdHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	if id := RequestIdFromContext(e.GetCtx()); id != "" {
+		e.Str(LOG_FIELD_REQUEST_ID, id)
+	}
+}
+
+// AccessLog replaces gin text logger, it writes one record per request after it is handled.
+// Server errors are logged with error level, client errors with warn level.
+func AccessLog(log zerolog.Logger) gin.HandlerFunc {
+	log = componentLogger(log, "http")
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		code := c.Writer.Status()
+		level := zerolog.InfoLevel
+		switch {
+		case code >= 500:
+			level = zerolog.ErrorLevel
+		case code >= 400:
+			level = zerolog.WarnLevel
+		}
+		log.WithLevel(level).
+			Ctx(c.Request.Context()).
+			Str("method", c.Request.Method).
+			Str("route", c.FullPath()).
+			Str("path", c.Request.URL.Path).
+			Int("code", code).
+			Int("size", c.Writer.Size()).
+			Str("client_ip", c.ClientIP()).
+			Dur("latency", time.Since(start)).
+			Msg("request")
+	}
+}
+
+// grpcRequestId propagates x-request-id metadata or generates new id, the id is sent back in header.
+func grpcRequestId(ctx context.Context) (context.Context, string) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := NewRequestId()
+	if ids := md.Get(HEADER_REQUEST_ID); len(ids) > 0 && ids[0] != "" {
+		id = ids[0]
+	}
+	return ContextWithRequestId(ctx, id), id
+}
+
+// logUnary and logStream bind request id to call context and write access record of the call.
+func logUnary(log zerolog.Logger) grpc.UnaryServerInterceptor {
+	log = componentLogger(log, "grpc")
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, id := grpcRequestId(ctx)
+		grpc.SetHeader(ctx, metadata.Pairs(HEADER_REQUEST_ID, id))
+		start := time.Now()
+		res, err := handler(ctx, req)
+		logGrpcCall(ctx, log, info.FullMethod, start, err)
+		return res, err
+	}
+}
+
+func logStream(log zerolog.Logger) grpc.StreamServerInterceptor {
+	log = componentLogger(log, "grpc")
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, id := grpcRequestId(stream.Context())
+		stream.SetHeader(metadata.Pairs(HEADER_REQUEST_ID, id))
+		start := time.Now()
+		err := handler(srv, &contextStream{stream, ctx})
+		logGrpcCall(ctx, log, info.FullMethod, start, err)
+		return err
+	}
+}
+
+func logGrpcCall(ctx context.Context, log zerolog.Logger, method string, start time.Time, err error) {
+	level := zerolog.InfoLevel
+	if err != nil {
+		level = zerolog.WarnLevel
+	}
+	log.WithLevel(level).
+		Ctx(ctx).
+		Str("method", method).
+		Str("code", status.Code(err).String()).
+		Dur("latency", time.Since(start)).
+		Msg("request")
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	URL_METRICS string = "/metrics"
+
+	METRICS_NAMESPACE string = "balance"
+
+	METRICS_TRANSPORT_HTTP string = "http"
+	METRICS_TRANSPORT_GRPC string = "grpc"
+
+	METRICS_ROUTE_UNMATCHED string = "unmatched"
+
+	METRICS_RESULT_OK    string = "ok"
+	METRICS_RESULT_ERROR string = "error"
+)
+
+var (
+	// METRICS_REGISTRY holds service metrics exposed on /metrics.
+	METRICS_REGISTRY = prometheus.NewRegistry()
+
+	// OPERATION_NAMES labels ledger operations and advisory locks in metrics.
+	OPERATION_NAMES = map[int]string{
+		OPERATION_INCOME_CODE:     "income",
+		OPERATION_OUTCOME_CODE:    "outcome",
+		OPERATION_ADJUSTMENT_CODE: "adjustment",
+		LEDGER_CHAIN_LOCK:         "chain",
+	}
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	operationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "operation_errors_total",
+		Help:      "Errors returned to clients by OperationError code.",
+	}, []string{"code", "transport"})
+	ledgerOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "ledger_operations_total",
+		Help:      "Ledger writes by operation and result.",
+	}, []string{"operation", "result"})
+	lockWaitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "advisory_lock_wait_seconds",
+		Help:      "Time spent waiting on pg_advisory_xact_lock.",
+		Buckets:   []float64{.001, .005, .01, .05, .1, .5, 1, 2.5, 5, 10},
+	}, []string{"lock"})
+	lockTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "advisory_lock_timeouts_total",
+		Help:      "Advisory lock waits aborted by lock_timeout.",
+	}, []string{"lock"})
+	transactionRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "serializable_retries_total",
+		Help:      "Ledger transactions retried after serialization failure.",
+	})
+	currencyRequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "currency_request_duration_seconds",
+		Help:      "Currency rates provider latency.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	currencyErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "currency_errors_total",
+		Help:      "Failed currency rate requests by reason.",
+	}, []string{"reason"})
+	viewRefreshDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "view_refresh_duration_seconds",
+		Help:      "Duration of transactions_sum_order refresh.",
+		Buckets:   []float64{.1, .5, 1, 5, 10, 30, 60, 120, 300},
+	}, []string{"result"})
+)
+
+func init() {
+	METRICS_REGISTRY.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestDuration,
+		operationErrors,
+		ledgerOperations,
+		lockWaitDuration,
+		lockTimeouts,
+		transactionRetries,
+		currencyRequestDuration,
+		currencyErrors,
+		viewRefreshDuration,
+	)
+}
+
+// HttpMetrics observes request latency. Route is the registered path template,
+// so path parameters do not multiply series.
+func HttpMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = METRICS_ROUTE_UNMATCHED
+		}
+		httpRequestDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+	}
+}
+
+func Metrics() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(METRICS_REGISTRY, promhttp.HandlerOpts{}))
+}
+
+func observeOperationError(code int, transport string) {
+	operationErrors.WithLabelValues(strconv.Itoa(code), transport).Inc()
+}
+
+func observeLedgerOperation(oCode int, err error) {
+	result := METRICS_RESULT_OK
+	if err != nil {
+		result = METRICS_RESULT_ERROR
+	}
+	ledgerOperations.WithLabelValues(operationName(oCode), result).Inc()
+}
+
+func observeLockWait(oCode int, start time.Time, timedOut bool) {
+	lockWaitDuration.WithLabelValues(operationName(oCode)).Observe(time.Since(start).Seconds())
+	if timedOut {
+		lockTimeouts.WithLabelValues(operationName(oCode)).Inc()
+	}
+}
+
+func observeTransactionRetry() {
+	transactionRetries.Inc()
+}
+
+func observeCurrencyRequest(start time.Time, err error) {
+	currencyRequestDuration.Observe(time.Since(start).Seconds())
+	if err == nil {
+		return
+	}
+	reason := METRICS_RESULT_ERROR
+	var opErr *OperationError
+	if errors.As(err, &opErr) {
+		reason = strconv.Itoa(opErr.Code)
+	}
+	currencyErrors.WithLabelValues(reason).Inc()
+}
+
+func observeViewRefresh(start time.Time, err error) {
+	result := METRICS_RESULT_OK
+	if err != nil {
+		result = METRICS_RESULT_ERROR
+	}
+	viewRefreshDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+func operationName(oCode int) string {
+	if name, ok := OPERATION_NAMES[oCode]; ok {
+		return name
+	}
+	return strconv.Itoa(oCode)
+}
+
+// PoolCollector exports pgxpool statistics on every scrape.
+type PoolCollector struct {
+	pool *pgxpool.Pool
+
+	acquiredConns     *prometheus.Desc
+	idleConns         *prometheus.Desc
+	constructingConns *prometheus.Desc
+	totalConns        *prometheus.Desc
+	maxConns          *prometheus.Desc
+	acquireCount      *prometheus.Desc
+	acquireDuration   *prometheus.Desc
+	canceledAcquires  *prometheus.Desc
+	emptyAcquires     *prometheus.Desc
+}
+
+func NewPoolCollector(pool *pgxpool.Pool) *PoolCollector {
+	desc := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(METRICS_NAMESPACE, "db_pool", name), help, nil, nil)
+	}
+	return &PoolCollector{
+		pool:              pool,
+		acquiredConns:     desc("acquired_conns", "Connections currently in use."),
+		idleConns:         desc("idle_conns", "Idle connections."),
+		constructingConns: desc("constructing_conns", "Connections being established."),
+		totalConns:        desc("total_conns", "Total connections in the pool."),
+		maxConns:          desc("max_conns", "Maximum pool size."),
+		acquireCount:      desc("acquires_total", "Successful connection acquires."),
+		acquireDuration:   desc("acquire_duration_seconds_total", "Total time spent acquiring connections."),
+		canceledAcquires:  desc("canceled_acquires_total", "Acquires canceled by context."),
+		emptyAcquires:     desc("empty_acquires_total", "Acquires that waited for a connection because the pool was empty."),
+	}
+}
+
+func (pc *PoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pc.acquiredConns
+	ch <- pc.idleConns
+	ch <- pc.constructingConns
+	ch <- pc.totalConns
+	ch <- pc.maxConns
+	ch <- pc.acquireCount
+	ch <- pc.acquireDuration
+	ch <- pc.canceledAcquires
+	ch <- pc.emptyAcquires
+}
+
+func (pc *PoolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := pc.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(pc.acquiredConns, prometheus.GaugeValue, float64(s.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(pc.idleConns, prometheus.GaugeValue, float64(s.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(pc.constructingConns, prometheus.GaugeValue, float64(s.ConstructingConns()))
+	ch <- prometheus.MustNewConstMetric(pc.totalConns, prometheus.GaugeValue, float64(s.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(pc.maxConns, prometheus.GaugeValue, float64(s.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(pc.acquireCount, prometheus.CounterValue, float64(s.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(pc.acquireDuration, prometheus.CounterValue, s.AcquireDuration().Seconds())
+	ch <- prometheus.MustNewConstMetric(pc.canceledAcquires, prometheus.CounterValue, float64(s.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(pc.emptyAcquires, prometheus.CounterValue, float64(s.EmptyAcquireCount()))
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rs/zerolog"
+)
+
+const (
+	MIGRATIONS_DIR string = "migrations"
+
+	MIGRATION_UP   string = "up"
+	MIGRATION_DOWN string = "down"
+
+	MIGRATION_STATE_APPLIED string = "applied"
+	MIGRATION_STATE_PENDING string = "pending"
+	// MIGRATION_STATE_UNKNOWN marks version applied by newer binary, it has no migration here.
+	MIGRATION_STATE_UNKNOWN string = "unknown"
+
+	// MIGRATION_LOCK is a single bigint advisory lock key, it does not collide
+	// with (account, operation) locks which use two int keys.
+	MIGRATION_LOCK int64 = 0x62616c616e6365
+
+	CREATE_SCHEMA_MIGRATIONS        string = "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied BIGINT NOT NULL DEFAULT EXTRACT(EPOCH FROM (now() AT TIME ZONE 'UTC')))"
+	SELECT_SCHEMA_VERSION           string = "SELECT COALESCE(MAX(version), 0) FROM schema_migrations"
+	SELECT_SCHEMA_MIGRATIONS        string = "SELECT version, applied FROM schema_migrations ORDER BY version"
+	SELECT_SCHEMA_MIGRATIONS_EXISTS string = "SELECT to_regclass('schema_migrations') IS NOT NULL"
+	INSERT_SCHEMA_MIGRATION         string = "INSERT INTO schema_migrations(version) VALUES ($1)"
+	DELETE_SCHEMA_MIGRATION         string = "DELETE FROM schema_migrations WHERE version = $1"
+	SELECT_MIGRATION_LOCK           string = "SELECT pg_advisory_lock($1)"
+	SELECT_MIGRATION_UNLOCK         string = "SELECT pg_advisory_unlock($1)"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+var (
+	MIGRATIONS = withMigrationHooks(MustLoadMigrations(migrationsFS, MIGRATIONS_DIR), migrationHooks)
+
+	// migrationHooks backfill data of embedded migrations by version.
+	migrationHooks = map[int]MigrationHook{1: backfillChainHashes}
+
+	migrationFileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+	ErrSchemaPending = errors.New("schema has pending migrations")
+	ErrSchemaUnknown = errors.New("schema version is unknown")
+)
+
+// Migration is a numbered schema change. Up and Down run in one transaction with
+// the schema_migrations update, so a failed migration leaves no trace.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// AfterUp runs after Up in the same transaction, for data changes SQL can not compute.
+	AfterUp MigrationHook
+}
+
+type MigrationHook func(ctx context.Context, tx pgx.Tx) error
+
+type MigrationStatus struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	State   string `json:"state"`
+	Applied int64  `json:"applied"`
+}
+
+// LoadMigrations reads <version>_<name>.up.sql and .down.sql pairs from dir.
+// Versions should go from 1 without gaps.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, f := range files {
+		m := migrationFileName.FindStringSubmatch(path.Base(f))
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: name should be <version>_<name>.up.sql or .down.sql", f)
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, err
+		}
+		mg, ok := byVersion[version]
+		if !ok {
+			mg = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mg
+		}
+		if mg.Name != m[2] {
+			return nil, fmt.Errorf("migration %d: names %q and %q differ", version, mg.Name, m[2])
+		}
+		if m[3] == MIGRATION_UP {
+			mg.Up = string(data)
+		} else {
+			mg.Down = string(data)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mg := range byVersion {
+		migrations = append(migrations, *mg)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, mg := range migrations {
+		if mg.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+		if mg.Up == "" || mg.Down == "" {
+			return nil, fmt.Errorf("migration %d %s: both up and down are required", mg.Version, mg.Name)
+		}
+	}
+	return migrations, nil
+}
+
+func MustLoadMigrations(fsys fs.FS, dir string) []Migration {
+	migrations, err := LoadMigrations(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return migrations
+}
+
+func withMigrationHooks(migrations []Migration, hooks map[int]MigrationHook) []Migration {
+	for i := range migrations {
+		migrations[i].AfterUp = hooks[migrations[i].Version]
+	}
+	return migrations
+}
+
+// SchemaVersion is the latest embedded migration, the server works only with this version.
+func SchemaVersion() int {
+	return MIGRATIONS[len(MIGRATIONS)-1].Version
+}
+
+// Migrator applies migrations under session advisory lock, concurrent runners wait for each other
+// and then see migrations already applied.
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+	log        zerolog.Logger
+}
+
+func NewMigrator(db *Database, migrations []Migration, log zerolog.Logger) *Migrator {
+	return &Migrator{db.Conn, migrations, componentLogger(log, "migrator")}
+}
+
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies all pending migrations in version order and returns them.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if v := m.unknown(applied); v != 0 {
+			return fmt.Errorf("%w: %d, latest known is %d", ErrSchemaUnknown, v, m.Latest())
+		}
+		for _, mg := range m.migrations {
+			if _, ok := applied[mg.Version]; ok {
+				continue
+			}
+			if err := m.run(ctx, conn, mg.Up, mg.AfterUp, INSERT_SCHEMA_MIGRATION, mg.Version); err != nil {
+				return fmt.Errorf("migration %d %s up: %w", mg.Version, mg.Name, err)
+			}
+			m.log.Info().Int("version", mg.Version).Str("name", mg.Name).Msg("migration applied")
+			done = append(done, mg)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts up to steps latest applied migrations and returns them.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if v := m.unknown(applied); v != 0 {
+			return fmt.Errorf("%w: %d, it can be reverted only by the binary which applied it", ErrSchemaUnknown, v)
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			mg := m.migrations[i]
+			if _, ok := applied[mg.Version]; !ok {
+				continue
+			}
+			if err := m.run(ctx, conn, mg.Down, nil, DELETE_SCHEMA_MIGRATION, mg.Version); err != nil {
+				return fmt.Errorf("migration %d %s down: %w", mg.Version, mg.Name, err)
+			}
+			m.log.Info().Int("version", mg.Version).Str("name", mg.Name).Msg("migration reverted")
+			done = append(done, mg)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status lists known migrations and versions applied by unknown migrations.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	list := []MigrationStatus{}
+	for _, mg := range m.migrations {
+		st := MigrationStatus{Version: mg.Version, Name: mg.Name, State: MIGRATION_STATE_PENDING}
+		if date, ok := applied[mg.Version]; ok {
+			st.State, st.Applied = MIGRATION_STATE_APPLIED, date
+		}
+		list = append(list, st)
+	}
+	for v, date := range applied {
+		if v > m.Latest() {
+			list = append(list, MigrationStatus{Version: v, State: MIGRATION_STATE_UNKNOWN, Applied: date})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Version < list[j].Version
+	})
+	return list, nil
+}
+
+// Check fails with ErrSchemaPending or ErrSchemaUnknown unless every known migration is applied
+// and there are no others. The server refuses to start on such schema.
+func (m *Migrator) Check(ctx context.Context) error {
+	list, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, st := range list {
+		switch st.State {
+		case MIGRATION_STATE_UNKNOWN:
+			return fmt.Errorf("%w: %d, latest known is %d", ErrSchemaUnknown, st.Version, m.Latest())
+		case MIGRATION_STATE_PENDING:
+			return fmt.Errorf("%w: %d %s, run migrate up", ErrSchemaPending, st.Version, st.Name)
+		}
+	}
+	return nil
+}
+
+// locked runs actn on dedicated connection holding MIGRATION_LOCK.
+func (m *Migrator) locked(ctx context.Context, actn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, SELECT_MIGRATION_LOCK, MIGRATION_LOCK); err != nil {
+		return contextErrorOr(ctx, err)
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), SELECT_MIGRATION_UNLOCK, MIGRATION_LOCK); err != nil {
+			m.log.Warn().Err(err).Msg("migration unlock failed")
+		}
+	}()
+	if _, err := conn.Exec(ctx, CREATE_SCHEMA_MIGRATIONS); err != nil {
+		return err
+	}
+	return actn(conn)
+}
+
+// applied returns application time of applied versions. Missing table means nothing is applied.
+func (m *Migrator) applied(ctx context.Context, conn *pgxpool.Conn) (map[int]int64, error) {
+	applied := map[int]int64{}
+	var exists bool
+	if err := conn.QueryRow(ctx, SELECT_SCHEMA_MIGRATIONS_EXISTS).Scan(&exists); err != nil || !exists {
+		return applied, err
+	}
+	rows, err := conn.Query(ctx, SELECT_SCHEMA_MIGRATIONS)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v int
+		var date int64
+		if err := rows.Scan(&v, &date); err != nil {
+			return nil, err
+		}
+		applied[v] = date
+	}
+	return applied, rows.Err()
+}
+
+// unknown returns the latest applied version which has no migration, 0 if there is none.
+func (m *Migrator) unknown(applied map[int]int64) int {
+	latest := 0
+	for v := range applied {
+		if v > m.Latest() && v > latest {
+			latest = v
+		}
+	}
+	return latest
+}
+
+func (m *Migrator) run(ctx context.Context, conn *pgxpool.Conn, sql string, hook MigrationHook, record string, version int) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(context.Background()); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			m.log.Warn().Err(err).Msg("migration rollback failed")
+		}
+	}()
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return err
+	}
+	if hook != nil {
+		if err := hook(ctx, tx); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ctx, record, version); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,7 @@
+-- The first migration adopts tables of databases created by the old sql/init.sql, so they may hold
+-- the ledger and the admin audit which must not be lost. It is never reverted, drop the schema by hand instead.
+DO $$
+BEGIN
+	RAISE EXCEPTION 'migration 1 init is not reversible: it would drop the ledger and the admin audit';
+END;
+$$;
@@ -0,0 +1,72 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(128) NOT NULL DEFAULT '',
+	hash CHAR(64) NOT NULL UNIQUE,
+	scopes TEXT[] NOT NULL,
+	accounts INTEGER[] NOT NULL DEFAULT '{}',
+	created BIGINT NOT NULL DEFAULT EXTRACT(EPOCH FROM (now() AT TIME ZONE 'UTC')),
+	revoked BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS transactions (
+	id SERIAL PRIMARY KEY,
+	account INTEGER NOT NULL CHECK (account > 0),
+	operation INTEGER NOT NULL DEFAULT 0,
+	description VARCHAR(256) NOT NULL DEFAULT '',
+	sum NUMERIC(16, 2) NOT NULL,
+	date BIGINT NOT NULL DEFAULT EXTRACT(EPOCH FROM (now() AT TIME ZONE 'UTC'))
+);
+-- Tables created by the old sql/init.sql have no key and chain columns, hashes of existing rows
+-- are backfilled by the migration hook.
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS key_id INTEGER REFERENCES api_keys(id);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS prev_hash VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS hash VARCHAR(64) NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS transaction_account ON transactions(account);
+CREATE INDEX IF NOT EXISTS transaction_account_date ON transactions(account, date);
+CREATE INDEX IF NOT EXISTS transactions_account_sum ON transactions(account, sum);
+CREATE INDEX IF NOT EXISTS transactions_account_sum_date ON transactions(account, sum, date);
+CREATE INDEX IF NOT EXISTS transactions_key_id ON transactions(key_id);
+CREATE INDEX IF NOT EXISTS transactions_account_id ON transactions(account, id);
+
+CREATE TABLE IF NOT EXISTS frozen_accounts (
+	account INTEGER PRIMARY KEY CHECK (account > 0),
+	reason TEXT NOT NULL,
+	actor VARCHAR(256) NOT NULL,
+	date BIGINT NOT NULL DEFAULT EXTRACT(EPOCH FROM (now() AT TIME ZONE 'UTC'))
+);
+
+CREATE TABLE IF NOT EXISTS admin_audit (
+	id SERIAL PRIMARY KEY,
+	actor VARCHAR(256) NOT NULL,
+	action VARCHAR(32) NOT NULL,
+	account INTEGER NOT NULL,
+	before JSONB NOT NULL,
+	after JSONB NOT NULL,
+	reason TEXT NOT NULL CHECK (reason <> ''),
+	date BIGINT NOT NULL DEFAULT EXTRACT(EPOCH FROM (now() AT TIME ZONE 'UTC'))
+);
+CREATE INDEX IF NOT EXISTS admin_audit_account ON admin_audit(account, id);
+
+CREATE TABLE IF NOT EXISTS rate_limits (
+	key VARCHAR(512) PRIMARY KEY,
+	tokens DOUBLE PRECISION NOT NULL,
+	updated DOUBLE PRECISION NOT NULL,
+	allowed BOOLEAN NOT NULL
+);
+CREATE INDEX IF NOT EXISTS rate_limits_updated ON rate_limits(updated);
+
+CREATE OR REPLACE FUNCTION admin_audit_append_only() RETURNS TRIGGER AS $$
+BEGIN
+	RAISE EXCEPTION 'admin_audit is append-only';
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS admin_audit_no_update ON admin_audit;
+CREATE TRIGGER admin_audit_no_update BEFORE UPDATE OR DELETE ON admin_audit FOR EACH ROW EXECUTE PROCEDURE admin_audit_append_only();
+DROP TRIGGER IF EXISTS admin_audit_no_truncate ON admin_audit;
+CREATE TRIGGER admin_audit_no_truncate BEFORE TRUNCATE ON admin_audit FOR EACH STATEMENT EXECUTE PROCEDURE admin_audit_append_only();
+
+-- The view is recreated, so the one left by the old sql/init.sql gets current definition and indexes.
+DROP MATERIALIZED VIEW IF EXISTS transactions_sum_order;
+CREATE MATERIALIZED VIEW transactions_sum_order AS (WITH p AS (SELECT id AS id, row_number() OVER (ORDER BY sum DESC) AS pager FROM transactions) SELECT * FROM p ORDER BY p.pager ASC);
+CREATE UNIQUE INDEX transactions_sum_order_pager ON transactions_sum_order(pager);
+CREATE INDEX transactions_sum_order_account_date ON transactions_sum_order(id, pager);
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS accounts (
+	id INTEGER PRIMARY KEY CHECK (id > 0)
+);
+INSERT INTO accounts(id) SELECT DISTINCT account FROM transactions ON CONFLICT DO NOTHING;
@@ -0,0 +1,495 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	URL_OPENAPI string = "/openapi.json"
+
+	OPENAPI_VERSION     string = "3.0.3"
+	OPENAPI_TITLE       string = "Balance server API"
+	OPENAPI_API_VERSION string = "1.0.0"
+	OPENAPI_SCHEMA_REF  string = "#/components/schemas/"
+
+	OPENAPI_SECURITY_API_KEY string = "ApiKey"
+	OPENAPI_SECURITY_BEARER  string = "Bearer"
+)
+
+// ApiRoute describes route for OpenAPI document. Uri, Query and Request are the structs
+// the handler binds, tests check handlers bind exactly them.
+type ApiRoute struct {
+	Method     string
+	Path       string
+	Summary    string
+	Uri        interface{}
+	Query      interface{}
+	Request    interface{}
+	Response   interface{}
+	Errors     []int
+	Scopes     []string
+	Signed     bool
+	Cached     bool
+	Deprecated bool
+}
+
+var (
+	API_ROUTES = []ApiRoute{
+		{
+			Method:     http.MethodGet,
+			Path:       URL_BALANCE,
+			Summary:    "User balance",
+			Request:    BalanceRequest{},
+			Response:   float64(0),
+			Errors:     []int{ERROR_WRONG_REQUEST, ERROR_UNAUTHORIZED, ERROR_FORBIDDEN, ERROR_RATE_LIMITED, ERROR_ACCOUNT_MISMATCH, ERROR_BALANCE_WRONG_CURRENCY_CODE, ERROR_NO_BALANCE, ERROR_REQUEST_TIMEOUT, ERROR_NOT_READY, ERROR_INTERNAL},
+			Scopes:     []string{SCOPE_BALANCE_READ},
+			Cached:     true,
+			Deprecated: true,
+		},
+		{
+			Method:   http.MethodPost,
+			Path:     URL_TRANSACTION,
+			Summary:  "Credit or debit user account",
+			Request:  TransactionRequest{},
+			Response: "",
+			Errors:   []int{ERROR_WRONG_REQUEST, ERROR_UNAUTHORIZED, ERROR_FORBIDDEN, ERROR_RATE_LIMITED, ERROR_SIGNATURE_MISSING, ERROR_SIGNATURE_UNKNOWN_PARTNER, ERROR_SIGNATURE_STALE, ERROR_SIGNATURE_NONCE_REUSED, ERROR_SIGNATURE_INVALID, ERROR_NOT_ENOUGH_MONEY, ERROR_ACCOUNT_FROZEN, ERROR_LOCK_TIMEOUT, ERROR_TRANSACTION_CONFLICT, ERROR_DUPLICATE, ERROR_CONSTRAINT_VIOLATION, ERROR_REQUEST_TIMEOUT, ERROR_NOT_READY, ERROR_INTERNAL},
+			Scopes:   []string{SCOPE_TRANSACTION_CREDIT, SCOPE_TRANSACTION_DEBIT},
+			Signed:   true,
+		},
+		{
+			Method:   http.MethodPost,
+			Path:     URL_TRANSFER,
+			Summary:  "Transfer money between users",
+			Request:  SendRequest{},
+			Response: "",
+			Errors:   []int{ERROR_WRONG_REQUEST, ERROR_UNAUTHORIZED, ERROR_FORBIDDEN, ERROR_RATE_LIMITED, ERROR_ACCOUNT_MISMATCH, ERROR_SIGNATURE_MISSING, ERROR_SIGNATURE_UNKNOWN_PARTNER, ERROR_SIGNATURE_STALE, ERROR_SIGNATURE_NONCE_REUSED, ERROR_SIGNATURE_INVALID, ERROR_NOT_ENOUGH_MONEY, ERROR_ACCOUNT_FROZEN, ERROR_LOCK_TIMEOUT, ERROR_TRANSACTION_CONFLICT, ERROR_DUPLICATE, ERROR_CONSTRAINT_VIOLATION, ERROR_REQUEST_TIMEOUT, ERROR_NOT_READY, ERROR_INTERNAL},
+			Scopes:   []string{SCOPE_TRANSFER},
+			Signed:   true,
+		},
+		{
+			Method:     http.MethodGet,
+			Path:       URL_TRANSACTIONS,
+			Summary:    "User transactions history",
+			Request:    TransactionsRequest{},
+			Response:   TransactionsData{},
+			Errors:     []int{ERROR_WRONG_REQUEST, ERROR_UNAUTHORIZED, ERROR_FORBIDDEN, ERROR_RATE_LIMITED, ERROR_ACCOUNT_MISMATCH, ERROR_TRANSACTIONS_WRONG_SORT, ERROR_TRANSACTIONS_WRONG_PAGE, ERROR_REQUEST_TIMEOUT, ERROR_NOT_READY, ERROR_INTERNAL},
+			Scopes:     []string{SCOPE_TRANSACTIONS_READ},
+			Deprecated: true,
+		},
+		{
+			Method:   http.MethodGet,
+			Path:     URL_ACCOUNT_BALANCE,
+			Summary:  "User balance",
+			Uri:      AccountUri{},
+			Query:    BalanceQuery{},
+			Response: float64(0),
+			Errors:   []int{ERROR_WRONG_REQUEST, ERROR_UNAUTHORIZED, ERROR_FORBIDDEN, ERROR_RATE_LIMITED, ERROR_ACCOUNT_MISMATCH, ERROR_BALANCE_WRONG_CURRENCY_CODE, ERROR_NO_BALANCE, ERROR_REQUEST_TIMEOUT, ERROR_NOT_READY, ERROR_INTERNAL},
+			Scopes:   []string{SCOPE_BALANCE_READ},
+			Cached:   true,
+		},
+		{
+			Method:   http.MethodGet,
+			Path:     URL_ACCOUNT_TRANSACTIONS,
+			Summary:  "User transactions history",
+			Uri:      AccountUri{},
+			Query:    TransactionsQuery{},
+			Response: TransactionsData{},
+			Errors:   []int{ERROR_WRONG_REQUEST, ERROR_UNAUTHORIZED, ERROR_FORBIDDEN, ERROR_RATE_LIMITED, ERROR_ACCOUNT_MISMATCH, ERROR_TRANSACTIONS_WRONG_SORT, ERROR_TRANSACTIONS_WRONG_PAGE, ERROR_REQUEST_TIMEOUT, ERROR_NOT_READY, ERROR_INTERNAL},
+			Scopes:   []string{SCOPE_TRANSACTIONS_READ},
+		},
+		{
+			Method:   http.MethodGet,
+			Path:     URL_ADMIN_TRANSACTIONS,
+			Summary:  "Search transactions across accounts",
+			Query:    AdminTransactionsQuery{},
+			Response: AdminTransactionsData{},
+			Errors:   []int{ERROR_WRONG_REQUEST, ERROR_UNAUTHORIZED, ERROR_FORBIDDEN, ERROR_RATE_LIMITED, ERROR_REQUEST_TIMEOUT, ERROR_NOT_READY, ERROR_INTERNAL},
+			Scopes:   []string{SCOPE_ADMIN_TRANSACTIONS_READ},
+		},
+		{
+			Method:   http.MethodPost,
+			Path:     URL_ADMIN_ADJUSTMENTS,
+			Summary:  "Post balance adjustment",
+			Request:  AdjustmentRequest{},
+			Response: AuditRecord{},
+			Errors:   []int{ERROR_WRONG_REQUEST, ERROR_UNAUTHORIZED, ERROR_FORBIDDEN, ERROR_RATE_LIMITED, ERROR_NOT_ENOUGH_MONEY, ERROR_ACCOUNT_FROZEN, ERROR_LOCK_TIMEOUT, ERROR_TRANSACTION_CONFLICT, ERROR_DUPLICATE, ERROR_CONSTRAINT_VIOLATION, ERROR_REQUEST_TIMEOUT, ERROR_NOT_READY, ERROR_INTERNAL},
+			Scopes:   []string{SCOPE_ADMIN_ADJUST},
+		},
+		{
+			Method:   http.MethodPost,
+			Path:     URL_ADMIN_FREEZE,
+			Summary:  "Freeze account debits",
+			Uri:      AccountUri{},
+			Request:  FreezeRequest{},
+			Response: AuditRecord{},
+			Errors:   []int{ERROR_WRONG_REQUEST, ERROR_UNAUTHORIZED, ERROR_FORBIDDEN, ERROR_RATE_LIMITED, ERROR_STATE_UNCHANGED, ERROR_LOCK_TIMEOUT, ERROR_TRANSACTION_CONFLICT, ERROR_DUPLICATE, ERROR_CONSTRAINT_VIOLATION, ERROR_REQUEST_TIMEOUT, ERROR_NOT_READY, ERROR_INTERNAL},
+			Scopes:   []string{SCOPE_ADMIN_FREEZE},
+		},
+		{
+			Method:   http.MethodPost,
+			Path:     URL_ADMIN_UNFREEZE,
+			Summary:  "Unfreeze account debits",
+			Uri:      AccountUri{},
+			Request:  FreezeRequest{},
+			Response: AuditRecord{},
+			Errors:   []int{ERROR_WRONG_REQUEST, ERROR_UNAUTHORIZED, ERROR_FORBIDDEN, ERROR_RATE_LIMITED, ERROR_STATE_UNCHANGED, ERROR_LOCK_TIMEOUT, ERROR_TRANSACTION_CONFLICT, ERROR_DUPLICATE, ERROR_CONSTRAINT_VIOLATION, ERROR_REQUEST_TIMEOUT, ERROR_NOT_READY, ERROR_INTERNAL},
+			Scopes:   []string{SCOPE_ADMIN_FREEZE},
+		},
+		{
+			Method:   http.MethodGet,
+			Path:     URL_ADMIN_AUDIT,
+			Summary:  "Admin audit log",
+			Query:    AuditQuery{},
+			Response: AuditData{},
+			Errors:   []int{ERROR_WRONG_REQUEST, ERROR_UNAUTHORIZED, ERROR_FORBIDDEN, ERROR_RATE_LIMITED, ERROR_REQUEST_TIMEOUT, ERROR_NOT_READY, ERROR_INTERNAL},
+			Scopes:   []string{SCOPE_ADMIN_AUDIT_READ},
+		},
+		{
+			Method:   http.MethodGet,
+			Path:     URL_ADMIN_LEDGER_VERIFY,
+			Summary:  "Verify ledger hash chain",
+			Query:    LedgerQuery{},
+			Response: ChainReport{},
+			Errors:   []int{ERROR_WRONG_REQUEST, ERROR_UNAUTHORIZED, ERROR_FORBIDDEN, ERROR_RATE_LIMITED, ERROR_REQUEST_TIMEOUT, ERROR_NOT_READY, ERROR_INTERNAL},
+			Scopes:   []string{SCOPE_ADMIN_AUDIT_READ},
+		},
+		{
+			Method:   http.MethodGet,
+			Path:     URL_ADMIN_CONFIG,
+			Summary:  "Effective server config, secrets are redacted",
+			Response: Config{},
+			Errors:   []int{ERROR_UNAUTHORIZED, ERROR_FORBIDDEN, ERROR_RATE_LIMITED, ERROR_REQUEST_TIMEOUT, ERROR_NOT_READY, ERROR_INTERNAL},
+			Scopes:   []string{SCOPE_ADMIN_CONFIG_READ},
+		},
+	}
+)
+
+// OpenApiSpec builds OpenAPI 3 document from API_ROUTES request and response types.
+func OpenApiSpec(routes []ApiRoute, er ExpectedResultI) map[string]interface{} {
+	schemas := map[string]interface{}{
+		"Result": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"status", "data"},
+			"properties": map[string]interface{}{
+				"status": map[string]interface{}{"type": "integer"},
+				"data":   map[string]interface{}{},
+			},
+		},
+	}
+	paths := map[string]interface{}{}
+	for _, route := range routes {
+		specPath := uriTemplate(route.Path)
+		path, ok := paths[specPath].(map[string]interface{})
+		if !ok {
+			path = map[string]interface{}{}
+			paths[specPath] = path
+		}
+		path[strings.ToLower(route.Method)] = openApiOperation(route, er, schemas)
+	}
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]interface{}{
+			"title":   OPENAPI_TITLE,
+			"version": OPENAPI_API_VERSION,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				OPENAPI_SECURITY_API_KEY: map[string]interface{}{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        HEADER_AUTHORIZATION,
+					"description": "API key passed as \"" + AUTH_SCHEME_API_KEY + " <secret>\"",
+				},
+				OPENAPI_SECURITY_BEARER: map[string]interface{}{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+					"description":  "Account owner token, grants " + strings.Join(JWT_SCOPES, ", ") + " on own account",
+				},
+			},
+		},
+	}
+}
+
+func OpenApi(c *gin.Context) {
+	c.JSON(200, OpenApiSpec(API_ROUTES, &AccountExpectedResult))
+}
+
+func openApiOperation(route ApiRoute, er ExpectedResultI, schemas map[string]interface{}) map[string]interface{} {
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "Operation completed",
+			"content":     openApiResultContent(openApiSchema(reflect.TypeOf(route.Response), schemas), nil),
+		},
+	}
+	codes := map[int][]int{}
+	for _, code := range route.Errors {
+		httpCode := er.GetHttpCode(code)
+		codes[httpCode] = append(codes[httpCode], code)
+	}
+	for httpCode, opCodes := range codes {
+		descs := make([]string, 0, len(opCodes))
+		retryable := false
+		for _, code := range opCodes {
+			descs = append(descs, strconv.Itoa(code)+": "+openApiErrorStatus(code, er))
+			retryable = retryable || er.GetError(code).Retryable
+		}
+		content := openApiResultContent(openApiErrorData(opCodes, schemas), opCodes)
+		content[MIME_PROBLEM_JSON] = map[string]interface{}{
+			"schema": openApiSchema(reflect.TypeOf(Problem{}), schemas),
+		}
+		response := map[string]interface{}{
+			"description": strings.Join(descs, "; "),
+			"content":     content,
+		}
+		if retryable {
+			response["headers"] = map[string]interface{}{
+				HEADER_RETRY_AFTER: map[string]interface{}{
+					"description": "Seconds to wait before retrying the request",
+					"schema":      map[string]interface{}{"type": "integer"},
+				},
+			}
+		}
+		responses[strconv.Itoa(httpCode)] = response
+	}
+	params := []interface{}{}
+	if route.Uri != nil {
+		params = append(params, openApiParameters(reflect.TypeOf(route.Uri), "uri", "path", schemas)...)
+	}
+	if route.Query != nil {
+		params = append(params, openApiParameters(reflect.TypeOf(route.Query), "form", "query", schemas)...)
+	}
+	if route.Signed {
+		for _, h := range []string{HEADER_SIGNATURE, HEADER_SIGNATURE_TIMESTAMP, HEADER_SIGNATURE_NONCE} {
+			params = append(params, map[string]interface{}{
+				"name":        h,
+				"in":          "header",
+				"description": "Required for partners with signing secret",
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	if route.Cached {
+		params = append(params, map[string]interface{}{
+			"name":   HEADER_IF_NONE_MATCH,
+			"in":     "header",
+			"schema": map[string]interface{}{"type": "string"},
+		})
+		responses["304"] = map[string]interface{}{"description": "Not modified"}
+	}
+	op := map[string]interface{}{
+		"summary":     route.Summary,
+		"operationId": openApiOperationId(route),
+		"responses":   responses,
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	var descs []string
+	if len(route.Scopes) > 0 {
+		op["security"] = []interface{}{
+			map[string]interface{}{OPENAPI_SECURITY_API_KEY: []string{}},
+			map[string]interface{}{OPENAPI_SECURITY_BEARER: []string{}},
+		}
+		descs = append(descs, "Required API key scope: "+strings.Join(route.Scopes, " or "))
+	}
+	if route.Request != nil {
+		schema := openApiSchema(reflect.TypeOf(route.Request), schemas)
+		if route.Method == http.MethodGet {
+			// OpenAPI does not define body of GET requests, legacy routes only reference its schema.
+			descs = append(descs, "Legacy JSON body: "+schema["$ref"].(string))
+		} else {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					MIME_JSON: map[string]interface{}{
+						"schema": schema,
+					},
+				},
+			}
+		}
+	}
+	if len(descs) > 0 {
+		op["description"] = strings.Join(descs, ". ")
+	}
+	if route.Deprecated {
+		op["deprecated"] = true
+	}
+	return op
+}
+
+func openApiOperationId(route ApiRoute) string {
+	id := strings.ToLower(route.Method)
+	for _, p := range strings.Split(route.Path, "/") {
+		if p != "" && !strings.HasPrefix(p, ":") {
+			id += strings.Title(p)
+		}
+	}
+	return id
+}
+
+func openApiParameters(t reflect.Type, tag string, in string, schemas map[string]interface{}) []interface{} {
+	params := []interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get(tag)
+		if name == "" || name == "-" {
+			continue
+		}
+		schema, required := openApiFieldSchema(f, schemas)
+		params = append(params, map[string]interface{}{
+			"name":     name,
+			"in":       in,
+			"required": required || in == "path",
+			"schema":   schema,
+		})
+	}
+	return params
+}
+
+func openApiErrorStatus(code int, er ExpectedResultI) string {
+	return er.GetStatus(code, DEFAULT_LOCALE)
+}
+
+func openApiErrorData(codes []int, schemas map[string]interface{}) map[string]interface{} {
+	message := map[string]interface{}{"type": "string"}
+	for _, code := range codes {
+		if code != ERROR_WRONG_REQUEST {
+			continue
+		}
+		validation := openApiSchema(reflect.TypeOf(RequestErrors{}), schemas)
+		if len(codes) == 1 {
+			return validation
+		}
+		return map[string]interface{}{"oneOf": []interface{}{message, validation}}
+	}
+	return message
+}
+
+func openApiResultContent(data map[string]interface{}, codes []int) map[string]interface{} {
+	status := map[string]interface{}{"type": "integer"}
+	if codes == nil {
+		codes = []int{STATUS_CODE_OK}
+	}
+	sort.Ints(codes)
+	status["enum"] = codes
+	return map[string]interface{}{
+		MIME_JSON: map[string]interface{}{
+			"schema": map[string]interface{}{
+				"allOf": []interface{}{
+					map[string]interface{}{"$ref": OPENAPI_SCHEMA_REF + "Result"},
+					map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"status": status,
+							"data":   data,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func openApiSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == durationType {
+		return map[string]interface{}{"type": "string", "example": LOCK_TIMEOUT.String()}
+	}
+	if t == rateLimitType {
+		return map[string]interface{}{"type": "string", "example": RATE_LIMIT_POLICIES[RATE_LIMIT_GROUP_WRITE].Client.String()}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return openApiSchema(t.Elem(), schemas)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": openApiSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": true}
+	case reflect.Struct:
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = openApiStructSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": OPENAPI_SCHEMA_REF + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func openApiStructSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	props := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		prop, req := openApiFieldSchema(f, schemas)
+		if req {
+			required = append(required, name)
+		}
+		props[name] = prop
+	}
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func openApiFieldSchema(f reflect.StructField, schemas map[string]interface{}) (prop map[string]interface{}, required bool) {
+	prop = openApiSchema(f.Type, schemas)
+	for _, rule := range strings.Split(f.Tag.Get("binding"), ",") {
+		kv := strings.SplitN(rule, "=", 2)
+		switch kv[0] {
+		case "required":
+			required = true
+		case "gte", "gt":
+			if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+				prop["minimum"] = v
+				if kv[0] == "gt" {
+					prop["exclusiveMinimum"] = true
+				}
+			}
+		case "max":
+			if v, err := strconv.Atoi(kv[1]); err == nil && prop["type"] == "string" {
+				prop["maxLength"] = v
+			}
+		case "lte", "lt":
+			if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+				prop["maximum"] = v
+				if kv[0] == "lt" {
+					prop["exclusiveMaximum"] = true
+				}
+			}
+		}
+	}
+	return prop, required
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MIME_JSON         string = "application/json"
+	MIME_PROBLEM_JSON string = "application/problem+json"
+
+	PROBLEM_TYPE     string = "/problems/%d"
+	PROBLEM_INSTANCE string = "urn:request:%s"
+)
+
+var (
+	// RESULT_FORMATS lists response formats in negotiation order, the first one is default.
+	RESULT_FORMATS = []string{MIME_JSON, MIME_PROBLEM_JSON}
+
+	RESULT_WRITERS = map[string]ResultWriter{
+		MIME_JSON:         &EnvelopeWriter{},
+		MIME_PROBLEM_JSON: &ProblemWriter{&EnvelopeWriter{}},
+	}
+)
+
+// ResultWriter renders Result in one of the negotiated response formats.
+type ResultWriter interface {
+	Write(r *Result, code int)
+}
+
+func RegisterResultWriter(mime string, w ResultWriter) {
+	if _, ok := RESULT_WRITERS[mime]; !ok {
+		RESULT_FORMATS = append(RESULT_FORMATS, mime)
+	}
+	RESULT_WRITERS[mime] = w
+}
+
+func NegotiateResultWriter(c *gin.Context) ResultWriter {
+	w, ok := RESULT_WRITERS[c.NegotiateFormat(RESULT_FORMATS...)]
+	if !ok {
+		return RESULT_WRITERS[RESULT_FORMATS[0]]
+	}
+	return w
+}
+
+// EnvelopeWriter renders Result as {status, data} JSON.
+type EnvelopeWriter struct{}
+
+func (w *EnvelopeWriter) Write(r *Result, code int) {
+	r.ctx.JSON(code, r)
+}
+
+// Problem is RFC 7807 problem details object. Detail explains this occurrence of the problem,
+// it is omitted when the request has nothing to add to Title.
+type Problem struct {
+	Type     string        `json:"type"`
+	Title    string        `json:"title"`
+	Status   int           `json:"status"`
+	Detail   string        `json:"detail,omitempty"`
+	Instance string        `json:"instance,omitempty"`
+	Code     int           `json:"code"`
+	Errors   RequestErrors `json:"errors,omitempty"`
+}
+
+// ProblemWriter renders failed Result as application/problem+json, successful results are rendered by Success.
+type ProblemWriter struct {
+	Success ResultWriter
+}
+
+func (w *ProblemWriter) Write(r *Result, code int) {
+	if r.Status == STATUS_CODE_OK {
+		w.Success.Write(r, code)
+		return
+	}
+	p := Problem{
+		Type:   fmt.Sprintf(PROBLEM_TYPE, r.Status),
+		Title:  Messages.Status(r.Locale(), r.Status),
+		Status: code,
+		Code:   r.Status,
+	}
+	if id := GetRequestId(r.ctx); id != "" {
+		p.Instance = fmt.Sprintf(PROBLEM_INSTANCE, id)
+	}
+	switch m := r.Message.(type) {
+	case RequestErrors:
+		p.Detail = m.Error()
+		p.Errors = m
+	default:
+		if detail := fmt.Sprint(m); detail != p.Title {
+			p.Detail = detail
+		}
+	}
+	r.ctx.Header("Content-Type", MIME_PROBLEM_JSON)
+	r.ctx.JSON(code, p)
+}
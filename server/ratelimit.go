@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	ERROR_RATE_LIMITED int = 118
+
+	RATE_LIMIT_GROUP_READ  string = "read"
+	RATE_LIMIT_GROUP_WRITE string = "write"
+	RATE_LIMIT_GROUP_ADMIN string = "admin"
+
+	RATE_LIMIT_STORE_MEMORY   string = "memory"
+	RATE_LIMIT_STORE_POSTGRES string = "postgres"
+
+	// RATE_LIMIT_IDLE is how long unused bucket is kept. It must exceed the time to refill any bucket.
+	RATE_LIMIT_IDLE           time.Duration = time.Hour
+	RATE_LIMIT_PURGE_INTERVAL time.Duration = 10 * time.Minute
+
+	// TAKE_RATE_LIMIT_TOKEN refills buckets by database clock, so replicas with skewed clocks agree on them.
+	TAKE_RATE_LIMIT_TOKEN string = `INSERT INTO rate_limits AS r (key, tokens, updated, allowed) VALUES ($1, $2 - 1, EXTRACT(EPOCH FROM now()), true)
+ON CONFLICT (key) DO UPDATE SET
+	tokens = LEAST($2, r.tokens + (EXCLUDED.updated - r.updated) * $3) - CASE WHEN LEAST($2, r.tokens + (EXCLUDED.updated - r.updated) * $3) >= 1 THEN 1 ELSE 0 END,
+	allowed = LEAST($2, r.tokens + (EXCLUDED.updated - r.updated) * $3) >= 1,
+	updated = EXCLUDED.updated
+RETURNING tokens, allowed`
+	DELETE_IDLE_RATE_LIMITS string = "DELETE FROM rate_limits WHERE updated < EXTRACT(EPOCH FROM now()) - $1"
+)
+
+var (
+	// RATE_LIMIT_POLICIES are default limits of route groups, see RateLimitConfig.
+	RATE_LIMIT_POLICIES = map[string]RateLimitPolicy{
+		RATE_LIMIT_GROUP_READ: {
+			Group:   RATE_LIMIT_GROUP_READ,
+			Client:  RateLimit{Rate: 50, Burst: 100},
+			Account: RateLimit{Rate: 20, Burst: 40},
+		},
+		RATE_LIMIT_GROUP_WRITE: {
+			Group:   RATE_LIMIT_GROUP_WRITE,
+			Client:  RateLimit{Rate: 20, Burst: 40},
+			Account: RateLimit{Rate: 5, Burst: 10},
+		},
+		RATE_LIMIT_GROUP_ADMIN: {
+			Group:  RATE_LIMIT_GROUP_ADMIN,
+			Client: RateLimit{Rate: 10, Burst: 20},
+		},
+	}
+)
+
+// RateLimit is token bucket refilled with Rate tokens per second up to Burst tokens.
+// Zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// RateLimitPolicy limits requests of a route group per client identity and per target account.
+type RateLimitPolicy struct {
+	Group   string
+	Client  RateLimit
+	Account RateLimit
+}
+
+// ParseRateLimit reads limit written as "rate,burst", "0" disables the limit.
+func ParseRateLimit(s string) (RateLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "0" {
+		return RateLimit{}, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("expected \"rate,burst\", got %q", s)
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || rate <= 0 {
+		return RateLimit{}, fmt.Errorf("wrong rate %q", parts[0])
+	}
+	burst, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || burst < 1 {
+		return RateLimit{}, fmt.Errorf("wrong burst %q", parts[1])
+	}
+	return RateLimit{Rate: rate, Burst: burst}, nil
+}
+
+func (l RateLimit) String() string {
+	if !l.Enabled() {
+		return "0"
+	}
+	return strconv.FormatFloat(l.Rate, 'f', -1, 64) + "," + strconv.Itoa(l.Burst)
+}
+
+// MarshalJSON writes limit as "rate,burst" string in config file and admin endpoint.
+func (l RateLimit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+func (l *RateLimit) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("rate limit should be a string like \"20,40\": %w", err)
+	}
+	v, err := ParseRateLimit(s)
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
+
+// RateLimitStoreI takes a token from the bucket. If the bucket is empty it returns
+// false and the time until the next token.
+type RateLimitStoreI interface {
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (bool, time.Duration, error)
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// MemoryRateLimitStore keeps buckets in process memory, so limits apply per instance.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	purged  time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*rateBucket{}}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.purged) > RATE_LIMIT_IDLE {
+		for k, b := range s.buckets {
+			if now.Sub(b.updated) > RATE_LIMIT_IDLE {
+				delete(s.buckets, k)
+			}
+		}
+		s.purged = now
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &rateBucket{float64(limit.Burst), now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, tokenWait(b.tokens, limit), nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
+
+// PostgresRateLimitStore shares buckets between replicas in rate_limits table.
+type PostgresRateLimitStore struct {
+	db DatabaseI
+}
+
+func NewPostgresRateLimitStore(db DatabaseI) *PostgresRateLimitStore {
+	return &PostgresRateLimitStore{db}
+}
+
+// Take ignores now and uses database clock instead, see TAKE_RATE_LIMIT_TOKEN.
+func (s *PostgresRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (bool, time.Duration, error) {
+	var tokens float64
+	var allowed bool
+	_, err := s.db.ExecuteInTransaction(ctx, func(tx *pgx.Tx) (interface{}, error) {
+		return nil, (*tx).QueryRow(ctx, TAKE_RATE_LIMIT_TOKEN, key, float64(limit.Burst), limit.Rate).Scan(&tokens, &allowed)
+	})
+	if err != nil || allowed {
+		return allowed, 0, err
+	}
+	return false, tokenWait(tokens, limit), nil
+}
+
+// Run deletes idle buckets, scheduled with other periodic jobs.
+func (s *PostgresRateLimitStore) Run(ctx context.Context) {
+	s.db.ExecuteInTransaction(ctx, func(tx *pgx.Tx) (interface{}, error) {
+		_, err := (*tx).Exec(ctx, DELETE_IDLE_RATE_LIMITS, RATE_LIMIT_IDLE.Seconds())
+		return nil, err
+	})
+}
+
+// NewRateLimitStoreFromConfig selects store by cfg.Store, memory by default.
+func NewRateLimitStoreFromConfig(cfg RateLimitConfig, db DatabaseI) (RateLimitStoreI, error) {
+	switch cfg.Store {
+	case "", RATE_LIMIT_STORE_MEMORY:
+		return NewMemoryRateLimitStore(), nil
+	case RATE_LIMIT_STORE_POSTGRES:
+		return NewPostgresRateLimitStore(db), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", cfg.Store)
+	}
+}
+
+type RateLimiter struct {
+	store   RateLimitStoreI
+	nowFunc func() time.Time
+}
+
+func NewRateLimiter(store RateLimitStoreI) *RateLimiter {
+	return &RateLimiter{store, time.Now}
+}
+
+// Allow takes a token for key and returns ERROR_RATE_LIMITED with retry delay when the bucket is empty.
+// Store failures do not block requests.
+func (l *RateLimiter) Allow(ctx context.Context, key string, limit RateLimit) (time.Duration, error) {
+	if !limit.Enabled() {
+		return 0, nil
+	}
+	ok, wait, err := l.store.Take(ctx, key, limit, l.nowFunc())
+	if err != nil || ok {
+		return 0, nil
+	}
+	return wait, &OperationError{Code: ERROR_RATE_LIMITED}
+}
+
+// AllowRequest takes tokens of policy p for client and, when account is positive, for the account.
+// HTTP and gRPC share the keys, so a client has one budget per group on both.
+func (l *RateLimiter) AllowRequest(ctx context.Context, p RateLimitPolicy, client string, account int) (time.Duration, error) {
+	wait, err := l.Allow(ctx, p.Group+":client:"+client, p.Client)
+	if err == nil && account > 0 {
+		wait, err = l.Allow(ctx, p.Group+":account:"+strconv.Itoa(account), p.Account)
+	}
+	return wait, err
+}
+
+// RateLimited limits requests of the route group by client and by target account.
+// Must be mounted after Authenticate, client is identified by principal or by IP.
+func RateLimited(l *RateLimiter, p RateLimitPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := principalActor(c)
+		if client == "" {
+			client = "ip:" + c.ClientIP()
+		}
+		account := 0
+		if p.Account.Enabled() {
+			var err error
+			if account, err = requestAccountId(c); err != nil {
+				NewResult(c).BadRequest(err)
+				c.Abort()
+				return
+			}
+		}
+		wait, err := l.AllowRequest(c.Request.Context(), p, client, account)
+		if err != nil {
+			c.Header(HEADER_RETRY_AFTER, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			NewResult(c).Err(&err, &AccountExpectedResult)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// requestAccountId returns account the request operates on from path or JSON body,
+// for transfers it is the sender. Bodies larger than SIGNATURE_MAX_BODY_SIZE are rejected
+// before they are read, as the limiter runs ahead of VerifySignature.
+func requestAccountId(c *gin.Context) (int, error) {
+	if id, err := strconv.Atoi(c.Param("id")); err == nil {
+		return id, nil
+	}
+	if c.Request.Body == nil {
+		return 0, nil
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, SIGNATURE_MAX_BODY_SIZE))
+	if err != nil {
+		return 0, err
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var target struct {
+		Id      int `json:"id"`
+		Account int `json:"account"`
+	}
+	json.Unmarshal(body, &target)
+	if target.Id > 0 {
+		return target.Id, nil
+	}
+	return target.Account, nil
+}
+
+func tokenWait(tokens float64, limit RateLimit) time.Duration {
+	return time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+}
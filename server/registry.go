@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	LOG_LEVEL_DEBUG LogLevel = "debug"
+	LOG_LEVEL_INFO  LogLevel = "info"
+	LOG_LEVEL_WARN  LogLevel = "warn"
+	LOG_LEVEL_ERROR LogLevel = "error"
+
+	HEADER_RETRY_AFTER string = "Retry-After"
+
+	RETRY_AFTER_SECONDS int = 1
+)
+
+var (
+	ERROR_REGISTRY = NewErrorRegistry(
+		ErrorCode{Code: ERROR_BALANCE_WRONG_CURRENCY_CODE, HttpCode: http.StatusBadRequest, GrpcCode: codes.InvalidArgument, Retryable: false, LogLevel: LOG_LEVEL_INFO},
+		ErrorCode{Code: ERROR_TRANSACTIONS_WRONG_SORT, HttpCode: http.StatusBadRequest, GrpcCode: codes.InvalidArgument, Retryable: false, LogLevel: LOG_LEVEL_INFO},
+		ErrorCode{Code: ERROR_TRANSACTIONS_WRONG_PAGE, HttpCode: http.StatusBadRequest, GrpcCode: codes.InvalidArgument, Retryable: false, LogLevel: LOG_LEVEL_INFO},
+		ErrorCode{Code: ERROR_NOT_ENOUGH_MONEY, HttpCode: http.StatusUnprocessableEntity, GrpcCode: codes.FailedPrecondition, Retryable: false, LogLevel: LOG_LEVEL_INFO},
+		ErrorCode{Code: ERROR_LOCK_TIMEOUT, HttpCode: http.StatusServiceUnavailable, GrpcCode: codes.Unavailable, Retryable: true, LogLevel: LOG_LEVEL_WARN},
+		ErrorCode{Code: ERROR_NO_BALANCE, HttpCode: http.StatusNotFound, GrpcCode: codes.NotFound, Retryable: false, LogLevel: LOG_LEVEL_INFO},
+		ErrorCode{Code: ERROR_UNAUTHORIZED, HttpCode: http.StatusUnauthorized, GrpcCode: codes.Unauthenticated, Retryable: false, LogLevel: LOG_LEVEL_INFO},
+		ErrorCode{Code: ERROR_FORBIDDEN, HttpCode: http.StatusForbidden, GrpcCode: codes.PermissionDenied, Retryable: false, LogLevel: LOG_LEVEL_WARN},
+		ErrorCode{Code: ERROR_ACCOUNT_MISMATCH, HttpCode: http.StatusForbidden, GrpcCode: codes.PermissionDenied, Retryable: false, LogLevel: LOG_LEVEL_WARN},
+		ErrorCode{Code: ERROR_SIGNATURE_MISSING, HttpCode: http.StatusUnauthorized, GrpcCode: codes.Unauthenticated, Retryable: false, LogLevel: LOG_LEVEL_INFO},
+		ErrorCode{Code: ERROR_SIGNATURE_UNKNOWN_PARTNER, HttpCode: http.StatusUnauthorized, GrpcCode: codes.Unauthenticated, Retryable: false, LogLevel: LOG_LEVEL_INFO},
+		ErrorCode{Code: ERROR_SIGNATURE_STALE, HttpCode: http.StatusUnauthorized, GrpcCode: codes.Unauthenticated, Retryable: false, LogLevel: LOG_LEVEL_INFO},
+		ErrorCode{Code: ERROR_SIGNATURE_NONCE_REUSED, HttpCode: http.StatusUnauthorized, GrpcCode: codes.Unauthenticated, Retryable: false, LogLevel: LOG_LEVEL_WARN},
+		ErrorCode{Code: ERROR_SIGNATURE_INVALID, HttpCode: http.StatusUnauthorized, GrpcCode: codes.Unauthenticated, Retryable: false, LogLevel: LOG_LEVEL_WARN},
+		ErrorCode{Code: ERROR_ACCOUNT_FROZEN, HttpCode: http.StatusForbidden, GrpcCode: codes.FailedPrecondition, Retryable: false, LogLevel: LOG_LEVEL_INFO},
+		ErrorCode{Code: ERROR_STATE_UNCHANGED, HttpCode: http.StatusConflict, GrpcCode: codes.FailedPrecondition, Retryable: false, LogLevel: LOG_LEVEL_INFO},
+		ErrorCode{Code: ERROR_RATE_LIMITED, HttpCode: http.StatusTooManyRequests, GrpcCode: codes.ResourceExhausted, Retryable: true, LogLevel: LOG_LEVEL_WARN},
+		ErrorCode{Code: ERROR_REQUEST_CANCELED, HttpCode: HTTP_CLIENT_CLOSED_REQUEST, GrpcCode: codes.Canceled, Retryable: false, LogLevel: LOG_LEVEL_INFO},
+		ErrorCode{Code: ERROR_REQUEST_TIMEOUT, HttpCode: http.StatusGatewayTimeout, GrpcCode: codes.DeadlineExceeded, Retryable: true, LogLevel: LOG_LEVEL_WARN},
+		ErrorCode{Code: ERROR_TRANSACTION_CONFLICT, HttpCode: http.StatusConflict, GrpcCode: codes.Aborted, Retryable: true, LogLevel: LOG_LEVEL_WARN},
+		ErrorCode{Code: ERROR_DUPLICATE, HttpCode: http.StatusConflict, GrpcCode: codes.AlreadyExists, Retryable: false, LogLevel: LOG_LEVEL_WARN},
+		ErrorCode{Code: ERROR_CONSTRAINT_VIOLATION, HttpCode: http.StatusUnprocessableEntity, GrpcCode: codes.FailedPrecondition, Retryable: false, LogLevel: LOG_LEVEL_WARN},
+		ErrorCode{Code: ERROR_NOT_READY, HttpCode: http.StatusServiceUnavailable, GrpcCode: codes.Unavailable, Retryable: true, LogLevel: LOG_LEVEL_WARN},
+		ErrorCode{Code: ERROR_INTERNAL, HttpCode: http.StatusInternalServerError, GrpcCode: codes.Internal, Retryable: false, LogLevel: LOG_LEVEL_ERROR},
+		ErrorCode{Code: ERROR_WRONG_REQUEST, HttpCode: http.StatusBadRequest, GrpcCode: codes.InvalidArgument, Retryable: false, LogLevel: LOG_LEVEL_INFO},
+	)
+)
+
+type LogLevel string
+
+// ErrorCode declares how OperationError with this code is reported to clients.
+type ErrorCode struct {
+	Code      int
+	HttpCode  int
+	GrpcCode  codes.Code
+	Retryable bool
+	LogLevel  LogLevel
+}
+
+type ErrorRegistry struct {
+	codes map[int]ErrorCode
+	dup   []int
+}
+
+func NewErrorRegistry(errCodes ...ErrorCode) *ErrorRegistry {
+	r := &ErrorRegistry{codes: map[int]ErrorCode{}}
+	for _, c := range errCodes {
+		if _, ok := r.codes[c.Code]; ok {
+			r.dup = append(r.dup, c.Code)
+		}
+		r.codes[c.Code] = c
+	}
+	return r
+}
+
+// Get returns declared code or ERROR_INTERNAL declaration for unknown codes.
+func (r *ErrorRegistry) Get(code int) ErrorCode {
+	c, ok := r.codes[code]
+	if !ok {
+		return r.codes[ERROR_INTERNAL]
+	}
+	return c
+}
+
+func (r *ErrorRegistry) Codes() []int {
+	cs := make([]int, 0, len(r.codes))
+	for c := range r.codes {
+		cs = append(cs, c)
+	}
+	sort.Ints(cs)
+	return cs
+}
+
+// Validate checks that every code is declared once with an error HTTP status,
+// known log level and message in every catalog locale, and that every error
+// message in catalog has a declared code.
+func (r *ErrorRegistry) Validate(catalog *MessageCatalog) error {
+	if len(r.dup) > 0 {
+		return fmt.Errorf("error codes declared more than once: %v", r.dup)
+	}
+	if _, ok := r.codes[ERROR_INTERNAL]; !ok {
+		return fmt.Errorf("error code %d must be declared", ERROR_INTERNAL)
+	}
+	for _, code := range r.Codes() {
+		c := r.codes[code]
+		if c.HttpCode < 400 || c.HttpCode > 599 {
+			return fmt.Errorf("error code %d has non-error HTTP status %d", code, c.HttpCode)
+		}
+		if c.GrpcCode == codes.OK {
+			return fmt.Errorf("error code %d has OK gRPC status", code)
+		}
+		switch c.LogLevel {
+		case LOG_LEVEL_DEBUG, LOG_LEVEL_INFO, LOG_LEVEL_WARN, LOG_LEVEL_ERROR:
+		default:
+			return fmt.Errorf("error code %d has unknown log level %q", code, c.LogLevel)
+		}
+		for _, l := range catalog.Locales() {
+			if catalog.Status(l, code) == "" {
+				return fmt.Errorf("error code %d has no message in locale %s", code, l)
+			}
+		}
+	}
+	for _, l := range catalog.Locales() {
+		for _, k := range catalog.Keys(l) {
+			code, err := strconv.Atoi(k)
+			if err != nil || code >= VALIDATION_INVALID {
+				continue
+			}
+			if _, ok := r.codes[code]; !ok {
+				return fmt.Errorf("message %s in locale %s has no declared error code", k, l)
+			}
+		}
+	}
+	return nil
+}
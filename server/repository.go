@@ -1,26 +1,34 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
+	"time"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
 	SELECT_ADVISORY_LOCK                            string = "SELECT pg_advisory_xact_lock($1, $2)"
-	SET_LOCK_TIMEOUT                                string = "SET LOCAL lock_timeout = '10s'"
 	SELECT_CURRENT_BALANCE                          string = "SELECT SUM(sum) FROM transactions WHERE account = $1"
 	SELECT_CURRENT_BALANCE_COALESCE                 string = "SELECT COALESCE(SUM(sum), 0) FROM transactions WHERE account = $1"
 	COUNT_TRANSACTIONS                              string = "SELECT COUNT(*) FROM transactions WHERE account = $1"
-	CREATE_TRANSACTION                              string = "INSERT INTO transactions(account, sum, operation, description) VALUES($1, $2, $3, $4)"
+	CREATE_TRANSACTION                              string = "INSERT INTO transactions(account, sum, operation, description, key_id, date, prev_hash, hash) VALUES($1, $2, $3, $4, $5, $6, $7, $8)"
+	SELECT_CHAIN_HEAD                               string = "SELECT hash FROM transactions WHERE account = $1 ORDER BY id DESC LIMIT 1"
+	SELECT_LAST_TRANSACTION_ID                      string = "SELECT COALESCE(MAX(id), 0) FROM transactions WHERE account = $1"
 	GET_TRANSACTIONS_FROM_TO_ORDERED_DATE_FIRSTPAGE string = "SELECT id, sum, operation, date, description FROM transactions WHERE account = $1 AND date >= $2 AND date <= $3 ORDER BY date DESC LIMIT $4"
 	GET_TRANSACTIONS_FROM_TO_ORDERED_DATE           string = "SELECT id, sum, operation, date, description FROM transactions WHERE account = $1 AND date >= $2 AND date <= $3 AND id <= $4 ORDER BY date DESC LIMIT $5"
 	GET_TRANSACTIONS_FROM_TO_ORDERED_SUM            string = "SELECT pager, sum, operation, date, description FROM transactions_sum_order INNER JOIN transactions ON transactions_sum_order.id = transactions.id WHERE transactions.account = $1 AND transactions.date >= $2 AND transactions.date <= $3 AND transactions_sum_order.pager >= $4 ORDER BY pager ASC LIMIT $5"
 	UPDATE_ORDERED_SUM_VIEW                         string = "REFRESH MATERIALIZED VIEW CONCURRENTLY transactions_sum_order"
+	SELECT_ACCOUNT_FROZEN                           string = "SELECT EXISTS(SELECT 1 FROM frozen_accounts WHERE account = $1)"
 
-	OPERATION_INCOME_CODE  int = 0
-	OPERATION_OUTCOME_CODE int = 1
+	OPERATION_INCOME_CODE     int = 0
+	OPERATION_OUTCOME_CODE    int = 1
+	OPERATION_ADJUSTMENT_CODE int = 2
 
 	OPERATION_TRANSFER_DESC string = "Transfer to user %d from user %d"
 )
@@ -32,118 +40,176 @@ var (
 )
 
 type TransactionViewsRefresher struct {
-	db DatabaseI
+	db  DatabaseI
+	log zerolog.Logger
 }
 
-func NewTransactionViewsRefresher(db DatabaseI) *TransactionViewsRefresher {
-	return &TransactionViewsRefresher{db}
+func NewTransactionViewsRefresher(db DatabaseI, log zerolog.Logger) *TransactionViewsRefresher {
+	return &TransactionViewsRefresher{db, componentLogger(log, "scheduler")}
 }
 
-func (r *TransactionViewsRefresher) Run() {
-	fmt.Println("Updating DB transaction_sum_order view")
-	r.db.ExecuteInTransaction(func(tx *pgx.Tx) (interface{}, error) {
-		_, err := (*tx).Exec(r.db.GetCtx(), UPDATE_ORDERED_SUM_VIEW)
+func (r *TransactionViewsRefresher) Run(ctx context.Context) {
+	r.log.Debug().Msg("updating transaction_sum_order view")
+	start := time.Now()
+	_, err := r.db.ExecuteInTransaction(ctx, func(tx *pgx.Tx) (interface{}, error) {
+		_, err := (*tx).Exec(ctx, UPDATE_ORDERED_SUM_VIEW)
 		if err != nil {
 			return nil, err
 		}
 		return nil, nil
 	})
+	observeViewRefresh(start, err)
+	if err != nil {
+		r.log.Error().Err(err).Msg("transaction_sum_order view update failed")
+	}
 }
 
 type AccountRepositoryI interface {
-	ExecuteTransaction(trxData TransactionData, oCode int) error
-	ExecuteOperation(trxData TransactionData) error
-	GetBalance(dt BalanceData) (float64, error)
-	ExecuteTransfer(tData TransferData) error
-	GetTransactionsSortedByDate(trxData TransactionsListData) (pgx.Rows, error)
-	GetTransactionsSortedBySum(trxData TransactionsListData) (pgx.Rows, error)
+	ExecuteTransaction(ctx context.Context, trxData TransactionData, oCode int) error
+	ExecuteOperation(ctx context.Context, trxData TransactionData) error
+	GetBalance(ctx context.Context, dt BalanceData) (float64, error)
+	GetLastTransactionId(ctx context.Context, id int) (int, error)
+	ExecuteTransfer(ctx context.Context, tData TransferData) error
+	GetTransactionsSortedByDate(ctx context.Context, trxData TransactionsListData) (pgx.Rows, error)
+	GetTransactionsSortedBySum(ctx context.Context, trxData TransactionsListData) (pgx.Rows, error)
 }
 
 type AccountRepository struct {
-	db DatabaseI
+	db  DatabaseI
+	cfg LedgerConfig
+	log zerolog.Logger
 }
 
-func NewAccountRepository(db DatabaseI) *AccountRepository {
-	return &AccountRepository{db}
+func NewAccountRepository(db DatabaseI, cfg LedgerConfig, log zerolog.Logger) *AccountRepository {
+	return &AccountRepository{db, cfg, componentLogger(log, "repository")}
 }
 
-func (rep *AccountRepository) ExecuteTransaction(trxData TransactionData, oCode int) error {
-	_, err := rep.db.ExecuteInTransaction(func(tx *pgx.Tx) (interface{}, error) {
-		var err error
-		if l := rep.shouldBeLocked(oCode); l {
-			(*tx).Exec(rep.db.GetCtx(), SET_LOCK_TIMEOUT)
-			_, err = (*tx).Exec(rep.db.GetCtx(), SELECT_ADVISORY_LOCK, trxData.Id, oCode)
-			if err != nil {
-				return nil, &OperationError{ERROR_LOCK_TIMEOUT}
-			}
-		}
-		var curBal float64
-		err = (*tx).QueryRow(rep.db.GetCtx(), SELECT_CURRENT_BALANCE_COALESCE, trxData.Id).Scan(&curBal)
-		if err != nil {
-			return nil, err
+func (rep *AccountRepository) ExecuteTransaction(ctx context.Context, trxData TransactionData, oCode int) (err error) {
+	ctx, span := startSpan(ctx, "AccountRepository.ExecuteTransaction", accountAttr(trxData.Id), attribute.Int("operation", oCode))
+	defer func() { endSpan(span, err) }()
+	c := rep.db.Concurrency()
+	_, err = c.Execute(ctx, rep.db, func(tx *pgx.Tx) (interface{}, error) {
+		return nil, rep.executeTransaction(ctx, tx, c, trxData, oCode)
+	})
+	observeLedgerOperation(oCode, err)
+	if err != nil {
+		rep.log.Debug().Ctx(ctx).Err(err).
+			Int(LOG_FIELD_ACCOUNT, trxData.Id).
+			Int("operation", oCode).
+			Msg("ledger operation rolled back")
+	}
+	return err
+}
+
+// executeTransaction locks account for operations listed in LOCKED_OPERATIONS,
+// refuses debit of frozen account and appends ledger row in tx.
+func (rep *AccountRepository) executeTransaction(ctx context.Context, tx *pgx.Tx, c ConcurrencyStrategy, trxData TransactionData, oCode int) error {
+	if l := rep.shouldBeLocked(oCode); l {
+		if err := c.Lock(ctx, tx, trxData.Id, oCode); err != nil {
+			return err
 		}
-		if trxData.Sum < 0 && math.Abs(curBal) < math.Abs(trxData.Sum) {
-			return nil, &OperationError{ERROR_NOT_ENOUGH_MONEY}
+	}
+	if trxData.Sum < 0 {
+		if err := checkNotFrozen(ctx, tx, trxData.Id); err != nil {
+			return err
 		}
-		_, err = (*tx).Exec(rep.db.GetCtx(), CREATE_TRANSACTION, trxData.Id, trxData.Sum, oCode, trxData.Desc)
-		return nil, err
-	})
+	}
+	_, err := appendTransaction(ctx, tx, c, trxData, oCode)
 	return err
 }
 
-func (rep *AccountRepository) ExecuteOperation(trxData TransactionData) error {
+// checkNotFrozen returns ERROR_ACCOUNT_FROZEN for frozen account. Callers hold the debit lock,
+// so the account is not frozen before their transaction commits.
+func checkNotFrozen(ctx context.Context, tx *pgx.Tx, id int) error {
+	var frozen bool
+	if err := (*tx).QueryRow(ctx, SELECT_ACCOUNT_FROZEN, id).Scan(&frozen); err != nil {
+		return err
+	}
+	if frozen {
+		return &OperationError{Code: ERROR_ACCOUNT_FROZEN}
+	}
+	return nil
+}
+
+func (rep *AccountRepository) ExecuteOperation(ctx context.Context, trxData TransactionData) error {
 	if trxData.Sum > 0 {
-		return rep.ExecuteTransaction(trxData, OPERATION_INCOME_CODE)
+		return rep.ExecuteTransaction(ctx, trxData, OPERATION_INCOME_CODE)
 	} else {
-		return rep.ExecuteTransaction(trxData, OPERATION_OUTCOME_CODE)
+		return rep.ExecuteTransaction(ctx, trxData, OPERATION_OUTCOME_CODE)
 	}
 }
 
-func (rep *AccountRepository) GetBalance(dt BalanceData) (float64, error) {
+func (rep *AccountRepository) GetBalance(ctx context.Context, dt BalanceData) (bal float64, err error) {
+	ctx, span := startSpan(ctx, "AccountRepository.GetBalance", accountAttr(dt.Id))
+	defer func() { endSpan(span, err) }()
 	var curBal *float64
-	_, err := rep.db.ExecuteInTransaction(func(tx *pgx.Tx) (interface{}, error) {
-		err := (*tx).QueryRow(rep.db.GetCtx(), SELECT_CURRENT_BALANCE, dt.Id).Scan(&curBal)
-		if err != nil {
-			fmt.Println(err.Error())
-		}
+	_, err = rep.db.ExecuteInTransaction(ctx, func(tx *pgx.Tx) (interface{}, error) {
+		err := (*tx).QueryRow(ctx, SELECT_CURRENT_BALANCE, dt.Id).Scan(&curBal)
 		return nil, err
 	})
+	if err != nil {
+		rep.log.Debug().Ctx(ctx).Err(err).Int(LOG_FIELD_ACCOUNT, dt.Id).Msg("balance query failed")
+		return 0, err
+	}
 	if curBal == nil {
-		return 0, &OperationError{ERROR_NO_BALANCE}
+		return 0, &OperationError{Code: ERROR_NO_BALANCE}
 	}
-	return *curBal, err
+	return *curBal, nil
+}
+
+// GetLastTransactionId returns id of the latest ledger row of the account, 0 for account without rows.
+// Every write appends a row, so the id changes whenever the balance does.
+func (rep *AccountRepository) GetLastTransactionId(ctx context.Context, id int) (last int, err error) {
+	ctx, span := startSpan(ctx, "AccountRepository.GetLastTransactionId", accountAttr(id))
+	defer func() { endSpan(span, err) }()
+	_, err = rep.db.ExecuteInTransaction(ctx, func(tx *pgx.Tx) (interface{}, error) {
+		return nil, (*tx).QueryRow(ctx, SELECT_LAST_TRANSACTION_ID, id).Scan(&last)
+	})
+	return last, err
 }
 
-func (rep *AccountRepository) ExecuteTransfer(tData TransferData) error {
+// ExecuteTransfer debits and credits accounts in one transaction, so the transfer is applied fully
+// or not at all, also when it is interrupted by shutdown. Both accounts are locked before the
+// balance is checked, see ConcurrencyStrategy.LockTransfer.
+func (rep *AccountRepository) ExecuteTransfer(ctx context.Context, tData TransferData) (err error) {
+	ctx, span := startSpan(ctx, "AccountRepository.ExecuteTransfer", accountAttr(tData.From), attribute.Int("account.to", tData.To))
+	defer func() { endSpan(span, err) }()
 	desc := fmt.Sprintf(OPERATION_TRANSFER_DESC, tData.To, tData.From)
-	trxData := TransactionData{tData.From, -tData.Sum, desc}
-	err := rep.ExecuteTransaction(trxData, OPERATION_OUTCOME_CODE)
+	debit := TransactionData{Id: tData.From, Sum: -tData.Sum, Desc: desc, KeyId: tData.KeyId}
+	credit := TransactionData{Id: tData.To, Sum: tData.Sum, Desc: desc, KeyId: tData.KeyId}
+	c := rep.db.Concurrency()
+	_, err = c.Execute(ctx, rep.db, func(tx *pgx.Tx) (interface{}, error) {
+		if err := c.LockTransfer(ctx, tx, debit.Id, credit.Id); err != nil {
+			return nil, err
+		}
+		if err := rep.executeTransaction(ctx, tx, c, debit, OPERATION_OUTCOME_CODE); err != nil {
+			return nil, err
+		}
+		return nil, rep.executeTransaction(ctx, tx, c, credit, OPERATION_INCOME_CODE)
+	})
+	observeLedgerOperation(OPERATION_OUTCOME_CODE, err)
+	observeLedgerOperation(OPERATION_INCOME_CODE, err)
 	if err != nil {
-		return err
+		rep.log.Debug().Ctx(ctx).Err(err).
+			Int(LOG_FIELD_ACCOUNT, tData.From).
+			Int("account.to", tData.To).
+			Msg("transfer rolled back")
 	}
-	trxData = TransactionData{tData.To, tData.Sum, desc}
-	err = rep.ExecuteTransaction(trxData, OPERATION_INCOME_CODE)
 	return err
 }
 
-func (rep *AccountRepository) getTransactions(qry string, args ...interface{}) (pgx.Rows, error) {
-	rows, err := rep.db.ExecuteInTransaction(func(tx *pgx.Tx) (interface{}, error) {
-		return (*tx).Query(rep.db.GetCtx(), qry, args...)
-
-	})
-	if err != nil {
-		return nil, err
-	}
-	return rows.(pgx.Rows), nil
+// getTransactions returns rows holding pool connection until they are read or closed.
+func (rep *AccountRepository) getTransactions(ctx context.Context, qry string, args ...interface{}) (pgx.Rows, error) {
+	return rep.db.Query(ctx, qry, args...)
 }
 
-func (rep *AccountRepository) GetTransactionsSortedByDate(trxData TransactionsListData) (pgx.Rows, error) {
-	var rows pgx.Rows
-	var err error
+func (rep *AccountRepository) GetTransactionsSortedByDate(ctx context.Context, trxData TransactionsListData) (rows pgx.Rows, err error) {
+	ctx, span := startSpan(ctx, "AccountRepository.GetTransactionsSortedByDate", accountAttr(trxData.Id))
+	defer func() { endSpan(span, err) }()
 	if trxData.Page == 0 {
-		rows, err = rep.getTransactions(GET_TRANSACTIONS_FROM_TO_ORDERED_DATE_FIRSTPAGE, trxData.Id, trxData.From, trxData.To, PAGINATION_PAGE_SIZE+1)
+		rows, err = rep.getTransactions(ctx, GET_TRANSACTIONS_FROM_TO_ORDERED_DATE_FIRSTPAGE, trxData.Id, trxData.From, trxData.To, trxData.PageSize(rep.cfg.PageSize)+1)
 	} else {
-		rows, err = rep.getTransactions(GET_TRANSACTIONS_FROM_TO_ORDERED_DATE, trxData.Id, trxData.From, trxData.To, trxData.Page, PAGINATION_PAGE_SIZE+1)
+		rows, err = rep.getTransactions(ctx, GET_TRANSACTIONS_FROM_TO_ORDERED_DATE, trxData.Id, trxData.From, trxData.To, trxData.Page, trxData.PageSize(rep.cfg.PageSize)+1)
 	}
 	if err != nil {
 		return nil, err
@@ -151,8 +217,10 @@ func (rep *AccountRepository) GetTransactionsSortedByDate(trxData TransactionsLi
 	return rows, nil
 }
 
-func (rep *AccountRepository) GetTransactionsSortedBySum(trxData TransactionsListData) (pgx.Rows, error) {
-	rows, err := rep.getTransactions(GET_TRANSACTIONS_FROM_TO_ORDERED_SUM, trxData.Id, trxData.From, trxData.To, trxData.Page, PAGINATION_PAGE_SIZE+1)
+func (rep *AccountRepository) GetTransactionsSortedBySum(ctx context.Context, trxData TransactionsListData) (rows pgx.Rows, err error) {
+	ctx, span := startSpan(ctx, "AccountRepository.GetTransactionsSortedBySum", accountAttr(trxData.Id))
+	defer func() { endSpan(span, err) }()
+	rows, err = rep.getTransactions(ctx, GET_TRANSACTIONS_FROM_TO_ORDERED_SUM, trxData.Id, trxData.From, trxData.To, trxData.Page, trxData.PageSize(rep.cfg.PageSize)+1)
 	if err != nil {
 		return nil, err
 	}
@@ -166,3 +234,57 @@ func (rep *AccountRepository) shouldBeLocked(oCode int) bool {
 	}
 	return r
 }
+
+// lockAccount takes advisory lock on account operation, waiting up to lock_timeout
+// of the transaction, see withLockTimeout, or until ctx is done. Only lock_not_available is reported as ERROR_LOCK_TIMEOUT,
+// other failures keep their cause.
+func lockAccount(ctx context.Context, tx *pgx.Tx, id int, oCode int) error {
+	start := time.Now()
+	_, err := (*tx).Exec(ctx, SELECT_ADVISORY_LOCK, id, oCode)
+	if err != nil {
+		err = contextErrorOr(ctx, ClassifyPgError(err))
+	}
+	observeLockWait(oCode, start, errors.Is(err, &OperationError{Code: ERROR_LOCK_TIMEOUT}))
+	return err
+}
+
+// appendTransaction checks balance and appends ledger row linked to the account hash chain.
+// Appends to one account are serialized by chain lock of c. Returns balance before the row.
+func appendTransaction(ctx context.Context, tx *pgx.Tx, c ConcurrencyStrategy, trxData TransactionData, oCode int) (float64, error) {
+	if err := c.Lock(ctx, tx, trxData.Id, LEDGER_CHAIN_LOCK); err != nil {
+		return 0, err
+	}
+	var curBal float64
+	err := (*tx).QueryRow(ctx, SELECT_CURRENT_BALANCE_COALESCE, trxData.Id).Scan(&curBal)
+	if err != nil {
+		return 0, err
+	}
+	if trxData.Sum < 0 && math.Abs(curBal) < math.Abs(trxData.Sum) {
+		return curBal, &OperationError{Code: ERROR_NOT_ENOUGH_MONEY}
+	}
+	var prev string
+	err = (*tx).QueryRow(ctx, SELECT_CHAIN_HEAD, trxData.Id).Scan(&prev)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return curBal, err
+	}
+	row := ChainRow{
+		Account:   trxData.Id,
+		Sum:       FormatLedgerSum(trxData.Sum),
+		Operation: oCode,
+		Date:      time.Now().Unix(),
+		Desc:      trxData.Desc,
+		KeyId:     trxData.KeyId,
+		PrevHash:  prev,
+	}
+	row.Hash = HashChainRow(row)
+	_, err = (*tx).Exec(ctx, CREATE_TRANSACTION, row.Account, row.Sum, row.Operation, row.Desc, nullableKeyId(row.KeyId), row.Date, row.PrevHash, row.Hash)
+	return curBal, err
+}
+
+// nullableKeyId stores operations made without API key with NULL key_id.
+func nullableKeyId(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
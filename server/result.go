@@ -1,41 +1,32 @@
 package server
 
 import (
-	"fmt"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
 type ExpectedResultI interface {
-	GetStatus(code int) string
+	GetStatus(code int, locale string) string
 	GetHttpCode(code int) int
+	GetError(code int) ErrorCode
 }
 
 type ExpectedResult struct {
-	Statuses  map[int]string
-	HttpCodes map[int]int
+	Statuses *MessageCatalog
+	Errors   *ErrorRegistry
 }
 
-func (er *ExpectedResult) GetStatus(code int) string {
-	c, ok := er.Statuses[code]
-	if !ok {
-		if code == ERROR_INTERNAL {
-			return STATUS_INTERNAL_ERROR
-		}
-		return ""
-	}
-	return c
+func (er *ExpectedResult) GetStatus(code int, locale string) string {
+	return er.Statuses.Status(locale, code)
 }
 
 func (er *ExpectedResult) GetHttpCode(code int) int {
-	c, ok := er.HttpCodes[code]
-	if !ok {
-		if code == ERROR_INTERNAL {
-			return 500
-		}
-		return 200
-	}
-	return c
+	return er.GetError(code).HttpCode
+}
+
+func (er *ExpectedResult) GetError(code int) ErrorCode {
+	return er.Errors.Get(code)
 }
 
 type Result struct {
@@ -65,28 +56,39 @@ func (r *Result) Give(message interface{}) {
 }
 
 func (r *Result) Ok() {
-	r.ctx.JSON(200, r)
+	r.Response(200)
 }
 
+// Err writes OperationError found in err chain, other errors are written as ERROR_INTERNAL.
 func (r *Result) Err(err *error, er ExpectedResultI) {
-	switch e := (*err).(type) {
-	case *OperationError:
-		r.SetStatus(e.Code)
-		r.SetMessage(er.GetStatus(e.Code))
-		r.Response(er.GetHttpCode(e.Code))
-	default:
-		r.SetStatus(ERROR_INTERNAL)
-		r.SetMessage(STATUS_INTERNAL_ERROR)
-		r.Response(500)
+	e := ConvertError(*err)
+	if r.ctx.Request != nil {
+		e = shutdownErrorOr(r.ctx.Request.Context(), e)
 	}
+	observeOperationError(e.Code, METRICS_TRANSPORT_HTTP)
+	r.SetStatus(e.Code)
+	r.SetMessage(er.GetStatus(e.Code, r.Locale()))
+	if er.GetError(e.Code).Retryable && r.ctx.Writer.Header().Get(HEADER_RETRY_AFTER) == "" {
+		r.ctx.Header(HEADER_RETRY_AFTER, strconv.Itoa(RETRY_AFTER_SECONDS))
+	}
+	r.Response(er.GetHttpCode(e.Code))
 }
 
 func (r *Result) Response(code int) {
-	r.ctx.JSON(code, r)
+	if key, ok := r.Message.(MessageKey); ok {
+		r.Message = Messages.Message(r.Locale(), key)
+	}
+	NegotiateResultWriter(r.ctx).Write(r, code)
 }
 
-func (r *Result) BadRequest(msg string) {
+func (r *Result) BadRequest(err error) {
+	observeOperationError(ERROR_WRONG_REQUEST, METRICS_TRANSPORT_HTTP)
 	r.SetStatus(ERROR_WRONG_REQUEST)
-	r.SetMessage(fmt.Sprintf(BAD_REQUEST_BINDING, msg))
-	r.Response(400)
+	r.SetMessage(ConvertRequestErrors(err).Localize(Messages, r.Locale()))
+	r.Response(ERROR_REGISTRY.Get(ERROR_WRONG_REQUEST).HttpCode)
+}
+
+// Locale returns message locale requested by client in Accept-Language header.
+func (r *Result) Locale() string {
+	return Messages.Locale(r.ctx.GetHeader(HEADER_ACCEPT_LANGUAGE))
 }
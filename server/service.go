@@ -1,9 +1,11 @@
 package server
 
 import (
+	"context"
 	"time"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
 )
 
 const (
@@ -11,15 +13,15 @@ const (
 	ERROR_TRANSACTIONS_WRONG_SORT     int = 102
 	ERROR_TRANSACTIONS_WRONG_PAGE     int = 103
 	ERROR_NOT_ENOUGH_MONEY            int = 104
-	ERROR_WRONG_USER_ID               int = 105
 	ERROR_LOCK_TIMEOUT                int = 106
 	ERROR_NO_BALANCE                  int = 107
 )
 
 type TransactionData struct {
-	Id   int
-	Sum  float64
-	Desc string
+	Id    int
+	Sum   float64
+	Desc  string
+	KeyId int
 }
 
 type BalanceData struct {
@@ -28,9 +30,10 @@ type BalanceData struct {
 }
 
 type TransferData struct {
-	From int
-	To   int
-	Sum  float64
+	From  int
+	To    int
+	Sum   float64
+	KeyId int
 }
 
 type TransactionsListData struct {
@@ -39,79 +42,125 @@ type TransactionsListData struct {
 	To   int64
 	Page int
 	Sort string
+	// Limit overrides configured page size when positive.
+	Limit int
+}
+
+// PageSize is Limit when it is set and pageSize otherwise.
+func (trxData TransactionsListData) PageSize(pageSize int) int {
+	if trxData.Limit > 0 {
+		return trxData.Limit
+	}
+	return pageSize
 }
 
 type AccountService struct {
 	accRep AccountRepositoryI
+	cfg    *Config
+	log    zerolog.Logger
 }
 
-func NewAccountService(r AccountRepositoryI) *AccountService {
-	return &AccountService{r}
+func NewAccountService(r AccountRepositoryI, cfg *Config, log zerolog.Logger) *AccountService {
+	return &AccountService{r, cfg, componentLogger(log, "service")}
 }
 
-func (s *AccountService) GetUserBalance(bData *BalanceData) (float64, error) {
+// BaseCurrency is the currency balances are stored in.
+func (s *AccountService) BaseCurrency() string {
+	return s.cfg.Currency.Base
+}
+
+func (s *AccountService) GetUserBalance(ctx context.Context, bData *BalanceData) (bal float64, err error) {
+	ctx, span := startSpan(ctx, "AccountService.GetUserBalance", accountAttr(bData.Id))
+	defer func() { endSpan(span, err) }()
+	if bData.Cur == "" {
+		bData.Cur = s.BaseCurrency()
+	}
 	if len(bData.Cur) != 3 {
-		return 0, &OperationError{ERROR_BALANCE_WRONG_CURRENCY_CODE}
+		return 0, &OperationError{Code: ERROR_BALANCE_WRONG_CURRENCY_CODE}
 	}
-	curBal, err := s.accRep.GetBalance(*bData)
+	curBal, err := s.accRep.GetBalance(ctx, *bData)
 	if err != nil {
-		return 0, ConvertError(err)
+		return 0, s.convertError(ctx, err)
 	}
-	if bData.Cur != BASE_CURRENCY {
-		rate, err := GetCurrencyRate(BASE_CURRENCY, (*bData).Cur)
+	if bData.Cur != s.BaseCurrency() {
+		rate, err := GetCurrencyRate(ctx, s.cfg.Currency, s.BaseCurrency(), (*bData).Cur)
 		if err != nil {
-			return 0, ConvertError(err)
+			return 0, s.convertError(ctx, err)
 		}
 		curBal *= rate
 	}
 	return curBal, nil
 }
 
-func (s *AccountService) GetUserTransactions(trxData *TransactionsListData) (TransactionsData, error) {
+// GetBalanceVersion returns version of the account balance in the ledger, see AccountRepository.GetLastTransactionId.
+func (s *AccountService) GetBalanceVersion(ctx context.Context, id int) (int, error) {
+	last, err := s.accRep.GetLastTransactionId(ctx, id)
+	if err != nil {
+		return 0, s.convertError(ctx, err)
+	}
+	return last, nil
+}
+
+func (s *AccountService) GetUserTransactions(ctx context.Context, trxData *TransactionsListData) (res TransactionsData, err error) {
+	ctx, span := startSpan(ctx, "AccountService.GetUserTransactions", accountAttr(trxData.Id))
+	defer func() { endSpan(span, err) }()
 	var trxs []map[string]interface{}
-	var err error
 	var last int
 	var rows pgx.Rows
 	switch trxData.Sort {
 	case "date":
-		rows, err = s.accRep.GetTransactionsSortedByDate(*trxData)
+		rows, err = s.accRep.GetTransactionsSortedByDate(ctx, *trxData)
 	case "sum":
-		rows, err = s.accRep.GetTransactionsSortedBySum(*trxData)
+		rows, err = s.accRep.GetTransactionsSortedBySum(ctx, *trxData)
 	case "":
-		rows, err = s.accRep.GetTransactionsSortedByDate(*trxData)
+		rows, err = s.accRep.GetTransactionsSortedByDate(ctx, *trxData)
 	default:
-		return TransactionsData{}, &OperationError{ERROR_TRANSACTIONS_WRONG_SORT}
+		return TransactionsData{}, &OperationError{Code: ERROR_TRANSACTIONS_WRONG_SORT}
 	}
 	if err != nil {
-		return TransactionsData{}, ConvertError(err)
+		return TransactionsData{}, s.convertError(ctx, err)
 	}
-	last, trxs, err = s.transactionRowsToArray(&rows)
+	last, trxs, err = s.transactionRowsToArray(&rows, trxData.PageSize(s.cfg.Ledger.PageSize))
 	if err != nil {
-		return TransactionsData{}, ConvertError(err)
+		return TransactionsData{}, s.convertError(ctx, err)
 	}
 	if len(trxs) == 0 && trxData.Page > 0 {
-		return TransactionsData{}, &OperationError{ERROR_TRANSACTIONS_WRONG_PAGE}
+		return TransactionsData{}, &OperationError{Code: ERROR_TRANSACTIONS_WRONG_PAGE}
 	}
 	return TransactionsData{last, trxs}, nil
 }
 
-func (s *AccountService) TransferMoney(tData *TransferData) error {
-	err := s.accRep.ExecuteTransfer(*tData)
+func (s *AccountService) TransferMoney(ctx context.Context, tData *TransferData) (err error) {
+	ctx, span := startSpan(ctx, "AccountService.TransferMoney", accountAttr(tData.From))
+	defer func() { endSpan(span, err) }()
+	err = s.accRep.ExecuteTransfer(ctx, *tData)
 	if err != nil {
-		return ConvertError(err)
+		return s.convertError(ctx, err)
 	}
 	return nil
 }
 
-func (s *AccountService) DoTransaction(tData *TransactionData) error {
-	err := s.accRep.ExecuteOperation(*tData)
+func (s *AccountService) DoTransaction(ctx context.Context, tData *TransactionData) (err error) {
+	ctx, span := startSpan(ctx, "AccountService.DoTransaction", accountAttr(tData.Id))
+	defer func() { endSpan(span, err) }()
+	err = s.accRep.ExecuteOperation(ctx, *tData)
 	if err != nil {
-		return ConvertError(err)
+		return s.convertError(ctx, err)
 	}
 	return nil
 }
 
-func (s *AccountService) transactionRowsToArray(rows *pgx.Rows) (last int, trxs []map[string]interface{}, err error) {
+// convertError logs err when it has a cause hidden from clients behind operation code.
+func (s *AccountService) convertError(ctx context.Context, err error) *OperationError {
+	opErr := ConvertError(err)
+	if opErr.Err != nil {
+		logOperationError(ctx, s.log, "operation failed", err)
+	}
+	return opErr
+}
+
+func (s *AccountService) transactionRowsToArray(rows *pgx.Rows, pageSize int) (last int, trxs []map[string]interface{}, err error) {
+	defer (*rows).Close()
 	trxs = []map[string]interface{}{}
 	var (
 		sum       float64
@@ -132,14 +181,14 @@ func (s *AccountService) transactionRowsToArray(rows *pgx.Rows) (last int, trxs
 		}
 		trxs = append(trxs, trx)
 	}
-	if err != nil {
+	if err = (*rows).Err(); err != nil {
 		return 0, nil, err
 	}
 	l := len(trxs)
-	if l > PAGINATION_PAGE_SIZE {
+	if l > pageSize {
 		trxs = trxs[:l-1]
 	}
-	if l <= PAGINATION_PAGE_SIZE {
+	if l <= pageSize {
 		last = -1
 	}
 	return last, trxs, err
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/onatm/clockwerk"
+)
+
+const (
+	// SHUTDOWN_TIMEOUT is time given to in-flight requests and running jobs to finish on shutdown.
+	SHUTDOWN_TIMEOUT time.Duration = 30 * time.Second
+	// SHUTDOWN_DELAY is time between /readyz turning not ready and the start of drain, so load
+	// balancers notice the instance is leaving and stop routing new requests to it.
+	SHUTDOWN_DELAY time.Duration = 5 * time.Second
+)
+
+// HttpServer serves requests until Shutdown. Request contexts derive from server context,
+// which is canceled when drain time is over: unfinished requests roll back their
+// transactions instead of being cut when the pool is closed.
+type HttpServer struct {
+	srv      *http.Server
+	ctx      context.Context
+	cancel   context.CancelFunc
+	inFlight sync.WaitGroup
+}
+
+func NewHttpServer(addr string, handler http.Handler) *HttpServer {
+	s := &HttpServer{}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.srv = &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.inFlight.Add(1)
+			defer s.inFlight.Done()
+			handler.ServeHTTP(w, r)
+		}),
+		BaseContext: func(net.Listener) context.Context {
+			return withShutdown(s.ctx, s.ctx)
+		},
+	}
+	return s
+}
+
+func (s *HttpServer) ListenAndServe() error {
+	return ignoreServerClosed(s.srv.ListenAndServe())
+}
+
+func (s *HttpServer) Serve(lis net.Listener) error {
+	return ignoreServerClosed(s.srv.Serve(lis))
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests until ctx is done.
+// Then it cancels unfinished requests and waits until they respond with ERROR_NOT_READY.
+func (s *HttpServer) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	s.cancel()
+	if err != nil {
+		s.inFlight.Wait()
+	}
+	return err
+}
+
+func ignoreServerClosed(err error) error {
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Job is a periodic background task, ctx is canceled when shutdown time is over.
+type Job interface {
+	Run(ctx context.Context)
+}
+
+// Scheduler runs jobs periodically. Stop skips new runs and waits for running ones.
+type Scheduler struct {
+	clock   *clockwerk.Clockwerk
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	stopped bool
+	running sync.WaitGroup
+}
+
+func NewScheduler() *Scheduler {
+	s := &Scheduler{clock: clockwerk.New()}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+func (s *Scheduler) Every(period time.Duration, job Job) {
+	s.clock.Every(period).Do(scheduledJob{s, job})
+}
+
+func (s *Scheduler) Start() {
+	s.clock.Start()
+}
+
+// Stop waits for running jobs until ctx is done, then cancels their context and waits for them to return.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.clock.Stop()
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *Scheduler) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.running.Add(1)
+	return true
+}
+
+type scheduledJob struct {
+	s   *Scheduler
+	job Job
+}
+
+func (j scheduledJob) Run() {
+	if !j.s.begin() {
+		return
+	}
+	defer j.s.running.Done()
+	j.job.Run(j.s.ctx)
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ERROR_SIGNATURE_MISSING         int = 111
+	ERROR_SIGNATURE_UNKNOWN_PARTNER int = 112
+	ERROR_SIGNATURE_STALE           int = 113
+	ERROR_SIGNATURE_NONCE_REUSED    int = 114
+	ERROR_SIGNATURE_INVALID         int = 115
+
+	HEADER_SIGNATURE           string = "X-Signature"
+	HEADER_SIGNATURE_TIMESTAMP string = "X-Signature-Timestamp"
+	HEADER_SIGNATURE_NONCE     string = "X-Signature-Nonce"
+
+	// SIGNATURE_WINDOW is default allowed clock skew, see SignatureConfig.
+	SIGNATURE_WINDOW time.Duration = 5 * time.Minute
+	// SIGNATURE_MAX_BODY_SIZE bounds body read into memory to be hashed.
+	SIGNATURE_MAX_BODY_SIZE int64 = 1 << 20
+)
+
+// PartnerSecretStoreI returns HMAC secret of the partner authenticated with API key.
+type PartnerSecretStoreI interface {
+	GetSecret(keyId int) ([]byte, bool)
+}
+
+// PartnerSecrets maps API key id to partner HMAC secret.
+type PartnerSecrets map[int][]byte
+
+func (s PartnerSecrets) GetSecret(keyId int) ([]byte, bool) {
+	secret, ok := s[keyId]
+	return secret, ok
+}
+
+// LoadPartnerSecrets reads {"<api key id>": "<secret>"} JSON file.
+func LoadPartnerSecrets(path string) (PartnerSecrets, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("partner secrets %s: %w", path, err)
+	}
+	secrets := PartnerSecrets{}
+	for k, v := range raw {
+		id, err := strconv.Atoi(k)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("partner secrets %s: wrong api key id %q", path, k)
+		}
+		if v == "" {
+			return nil, fmt.Errorf("partner secrets %s: empty secret for key %d", path, id)
+		}
+		secrets[id] = []byte(v)
+	}
+	return secrets, nil
+}
+
+// LoadPartnerSecretsFromConfig returns empty store if secrets file is not set.
+func LoadPartnerSecretsFromConfig(cfg SignatureConfig) (PartnerSecrets, error) {
+	if cfg.SecretsFile == "" {
+		return PartnerSecrets{}, nil
+	}
+	return LoadPartnerSecrets(cfg.SecretsFile)
+}
+
+// NonceStoreI remembers used nonces. Use returns false if nonce was already used.
+type NonceStoreI interface {
+	Use(keyId int, nonce string, expires time.Time) bool
+}
+
+// MemoryNonceStore keeps nonces in process memory, so replay protection
+// covers requests served by this instance only. Expired nonces are purged once per window,
+// which should be the window of the verifier using the store.
+type MemoryNonceStore struct {
+	mu      sync.Mutex
+	nonces  map[string]time.Time
+	window  time.Duration
+	purged  time.Time
+	nowFunc func() time.Time
+}
+
+func NewMemoryNonceStore(window time.Duration) *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: map[string]time.Time{}, window: window, nowFunc: time.Now}
+}
+
+func (s *MemoryNonceStore) Use(keyId int, nonce string, expires time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.nowFunc()
+	if now.Sub(s.purged) > s.window {
+		for k, exp := range s.nonces {
+			if now.After(exp) {
+				delete(s.nonces, k)
+			}
+		}
+		s.purged = now
+	}
+	key := strconv.Itoa(keyId) + ":" + nonce
+	if exp, ok := s.nonces[key]; ok && !now.After(exp) {
+		return false
+	}
+	s.nonces[key] = expires
+	return true
+}
+
+type SignatureVerifier struct {
+	secrets PartnerSecretStoreI
+	nonces  NonceStoreI
+	window  time.Duration
+	nowFunc func() time.Time
+}
+
+func NewSignatureVerifier(secrets PartnerSecretStoreI, nonces NonceStoreI, window time.Duration) *SignatureVerifier {
+	return &SignatureVerifier{secrets, nonces, window, time.Now}
+}
+
+// Verify checks request of the partner authenticated with API key keyId.
+// Keys without partner secret may send unsigned requests.
+func (v *SignatureVerifier) Verify(keyId int, method string, uri string, header http.Header, body []byte) error {
+	signature := header.Get(HEADER_SIGNATURE)
+	timestamp := header.Get(HEADER_SIGNATURE_TIMESTAMP)
+	nonce := header.Get(HEADER_SIGNATURE_NONCE)
+	secret, partner := v.secrets.GetSecret(keyId)
+	if !partner {
+		if signature != "" {
+			return &OperationError{Code: ERROR_SIGNATURE_UNKNOWN_PARTNER}
+		}
+		return nil
+	}
+	if signature == "" || timestamp == "" || nonce == "" {
+		return &OperationError{Code: ERROR_SIGNATURE_MISSING}
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return &OperationError{Code: ERROR_SIGNATURE_STALE}
+	}
+	signed := time.Unix(ts, 0)
+	now := v.nowFunc()
+	if signed.Before(now.Add(-v.window)) || signed.After(now.Add(v.window)) {
+		return &OperationError{Code: ERROR_SIGNATURE_STALE}
+	}
+	want := SignRequest(secret, method, uri, timestamp, nonce, body)
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(want)) {
+		return &OperationError{Code: ERROR_SIGNATURE_INVALID}
+	}
+	if !v.nonces.Use(keyId, nonce, signed.Add(v.window)) {
+		return &OperationError{Code: ERROR_SIGNATURE_NONCE_REUSED}
+	}
+	return nil
+}
+
+// SignRequest returns hex HMAC-SHA256 of "METHOD\nURI\nTIMESTAMP\nNONCE\nhex(SHA256(body))".
+func SignRequest(secret []byte, method string, uri string, timestamp string, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{strings.ToUpper(method), uri, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks HMAC signature of requests made by partners. Must be mounted after Authenticate.
+// Bodies larger than SIGNATURE_MAX_BODY_SIZE are rejected before they are hashed.
+func VerifySignature(v *SignatureVerifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, SIGNATURE_MAX_BODY_SIZE))
+		if err != nil {
+			NewResult(c).BadRequest(err)
+			c.Abort()
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		err = v.Verify(principalKeyId(c), c.Request.Method, c.Request.URL.RequestURI(), c.Request.Header, body)
+		if err != nil {
+			NewResult(c).Err(&err, &AccountExpectedResult)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
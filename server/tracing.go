@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	TRACER_NAME  string = "balance-server"
+	SERVICE_NAME string = "balance-server"
+
+	TRACES_EXPORTER_NONE   string = "none"
+	TRACES_EXPORTER_OTLP   string = "otlp"
+	TRACES_EXPORTER_STDOUT string = "stdout"
+
+	DB_SYSTEM_POSTGRES string = "postgresql"
+)
+
+// InitTracing installs tracer provider and W3C trace context propagation.
+func InitTracing(tp trace.TracerProvider) {
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// NewTracerProviderFromConfig creates provider exporting spans as selected by cfg.Exporter.
+// With empty or "none" exporter spans are not exported, but trace context is still propagated.
+func NewTracerProviderFromConfig(ctx context.Context, cfg TracingConfig) (*sdktrace.TracerProvider, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "", TRACES_EXPORTER_NONE:
+		return sdktrace.NewTracerProvider(sdktrace.WithResource(tracingResource())), nil
+	case TRACES_EXPORTER_OTLP:
+		exp, err = otlptracegrpc.New(ctx)
+	case TRACES_EXPORTER_STDOUT:
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown traces exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(tracingResource())), nil
+}
+
+func tracingResource() *resource.Resource {
+	return resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(SERVICE_NAME))
+}
+
+// Tracing starts server span of the request, continuing trace from traceparent header.
+// Handlers get the span context from c.Request.Context().
+func Tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = METRICS_ROUTE_UNMATCHED
+		}
+		ctx, span := otel.Tracer(TRACER_NAME).Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(c.Request.Method),
+				semconv.HTTPRouteKey.String(route),
+				semconv.HTTPTargetKey.String(c.Request.URL.RequestURI()),
+			),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+	}
+}
+
+// startSpan starts internal span of service layer.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(TRACER_NAME).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func accountAttr(id int) attribute.KeyValue {
+	return attribute.Int("account.id", id)
+}
+
+// tracedTx creates span for every SQL statement executed in transaction.
+type tracedTx struct {
+	pgx.Tx
+}
+
+func (t tracedTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	ctx, span := startSqlSpan(ctx, sql)
+	tag, err := t.Tx.Exec(ctx, sql, args...)
+	endSpan(span, err)
+	return tag, err
+}
+
+// Query span ends when the query returns, rows are read afterwards.
+func (t tracedTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	ctx, span := startSqlSpan(ctx, sql)
+	rows, err := t.Tx.Query(ctx, sql, args...)
+	endSpan(span, err)
+	return rows, err
+}
+
+func (t tracedTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	ctx, span := startSqlSpan(ctx, sql)
+	return tracedRow{t.Tx.QueryRow(ctx, sql, args...), span}
+}
+
+type tracedRow struct {
+	pgx.Row
+	span trace.Span
+}
+
+func (r tracedRow) Scan(dest ...interface{}) error {
+	err := r.Row.Scan(dest...)
+	if err == pgx.ErrNoRows {
+		r.span.End()
+		return err
+	}
+	endSpan(r.span, err)
+	return err
+}
+
+func startSqlSpan(ctx context.Context, sql string) (context.Context, trace.Span) {
+	op := sql
+	if f := strings.Fields(sql); len(f) > 0 {
+		op = strings.ToUpper(f[0])
+	}
+	return otel.Tracer(TRACER_NAME).Start(ctx, op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemKey.String(DB_SYSTEM_POSTGRES),
+			semconv.DBOperationKey.String(op),
+			semconv.DBStatementKey.String(sql),
+		),
+	)
+}
+
+// metadataCarrier adapts gRPC metadata to trace context propagator.
+type metadataCarrier metadata.MD
+
+func (m metadataCarrier) Get(key string) string {
+	v := metadata.MD(m).Get(key)
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
+func (m metadataCarrier) Set(key string, value string) {
+	metadata.MD(m).Set(key, value)
+}
+
+func (m metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func startGrpcSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	return otel.Tracer(TRACER_NAME).Start(ctx, strings.TrimPrefix(method, "/"),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.RPCSystemKey.String("grpc"), attribute.String("rpc.method", method)),
+	)
+}
+
+func traceUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, span := startGrpcSpan(ctx, info.FullMethod)
+	res, err := handler(ctx, req)
+	endSpan(span, err)
+	return res, err
+}
+
+func traceStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, span := startGrpcSpan(stream.Context(), info.FullMethod)
+	err := handler(srv, &contextStream{stream, ctx})
+	endSpan(span, err)
+	return err
+}
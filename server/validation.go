@@ -0,0 +1,153 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+const (
+	RULE_REQUIRED  string = "required"
+	RULE_NUMERIC   string = "numeric"
+	RULE_GTE       string = "gte"
+	RULE_GT        string = "gt"
+	RULE_LTE       string = "lte"
+	RULE_LT        string = "lt"
+	RULE_NEFIELD   string = "nefield"
+	RULE_LTEFIELD  string = "ltefield"
+	RULE_TYPE      string = "type"
+	RULE_MALFORMED string = "malformed"
+	RULE_MAX       string = "max"
+
+	VALIDATION_INVALID   int = 1000
+	VALIDATION_REQUIRED  int = 1001
+	VALIDATION_NUMERIC   int = 1002
+	VALIDATION_GTE       int = 1003
+	VALIDATION_GT        int = 1004
+	VALIDATION_LTE       int = 1005
+	VALIDATION_LT        int = 1006
+	VALIDATION_NEFIELD   int = 1007
+	VALIDATION_LTEFIELD  int = 1008
+	VALIDATION_TYPE      int = 1009
+	VALIDATION_MALFORMED int = 1010
+	VALIDATION_MAX       int = 1011
+)
+
+var (
+	VALIDATION_RULE_CODE = map[string]int{
+		RULE_REQUIRED:  VALIDATION_REQUIRED,
+		RULE_NUMERIC:   VALIDATION_NUMERIC,
+		RULE_GTE:       VALIDATION_GTE,
+		RULE_GT:        VALIDATION_GT,
+		RULE_LTE:       VALIDATION_LTE,
+		RULE_LT:        VALIDATION_LT,
+		RULE_NEFIELD:   VALIDATION_NEFIELD,
+		RULE_LTEFIELD:  VALIDATION_LTEFIELD,
+		RULE_TYPE:      VALIDATION_TYPE,
+		RULE_MALFORMED: VALIDATION_MALFORMED,
+		RULE_MAX:       VALIDATION_MAX,
+	}
+)
+
+func init() {
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(requestFieldName)
+	}
+}
+
+type ValidationError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Param   string `json:"-"`
+}
+
+type RequestErrors []ValidationError
+
+func (errs RequestErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Message)
+	}
+	return strings.Join(msgs, ", ")
+}
+
+func NewValidationError(field string, rule string, param string) ValidationError {
+	code, ok := VALIDATION_RULE_CODE[rule]
+	if !ok {
+		code = VALIDATION_INVALID
+	}
+	e := ValidationError{Field: field, Rule: rule, Code: code, Param: param}
+	e.Message = e.Localize(Messages, DEFAULT_LOCALE)
+	return e
+}
+
+// Localize formats validation message from catalog in the given locale.
+func (e ValidationError) Localize(c *MessageCatalog, locale string) string {
+	status := c.Status(locale, e.Code)
+	subject := e.Field
+	if subject == "" {
+		subject = c.Message(locale, MESSAGE_VALUE)
+	}
+	switch strings.Count(status, "%s") {
+	case 0:
+		return status
+	case 1:
+		return fmt.Sprintf(status, subject)
+	default:
+		return fmt.Sprintf(status, subject, e.Param)
+	}
+}
+
+func (errs RequestErrors) Localize(c *MessageCatalog, locale string) RequestErrors {
+	localized := make(RequestErrors, len(errs))
+	for i, e := range errs {
+		e.Message = e.Localize(c, locale)
+		localized[i] = e
+	}
+	return localized
+}
+
+// ConvertRequestErrors converts binding error to the list of validation errors.
+func ConvertRequestErrors(err error) RequestErrors {
+	var reqErrs RequestErrors
+	var valErrs validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+	var numErr *strconv.NumError
+	switch {
+	case errors.As(err, &reqErrs):
+		return reqErrs
+	case errors.As(err, &valErrs):
+		reqErrs = make(RequestErrors, 0, len(valErrs))
+		for _, e := range valErrs {
+			reqErrs = append(reqErrs, NewValidationError(e.Field(), e.Tag(), e.Param()))
+		}
+		return reqErrs
+	case errors.As(err, &typeErr):
+		return RequestErrors{NewValidationError(typeErr.Field, RULE_TYPE, "")}
+	case errors.As(err, &numErr):
+		return RequestErrors{NewValidationError("", RULE_TYPE, "")}
+	default:
+		return RequestErrors{NewValidationError("", RULE_MALFORMED, "")}
+	}
+}
+
+func requestFieldName(f reflect.StructField) string {
+	for _, tag := range []string{"json", "form", "uri"} {
+		name := strings.Split(f.Tag.Get(tag), ",")[0]
+		if name == "-" {
+			return ""
+		}
+		if name != "" {
+			return name
+		}
+	}
+	return f.Name
+}
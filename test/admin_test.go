@@ -0,0 +1,180 @@
+package tests
+
+import (
+	"balance-server/server"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type MockAdminRepository struct {
+	balance map[int]float64
+	frozen  map[int]bool
+	audit   []server.AuditRecord
+}
+
+func NewMockAdminRepository() *MockAdminRepository {
+	return &MockAdminRepository{balance: map[int]float64{}, frozen: map[int]bool{}}
+}
+
+func (rep *MockAdminRepository) SearchTransactions(ctx context.Context, sData server.TransactionsSearchData, limit int) ([]server.AdminTransaction, error) {
+	return []server.AdminTransaction{}, nil
+}
+
+func (rep *MockAdminRepository) Adjust(ctx context.Context, aData server.AdjustmentData) (server.AuditRecord, error) {
+	before := rep.balance[aData.Account]
+	if before+aData.Sum < 0 {
+		return server.AuditRecord{}, &server.OperationError{Code: server.ERROR_NOT_ENOUGH_MONEY}
+	}
+	rep.balance[aData.Account] = before + aData.Sum
+	return rep.record(aData.Actor, server.AUDIT_ACTION_ADJUST, aData.Account, "balance", before, before+aData.Sum, aData.Reason), nil
+}
+
+func (rep *MockAdminRepository) SetFrozen(ctx context.Context, fData server.FreezeData) (server.AuditRecord, error) {
+	before := rep.frozen[fData.Account]
+	if before == fData.Frozen {
+		return server.AuditRecord{}, &server.OperationError{Code: server.ERROR_STATE_UNCHANGED}
+	}
+	rep.frozen[fData.Account] = fData.Frozen
+	action := server.AUDIT_ACTION_UNFREEZE
+	if fData.Frozen {
+		action = server.AUDIT_ACTION_FREEZE
+	}
+	return rep.record(fData.Actor, action, fData.Account, "frozen", before, fData.Frozen, fData.Reason), nil
+}
+
+func (rep *MockAdminRepository) GetAuditRecords(ctx context.Context, account int, cursor int, limit int) ([]server.AuditRecord, error) {
+	return rep.audit, nil
+}
+
+func (rep *MockAdminRepository) record(actor string, action string, account int, field string, before interface{}, after interface{}, reason string) server.AuditRecord {
+	rec := server.AuditRecord{
+		Id:      len(rep.audit) + 1,
+		Actor:   actor,
+		Action:  action,
+		Account: account,
+		Before:  map[string]interface{}{field: before},
+		After:   map[string]interface{}{field: after},
+		Reason:  reason,
+	}
+	rep.audit = append(rep.audit, rec)
+	return rec
+}
+
+func TestAdminRoles(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(keys, nil), Admin: NewMockAdminRepository()})
+	viewer := issueKey(t, keys, []string{server.ROLE_VIEWER}, nil)
+	operator := issueKey(t, keys, []string{server.ROLE_OPERATOR}, nil)
+	auditor := issueKey(t, keys, []string{server.ROLE_AUDITOR}, nil)
+	client := issueKey(t, keys, []string{server.SCOPE_TRANSACTIONS_READ}, nil)
+	adjust := `{"account": 1, "sum": 10, "reason": "refund"}`
+
+	assert.Equal(t, 200, makeAuthRequest(t, r, "GET", "/admin/transactions?account=1", "", viewer))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "POST", "/admin/adjustments", adjust, viewer))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "GET", "/admin/audit", "", viewer))
+
+	assert.Equal(t, 200, makeAuthRequest(t, r, "GET", "/admin/transactions", "", operator))
+	assert.Equal(t, 200, makeAuthRequest(t, r, "POST", "/admin/adjustments", adjust, operator))
+	assert.Equal(t, 200, makeAuthRequest(t, r, "POST", "/admin/accounts/1/freeze", `{"reason": "fraud"}`, operator))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "GET", "/admin/audit", "", operator))
+
+	assert.Equal(t, 200, makeAuthRequest(t, r, "GET", "/admin/audit", "", auditor))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "POST", "/admin/accounts/1/unfreeze", `{"reason": "ok"}`, auditor))
+
+	assert.Equal(t, 403, makeAuthRequest(t, r, "GET", "/admin/transactions", "", client))
+	assert.Equal(t, 401, makeAuthRequest(t, r, "GET", "/admin/transactions", "", ""))
+}
+
+func TestAdminAudit(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	rep := NewMockAdminRepository()
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(keys, nil), Admin: rep})
+	operator := issueKey(t, keys, []string{server.ROLE_OPERATOR}, nil)
+
+	assert.Equal(t, 200, makeAuthRequest(t, r, "POST", "/admin/adjustments", `{"account": 3, "sum": 25.5, "reason": " chargeback "}`, operator))
+	assert.Equal(t, 200, makeAuthRequest(t, r, "POST", "/admin/accounts/3/freeze", `{"reason": "fraud"}`, operator))
+	assert.Equal(t, 409, makeAuthRequest(t, r, "POST", "/admin/accounts/3/freeze", `{"reason": "fraud"}`, operator))
+	assert.Equal(t, 422, makeAuthRequest(t, r, "POST", "/admin/adjustments", `{"account": 3, "sum": -100, "reason": "fix"}`, operator))
+
+	assert.Len(t, rep.audit, 2)
+	assert.Equal(t, "apikey:1:test", rep.audit[0].Actor)
+	assert.Equal(t, server.AUDIT_ACTION_ADJUST, rep.audit[0].Action)
+	assert.Equal(t, "chargeback", rep.audit[0].Reason)
+	assert.Equal(t, 0.0, rep.audit[0].Before["balance"])
+	assert.Equal(t, 25.5, rep.audit[0].After["balance"])
+	assert.Equal(t, server.AUDIT_ACTION_FREEZE, rep.audit[1].Action)
+	assert.Equal(t, false, rep.audit[1].Before["frozen"])
+	assert.Equal(t, true, rep.audit[1].After["frozen"])
+}
+
+func TestAdminReasonRequired(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	rep := NewMockAdminRepository()
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(keys, nil), Admin: rep})
+	operator := issueKey(t, keys, []string{server.ROLE_OPERATOR}, nil)
+
+	for _, body := range []string{
+		`{"account": 1, "sum": 10}`,
+		`{"account": 1, "sum": 10, "reason": "   "}`,
+	} {
+		req, _ := http.NewRequest("POST", "/admin/adjustments", bytes.NewBufferString(body))
+		req.Header.Set(server.HEADER_AUTHORIZATION, operator)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, 400, rec.Code)
+		var res map[string]interface{}
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		assert.Contains(t, rec.Body.String(), `"field":"reason"`)
+	}
+	assert.Equal(t, 400, makeAuthRequest(t, r, "POST", "/admin/accounts/1/freeze", `{}`, operator))
+	assert.Empty(t, rep.audit)
+}
+
+func TestAdminAuthorizeBeforeValidation(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(keys, nil), Admin: NewMockAdminRepository()})
+	viewer := issueKey(t, keys, []string{server.ROLE_VIEWER}, nil)
+	client := issueKey(t, keys, []string{server.SCOPE_TRANSACTIONS_READ}, nil)
+
+	assert.Equal(t, 403, makeAuthRequest(t, r, "POST", "/admin/adjustments", `{"sum": "wrong"}`, viewer))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "POST", "/admin/accounts/0/freeze", `{}`, viewer))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "GET", "/admin/transactions?start=20&end=10", "", client))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "GET", "/admin/audit?account=wrong", "", client))
+}
+
+func TestAdminRoleIssue(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	_, _, err := keys.Issue(context.Background(), "support", []string{server.ROLE_OPERATOR}, []int{1})
+	assert.NotNil(t, err)
+
+	key := server.ApiKey{Scopes: []string{server.ROLE_AUDITOR}}
+	assert.True(t, key.HasScope(server.SCOPE_ADMIN_AUDIT_READ))
+	assert.True(t, key.HasScope(server.SCOPE_ADMIN_TRANSACTIONS_READ))
+	assert.False(t, key.HasScope(server.SCOPE_ADMIN_ADJUST))
+	assert.False(t, key.HasScope(server.SCOPE_BALANCE_READ))
+}
+
+func TestAdjustFrozenAccount(t *testing.T) {
+	const account = 123150
+	ctx := context.Background()
+	admRep := server.NewAdminRepository(testDb)
+	_, err := admRep.Adjust(ctx, server.AdjustmentData{Account: account, Sum: 20, Reason: "deposit", Actor: "test"})
+	assert.Nil(t, err)
+	_, err = admRep.SetFrozen(ctx, server.FreezeData{Account: account, Frozen: true, Reason: "fraud", Actor: "test"})
+	assert.Nil(t, err)
+
+	_, err = admRep.Adjust(ctx, server.AdjustmentData{Account: account, Sum: -5, Reason: "chargeback", Actor: "test"})
+	assert.True(t, errors.Is(err, &server.OperationError{Code: server.ERROR_ACCOUNT_FROZEN}), err)
+	_, err = admRep.Adjust(ctx, server.AdjustmentData{Account: account, Sum: 5, Reason: "refund", Actor: "test"})
+	assert.Nil(t, err, "Credit adjustment of frozen account is allowed")
+	bal, err := testRep.GetBalance(ctx, server.BalanceData{Id: account})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(25), bal)
+}
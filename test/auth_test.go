@@ -0,0 +1,274 @@
+package tests
+
+import (
+	"balance-server/pb"
+	"balance-server/server"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+type MockApiKeyRepository struct {
+	keys   map[string]server.ApiKey
+	nextId int
+}
+
+func NewMockApiKeyRepository() *MockApiKeyRepository {
+	return &MockApiKeyRepository{keys: map[string]server.ApiKey{}, nextId: 1}
+}
+
+func (rep *MockApiKeyRepository) CreateApiKey(ctx context.Context, key server.ApiKey, hash string) (server.ApiKey, error) {
+	key.Id = rep.nextId
+	key.Created = 1
+	rep.nextId++
+	rep.keys[hash] = key
+	return key, nil
+}
+
+func (rep *MockApiKeyRepository) GetApiKeyByHash(ctx context.Context, hash string) (server.ApiKey, error) {
+	key, ok := rep.keys[hash]
+	if !ok {
+		return key, &server.OperationError{Code: server.ERROR_UNAUTHORIZED}
+	}
+	return key, nil
+}
+
+func (rep *MockApiKeyRepository) ListApiKeys(ctx context.Context) ([]server.ApiKey, error) {
+	list := []server.ApiKey{}
+	for id := 1; id < rep.nextId; id++ {
+		for _, k := range rep.keys {
+			if k.Id == id {
+				list = append(list, k)
+			}
+		}
+	}
+	return list, nil
+}
+
+func (rep *MockApiKeyRepository) RevokeApiKey(ctx context.Context, id int) error {
+	for h, k := range rep.keys {
+		if k.Id == id && k.Revoked == 0 {
+			k.Revoked = 2
+			rep.keys[h] = k
+			return nil
+		}
+	}
+	return fmt.Errorf("api key %d not found or already revoked", id)
+}
+
+var (
+	// testAuth authenticates requests of test routers, testAuthorization is a key with every scope.
+	testKeys          = server.NewApiKeyService(NewMockApiKeyRepository())
+	testAuth          = server.NewAuthenticator(testKeys, nil)
+	testAuthorization = issueTestKey()
+)
+
+func issueTestKey() string {
+	secret, _, err := testKeys.Issue(context.Background(), "test", server.API_KEY_SCOPES, nil)
+	if err != nil {
+		panic(err)
+	}
+	return server.AUTH_SCHEME_API_KEY + " " + secret
+}
+
+// authorized sets testAuthorization on requests to routers mounted with testAuth.
+func authorized(req *http.Request) *http.Request {
+	req.Header.Set(server.HEADER_AUTHORIZATION, testAuthorization)
+	return req
+}
+
+// grpcAuthorized sends testAuthorization with every call of the client.
+func grpcAuthorized() []grpc.DialOption {
+	withAuth := func(ctx context.Context) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, server.HEADER_AUTHORIZATION, testAuthorization)
+	}
+	return []grpc.DialOption{
+		grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(withAuth(ctx), method, req, reply, cc, opts...)
+		}),
+		grpc.WithStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(withAuth(ctx), desc, cc, method, opts...)
+		}),
+	}
+}
+
+// issueKey returns Authorization header value with a new API key.
+func issueKey(t *testing.T, keys *server.ApiKeyService, scopes []string, accounts []int) string {
+	secret, _, err := keys.Issue(context.Background(), "test", scopes, accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server.AUTH_SCHEME_API_KEY + " " + secret
+}
+
+func makeAuthRequest(t *testing.T, r *gin.Engine, m string, path string, body string, authorization string) int {
+	req, err := http.NewRequest(m, path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		req.Header.Set(server.HEADER_AUTHORIZATION, authorization)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestApiKeyAuthentication(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	rep := &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 10, nil
+		},
+	}
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(keys, nil), Accounts: rep})
+	header := issueKey(t, keys, []string{server.SCOPE_BALANCE_READ}, nil)
+
+	req, _ := http.NewRequest("GET", "/accounts/1/balance", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, 401, rec.Code)
+	assert.Equal(t, server.AUTH_SCHEME_API_KEY, rec.Header().Get(server.HEADER_WWW_AUTHENTICATE))
+
+	assert.Equal(t, 401, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", server.AUTH_SCHEME_API_KEY+" bsk_wrong"))
+	assert.Equal(t, 401, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", ""))
+	assert.Equal(t, 200, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", header))
+
+	key, err := keys.Authenticate(context.Background(), strings.TrimPrefix(header, server.AUTH_SCHEME_API_KEY+" "))
+	assert.Nil(t, err)
+	assert.Nil(t, keys.Revoke(context.Background(), key.Id))
+	assert.Equal(t, 401, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", header))
+}
+
+func TestApiKeyScopes(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	var keyId int
+	rep := &MockAccountRepository{
+		executeTransactionFunc: func(trxData server.TransactionData, oCode int) error {
+			keyId = trxData.KeyId
+			return nil
+		},
+		executeTransferFunc: func(tData server.TransferData) error {
+			keyId = tData.KeyId
+			return nil
+		},
+	}
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(keys, nil), Accounts: rep})
+	credit := issueKey(t, keys, []string{server.SCOPE_TRANSACTION_CREDIT}, nil)
+	transfer := issueKey(t, keys, []string{server.SCOPE_TRANSFER}, nil)
+
+	assert.Equal(t, 403, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", credit))
+	assert.Equal(t, 200, makeAuthRequest(t, r, "POST", server.URL_TRANSACTION, `{"id": 1, "sum": 10}`, credit))
+	assert.Equal(t, 1, keyId)
+	assert.Equal(t, 403, makeAuthRequest(t, r, "POST", server.URL_TRANSACTION, `{"id": 1, "sum": -10}`, credit))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "POST", server.URL_TRANSFER, `{"id": 1, "to": 2, "sum": 10}`, credit))
+	assert.Equal(t, 200, makeAuthRequest(t, r, "POST", server.URL_TRANSFER, `{"id": 1, "to": 2, "sum": 10}`, transfer))
+	assert.Equal(t, 2, keyId)
+}
+
+func TestApiKeyAccountAllowlist(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	rep := &MockAccountRepository{
+		executeTransferFunc: func(tData server.TransferData) error {
+			return nil
+		},
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 10, nil
+		},
+	}
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(keys, nil), Accounts: rep})
+	header := issueKey(t, keys, []string{server.SCOPE_BALANCE_READ, server.SCOPE_TRANSFER}, []int{1})
+
+	assert.Equal(t, 200, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", header))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "GET", "/accounts/2/balance", "", header))
+	assert.Equal(t, 200, makeAuthRequest(t, r, "POST", server.URL_TRANSFER, `{"id": 1, "to": 2, "sum": 10}`, header))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "POST", server.URL_TRANSFER, `{"id": 2, "to": 1, "sum": 10}`, header))
+}
+
+func TestApiKeyIssueUnknownScope(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	_, _, err := keys.Issue(context.Background(), "test", []string{"money:print"}, nil)
+	assert.NotNil(t, err)
+	_, _, err = keys.Issue(context.Background(), "test", nil, nil)
+	assert.NotNil(t, err)
+}
+
+func TestApiKeyHashed(t *testing.T) {
+	keyRep := NewMockApiKeyRepository()
+	keys := server.NewApiKeyService(keyRep)
+	secret, _, err := keys.Issue(context.Background(), "test", []string{server.SCOPE_TRANSFER}, nil)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(secret, server.API_KEY_PREFIX))
+	_, stored := keyRep.keys[secret]
+	assert.False(t, stored, "Secret must not be stored in plain text")
+	_, stored = keyRep.keys[server.HashApiKey(secret)]
+	assert.True(t, stored)
+}
+
+func TestGrpcApiKey(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	rep := &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 10, nil
+		},
+	}
+	client := newGrpcServerClient(t, server.NewAccountGrpcServer(server.NewAccountService(rep, server.DefaultConfig(), zerolog.Nop()), server.NewAuthenticator(keys, nil), zerolog.Nop()))
+	header := issueKey(t, keys, []string{server.SCOPE_BALANCE_READ}, []int{1})
+	_, err := client.Balance(context.Background(), &pb.BalanceRequest{Id: 1})
+	grpcTest(t, err, codes.Unauthenticated, server.ERROR_UNAUTHORIZED)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), strings.ToLower(server.HEADER_AUTHORIZATION), header)
+	res, err := client.Balance(ctx, &pb.BalanceRequest{Id: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(10), res.GetBalance())
+	_, err = client.Balance(ctx, &pb.BalanceRequest{Id: 2})
+	grpcTest(t, err, codes.PermissionDenied, server.ERROR_FORBIDDEN)
+	_, err = client.Transaction(ctx, &pb.TransactionRequest{Id: 1, Sum: 10})
+	grpcTest(t, err, codes.PermissionDenied, server.ERROR_FORBIDDEN)
+}
+
+func TestAuthorizeWithoutPrincipal(t *testing.T) {
+	rep := &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 10, nil
+		},
+	}
+	r := gin.New()
+	r.GET(server.URL_ACCOUNT_BALANCE, server.NewAccountController(rep, zerolog.Nop()).AccountBalance)
+	assert.Equal(t, 401, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", ""))
+
+	client := newGrpcServerClient(t, server.NewAccountGrpcServer(server.NewAccountService(rep, server.DefaultConfig(), zerolog.Nop()), nil, zerolog.Nop()))
+	_, err := client.Balance(context.Background(), &pb.BalanceRequest{Id: 1})
+	grpcTest(t, err, codes.Unauthenticated, server.ERROR_UNAUTHORIZED)
+}
+
+func TestApiKeyCommand(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	var out bytes.Buffer
+	err := server.ApiKeyCommand(keys, []string{"issue", "-name", "partner", "-scopes", "balance:read,transfer", "-accounts", "1,2"}, &out)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), server.API_KEY_PREFIX)
+
+	out.Reset()
+	assert.Nil(t, server.ApiKeyCommand(keys, []string{"list"}, &out))
+	assert.Contains(t, out.String(), "partner")
+	assert.Contains(t, out.String(), "balance:read,transfer")
+	assert.Contains(t, out.String(), "1,2")
+
+	assert.Nil(t, server.ApiKeyCommand(keys, []string{"revoke", "-id", "1"}, &out))
+	assert.NotNil(t, server.ApiKeyCommand(keys, []string{"revoke", "-id", "1"}, &out))
+	assert.NotNil(t, server.ApiKeyCommand(keys, []string{"issue", "-scopes", "everything"}, &out))
+	assert.NotNil(t, server.ApiKeyCommand(keys, []string{"issue", "-scopes", "transfer", "-accounts", "x"}, &out))
+	assert.NotNil(t, server.ApiKeyCommand(keys, []string{"rotate"}, &out))
+}
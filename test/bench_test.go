@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"balance-server/server"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	TEST_BENCH_FIRST_ACCOUNT int = 4900
+	TEST_BENCH_ACCOUNTS      int = 10
+
+	TEST_BENCH_SCHEMA string = "balance_bench_test"
+)
+
+func TestParseBenchMix(t *testing.T) {
+	mix, err := server.ParseBenchMix("transfer=3, history=1")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{server.BENCH_OP_TRANSFER: 3, server.BENCH_OP_HISTORY: 1}, mix)
+
+	for _, wrong := range []string{"transfer", "debit=-1", "history=many"} {
+		_, err := server.ParseBenchMix(wrong)
+		assert.NotNil(t, err, wrong)
+	}
+}
+
+func TestBenchConfigValidate(t *testing.T) {
+	assert.Nil(t, server.DefaultBenchConfig().Validate())
+
+	cfg := server.DefaultBenchConfig()
+	cfg.Accounts = 1
+	cfg.Skew = 0.5
+	cfg.Workers = 0
+	cfg.HistorySort = "amount"
+	cfg.Mix = map[string]int{"refund": 1}
+	err := cfg.Validate()
+	if assert.NotNil(t, err) {
+		for _, field := range []string{"accounts", "skew", "workers", "history_sort", "mix: unknown operation"} {
+			assert.Contains(t, err.Error(), field)
+		}
+	}
+	cfg = server.DefaultBenchConfig()
+	cfg.Mix = map[string]int{server.BENCH_OP_DEBIT: 0}
+	assert.NotNil(t, cfg.Validate(), "Mix without weights has nothing to run")
+}
+
+func TestBenchCommandWrongFlags(t *testing.T) {
+	var out bytes.Buffer
+	assert.NotNil(t, server.BenchCommand(nil, nil, zerolog.Nop(), []string{"-mix", "transfer"}, &out))
+	assert.NotNil(t, server.BenchCommand(nil, nil, zerolog.Nop(), []string{"-skew", "1"}, &out), "Config should be validated before database is used")
+	assert.NotNil(t, server.BenchCommand(nil, nil, zerolog.Nop(), []string{"-schema", ""}, &out))
+}
+
+func TestBenchRun(t *testing.T) {
+	ctx := context.Background()
+	srvCfg := server.DefaultConfig()
+	srvCfg.Database.Url = os.Getenv("PGX_TEST_DATABASE")
+	cfg := server.DefaultBenchConfig()
+	cfg.Schema = TEST_BENCH_SCHEMA
+	cfg.Accounts = TEST_BENCH_ACCOUNTS
+	cfg.Transactions = 200
+	cfg.FirstAccount = TEST_BENCH_FIRST_ACCOUNT
+	cfg.Workers = 4
+	cfg.Duration = server.Duration(time.Second)
+	report, err := server.NewBench(testDb, srvCfg, cfg, zerolog.Nop()).Run(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, cfg.Transactions, report.Seed.Transactions)
+	assert.NotZero(t, report.Total.Count)
+	assert.Zero(t, report.Total.Errors)
+	sum := 0
+	for _, op := range server.BENCH_OPERATIONS {
+		st := report.Operations[op]
+		sum += st.Count
+		assert.LessOrEqual(t, st.P50, st.P99, op)
+	}
+	assert.Equal(t, report.Total.Count, sum)
+
+	var used int
+	assert.Nil(t, testDb.Conn.QueryRow(ctx, "SELECT COUNT(*) FROM transactions WHERE account BETWEEN $1 AND $2", TEST_BENCH_FIRST_ACCOUNT, TEST_BENCH_FIRST_ACCOUNT+TEST_BENCH_ACCOUNTS-1).Scan(&used))
+	assert.Zero(t, used, "Bench should not write to live ledger")
+	var exists bool
+	assert.Nil(t, testDb.Conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_namespace WHERE nspname = $1)", TEST_BENCH_SCHEMA).Scan(&exists))
+	assert.False(t, exists, "Bench schema should be dropped after the run")
+
+	_, err = testDb.Conn.Exec(ctx, "CREATE SCHEMA "+TEST_BENCH_SCHEMA)
+	assert.Nil(t, err)
+	_, err = server.NewBench(testDb, srvCfg, cfg, zerolog.Nop()).Run(ctx)
+	assert.NotNil(t, err, "Bench should refuse existing schema")
+	testDb.Conn.Exec(ctx, "DROP SCHEMA "+TEST_BENCH_SCHEMA)
+
+	var out bytes.Buffer
+	assert.Nil(t, json.NewEncoder(&out).Encode(report))
+	assert.Contains(t, out.String(), `"p99_ms"`)
+}
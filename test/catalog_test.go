@@ -0,0 +1,44 @@
+package tests
+
+import (
+	"balance-server/server"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageCatalogBundlesComplete(t *testing.T) {
+	want := server.Messages.Keys(server.DEFAULT_LOCALE)
+	for _, l := range server.Messages.Locales() {
+		assert.Equal(t, want, server.Messages.Keys(l), "Locale ", l, " has different message keys")
+	}
+	for _, code := range server.ERROR_REGISTRY.Codes() {
+		assert.NotEmpty(t, server.AccountExpectedResult.GetStatus(code, server.DEFAULT_LOCALE), "No message for code ", code)
+	}
+}
+
+func TestMessageCatalogLocale(t *testing.T) {
+	assert.Equal(t, "ru", server.Messages.Locale("ru-RU,ru;q=0.9,en;q=0.8"))
+	assert.Equal(t, "en", server.Messages.Locale("en-US"))
+	assert.Equal(t, "ru", server.Messages.Locale("de;q=0.9,ru;q=0.5"))
+	assert.Equal(t, server.DEFAULT_LOCALE, server.Messages.Locale("de"))
+	assert.Equal(t, server.DEFAULT_LOCALE, server.Messages.Locale(""))
+}
+
+func TestAcceptLanguage(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/accounts/-1/balance", nil)
+	req.Header.Set(server.HEADER_ACCEPT_LANGUAGE, "ru")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, authorized(req))
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Поле id должно быть больше или равно 0")
+
+	req, _ = http.NewRequest("GET", "/nothing", nil)
+	req.Header.Set(server.HEADER_ACCEPT_LANGUAGE, "ru-RU")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, 404, rec.Code)
+	assert.Contains(t, rec.Body.String(), server.Messages.Message("ru", server.MESSAGE_NO_ROUTE))
+}
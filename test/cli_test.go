@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"balance-server/server"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	TEST_CLI_EXPORT_ACCOUNT int = 4801
+)
+
+type commandResponse struct {
+	Status int             `json:"status"`
+	Data   json.RawMessage `json:"data"`
+}
+
+func newCommandService(rep *MockAccountRepository) *server.AccountService {
+	return server.NewAccountService(rep, server.DefaultConfig(), zerolog.Nop())
+}
+
+func newCommandAdminService() (*server.AdminService, *MockAdminRepository) {
+	rep := NewMockAdminRepository()
+	return server.NewAdminService(rep), rep
+}
+
+func decodeCommandResponse(t *testing.T, out *bytes.Buffer) commandResponse {
+	var res commandResponse
+	if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+		t.Fatal(err, out.String())
+	}
+	return res
+}
+
+func TestCommandBalance(t *testing.T) {
+	s := newCommandService(&MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 150, nil
+		},
+	})
+	adm, _ := newCommandAdminService()
+	var out bytes.Buffer
+	assert.Nil(t, server.AccountCommand(s, adm, server.COMMAND_BALANCE, []string{"-account", "7"}, &out))
+	assert.Contains(t, out.String(), "ACCOUNT")
+	assert.Contains(t, out.String(), "150.00")
+	assert.Contains(t, out.String(), server.BASE_CURRENCY)
+
+	out.Reset()
+	assert.Nil(t, server.AccountCommand(s, adm, server.COMMAND_BALANCE, []string{"-account", "7", "-output", server.OUTPUT_JSON}, &out))
+	res := decodeCommandResponse(t, &out)
+	assert.Equal(t, server.STATUS_CODE_OK, res.Status)
+	var bal server.BalanceOutput
+	assert.Nil(t, json.Unmarshal(res.Data, &bal))
+	assert.Equal(t, server.BalanceOutput{Account: 7, Balance: 150, Currency: server.BASE_CURRENCY}, bal)
+}
+
+func TestCommandValidation(t *testing.T) {
+	s := newCommandService(&MockAccountRepository{})
+	adm, _ := newCommandAdminService()
+	tests := map[string][]string{
+		server.COMMAND_BALANCE:  {"-account", "0"},
+		server.COMMAND_CREDIT:   {"-account", "1", "-sum", "5"},
+		server.COMMAND_DEBIT:    {"-account", "1", "-reason", "fix"},
+		server.COMMAND_TRANSFER: {"-from", "1", "-to", "1", "-sum", "5"},
+		server.COMMAND_HISTORY:  {"-account", "1", "-start", "20", "-end", "10"},
+		server.COMMAND_EXPORT:   {"-account", "-1"},
+	}
+	for command, args := range tests {
+		var out bytes.Buffer
+		err := server.AccountCommand(s, adm, command, append(args, "-output", server.OUTPUT_JSON), &out)
+		var cmdErr *server.CommandError
+		if assert.True(t, errors.As(err, &cmdErr), command) {
+			assert.Equal(t, server.ERROR_WRONG_REQUEST, cmdErr.Status, command)
+		}
+		assert.Equal(t, server.ERROR_WRONG_REQUEST, decodeCommandResponse(t, &out).Status, command)
+	}
+}
+
+func TestCommandOperationError(t *testing.T) {
+	s := newCommandService(&MockAccountRepository{})
+	adm, _ := newCommandAdminService()
+	var out bytes.Buffer
+	err := server.AccountCommand(s, adm, server.COMMAND_DEBIT, []string{"-account", "3", "-sum", "50", "-reason", "fix", "-output", server.OUTPUT_JSON}, &out)
+	var cmdErr *server.CommandError
+	if assert.True(t, errors.As(err, &cmdErr)) {
+		assert.Equal(t, server.ERROR_NOT_ENOUGH_MONEY, cmdErr.Status)
+	}
+	res := decodeCommandResponse(t, &out)
+	assert.Equal(t, server.ERROR_NOT_ENOUGH_MONEY, res.Status)
+	var msg string
+	assert.Nil(t, json.Unmarshal(res.Data, &msg))
+	assert.Equal(t, server.AccountExpectedResult.GetStatus(server.ERROR_NOT_ENOUGH_MONEY, server.DEFAULT_LOCALE), msg, "Message should be the one HTTP API responds with")
+
+	out.Reset()
+	assert.NotNil(t, server.AccountCommand(s, adm, server.COMMAND_DEBIT, []string{"-account", "3", "-sum", "50", "-reason", "fix"}, &out))
+	assert.Empty(t, out.String(), "Table output should leave error to caller")
+}
+
+func TestCommandCreditAudited(t *testing.T) {
+	s := newCommandService(&MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 25, nil
+		},
+	})
+	adm, rep := newCommandAdminService()
+	var out bytes.Buffer
+	assert.Nil(t, server.AccountCommand(s, adm, server.COMMAND_CREDIT, []string{"-account", "5", "-sum", "25", "-reason", " refund ", "-output", server.OUTPUT_JSON}, &out))
+	var op server.OperationOutput
+	assert.Nil(t, json.Unmarshal(decodeCommandResponse(t, &out).Data, &op))
+	assert.Equal(t, server.OperationOutput{Account: 5, Sum: 25, Balance: 25, AuditId: 1}, op)
+	if assert.Len(t, rep.audit, 1) {
+		assert.Equal(t, server.AUDIT_ACTION_ADJUST, rep.audit[0].Action)
+		assert.Equal(t, "refund", rep.audit[0].Reason)
+		assert.True(t, strings.HasPrefix(rep.audit[0].Actor, server.COMMAND_ACTOR_PREFIX), rep.audit[0].Actor)
+	}
+}
+
+func TestCommandUsage(t *testing.T) {
+	s := newCommandService(&MockAccountRepository{})
+	adm, _ := newCommandAdminService()
+	var out bytes.Buffer
+	assert.NotNil(t, server.AccountCommand(s, adm, "refund", nil, &out))
+	assert.NotNil(t, server.AccountCommand(s, adm, server.COMMAND_BALANCE, []string{"-account", "1", "-output", "xml"}, &out))
+	assert.NotNil(t, server.AccountCommand(s, adm, server.COMMAND_HISTORY, []string{"-account", "1", "-output", server.OUTPUT_CSV}, &out), "Only export writes csv")
+}
+
+func TestCommandExportAllPages(t *testing.T) {
+	ctx := context.Background()
+	testDb.Conn.Exec(ctx, "DELETE FROM transactions WHERE account = $1", TEST_CLI_EXPORT_ACCOUNT)
+	rep := server.NewAccountRepository(testDb, server.LedgerConfig{PageSize: 2}, zerolog.Nop())
+	s := server.NewAccountService(rep, server.DefaultConfig(), zerolog.Nop())
+	adm := server.NewAdminService(server.NewAdminRepository(testDb))
+	account := []string{"-account", "4801"}
+	var out bytes.Buffer
+	for _, sum := range []string{"10", "20", "30"} {
+		assert.Nil(t, server.AccountCommand(s, adm, server.COMMAND_CREDIT, append(account, "-sum", sum, "-reason", "refill, "+sum), &out))
+	}
+	assert.Nil(t, server.AccountCommand(s, adm, server.COMMAND_DEBIT, append(account, "-sum", "15", "-reason", "fee"), &out))
+
+	out.Reset()
+	assert.Nil(t, server.AccountCommand(s, adm, server.COMMAND_EXPORT, append(account, "-page-size", "2", "-output", server.OUTPUT_CSV), &out))
+	records, err := csv.NewReader(&out).ReadAll()
+	assert.Nil(t, err)
+	if assert.Len(t, records, 5, "Header and every operation of all pages") {
+		assert.Equal(t, []string{"date", "sum", "operation", "description"}, records[0])
+		descs := []string{}
+		for _, r := range records[1:] {
+			descs = append(descs, r[3])
+		}
+		assert.Contains(t, descs, fmt.Sprintf(server.OPERATION_ADJUSTMENT_DESC, "refill, 10"), "Description with comma should survive csv quoting")
+	}
+
+	out.Reset()
+	assert.Nil(t, server.AccountCommand(s, adm, server.COMMAND_EXPORT, append(account, "-page-size", "3", "-output", server.OUTPUT_JSON), &out))
+	var trxs []map[string]interface{}
+	assert.Nil(t, json.Unmarshal(decodeCommandResponse(t, &out).Data, &trxs))
+	assert.Len(t, trxs, 4, "Every operation of all pages")
+
+	out.Reset()
+	assert.Nil(t, server.AccountCommand(s, adm, server.COMMAND_HISTORY, append(account, "-output", server.OUTPUT_JSON), &out))
+	var page server.TransactionsData
+	assert.Nil(t, json.Unmarshal(decodeCommandResponse(t, &out).Data, &page))
+	assert.Len(t, page.Trxs, 2)
+	assert.NotEqual(t, -1, page.Last, "History shows one page with cursor of the next")
+}
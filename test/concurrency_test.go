@@ -0,0 +1,235 @@
+package tests
+
+import (
+	"balance-server/server"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	TEST_CONCURRENCY_ACCOUNTS int = 4
+	TEST_CONCURRENCY_FUNDS    int = 10000
+	TEST_CONCURRENCY_WORKERS  int = 16
+	TEST_CONCURRENCY_OPS      int = 25
+)
+
+var (
+	// TEST_CONCURRENCY_FIRST_ACCOUNTS keeps accounts of strategies apart, so runs do not share balances.
+	TEST_CONCURRENCY_FIRST_ACCOUNTS = map[string]int{
+		server.CONCURRENCY_ADVISORY:     5100,
+		server.CONCURRENCY_ROW_LOCK:     5200,
+		server.CONCURRENCY_SERIALIZABLE: 5300,
+	}
+)
+
+// MockConcurrencyDatabase fails transactions with serialization failure the given number of times.
+type MockConcurrencyDatabase struct {
+	failures int
+	calls    int
+	opts     []pgx.TxOptions
+}
+
+func (db *MockConcurrencyDatabase) Open(ctx context.Context) {}
+
+func (db *MockConcurrencyDatabase) Close() {}
+
+func (db *MockConcurrencyDatabase) ExecuteInTransaction(ctx context.Context, actn func(tx *pgx.Tx) (interface{}, error)) (interface{}, error) {
+	return db.ExecuteInTransactionWith(ctx, pgx.TxOptions{}, actn)
+}
+
+func (db *MockConcurrencyDatabase) ExecuteInTransactionWith(ctx context.Context, opts pgx.TxOptions, actn func(tx *pgx.Tx) (interface{}, error)) (interface{}, error) {
+	db.calls++
+	db.opts = append(db.opts, opts)
+	if db.calls <= db.failures {
+		return nil, server.ClassifyPgError(&pgconn.PgError{Code: server.PG_SERIALIZATION_FAILURE})
+	}
+	return actn(nil)
+}
+
+func (db *MockConcurrencyDatabase) Concurrency() server.ConcurrencyStrategy {
+	return server.AdvisoryLocks{}
+}
+
+func (db *MockConcurrencyDatabase) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestNewConcurrencyStrategy(t *testing.T) {
+	for _, name := range server.CONCURRENCY_STRATEGIES {
+		c, err := server.NewConcurrencyStrategy(server.DatabaseConfig{Concurrency: name})
+		assert.Nil(t, err)
+		assert.Equal(t, name, c.Name())
+	}
+	_, err := server.NewConcurrencyStrategy(server.DatabaseConfig{Concurrency: "optimistic"})
+	assert.NotNil(t, err)
+	assert.Equal(t, server.CONCURRENCY_ADVISORY, (&server.Database{}).Concurrency().Name(), "Advisory locks are the default")
+}
+
+func TestSerializableRetry(t *testing.T) {
+	s := server.SerializableIsolation{Retries: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	db := &MockConcurrencyDatabase{failures: 2}
+	res, err := s.Execute(context.Background(), db, func(tx *pgx.Tx) (interface{}, error) {
+		return "done", nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "done", res)
+	assert.Equal(t, 3, db.calls, "Transaction should be retried until it succeeds")
+	for _, opts := range db.opts {
+		assert.Equal(t, pgx.Serializable, opts.IsoLevel)
+	}
+
+	db = &MockConcurrencyDatabase{failures: 10}
+	_, err = s.Execute(context.Background(), db, func(tx *pgx.Tx) (interface{}, error) {
+		return nil, nil
+	})
+	assert.True(t, errors.Is(err, &server.OperationError{Code: server.ERROR_TRANSACTION_CONFLICT}))
+	assert.Equal(t, 4, db.calls, "Retries should be bounded")
+
+	db = &MockConcurrencyDatabase{}
+	_, err = s.Execute(context.Background(), db, func(tx *pgx.Tx) (interface{}, error) {
+		return nil, &server.OperationError{Code: server.ERROR_NOT_ENOUGH_MONEY}
+	})
+	assert.True(t, errors.Is(err, &server.OperationError{Code: server.ERROR_NOT_ENOUGH_MONEY}))
+	assert.Equal(t, 1, db.calls, "Other errors should not be retried")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	db = &MockConcurrencyDatabase{failures: 10}
+	s.Backoff, s.MaxBackoff = time.Hour, time.Hour
+	_, err = s.Execute(ctx, db, func(tx *pgx.Tx) (interface{}, error) {
+		return nil, nil
+	})
+	assert.True(t, errors.Is(err, &server.OperationError{Code: server.ERROR_REQUEST_CANCELED}), "Backoff should stop when context is done")
+}
+
+func TestIsSerializationFailure(t *testing.T) {
+	assert.True(t, server.IsSerializationFailure(server.ClassifyPgError(&pgconn.PgError{Code: server.PG_SERIALIZATION_FAILURE})))
+	assert.False(t, server.IsSerializationFailure(server.ClassifyPgError(&pgconn.PgError{Code: server.PG_DEADLOCK_DETECTED})))
+	assert.False(t, server.IsSerializationFailure(nil))
+}
+
+// TestConcurrencyStrategiesKeepBalance runs concurrent debits, transfers and negative adjustments
+// on a few accounts under every strategy. Balances should never go negative, money should only
+// leave through successful debits and adjustments, and hash chains should stay intact.
+func TestConcurrencyStrategiesKeepBalance(t *testing.T) {
+	for _, name := range server.CONCURRENCY_STRATEGIES {
+		t.Run(name, func(t *testing.T) {
+			testConcurrencyStrategy(t, name)
+		})
+	}
+}
+
+func testConcurrencyStrategy(t *testing.T, strategy string) {
+	ctx := context.Background()
+	cfg := server.DefaultConfig()
+	cfg.Database.Url = os.Getenv("PGX_TEST_DATABASE")
+	cfg.Database.Concurrency = strategy
+	cfg.Database.SerializableRetries = 20
+	db := server.NewDatabase(cfg.Database, zerolog.Nop())
+	defer db.Close()
+	assert.Equal(t, strategy, db.Concurrency().Name())
+	rep := server.NewAccountRepository(db, cfg.Ledger, zerolog.Nop())
+	adm := server.NewAdminRepository(db)
+
+	first := TEST_CONCURRENCY_FIRST_ACCOUNTS[strategy]
+	last := first + TEST_CONCURRENCY_ACCOUNTS - 1
+	testDb.Conn.Exec(ctx, "DELETE FROM transactions WHERE account BETWEEN $1 AND $2", first, last)
+	for id := first; id <= last; id++ {
+		assert.Nil(t, rep.ExecuteOperation(ctx, server.TransactionData{Id: id, Sum: float64(TEST_CONCURRENCY_FUNDS) / 100}))
+	}
+
+	var spent int64
+	var wg sync.WaitGroup
+	for w := 0; w < TEST_CONCURRENCY_WORKERS; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < TEST_CONCURRENCY_OPS; i++ {
+				account := first + rnd.Intn(TEST_CONCURRENCY_ACCOUNTS)
+				cents := 500 + rnd.Intn(2000)
+				sum := float64(cents) / 100
+				var err error
+				switch rnd.Intn(3) {
+				case 0:
+					err = rep.ExecuteOperation(ctx, server.TransactionData{Id: account, Sum: -sum})
+					if err == nil {
+						atomic.AddInt64(&spent, int64(cents))
+					}
+				case 1:
+					to := first + (account-first+1+rnd.Intn(TEST_CONCURRENCY_ACCOUNTS-1))%TEST_CONCURRENCY_ACCOUNTS
+					err = rep.ExecuteTransfer(ctx, server.TransferData{From: account, To: to, Sum: sum})
+				default:
+					_, err = adm.Adjust(ctx, server.AdjustmentData{Account: account, Sum: -sum, Reason: "concurrency test", Actor: "test"})
+					if err == nil {
+						atomic.AddInt64(&spent, int64(cents))
+					}
+				}
+				if err != nil {
+					code := server.ConvertError(err).Code
+					assert.Contains(t, []int{server.ERROR_NOT_ENOUGH_MONEY, server.ERROR_LOCK_TIMEOUT, server.ERROR_TRANSACTION_CONFLICT}, code, err.Error())
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	total := 0.0
+	ledger := server.NewLedgerService(server.NewLedgerRepository(db))
+	for id := first; id <= last; id++ {
+		bal, err := rep.GetBalance(ctx, server.BalanceData{Id: id})
+		assert.Nil(t, err)
+		assert.GreaterOrEqual(t, bal, 0.0, "Balance of %d went negative", id)
+		total += bal
+		report, err := ledger.Verify(ctx, id, nil)
+		assert.Nil(t, err)
+		assert.True(t, report.Ok, "Chain of %d should stay intact", id)
+
+		var negative bool
+		err = testDb.Conn.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM (SELECT SUM(sum) OVER (ORDER BY id) AS running FROM transactions WHERE account = $1) r WHERE running < 0)", id).Scan(&negative)
+		assert.Nil(t, err)
+		assert.False(t, negative, "Balance of %d should not be negative after any row", id)
+	}
+	want := float64(TEST_CONCURRENCY_FUNDS*TEST_CONCURRENCY_ACCOUNTS-int(spent)) / 100
+	assert.InDelta(t, want, total, 0.001, "Transfers should not create or lose money")
+}
+
+func TestLockTimeoutIsTransactionLocal(t *testing.T) {
+	const account = 5900
+	ctx := context.Background()
+	holder, err := testDb.Conn.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Rollback(ctx)
+	_, err = holder.Exec(ctx, server.SELECT_ADVISORY_LOCK, account, server.OPERATION_OUTCOME_CODE)
+	assert.Nil(t, err)
+
+	c := server.AdvisoryLocks{LockTimeout: 100 * time.Millisecond}
+	_, err = c.Execute(ctx, testDb, func(tx *pgx.Tx) (interface{}, error) {
+		var timeout string
+		if err := (*tx).QueryRow(ctx, "SHOW lock_timeout").Scan(&timeout); err != nil {
+			return nil, err
+		}
+		assert.Equal(t, "100ms", timeout)
+		return nil, c.Lock(ctx, tx, account, server.OPERATION_OUTCOME_CODE)
+	})
+	assert.True(t, errors.Is(err, &server.OperationError{Code: server.ERROR_LOCK_TIMEOUT}), err)
+
+	for i := 0; i < int(testDb.Conn.Stat().TotalConns()); i++ {
+		var timeout string
+		assert.Nil(t, testDb.Conn.QueryRow(ctx, "SHOW lock_timeout").Scan(&timeout))
+		assert.NotEqual(t, "100ms", timeout, "Lock timeout should not outlive the transaction")
+	}
+}
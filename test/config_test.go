@@ -0,0 +1,160 @@
+package tests
+
+import (
+	"balance-server/server"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	TEST_CONFIG_DATABASE_URL string = "postgres://balance:secret@db:5432/balance"
+)
+
+type configResponse struct {
+	Status int                    `json:"status"`
+	Data   map[string]interface{} `json:"data"`
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigDefaults(t *testing.T) {
+	t.Setenv("DATABASE_URL", TEST_CONFIG_DATABASE_URL)
+	cfg, err := server.LoadConfig([]string{})
+	assert.Nil(t, err)
+	want := server.DefaultConfig()
+	want.Database.Url = TEST_CONFIG_DATABASE_URL
+	assert.Equal(t, want, cfg)
+	assert.Equal(t, ":8080", cfg.HttpAddress())
+	assert.Equal(t, ":9090", cfg.GrpcAddress())
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := writeConfigFile(t, `{
+		"http": {"port": 8000, "shutdown_timeout": "1m"},
+		"database": {"url": "postgres://file/balance", "lock_timeout": "5s"},
+		"ledger": {"page_size": 20},
+		"currency": {"base": "USD"}
+	}`)
+	t.Setenv(server.ENV_CONFIG_FILE, file)
+	t.Setenv("DATABASE_URL", TEST_CONFIG_DATABASE_URL)
+	t.Setenv("PAGE_SIZE", "30")
+	t.Setenv("LOG_LEVEL", "WARN")
+	cfg, err := server.LoadConfig([]string{"-page-size", "40", "-lock-timeout=2s", "-migrate-on-start"})
+	assert.Nil(t, err)
+	assert.Equal(t, 8000, cfg.Http.Port, "File overrides default")
+	assert.Equal(t, time.Minute, cfg.Http.ShutdownTimeout.Duration())
+	assert.Equal(t, "USD", cfg.Currency.Base)
+	assert.Equal(t, TEST_CONFIG_DATABASE_URL, cfg.Database.Url, "Environment overrides file")
+	assert.Equal(t, server.LOG_LEVEL_WARN, cfg.Log.Level)
+	assert.Equal(t, 40, cfg.Ledger.PageSize, "Flag overrides environment")
+	assert.Equal(t, 2*time.Second, cfg.Database.LockTimeout.Duration(), "Flag overrides file")
+	assert.True(t, cfg.Database.MigrateOnStart, "Boolean flag without value")
+	assert.Equal(t, server.VIEW_REFRESH_INTERVAL, cfg.Ledger.ViewRefreshInterval.Duration(), "Unset value keeps default")
+}
+
+func TestConfigFileFlag(t *testing.T) {
+	t.Setenv(server.ENV_CONFIG_FILE, writeConfigFile(t, `{"grpc": {"port": 7000}}`))
+	t.Setenv("DATABASE_URL", TEST_CONFIG_DATABASE_URL)
+	cfg, err := server.LoadConfig([]string{"-config", writeConfigFile(t, `{"grpc": {"port": 7001}}`)})
+	assert.Nil(t, err)
+	assert.Equal(t, 7001, cfg.Grpc.Port)
+
+	_, err = server.LoadConfig([]string{"-config", writeConfigFile(t, `{"grpc": {"address": ":7001"}}`)})
+	assert.NotNil(t, err, "Unknown config field should be rejected")
+	_, err = server.LoadConfig([]string{"-config", writeConfigFile(t, `{"database": {"lock_timeout": 10}}`)})
+	assert.NotNil(t, err, "Duration should be a string")
+}
+
+func TestConfigValidation(t *testing.T) {
+	t.Setenv("DATABASE_URL", "")
+	t.Setenv("PORT", "70000")
+	t.Setenv("PAGE_SIZE", "0")
+	t.Setenv("BASE_CURRENCY", "rub")
+	t.Setenv("CURRENCY_RATES_URL", "ftp://rates")
+	t.Setenv("CURRENCY_TIMEOUT", "0s")
+	t.Setenv("LOG_LEVEL", "verbose")
+	t.Setenv("CONCURRENCY", "optimistic")
+	t.Setenv("SERIALIZABLE_RETRIES", "-1")
+	t.Setenv("SHUTDOWN_DELAY", "-1s")
+	t.Setenv("CHECKPOINT_INTERVAL", "0s")
+	t.Setenv("RATE_LIMIT_STORE", "redis")
+	t.Setenv("SIGNATURE_WINDOW", "0s")
+	t.Setenv("JWT_ACCOUNT_CLAIM", "")
+	t.Setenv("OTEL_TRACES_EXPORTER", "jaeger")
+	_, err := server.LoadConfig(nil)
+	if assert.NotNil(t, err) {
+		for _, field := range []string{"http.port", "http.shutdown_delay", "database.url", "database.concurrency", "database.serializable_retries", "ledger.page_size", "ledger.checkpoint_interval", "currency.base", "currency.rates_url", "currency.timeout", "log.level", "rate_limit.store", "signature.window", "jwt.account_claim", "tracing.exporter"} {
+			assert.Contains(t, err.Error(), field)
+		}
+	}
+	t.Setenv("PORT", "eighty")
+	_, err = server.LoadConfig(nil)
+	assert.NotNil(t, err)
+	t.Setenv("PORT", "8080")
+	_, err = server.LoadConfig([]string{"-shutdown-timeout", "soon"})
+	assert.NotNil(t, err)
+}
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.Database.Url = TEST_CONFIG_DATABASE_URL
+	redacted := cfg.Redacted()
+	assert.Equal(t, "postgres://balance:xxxxx@db:5432/balance", redacted.Database.Url)
+	assert.Equal(t, TEST_CONFIG_DATABASE_URL, cfg.Database.Url, "Original config should not change")
+
+	cfg.Database.Url = "host=db user=balance password=secret"
+	assert.Equal(t, server.CONFIG_REDACTED, cfg.Redacted().Database.Url)
+
+	cfg.Jwt.Secret = "jwt-secret"
+	cfg.Signature.SecretsFile = "/etc/balance/partners.json"
+	redacted = cfg.Redacted()
+	assert.Equal(t, server.CONFIG_REDACTED, redacted.Jwt.Secret)
+	assert.Equal(t, server.CONFIG_REDACTED, redacted.Signature.SecretsFile)
+	assert.Empty(t, redacted.Jwt.JwksFile, "Unset secrets stay empty")
+}
+
+func TestAdminConfig(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	cfg := server.DefaultConfig()
+	cfg.Database.Url = TEST_CONFIG_DATABASE_URL
+	cfg.Jwt.Secret = "jwt-secret"
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(keys, nil), Config: cfg})
+	auditor := issueKey(t, keys, []string{server.ROLE_AUDITOR}, nil)
+	operator := issueKey(t, keys, []string{server.ROLE_OPERATOR}, nil)
+
+	assert.Equal(t, 403, makeAuthRequest(t, r, "GET", server.URL_ADMIN_CONFIG, "", operator))
+	req := httptest.NewRequest(http.MethodGet, server.URL_ADMIN_CONFIG, nil)
+	req.Header.Set(server.HEADER_AUTHORIZATION, auditor)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+	assert.NotContains(t, rec.Body.String(), ":secret@")
+	assert.NotContains(t, rec.Body.String(), "jwt-secret")
+	var res configResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	database := res.Data["database"].(map[string]interface{})
+	assert.True(t, strings.HasPrefix(database["url"].(string), "postgres://balance:"))
+	assert.Equal(t, "10s", database["lock_timeout"])
+	rateLimit := res.Data["rate_limit"].(map[string]interface{})
+	assert.Equal(t, server.RATE_LIMIT_POLICIES[server.RATE_LIMIT_GROUP_WRITE].Client.String(), rateLimit["write_client"])
+	assert.Equal(t, server.CONFIG_REDACTED, res.Data["jwt"].(map[string]interface{})["secret"])
+	for _, section := range []string{"signature", "tracing"} {
+		assert.Contains(t, res.Data, section)
+	}
+}
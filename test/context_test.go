@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"balance-server/server"
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// BlockingAccountRepository waits for request context to be done, as a query stuck on a lock does.
+type BlockingAccountRepository struct {
+	MockAccountRepository
+}
+
+func (rep *BlockingAccountRepository) GetBalance(ctx context.Context, dt server.BalanceData) (float64, error) {
+	<-ctx.Done()
+	return 0, fmt.Errorf("query aborted: %w", ctx.Err())
+}
+
+func TestRequestTimeout(t *testing.T) {
+	r := newTestRouter(testRoutes{Accounts: &BlockingAccountRepository{}, Group: []gin.HandlerFunc{server.Timeout(20 * time.Millisecond)}})
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, authorized(httptest.NewRequest("GET", "/accounts/1/balance", nil)))
+	assert.Equal(t, 504, rec.Code)
+	assert.Contains(t, rec.Body.String(), fmt.Sprintf(`"status":%d`, server.ERROR_REQUEST_TIMEOUT))
+	assert.NotEmpty(t, rec.Header().Get(server.HEADER_RETRY_AFTER))
+}
+
+func TestRequestCanceledByClient(t *testing.T) {
+	r := newTestRouter(testRoutes{Accounts: &BlockingAccountRepository{}, Group: []gin.HandlerFunc{server.Timeout(time.Minute)}})
+	ctx, cancel := context.WithCancel(context.Background())
+	req := authorized(httptest.NewRequest("GET", "/accounts/1/balance", nil)).WithContext(ctx)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, server.HTTP_CLIENT_CLOSED_REQUEST, rec.Code)
+	assert.Contains(t, rec.Body.String(), fmt.Sprintf(`"status":%d`, server.ERROR_REQUEST_CANCELED))
+}
+
+func TestConvertContextErrors(t *testing.T) {
+	assert.Equal(t, server.ERROR_REQUEST_TIMEOUT, server.ConvertError(fmt.Errorf("dial: %w", context.DeadlineExceeded)).Code)
+	assert.Equal(t, server.ERROR_REQUEST_CANCELED, server.ConvertError(context.Canceled).Code)
+	assert.Equal(t, server.ERROR_INTERNAL, server.ConvertError(errors.New("boom")).Code)
+	assert.Equal(t, server.ERROR_LOCK_TIMEOUT, server.ConvertError(&server.OperationError{Code: server.ERROR_LOCK_TIMEOUT}).Code)
+}
+
+func TestConfigRequestTimeouts(t *testing.T) {
+	t.Setenv("DATABASE_URL", TEST_CONFIG_DATABASE_URL)
+	t.Setenv("REQUEST_TIMEOUT_WRITE", "1500ms")
+	t.Setenv("REQUEST_TIMEOUT_ADMIN", "0")
+	cfg, err := server.LoadConfig(nil)
+	if assert.Nil(t, err) {
+		timeouts := cfg.Http.RequestTimeouts()
+		assert.Equal(t, server.REQUEST_TIMEOUTS[server.RATE_LIMIT_GROUP_READ], timeouts[server.RATE_LIMIT_GROUP_READ])
+		assert.Equal(t, 1500*time.Millisecond, timeouts[server.RATE_LIMIT_GROUP_WRITE])
+		assert.Zero(t, timeouts[server.RATE_LIMIT_GROUP_ADMIN])
+	}
+
+	t.Setenv("REQUEST_TIMEOUT_READ", "soon")
+	_, err = server.LoadConfig(nil)
+	assert.NotNil(t, err)
+	t.Setenv("REQUEST_TIMEOUT_READ", "-1s")
+	_, err = server.LoadConfig(nil)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "http.request_timeout_read")
+	}
+}
@@ -3,13 +3,14 @@ package tests
 import (
 	"balance-server/server"
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,21 +31,24 @@ type TestTable struct {
 var (
 	rec    = httptest.NewRecorder()
 	c, _   = gin.CreateTestContext(rec)
-	acc    = server.NewAccountController(testRep)
-	router = gin.New()
+	router = newTestRouter(testRoutes{
+		Accounts: testRep,
+		Admin:    server.NewAdminRepository(testDb),
+		Ledger:   server.NewLedgerRepository(testDb),
+		Use:      []gin.HandlerFunc{server.RequestId()},
+	})
 )
 
 func TestMain(m *testing.M) {
-	router.POST(server.URL_TRANSACTION, acc.Transaction)
-	router.POST(server.URL_TRANSFER, acc.Transfer)
-	router.GET(server.URL_BALANCE, acc.Balance)
-	router.GET(server.URL_TRANSACTIONS, acc.Transactions)
-	testDb.Conn.Query(testDb.Ctx, DB_INIT_QUERY)
+	if _, err := server.NewMigrator(testDb, server.MIGRATIONS, zerolog.Nop()).Up(context.Background()); err != nil {
+		panic(err)
+	}
+	testDb.Conn.Query(context.Background(), DB_INIT_QUERY)
 	m.Run()
 }
 
 func TestBalanceNotExistingUser(t *testing.T) {
-	exp := TestTable{server.ERROR_NO_BALANCE, server.STATUS_NO_BALANCE, 200}
+	exp := TestTable{server.ERROR_NO_BALANCE, server.AccountExpectedResult.GetStatus(server.ERROR_NO_BALANCE, server.DEFAULT_LOCALE), 404}
 	res := TestTable{}
 	d := server.BalanceRequest{Id: 1, Cur: "RUB"}
 	makeRequest(t, "GET", server.URL_BALANCE, &d, &res)
@@ -52,12 +56,12 @@ func TestBalanceNotExistingUser(t *testing.T) {
 }
 
 func TestBalanceWrongUser(t *testing.T) {
-	s := fmt.Sprintf(server.BAD_REQUEST_BINDING, server.STATUS_WRONG_ID)
-	exp := TestTable{server.ERROR_WRONG_REQUEST, s, 400}
+	exp := TestTable{server.ERROR_WRONG_REQUEST, STATUS_ANY, 400}
 	res := TestTable{}
 	d := server.BalanceRequest{Id: -199, Cur: "RUB"}
 	makeRequest(t, "GET", server.URL_BALANCE, &d, &res)
 	httpTest(t, &res, &exp)
+	validationTest(t, &res, "id", server.RULE_GTE)
 }
 
 func TestBalanceWrongCurrencyCode(t *testing.T) {
@@ -65,7 +69,7 @@ func TestBalanceWrongCurrencyCode(t *testing.T) {
 	res := TestTable{}
 	makeRequest(t, "POST", server.URL_TRANSACTION, &tD, &res)
 	res = TestTable{}
-	exp := TestTable{server.ERROR_BALANCE_WRONG_CURRENCY_CODE, server.AccountExpectedResult.GetStatus(server.ERROR_BALANCE_WRONG_CURRENCY_CODE), 400}
+	exp := TestTable{server.ERROR_BALANCE_WRONG_CURRENCY_CODE, server.AccountExpectedResult.GetStatus(server.ERROR_BALANCE_WRONG_CURRENCY_CODE, server.DEFAULT_LOCALE), 400}
 	d := server.BalanceRequest{Id: 1, Cur: "WRONG_CURRENCY"}
 	makeRequest(t, "GET", server.URL_BALANCE, &d, &res)
 	httpTest(t, &res, &exp)
@@ -75,7 +79,7 @@ func TestBalanceWrongCurrencyCode(t *testing.T) {
 }
 
 func TestTransactionIncome(t *testing.T) {
-	exp := TestTable{server.STATUS_CODE_OK, server.STATUS_TRANSACTION_COMPLETED, 200}
+	exp := TestTable{server.STATUS_CODE_OK, server.Messages.Message(server.DEFAULT_LOCALE, server.MESSAGE_TRANSACTION_COMPLETED), 200}
 	res := TestTable{}
 	d := server.TransactionRequest{Id: 1, Sum: 100, Desc: ""}
 	makeRequest(t, "POST", server.URL_TRANSACTION, &d, &res)
@@ -83,7 +87,7 @@ func TestTransactionIncome(t *testing.T) {
 }
 
 func TestTransactionOutcomeNoMoney(t *testing.T) {
-	exp := TestTable{server.ERROR_NOT_ENOUGH_MONEY, server.ACCOUNT_OPERATION_STATUS[server.ERROR_NOT_ENOUGH_MONEY], 200}
+	exp := TestTable{server.ERROR_NOT_ENOUGH_MONEY, server.AccountExpectedResult.GetStatus(server.ERROR_NOT_ENOUGH_MONEY, server.DEFAULT_LOCALE), 422}
 	res := TestTable{}
 	d := server.TransactionRequest{Id: 1, Sum: -10000, Desc: ""}
 	makeRequest(t, "POST", server.URL_TRANSACTION, &d, &res)
@@ -101,7 +105,7 @@ func TestTransactionZeroSum(t *testing.T) {
 func TestTransferSuccess(t *testing.T) {
 	pD := server.TransactionRequest{Id: 1, Sum: 100, Desc: ""}
 	makeRequest(t, "POST", server.URL_TRANSACTION, &pD, nil)
-	exp := TestTable{server.STATUS_CODE_OK, server.STATUS_TRANSFER_COMPLETED, 200}
+	exp := TestTable{server.STATUS_CODE_OK, server.Messages.Message(server.DEFAULT_LOCALE, server.MESSAGE_TRANSFER_COMPLETED), 200}
 	res := TestTable{}
 	d := server.SendRequest{From: 1, Sum: 100, To: 2}
 	makeRequest(t, "POST", server.URL_TRANSFER, &d, &res)
@@ -109,12 +113,12 @@ func TestTransferSuccess(t *testing.T) {
 }
 
 func TestTransferEqualIds(t *testing.T) {
-	s := fmt.Sprintf(server.BAD_REQUEST_BINDING, server.STATUS_WRONG_IDS_NOT_UNIQUE)
-	exp := TestTable{server.ERROR_WRONG_REQUEST, s, 400}
+	exp := TestTable{server.ERROR_WRONG_REQUEST, STATUS_ANY, 400}
 	res := TestTable{}
 	d := server.SendRequest{From: 2, Sum: 100, To: 2}
 	makeRequest(t, "POST", server.URL_TRANSFER, &d, &res)
 	httpTest(t, &res, &exp)
+	validationTest(t, &res, "to", server.RULE_NEFIELD)
 }
 
 func makeRequest(t *testing.T, m string, path string, d interface{}, res *TestTable) {
@@ -132,7 +136,7 @@ func makeRequest(t *testing.T, m string, path string, d interface{}, res *TestTa
 		t.Error(err)
 		return
 	}
-	router.ServeHTTP(rec, req)
+	router.ServeHTTP(rec, authorized(req))
 	if res != nil {
 		var result map[string]interface{}
 		err = json.NewDecoder(rec.Body).Decode(&result)
@@ -155,3 +159,92 @@ func httpTest(t *testing.T, get *TestTable, want *TestTable) {
 		assert.Equal(t, want.Message, get.Message, "Expexted data: ", want.Message, ", but got: ", get.Message)
 	}
 }
+
+func TestAccountBalance(t *testing.T) {
+	pD := server.TransactionRequest{Id: 3, Sum: 100, Desc: ""}
+	makeRequest(t, "POST", server.URL_TRANSACTION, &pD, nil)
+	req, _ := http.NewRequest("GET", "/accounts/3/balance?currency=RUB", nil)
+	router.ServeHTTP(rec, authorized(req))
+	assert.Equal(t, 200, rec.Code)
+	etag := rec.Header().Get(server.HEADER_ETAG)
+	assert.NotEmpty(t, etag, "Expected ETag header")
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/accounts/3/balance", nil)
+	req.Header.Set(server.HEADER_IF_NONE_MATCH, etag)
+	router.ServeHTTP(rec, authorized(req))
+	assert.Equal(t, 304, rec.Code)
+	assert.Equal(t, 0, rec.Body.Len())
+
+	makeRequest(t, "POST", server.URL_TRANSACTION, &pD, nil)
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/accounts/3/balance", nil)
+	req.Header.Set(server.HEADER_IF_NONE_MATCH, etag)
+	router.ServeHTTP(rec, authorized(req))
+	assert.Equal(t, 200, rec.Code, "New ledger row should change ETag")
+	assert.NotEqual(t, etag, rec.Header().Get(server.HEADER_ETAG))
+	rec = httptest.NewRecorder()
+}
+
+func TestAccountBalanceNotModifiedSkipsConversion(t *testing.T) {
+	var balanceReads int
+	rep := &MockAccountRepository{
+		getLastTransactionIdFunc: func(id int) (int, error) {
+			return 7, nil
+		},
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			balanceReads++
+			return 10, nil
+		},
+	}
+	cfg := server.DefaultConfig()
+	cfg.Currency.RatesUrl = "http://127.0.0.1:0/rates"
+	r := newTestRouter(testRoutes{Accounts: rep, Config: cfg})
+	req, _ := http.NewRequest("GET", "/accounts/1/balance", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, authorized(req))
+	assert.Equal(t, 200, rec.Code)
+	etag := rec.Header().Get(server.HEADER_ETAG)
+
+	req, _ = http.NewRequest("GET", "/accounts/1/balance", nil)
+	req.Header.Set(server.HEADER_IF_NONE_MATCH, etag)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, authorized(req))
+	assert.Equal(t, 304, rec.Code)
+	assert.Equal(t, 1, balanceReads, "Unchanged ledger should not be read again")
+
+	req, _ = http.NewRequest("GET", "/accounts/1/balance?currency=USD", nil)
+	req.Header.Set(server.HEADER_IF_NONE_MATCH, etag)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, authorized(req))
+	assert.NotEqual(t, 304, rec.Code, "ETag should depend on currency")
+}
+
+func TestAccountBalanceWrongUser(t *testing.T) {
+	exp := TestTable{server.ERROR_WRONG_REQUEST, STATUS_ANY, 400}
+	res := TestTable{}
+	makeRequest(t, "GET", "/accounts/-1/balance", nil, &res)
+	httpTest(t, &res, &exp)
+	validationTest(t, &res, "id", server.RULE_GTE)
+}
+
+func TestAccountTransactions(t *testing.T) {
+	pD := server.TransactionRequest{Id: 4, Sum: 100, Desc: ""}
+	makeRequest(t, "POST", server.URL_TRANSACTION, &pD, nil)
+	exp := TestTable{server.STATUS_CODE_OK, STATUS_ANY, 200}
+	res := TestTable{}
+	makeRequest(t, "GET", "/accounts/4/transactions?sort=date&cursor=0", nil, &res)
+	httpTest(t, &res, &exp)
+	trxs := res.Message.(map[string]interface{})["transactions"].([]interface{})
+	assert.Equal(t, 1, len(trxs))
+}
+
+func TestDeprecatedRoutes(t *testing.T) {
+	d := server.BalanceRequest{Id: 3, Cur: "RUB"}
+	data, _ := json.Marshal(&d)
+	req, _ := http.NewRequest("GET", server.URL_BALANCE, bytes.NewBuffer(data))
+	router.ServeHTTP(rec, authorized(req))
+	assert.Equal(t, "true", rec.Header().Get(server.HEADER_DEPRECATION))
+	assert.Equal(t, `</accounts/3/balance>; rel="successor-version"`, rec.Header().Get(server.HEADER_LINK))
+	rec = httptest.NewRecorder()
+}
@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"balance-server/server"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	TEST_RATES_RESPONSE string = `{"rates":{"USD":0.5}}`
+)
+
+func TestCurrencyRateTraceContext(t *testing.T) {
+	newSpanRecorder(t)
+	traceparents := make(chan string, 1)
+	rates := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+		w.Write([]byte(TEST_RATES_RESPONSE))
+	}))
+	defer rates.Close()
+	cfg := server.DefaultConfig().Currency
+	cfg.RatesUrl = rates.URL
+
+	rate, err := server.GetCurrencyRate(context.Background(), cfg, server.BASE_CURRENCY, "USD")
+	assert.Nil(t, err)
+	assert.Equal(t, 0.5, rate)
+	assert.Empty(t, <-traceparents, "Trace context should not leak to external provider")
+
+	cfg.PropagateTrace = true
+	_, err = server.GetCurrencyRate(context.Background(), cfg, server.BASE_CURRENCY, "USD")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, <-traceparents, "Trace context should be sent when propagation is enabled")
+}
+
+func TestCurrencyRateTimeout(t *testing.T) {
+	release := make(chan struct{})
+	rates := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(TEST_RATES_RESPONSE))
+	}))
+	defer rates.Close()
+	defer close(release)
+	cfg := server.DefaultConfig().Currency
+	cfg.RatesUrl = rates.URL
+	cfg.Timeout = server.Duration(50 * time.Millisecond)
+
+	start := time.Now()
+	_, err := server.GetCurrencyRate(context.Background(), cfg, server.BASE_CURRENCY, "USD")
+	assert.NotNil(t, err, "Slow provider should fail the request")
+	assert.Less(t, time.Since(start), time.Second)
+}
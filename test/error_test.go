@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"balance-server/server"
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOperationErrorWrapsCause(t *testing.T) {
+	cause := errors.New("conn closed")
+	err := fmt.Errorf("transfer: %w", &server.OperationError{Code: server.ERROR_LOCK_TIMEOUT, Err: cause})
+	assert.True(t, errors.Is(err, cause))
+	assert.True(t, errors.Is(err, &server.OperationError{Code: server.ERROR_LOCK_TIMEOUT}))
+	assert.False(t, errors.Is(err, &server.OperationError{Code: server.ERROR_INTERNAL}))
+	var opErr *server.OperationError
+	assert.True(t, errors.As(err, &opErr))
+	assert.Equal(t, server.ERROR_LOCK_TIMEOUT, opErr.Code)
+	assert.Contains(t, opErr.Error(), "conn closed")
+}
+
+func TestConvertErrorKeepsCause(t *testing.T) {
+	cause := errors.New("connection reset by peer")
+	opErr := server.ConvertError(cause)
+	assert.Equal(t, server.ERROR_INTERNAL, opErr.Code)
+	assert.True(t, errors.Is(opErr, cause))
+
+	wrapped := &server.OperationError{Code: server.ERROR_NO_BALANCE}
+	assert.Same(t, wrapped, server.ConvertError(fmt.Errorf("balance: %w", wrapped)))
+
+	timeout := server.ConvertError(fmt.Errorf("query: %w", context.DeadlineExceeded))
+	assert.Equal(t, server.ERROR_REQUEST_TIMEOUT, timeout.Code)
+	assert.True(t, errors.Is(timeout, context.DeadlineExceeded))
+}
+
+func TestClassifyPgError(t *testing.T) {
+	for state, code := range map[string]int{
+		server.PG_LOCK_NOT_AVAILABLE:    server.ERROR_LOCK_TIMEOUT,
+		server.PG_SERIALIZATION_FAILURE: server.ERROR_TRANSACTION_CONFLICT,
+		server.PG_DEADLOCK_DETECTED:     server.ERROR_TRANSACTION_CONFLICT,
+		server.PG_UNIQUE_VIOLATION:      server.ERROR_DUPLICATE,
+		server.PG_CHECK_VIOLATION:       server.ERROR_CONSTRAINT_VIOLATION,
+	} {
+		pgErr := &pgconn.PgError{Code: state}
+		err := server.ClassifyPgError(fmt.Errorf("exec: %w", pgErr))
+		assert.True(t, errors.Is(err, &server.OperationError{Code: code}), state)
+		var cause *pgconn.PgError
+		assert.True(t, errors.As(err, &cause), state)
+		assert.Same(t, pgErr, cause)
+	}
+
+	other := &pgconn.PgError{Code: "42P01"}
+	assert.Same(t, other, server.ClassifyPgError(other))
+	dropped := errors.New("unexpected EOF")
+	assert.Equal(t, dropped, server.ClassifyPgError(dropped))
+	classified := &server.OperationError{Code: server.ERROR_NOT_ENOUGH_MONEY, Err: &pgconn.PgError{Code: server.PG_CHECK_VIOLATION}}
+	assert.Same(t, classified, server.ClassifyPgError(classified))
+	assert.Nil(t, server.ClassifyPgError(nil))
+}
+
+func TestTransactionConflictIsRetryable(t *testing.T) {
+	r := newTestRouter(testRoutes{Accounts: &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 0, server.ClassifyPgError(&pgconn.PgError{Code: server.PG_SERIALIZATION_FAILURE})
+		},
+	}})
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, authorized(httptest.NewRequest("GET", "/accounts/1/balance", nil)))
+	assert.Equal(t, 409, rec.Code)
+	assert.Contains(t, rec.Body.String(), fmt.Sprintf(`"status":%d`, server.ERROR_TRANSACTION_CONFLICT))
+	assert.NotEmpty(t, rec.Header().Get(server.HEADER_RETRY_AFTER))
+}
@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"balance-server/pb"
+	"balance-server/server"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	GRPC_BUFFER_SIZE int = 1024 * 1024
+)
+
+func newGrpcClient(t *testing.T, rep server.AccountRepositoryI) pb.BalanceServiceClient {
+	return newGrpcServerClient(t, server.NewAccountGrpcServer(server.NewAccountService(rep, server.DefaultConfig(), zerolog.Nop()), testAuth, zerolog.Nop()), grpcAuthorized()...)
+}
+
+func newGrpcServerClient(t *testing.T, grpcSrv *server.AccountGrpcServer, opts ...grpc.DialOption) pb.BalanceServiceClient {
+	lis := bufconn.Listen(GRPC_BUFFER_SIZE)
+	srv := grpc.NewServer(grpcSrv.ServerOptions()...)
+	grpcSrv.Register(srv)
+	go srv.Serve(lis)
+	dialer := func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.DialContext(context.Background(), "bufnet", append([]grpc.DialOption{grpc.WithContextDialer(dialer), grpc.WithInsecure()}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Stop()
+	})
+	return pb.NewBalanceServiceClient(conn)
+}
+
+func grpcTest(t *testing.T, err error, code codes.Code, opCode int) {
+	st, ok := status.FromError(err)
+	assert.True(t, ok, "Expected gRPC status, but got: ", err)
+	assert.Equal(t, code, st.Code(), "Expected gRPC code: ", code, ", but got: ", st.Code())
+	var info *errdetails.ErrorInfo
+	for _, d := range st.Details() {
+		if i, ok := d.(*errdetails.ErrorInfo); ok {
+			info = i
+		}
+	}
+	if assert.NotNil(t, info, "Expected ErrorInfo details") {
+		assert.Equal(t, strconv.Itoa(opCode), info.Metadata["status"])
+	}
+}
+
+func TestGrpcTransactionAndBalance(t *testing.T) {
+	client := newGrpcClient(t, testRep)
+	ctx := context.Background()
+	res, err := client.Transaction(ctx, &pb.TransactionRequest{Id: 10, Sum: 150})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(server.STATUS_CODE_OK), res.Status)
+	bal, err := client.Balance(ctx, &pb.BalanceRequest{Id: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, server.BASE_CURRENCY, bal.Currency)
+	assert.True(t, bal.Balance >= 150)
+}
+
+func TestGrpcBalanceWrongUser(t *testing.T) {
+	client := newGrpcClient(t, testRep)
+	_, err := client.Balance(context.Background(), &pb.BalanceRequest{Id: -1})
+	grpcTest(t, err, codes.InvalidArgument, server.ERROR_WRONG_REQUEST)
+}
+
+func TestGrpcTransferEqualIds(t *testing.T) {
+	client := newGrpcClient(t, testRep)
+	_, err := client.Transfer(context.Background(), &pb.TransferRequest{From: 2, To: 2, Sum: 1})
+	grpcTest(t, err, codes.InvalidArgument, server.ERROR_WRONG_REQUEST)
+}
+
+func TestGrpcNotEnoughMoney(t *testing.T) {
+	rep := &MockAccountRepository{
+		executeTransactionFunc: func(trxData server.TransactionData, oCode int) error {
+			return &server.OperationError{Code: server.ERROR_NOT_ENOUGH_MONEY}
+		},
+	}
+	client := newGrpcClient(t, rep)
+	_, err := client.Transaction(context.Background(), &pb.TransactionRequest{Id: 1, Sum: -100})
+	grpcTest(t, err, codes.FailedPrecondition, server.ERROR_NOT_ENOUGH_MONEY)
+}
+
+func TestGrpcLockTimeoutRetryInfo(t *testing.T) {
+	rep := &MockAccountRepository{
+		executeTransactionFunc: func(trxData server.TransactionData, oCode int) error {
+			return &server.OperationError{Code: server.ERROR_LOCK_TIMEOUT}
+		},
+	}
+	client := newGrpcClient(t, rep)
+	_, err := client.Transaction(context.Background(), &pb.TransactionRequest{Id: 1, Sum: -100})
+	grpcTest(t, err, codes.Unavailable, server.ERROR_LOCK_TIMEOUT)
+	st, _ := status.FromError(err)
+	var retry *errdetails.RetryInfo
+	for _, d := range st.Details() {
+		if r, ok := d.(*errdetails.RetryInfo); ok {
+			retry = r
+		}
+	}
+	if assert.NotNil(t, retry, "Expected RetryInfo details") {
+		assert.Equal(t, int64(server.RETRY_AFTER_SECONDS), retry.RetryDelay.Seconds)
+	}
+}
+
+func TestGrpcStreamTransactions(t *testing.T) {
+	client := newGrpcClient(t, testRep)
+	ctx := context.Background()
+	count := server.PAGINATION_PAGE_SIZE*2 + 1
+	for i := 0; i < count; i++ {
+		_, err := client.Transaction(ctx, &pb.TransactionRequest{Id: 11, Sum: float64(i + 1)})
+		assert.Nil(t, err)
+	}
+	list, err := client.ListTransactions(ctx, &pb.ListTransactionsRequest{Id: 11})
+	assert.Nil(t, err)
+	assert.Equal(t, server.PAGINATION_PAGE_SIZE, len(list.Transactions))
+	stream, err := client.StreamTransactions(ctx, &pb.ListTransactionsRequest{Id: 11})
+	assert.Nil(t, err)
+	received := 0
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if !assert.Nil(t, err) {
+			break
+		}
+		received++
+	}
+	assert.GreaterOrEqual(t, received, server.PAGINATION_PAGE_SIZE+1, "Expected stream to cross a page boundary")
+}
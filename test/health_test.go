@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"balance-server/server"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type readinessResponse struct {
+	Status int                    `json:"status"`
+	Data   server.ReadinessReport `json:"data"`
+}
+
+func passingCheck(name string) server.HealthCheck {
+	return server.HealthCheck{Name: name, Critical: true, Check: func(ctx context.Context) error {
+		return nil
+	}}
+}
+
+func failingCheck(name string, critical bool) server.HealthCheck {
+	return server.HealthCheck{Name: name, Critical: critical, Check: func(ctx context.Context) error {
+		return errors.New(name + " is down")
+	}}
+}
+
+func probe(t *testing.T, readiness *server.Readiness) (int, readinessResponse) {
+	r := gin.New()
+	r.GET(server.URL_READYZ, readiness.Ready)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", server.URL_READYZ, nil))
+	var res readinessResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, res
+}
+
+func TestHealthz(t *testing.T) {
+	r := gin.New()
+	r.GET(server.URL_HEALTHZ, server.Healthz)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", server.URL_HEALTHZ, nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.JSONEq(t, `{"status":0,"data":"ok"}`, rec.Body.String())
+}
+
+func TestReadyzAllChecksPass(t *testing.T) {
+	code, res := probe(t, server.NewReadiness(passingCheck(server.HEALTH_CHECK_DATABASE), passingCheck(server.HEALTH_CHECK_SCHEMA)))
+	assert.Equal(t, 200, code)
+	assert.Equal(t, server.STATUS_CODE_OK, res.Status)
+	assert.True(t, res.Data.Ready)
+	assert.Len(t, res.Data.Checks, 2)
+	assert.Equal(t, server.HEALTH_STATUS_OK, res.Data.Checks[server.HEALTH_CHECK_SCHEMA].Status)
+}
+
+func TestReadyzCriticalCheckFails(t *testing.T) {
+	code, res := probe(t, server.NewReadiness(failingCheck(server.HEALTH_CHECK_DATABASE, true), passingCheck(server.HEALTH_CHECK_SCHEMA)))
+	assert.Equal(t, 503, code)
+	assert.Equal(t, server.ERROR_NOT_READY, res.Status)
+	assert.False(t, res.Data.Ready)
+	db := res.Data.Checks[server.HEALTH_CHECK_DATABASE]
+	assert.Equal(t, server.HEALTH_STATUS_FAIL, db.Status)
+	assert.Equal(t, "database is down", db.Error)
+	assert.Equal(t, server.HEALTH_STATUS_OK, res.Data.Checks[server.HEALTH_CHECK_SCHEMA].Status)
+}
+
+func TestReadyzOptionalCheckFails(t *testing.T) {
+	code, res := probe(t, server.NewReadiness(passingCheck(server.HEALTH_CHECK_DATABASE), failingCheck(server.HEALTH_CHECK_CURRENCY, false)))
+	assert.Equal(t, 200, code)
+	assert.True(t, res.Data.Ready)
+	assert.Equal(t, server.HEALTH_STATUS_FAIL, res.Data.Checks[server.HEALTH_CHECK_CURRENCY].Status)
+	assert.False(t, res.Data.Checks[server.HEALTH_CHECK_CURRENCY].Critical)
+}
+
+func TestReadyzCheckTimeout(t *testing.T) {
+	hanging := server.HealthCheck{Name: server.HEALTH_CHECK_DATABASE, Critical: true, Check: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	start := time.Now()
+	code, _ := probe(t, server.NewReadiness(hanging))
+	assert.Equal(t, 503, code)
+	assert.Less(t, time.Since(start), server.HEALTH_CHECK_TIMEOUT+time.Second)
+}
+
+func TestReadyzShuttingDown(t *testing.T) {
+	readiness := server.NewReadiness(passingCheck(server.HEALTH_CHECK_DATABASE))
+	readiness.Shutdown()
+	code, res := probe(t, readiness)
+	assert.Equal(t, 503, code)
+	assert.False(t, res.Data.Ready)
+	assert.Contains(t, res.Data.Checks, server.HEALTH_CHECK_SHUTDOWN)
+	assert.NotContains(t, res.Data.Checks, server.HEALTH_CHECK_DATABASE)
+}
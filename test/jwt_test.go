@@ -0,0 +1,187 @@
+package tests
+
+import (
+	"balance-server/server"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	JWT_TEST_SECRET string = "test-secret"
+	JWT_TEST_KID    string = "test-rsa"
+	JWT_TEST_SCOPE  string = "balance:read transactions:read transfer"
+)
+
+// writeTestJwks writes JWKS file with public part of the key, as an identity provider would publish it.
+func writeTestJwks(t *testing.T, key *rsa.PrivateKey) string {
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": server.JWK_TYPE_RSA,
+			"kid": JWT_TEST_KID,
+			"alg": server.JWT_ALG_RS256,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	}
+	data, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server.AUTH_SCHEME_BEARER + " " + s
+}
+
+func newTestJwtVerifier(t *testing.T, claim string) (*server.JwtVerifier, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := server.LoadJwks(writeTestJwks(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server.NewJwtVerifier([]byte(JWT_TEST_SECRET), jwks, claim), key
+}
+
+func newJwtTestRepository() *MockAccountRepository {
+	return &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 10, nil
+		},
+		executeTransferFunc: func(tData server.TransferData) error {
+			return nil
+		},
+		executeTransactionFunc: func(trxData server.TransactionData, oCode int) error {
+			return nil
+		},
+	}
+}
+
+func TestJwtAccountBinding(t *testing.T) {
+	verifier, key := newTestJwtVerifier(t, "")
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(nil, verifier), Accounts: newJwtTestRepository()})
+	exp := time.Now().Add(time.Hour).Unix()
+	tokens := map[string]string{
+		"HS256": signTestToken(t, jwt.SigningMethodHS256, []byte(JWT_TEST_SECRET), "", jwt.MapClaims{"sub": "1", "exp": exp, "scope": JWT_TEST_SCOPE}),
+		"RS256": signTestToken(t, jwt.SigningMethodRS256, key, JWT_TEST_KID, jwt.MapClaims{"sub": 1, "exp": exp, "scope": JWT_TEST_SCOPE}),
+	}
+	for alg, token := range tokens {
+		t.Run(alg, func(t *testing.T) {
+			assert.Equal(t, 200, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", token))
+			assert.Equal(t, 403, makeAuthRequest(t, r, "GET", "/accounts/2/balance", "", token))
+			assert.Equal(t, 200, makeAuthRequest(t, r, "POST", server.URL_TRANSFER, `{"id": 1, "to": 2, "sum": 10}`, token))
+			assert.Equal(t, 403, makeAuthRequest(t, r, "POST", server.URL_TRANSFER, `{"id": 2, "to": 1, "sum": 10}`, token))
+			assert.Equal(t, 403, makeAuthRequest(t, r, "POST", server.URL_TRANSACTION, `{"id": 1, "sum": 10}`, token))
+		})
+	}
+}
+
+func TestJwtAccountMismatchCode(t *testing.T) {
+	verifier, _ := newTestJwtVerifier(t, "")
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(nil, verifier), Accounts: newJwtTestRepository()})
+	token := signTestToken(t, jwt.SigningMethodHS256, []byte(JWT_TEST_SECRET), "", jwt.MapClaims{"sub": "1", "exp": time.Now().Add(time.Hour).Unix(), "scope": JWT_TEST_SCOPE})
+	for path, code := range map[string]int{"/accounts/2/balance": server.ERROR_ACCOUNT_MISMATCH, "/accounts/1/balance": server.STATUS_CODE_OK} {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set(server.HEADER_AUTHORIZATION, token)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		var res map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, float64(code), res["status"], path)
+	}
+}
+
+func TestJwtRejected(t *testing.T) {
+	verifier, key := newTestJwtVerifier(t, "")
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(nil, verifier), Accounts: newJwtTestRepository()})
+	exp := time.Now().Add(time.Hour).Unix()
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tokens := map[string]string{
+		"expired":      signTestToken(t, jwt.SigningMethodHS256, []byte(JWT_TEST_SECRET), "", jwt.MapClaims{"sub": "1", "exp": time.Now().Add(-time.Minute).Unix()}),
+		"no exp":       signTestToken(t, jwt.SigningMethodHS256, []byte(JWT_TEST_SECRET), "", jwt.MapClaims{"sub": "1"}),
+		"wrong secret": signTestToken(t, jwt.SigningMethodHS256, []byte("other"), "", jwt.MapClaims{"sub": "1", "exp": exp, "scope": JWT_TEST_SCOPE}),
+		"wrong key":    signTestToken(t, jwt.SigningMethodRS256, other, JWT_TEST_KID, jwt.MapClaims{"sub": "1", "exp": exp, "scope": JWT_TEST_SCOPE}),
+		"unknown kid":  signTestToken(t, jwt.SigningMethodRS256, key, "other", jwt.MapClaims{"sub": "1", "exp": exp, "scope": JWT_TEST_SCOPE}),
+		"alg none":     signTestToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", jwt.MapClaims{"sub": "1", "exp": exp, "scope": JWT_TEST_SCOPE}),
+		"no account":   signTestToken(t, jwt.SigningMethodHS256, []byte(JWT_TEST_SECRET), "", jwt.MapClaims{"exp": exp, "scope": JWT_TEST_SCOPE}),
+		"bad account":  signTestToken(t, jwt.SigningMethodHS256, []byte(JWT_TEST_SECRET), "", jwt.MapClaims{"sub": "user", "exp": exp, "scope": JWT_TEST_SCOPE}),
+		"malformed":    server.AUTH_SCHEME_BEARER + " not.a.token",
+	}
+	for name, token := range tokens {
+		assert.Equal(t, 401, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", token), name)
+	}
+}
+
+func TestJwtScopeClaim(t *testing.T) {
+	verifier, _ := newTestJwtVerifier(t, "")
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(nil, verifier), Accounts: newJwtTestRepository()})
+	exp := time.Now().Add(time.Hour).Unix()
+	readOnly := signTestToken(t, jwt.SigningMethodHS256, []byte(JWT_TEST_SECRET), "", jwt.MapClaims{"sub": "1", "exp": exp, "scope": "balance:read admin:adjust"})
+	assert.Equal(t, 200, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", readOnly))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "POST", server.URL_TRANSFER, `{"id": 1, "to": 2, "sum": 10}`, readOnly), "Scope missing from token should not be granted")
+	assert.Equal(t, []string{server.SCOPE_BALANCE_READ}, mustAuthenticateJwt(t, verifier, readOnly).Scopes, "Scopes outside JWT_SCOPES should be dropped")
+
+	list := signTestToken(t, jwt.SigningMethodHS256, []byte(JWT_TEST_SECRET), "", jwt.MapClaims{"sub": "1", "exp": exp, "scope": []string{"transfer"}})
+	assert.Equal(t, 200, makeAuthRequest(t, r, "POST", server.URL_TRANSFER, `{"id": 1, "to": 2, "sum": 10}`, list))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", list))
+
+	none := signTestToken(t, jwt.SigningMethodHS256, []byte(JWT_TEST_SECRET), "", jwt.MapClaims{"sub": "1", "exp": exp})
+	assert.Equal(t, 403, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", none), "Token without scope claim should be granted nothing")
+}
+
+func mustAuthenticateJwt(t *testing.T, verifier *server.JwtVerifier, header string) *server.JwtPrincipal {
+	p, err := verifier.Authenticate(strings.TrimPrefix(header, server.AUTH_SCHEME_BEARER+" "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestJwtAccountClaim(t *testing.T) {
+	verifier, _ := newTestJwtVerifier(t, "account_id")
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(nil, verifier), Accounts: newJwtTestRepository()})
+	token := signTestToken(t, jwt.SigningMethodHS256, []byte(JWT_TEST_SECRET), "", jwt.MapClaims{"sub": "user@example.com", "account_id": 5, "exp": time.Now().Add(time.Hour).Unix(), "scope": JWT_TEST_SCOPE})
+	assert.Equal(t, 200, makeAuthRequest(t, r, "GET", "/accounts/5/balance", "", token))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", token))
+}
+
+func TestJwtAndApiKey(t *testing.T) {
+	verifier, _ := newTestJwtVerifier(t, "")
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	auth := server.NewAuthenticator(keys, verifier)
+	r := newTestRouter(testRoutes{Auth: auth, Accounts: newJwtTestRepository()})
+	token := signTestToken(t, jwt.SigningMethodHS256, []byte(JWT_TEST_SECRET), "", jwt.MapClaims{"sub": "1", "exp": time.Now().Add(time.Hour).Unix(), "scope": JWT_TEST_SCOPE})
+	assert.Equal(t, 200, makeAuthRequest(t, r, "GET", "/accounts/1/balance", "", token))
+	assert.Equal(t, 200, makeAuthRequest(t, r, "GET", "/accounts/2/balance", "", issueKey(t, keys, []string{server.SCOPE_BALANCE_READ}, nil)))
+	assert.Equal(t, server.AUTH_SCHEME_API_KEY+", "+server.AUTH_SCHEME_BEARER, auth.Schemes())
+}
@@ -0,0 +1,221 @@
+package tests
+
+import (
+	"balance-server/server"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type MockLedgerRepository struct {
+	rows []server.ChainRow
+}
+
+func (rep *MockLedgerRepository) WalkChain(ctx context.Context, account int, fn func(row server.ChainRow) bool) error {
+	for _, row := range rep.rows {
+		if account != 0 && row.Account != account {
+			continue
+		}
+		if !fn(row) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (rep *MockLedgerRepository) GetChainHeads(ctx context.Context) ([]server.ChainHead, error) {
+	heads := []server.ChainHead{}
+	for _, row := range rep.rows {
+		if n := len(heads); n > 0 && heads[n-1].Account == row.Account {
+			heads[n-1] = server.ChainHead{Account: row.Account, Id: row.Id, Hash: row.Hash}
+			continue
+		}
+		heads = append(heads, server.ChainHead{Account: row.Account, Id: row.Id, Hash: row.Hash})
+	}
+	return heads, nil
+}
+
+// newTestChain builds valid chains ordered by account and id.
+func newTestChain(sums map[int][]float64) []server.ChainRow {
+	rows := []server.ChainRow{}
+	id := 1
+	for account := 1; account <= len(sums); account++ {
+		prev := ""
+		for _, sum := range sums[account] {
+			row := server.ChainRow{Id: id, Account: account, Sum: server.FormatLedgerSum(sum), Date: 1640000000 + int64(id), Desc: "test", PrevHash: prev}
+			row.Hash = server.HashChainRow(row)
+			prev = row.Hash
+			rows = append(rows, row)
+			id++
+		}
+	}
+	return rows
+}
+
+func verifyChain(t *testing.T, rows []server.ChainRow, cp *server.LedgerCheckpoint) server.ChainReport {
+	report, err := server.NewLedgerService(&MockLedgerRepository{rows}).Verify(context.Background(), 0, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestLedgerChainIntact(t *testing.T) {
+	report := verifyChain(t, newTestChain(map[int][]float64{1: {10, -2.5, 3}, 2: {7}}), nil)
+	assert.True(t, report.Ok)
+	assert.Equal(t, 4, report.Rows)
+	assert.Equal(t, 2, report.Accounts)
+	assert.Nil(t, report.Break)
+}
+
+func TestLedgerChainEditedRow(t *testing.T) {
+	rows := newTestChain(map[int][]float64{1: {10, -2.5, 3}})
+	rows[1].Sum = "-0.50"
+	report := verifyChain(t, rows, nil)
+	assert.False(t, report.Ok)
+	assert.Equal(t, &server.ChainBreak{Account: 1, Id: 2, Reason: server.CHAIN_BREAK_HASH}, report.Break)
+	assert.Equal(t, 1, report.Rows)
+}
+
+func TestLedgerChainDeletedRow(t *testing.T) {
+	rows := newTestChain(map[int][]float64{1: {10, -2.5, 3}})
+	rows = append(rows[:1], rows[2:]...)
+	report := verifyChain(t, rows, nil)
+	assert.False(t, report.Ok)
+	assert.Equal(t, &server.ChainBreak{Account: 1, Id: 3, Reason: server.CHAIN_BREAK_LINK}, report.Break)
+}
+
+func TestLedgerChainCheckpoint(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	rows := newTestChain(map[int][]float64{1: {10, -2.5}, 2: {7}})
+	cp, err := server.NewLedgerService(&MockLedgerRepository{rows}).Checkpoint(context.Background(), key)
+	assert.Nil(t, err)
+	assert.Nil(t, server.VerifyCheckpoint(key.Public().(ed25519.PublicKey), cp))
+	assert.True(t, verifyChain(t, rows, cp).Ok)
+
+	next := server.ChainRow{Id: 4, Account: 1, Sum: "1.00", Date: 1640000004, PrevHash: rows[1].Hash}
+	next.Hash = server.HashChainRow(next)
+	grown := []server.ChainRow{rows[0], rows[1], next, rows[2]}
+	assert.True(t, verifyChain(t, grown, cp).Ok)
+
+	truncated := rows[:1]
+	report := verifyChain(t, truncated, cp)
+	assert.False(t, report.Ok)
+	assert.Equal(t, &server.ChainBreak{Account: 1, Id: 2, Reason: server.CHAIN_BREAK_CHECKPOINT_MISSING}, report.Break)
+
+	report = verifyChain(t, []server.ChainRow{}, cp)
+	assert.False(t, report.Ok)
+	assert.Equal(t, &server.ChainBreak{Account: 1, Id: 2, Reason: server.CHAIN_BREAK_CHECKPOINT_MISSING}, report.Break)
+
+	rebuilt := newTestChain(map[int][]float64{1: {10, -1}, 2: {7}})
+	report = verifyChain(t, rebuilt, cp)
+	assert.False(t, report.Ok)
+	assert.Equal(t, &server.ChainBreak{Account: 1, Id: 2, Reason: server.CHAIN_BREAK_CHECKPOINT}, report.Break)
+
+	cp.Heads[0].Hash = rebuilt[1].Hash
+	assert.NotNil(t, server.VerifyCheckpoint(key.Public().(ed25519.PublicKey), cp))
+}
+
+func TestLedgerSumFormat(t *testing.T) {
+	assert.Equal(t, "10.00", server.FormatLedgerSum(10))
+	assert.Equal(t, "-0.83", server.FormatLedgerSum(-0.83))
+	assert.Equal(t, "0.00", server.FormatLedgerSum(-0.001))
+}
+
+func TestLedgerVerifyEndpoint(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(keys, nil), Ledger: &MockLedgerRepository{newTestChain(map[int][]float64{1: {10}})}})
+
+	assert.Equal(t, 200, makeAuthRequest(t, r, "GET", "/admin/ledger/verify?account=1", "", issueKey(t, keys, []string{server.ROLE_AUDITOR}, nil)))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "GET", "/admin/ledger/verify", "", issueKey(t, keys, []string{server.ROLE_VIEWER}, nil)))
+	assert.Equal(t, 403, makeAuthRequest(t, r, "GET", "/admin/ledger/verify?account=-1", "", issueKey(t, keys, []string{server.ROLE_VIEWER}, nil)), "Caller should be authorized before the query is checked")
+}
+
+func TestLedgerVerifyEndpointLatestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	conf := server.DefaultConfig()
+	cfg := &conf.Ledger
+	cfg.CheckpointKeyFile = filepath.Join(dir, "key.pem")
+	cfg.CheckpointDir = dir
+	assert.Nil(t, ioutil.WriteFile(cfg.CheckpointKeyFile, pem.EncodeToMemory(&pem.Block{Type: server.PEM_PRIVATE_KEY, Bytes: der}), 0600))
+	rep := &MockLedgerRepository{newTestChain(map[int][]float64{1: {10}})}
+	srv := server.NewLedgerService(rep)
+	old, err := srv.Checkpoint(context.Background(), key)
+	assert.Nil(t, err)
+	rep.rows = newTestChain(map[int][]float64{1: {10, 5}})
+	latest, err := srv.Checkpoint(context.Background(), key)
+	assert.Nil(t, err)
+	old.Date, latest.Date = 1640000000, 1640003600
+	for _, cp := range []*server.LedgerCheckpoint{old, latest} {
+		server.SignCheckpoint(key, cp)
+		data, _ := json.Marshal(cp)
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf(server.CHECKPOINT_FILE, cp.Date)), data, 0644))
+	}
+	rep.rows = rep.rows[:1]
+
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(keys, nil), Ledger: rep, Config: conf})
+	req := httptest.NewRequest("GET", server.URL_ADMIN_LEDGER_VERIFY, nil)
+	req.Header.Set(server.HEADER_AUTHORIZATION, issueKey(t, keys, []string{server.ROLE_AUDITOR}, nil))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+	var res struct {
+		Data server.ChainReport `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.False(t, res.Data.Ok, "Row deleted after the latest checkpoint should be reported")
+	assert.Equal(t, latest.Date, res.Data.Checkpoint)
+	assert.Equal(t, server.CHAIN_BREAK_CHECKPOINT_MISSING, res.Data.Break.Reason)
+
+	latest.Signature = old.Signature
+	data, _ := json.Marshal(latest)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf(server.CHECKPOINT_FILE, latest.Date)), data, 0644))
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, 500, rec.Code, "Checkpoint with wrong signature should not be trusted")
+}
+
+func TestLedgerCommand(t *testing.T) {
+	dir := t.TempDir()
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	keyFile := filepath.Join(dir, "key.pem")
+	pubFile := filepath.Join(dir, "pub.pem")
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: server.PEM_PRIVATE_KEY, Bytes: der}), 0600))
+	der, _ = x509.MarshalPKIXPublicKey(pub)
+	assert.Nil(t, ioutil.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: server.PEM_PUBLIC_KEY, Bytes: der}), 0644))
+
+	rep := &MockLedgerRepository{newTestChain(map[int][]float64{1: {10, 5}})}
+	ledger := server.NewLedgerService(rep)
+	cfg := server.DefaultConfig().Ledger
+	cfg.CheckpointKeyFile = keyFile
+	cfg.CheckpointDir = dir
+	var out bytes.Buffer
+	assert.Nil(t, server.LedgerCommand(ledger, cfg, []string{"checkpoint"}, &out))
+	files, _ := filepath.Glob(filepath.Join(dir, "checkpoint-*.json"))
+	assert.Len(t, files, 1)
+
+	out.Reset()
+	assert.Nil(t, server.LedgerCommand(ledger, cfg, []string{"verify", "-checkpoint", files[0], "-public-key", pubFile}, &out))
+	assert.Contains(t, out.String(), "2 rows in 1 accounts")
+
+	rep.rows = rep.rows[:1]
+	out.Reset()
+	assert.Equal(t, server.ErrChainBroken, server.LedgerCommand(ledger, cfg, []string{"verify", "-checkpoint", files[0], "-public-key", pubFile}, &out))
+	assert.Contains(t, out.String(), "account 1 row 2")
+	assert.NotNil(t, server.LedgerCommand(ledger, cfg, []string{"verify", "-checkpoint", files[0]}, &out))
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"balance-server/pb"
+	"balance-server/server"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	TEST_REQUEST_ID string = "test-request-id"
+)
+
+func failingBalanceRepository() *MockAccountRepository {
+	return &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 0, errors.New("connection reset by peer")
+		},
+	}
+}
+
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	s := bufio.NewScanner(buf)
+	for s.Scan() {
+		rec := map[string]interface{}{}
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			t.Fatalf("Log record is not JSON: %s", s.Text())
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestLogRequestIdPropagated(t *testing.T) {
+	var buf bytes.Buffer
+	log := server.NewLogger(&buf, server.LOG_LEVEL_DEBUG)
+	r := newTestRouter(testRoutes{Log: &log, Use: []gin.HandlerFunc{server.RequestId(), server.AccessLog(log)}, Accounts: failingBalanceRepository()})
+	req := authorized(httptest.NewRequest("GET", "/accounts/1/balance", nil))
+	req.Header.Set(server.HEADER_REQUEST_ID, TEST_REQUEST_ID)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, 500, rec.Code)
+	assert.Equal(t, TEST_REQUEST_ID, rec.Header().Get(server.HEADER_REQUEST_ID))
+
+	records := logRecords(t, &buf)
+	assert.NotEmpty(t, records)
+	var cause map[string]interface{}
+	for _, l := range records {
+		assert.Equal(t, TEST_REQUEST_ID, l[server.LOG_FIELD_REQUEST_ID], l)
+		if l[server.LOG_FIELD_COMPONENT] == "service" {
+			cause = l
+		}
+	}
+	if cause == nil {
+		t.Fatal("Expected service record, got: ", records)
+	}
+	assert.Equal(t, "error", cause["level"])
+	assert.Equal(t, "connection reset by peer", cause["error"])
+	assert.EqualValues(t, server.ERROR_INTERNAL, cause[server.LOG_FIELD_STATUS])
+	access := records[len(records)-1]
+	assert.Equal(t, "http", access[server.LOG_FIELD_COMPONENT])
+	assert.EqualValues(t, 500, access["code"])
+	assert.Equal(t, server.URL_ACCOUNT_BALANCE, access["route"])
+}
+
+func TestLogRequestIdGenerated(t *testing.T) {
+	var buf bytes.Buffer
+	log := server.NewLogger(&buf, server.LOG_LEVEL_INFO)
+	r := newTestRouter(testRoutes{Log: &log, Use: []gin.HandlerFunc{server.RequestId(), server.AccessLog(log)}, Accounts: &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 10, nil
+		},
+	}})
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, authorized(httptest.NewRequest("GET", "/accounts/1/balance", nil)))
+	id := rec.Header().Get(server.HEADER_REQUEST_ID)
+	assert.NotEmpty(t, id)
+	records := logRecords(t, &buf)
+	assert.Len(t, records, 1)
+	assert.Equal(t, id, records[0][server.LOG_FIELD_REQUEST_ID])
+	assert.Equal(t, "info", records[0]["level"])
+}
+
+func TestLogLevelFilter(t *testing.T) {
+	var buf bytes.Buffer
+	log := server.NewLogger(&buf, server.LOG_LEVEL_ERROR)
+	r := newTestRouter(testRoutes{Log: &log, Use: []gin.HandlerFunc{server.RequestId(), server.AccessLog(log)}, Accounts: &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 0, &server.OperationError{Code: server.ERROR_NO_BALANCE}
+		},
+	}})
+	r.ServeHTTP(httptest.NewRecorder(), authorized(httptest.NewRequest("GET", "/accounts/1/balance", nil)))
+	assert.Empty(t, logRecords(t, &buf))
+}
+
+func TestLogGrpcRequestId(t *testing.T) {
+	var buf bytes.Buffer
+	log := server.NewLogger(&buf, server.LOG_LEVEL_DEBUG)
+	client := newGrpcServerClient(t, server.NewAccountGrpcServer(server.NewAccountService(failingBalanceRepository(), server.DefaultConfig(), log), testAuth, log), grpcAuthorized()...)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), server.HEADER_REQUEST_ID, TEST_REQUEST_ID)
+	var header metadata.MD
+	_, err := client.Balance(ctx, &pb.BalanceRequest{Id: 1}, grpc.Header(&header))
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{TEST_REQUEST_ID}, header.Get(server.HEADER_REQUEST_ID))
+
+	records := logRecords(t, &buf)
+	assert.Len(t, records, 2)
+	for _, l := range records {
+		assert.Equal(t, TEST_REQUEST_ID, l[server.LOG_FIELD_REQUEST_ID], l)
+	}
+	assert.Equal(t, "connection reset by peer", records[0]["error"])
+	assert.Equal(t, "Internal", records[1]["code"])
+}
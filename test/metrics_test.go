@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"balance-server/server"
+	"bufio"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// scrapeMetrics reads samples exposed by router at URL_METRICS by series name with labels.
+// Metrics are process-wide, so tests compare samples taken before and after their requests.
+func scrapeMetrics(t *testing.T, r *gin.Engine) map[string]float64 {
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", server.URL_METRICS, nil))
+	if rec.Code != 200 {
+		t.Fatal("Metrics scrape failed with code ", rec.Code)
+	}
+	samples := map[string]float64{}
+	sc := bufio.NewScanner(rec.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		i := strings.LastIndex(line, " ")
+		if strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(line[i+1:], 64); err == nil {
+			samples[line[:i]] = v
+		}
+	}
+	return samples
+}
+
+func TestMetricsScrape(t *testing.T) {
+	rep := &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			if dt.Id == 2 {
+				return 0, &server.OperationError{Code: server.ERROR_NO_BALANCE}
+			}
+			return 10, nil
+		},
+	}
+	r := newTestRouter(testRoutes{Accounts: rep, Use: []gin.HandlerFunc{server.HttpMetrics()}})
+
+	before := scrapeMetrics(t, r)
+	for _, path := range []string{"/accounts/1/balance", "/accounts/1/balance", "/accounts/2/balance", "/nowhere"} {
+		r.ServeHTTP(httptest.NewRecorder(), authorized(httptest.NewRequest("GET", path, nil)))
+	}
+	after := scrapeMetrics(t, r)
+
+	delta := func(series string) float64 {
+		return after[series] - before[series]
+	}
+	assert.Equal(t, 2.0, delta(`balance_http_request_duration_seconds_count{method="GET",route="/accounts/:id/balance",status="200"}`))
+	assert.Equal(t, 1.0, delta(`balance_http_request_duration_seconds_count{method="GET",route="/accounts/:id/balance",status="404"}`))
+	assert.Equal(t, 1.0, delta(`balance_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"}`))
+	assert.Equal(t, 1.0, delta(`balance_operation_errors_total{code="107",transport="http"}`))
+	assert.Contains(t, after, "go_goroutines")
+}
@@ -0,0 +1,251 @@
+package tests
+
+import (
+	"balance-server/server"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	TEST_MIGRATION_SCHEMA string = "migrate_test"
+	// TEST_LEGACY_SCHEMA is the schema created by sql/init.sql before migrations were introduced.
+	TEST_LEGACY_SCHEMA string = `
+CREATE TABLE IF NOT EXISTS transactions (
+	id SERIAL PRIMARY KEY,
+	account INTEGER NOT NULL CHECK (account > 0),
+	operation INTEGER NOT NULL DEFAULT 0,
+	description VARCHAR(256) NOT NULL DEFAULT '',
+	sum NUMERIC(16, 2) NOT NULL,
+	date BIGINT NOT NULL DEFAULT EXTRACT(EPOCH FROM (now() AT TIME ZONE 'UTC'))
+);
+CREATE INDEX IF NOT EXISTS transaction_account ON transactions(account);
+CREATE INDEX IF NOT EXISTS transaction_account_date ON transactions(account, date);
+CREATE INDEX IF NOT EXISTS transactions_account_sum ON transactions(account, sum);
+CREATE INDEX IF NOT EXISTS transactions_account_sum_date ON transactions(account, sum, date);
+
+CREATE MATERIALIZED VIEW transactions_sum_order AS (WITH p AS (SELECT id AS id, row_number() OVER (ORDER BY sum DESC) AS pager FROM transactions) SELECT * FROM p ORDER BY p.pager ASC);
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_sum_order_pager ON transactions_sum_order(pager);
+CREATE INDEX IF NOT EXISTS transactions_sum_order_account_date ON transactions_sum_order(id, pager);
+`
+)
+
+func migrationFile(sql string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(sql)}
+}
+
+func TestLoadMigrationsEmbedded(t *testing.T) {
+	assert.NotEmpty(t, server.MIGRATIONS)
+	assert.Equal(t, len(server.MIGRATIONS), server.SchemaVersion())
+	for i, m := range server.MIGRATIONS {
+		assert.Equal(t, i+1, m.Version)
+		assert.NotEmpty(t, m.Up)
+		assert.NotEmpty(t, m.Down)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := server.LoadMigrations(fstest.MapFS{
+		"m/0002_users.down.sql": migrationFile("DROP TABLE users;"),
+		"m/0001_init.up.sql":    migrationFile("CREATE TABLE a();"),
+		"m/0002_users.up.sql":   migrationFile("CREATE TABLE users();"),
+		"m/0001_init.down.sql":  migrationFile("DROP TABLE a;"),
+	}, "m")
+	assert.Nil(t, err)
+	assert.Equal(t, []server.Migration{
+		{Version: 1, Name: "init", Up: "CREATE TABLE a();", Down: "DROP TABLE a;"},
+		{Version: 2, Name: "users", Up: "CREATE TABLE users();", Down: "DROP TABLE users;"},
+	}, migrations)
+}
+
+func TestLoadMigrationsErrors(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"missing down": {
+			"m/0001_init.up.sql": migrationFile("SELECT 1;"),
+		},
+		"gap": {
+			"m/0001_init.up.sql":   migrationFile("SELECT 1;"),
+			"m/0001_init.down.sql": migrationFile("SELECT 1;"),
+			"m/0003_next.up.sql":   migrationFile("SELECT 1;"),
+			"m/0003_next.down.sql": migrationFile("SELECT 1;"),
+		},
+		"wrong name": {
+			"m/init.sql": migrationFile("SELECT 1;"),
+		},
+		"different names": {
+			"m/0001_init.up.sql":   migrationFile("SELECT 1;"),
+			"m/0001_base.down.sql": migrationFile("SELECT 1;"),
+		},
+	}
+	for name, fsys := range tests {
+		_, err := server.LoadMigrations(fsys, "m")
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestMigrateCommandUsage(t *testing.T) {
+	var out bytes.Buffer
+	assert.NotNil(t, server.MigrateCommand(nil, nil, &out))
+	assert.NotNil(t, server.MigrateCommand(nil, []string{"sideways"}, &out))
+	assert.NotNil(t, server.MigrateCommand(nil, []string{server.COMMAND_MIGRATE_DOWN, "-steps", "0"}, &out))
+}
+
+// newSchemaDatabase connects to empty schema of test database, migrations there do not touch tables of other tests.
+func newSchemaDatabase(t *testing.T) *server.Database {
+	ctx := context.Background()
+	drop := "DROP SCHEMA IF EXISTS " + TEST_MIGRATION_SCHEMA + " CASCADE"
+	if _, err := testDb.Conn.Exec(ctx, drop); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testDb.Conn.Exec(ctx, "CREATE SCHEMA "+TEST_MIGRATION_SCHEMA); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := pgxpool.ParseConfig(os.Getenv("PGX_TEST_DATABASE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = TEST_MIGRATION_SCHEMA
+	pool, err := pgxpool.ConnectConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pool.Close()
+		testDb.Conn.Exec(context.Background(), drop)
+	})
+	return &server.Database{Conn: pool}
+}
+
+func TestMigratorUpDown(t *testing.T) {
+	ctx := context.Background()
+	m := server.NewMigrator(newSchemaDatabase(t), server.MIGRATIONS, zerolog.Nop())
+	assert.True(t, errors.Is(m.Check(ctx), server.ErrSchemaPending))
+
+	done, err := m.Up(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, done, len(server.MIGRATIONS))
+	assert.Nil(t, m.Check(ctx))
+	done, err = m.Up(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, done, "Applied migrations should not run again")
+
+	list, err := m.Status(ctx)
+	assert.Nil(t, err)
+	for _, st := range list {
+		assert.Equal(t, server.MIGRATION_STATE_APPLIED, st.State)
+		assert.NotZero(t, st.Applied)
+	}
+
+	done, err = m.Down(ctx, len(server.MIGRATIONS)-1)
+	assert.Nil(t, err)
+	assert.Len(t, done, len(server.MIGRATIONS)-1)
+	list, err = m.Status(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, server.MIGRATION_STATE_APPLIED, list[0].State)
+	for _, st := range list[1:] {
+		assert.Equal(t, server.MIGRATION_STATE_PENDING, st.State)
+	}
+	_, err = m.Up(ctx)
+	assert.Nil(t, err, "Down should revert everything up created")
+}
+
+func TestMigratorInitIrreversible(t *testing.T) {
+	ctx := context.Background()
+	db := newSchemaDatabase(t)
+	m := server.NewMigrator(db, server.MIGRATIONS, zerolog.Nop())
+	_, err := m.Up(ctx)
+	assert.Nil(t, err)
+	_, err = db.Conn.Exec(ctx, `INSERT INTO transactions(account, sum) VALUES (1, 100)`)
+	assert.Nil(t, err)
+
+	done, err := m.Down(ctx, len(server.MIGRATIONS))
+	assert.NotNil(t, err)
+	assert.Len(t, done, len(server.MIGRATIONS)-1, "Migrations after the first should be reverted")
+	list, err := m.Status(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, server.MIGRATION_STATE_APPLIED, list[0].State)
+	var rows int
+	assert.Nil(t, db.Conn.QueryRow(ctx, "SELECT count(*) FROM transactions").Scan(&rows))
+	assert.Equal(t, 1, rows, "Ledger should be kept")
+}
+
+func TestMigratorLegacySchema(t *testing.T) {
+	ctx := context.Background()
+	db := newSchemaDatabase(t)
+	_, err := db.Conn.Exec(ctx, TEST_LEGACY_SCHEMA)
+	assert.Nil(t, err)
+	_, err = db.Conn.Exec(ctx, `INSERT INTO transactions(account, sum, operation, description) VALUES
+		(1, 100, 0, 'deposit'), (2, 50, 0, ''), (1, -12.5, 1, '<b> & "quoted"'), (2, 0.1, 0, E'line\nbreak')`)
+	assert.Nil(t, err)
+
+	m := server.NewMigrator(db, server.MIGRATIONS, zerolog.Nop())
+	_, err = m.Up(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, m.Check(ctx))
+
+	var empty int
+	assert.Nil(t, db.Conn.QueryRow(ctx, "SELECT count(*) FROM transactions WHERE hash = ''").Scan(&empty))
+	assert.Zero(t, empty, "Existing rows should get hashes")
+	report, err := server.NewLedgerService(server.NewLedgerRepository(db)).Verify(ctx, 0, nil)
+	assert.Nil(t, err)
+	assert.True(t, report.Ok)
+	assert.Equal(t, 4, report.Rows)
+	assert.Equal(t, 2, report.Accounts)
+
+	_, err = db.Conn.Exec(ctx, "REFRESH MATERIALIZED VIEW CONCURRENTLY transactions_sum_order")
+	assert.Nil(t, err, "View should keep the unique index")
+	var accounts int
+	assert.Nil(t, db.Conn.QueryRow(ctx, "SELECT count(*) FROM accounts").Scan(&accounts))
+	assert.Equal(t, 2, accounts)
+}
+
+func TestMigratorConcurrentRunners(t *testing.T) {
+	db := newSchemaDatabase(t)
+	const runners = 4
+	applied := make(chan int, runners)
+	var wg sync.WaitGroup
+	for i := 0; i < runners; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done, err := server.NewMigrator(db, server.MIGRATIONS, zerolog.Nop()).Up(context.Background())
+			assert.Nil(t, err)
+			applied <- len(done)
+		}()
+	}
+	wg.Wait()
+	close(applied)
+	total := 0
+	for n := range applied {
+		total += n
+	}
+	assert.Equal(t, len(server.MIGRATIONS), total, "Every migration should be applied by one runner")
+}
+
+func TestMigratorRefusesUnknownVersion(t *testing.T) {
+	ctx := context.Background()
+	db := newSchemaDatabase(t)
+	m := server.NewMigrator(db, server.MIGRATIONS, zerolog.Nop())
+	_, err := m.Up(ctx)
+	assert.Nil(t, err)
+	unknown := server.SchemaVersion() + 1
+	_, err = db.Conn.Exec(ctx, server.INSERT_SCHEMA_MIGRATION, unknown)
+	assert.Nil(t, err)
+
+	assert.True(t, errors.Is(m.Check(ctx), server.ErrSchemaUnknown))
+	_, err = m.Up(ctx)
+	assert.True(t, errors.Is(err, server.ErrSchemaUnknown))
+	_, err = m.Down(ctx, 1)
+	assert.True(t, errors.Is(err, server.ErrSchemaUnknown))
+	list, err := m.Status(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, server.MigrationStatus{Version: unknown, State: server.MIGRATION_STATE_UNKNOWN, Applied: list[len(list)-1].Applied}, list[len(list)-1])
+}
@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"balance-server/server"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	OPENAPI_SPEC_FILE string = "../openapi.json"
+)
+
+var updateOpenApi = flag.Bool("update-openapi", false, "rewrite openapi.json from request/response types")
+
+func TestOpenApiSpecUpToDate(t *testing.T) {
+	req, _ := http.NewRequest("GET", server.URL_OPENAPI, nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+	var got bytes.Buffer
+	if err := json.Indent(&got, rec.Body.Bytes(), "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	got.WriteString("\n")
+	if *updateOpenApi {
+		if err := ioutil.WriteFile(OPENAPI_SPEC_FILE, got.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(OPENAPI_SPEC_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(want), got.String(), "Request/response types drifted from openapi.json, run tests with -update-openapi")
+}
+
+func TestOpenApiRoutesRegistered(t *testing.T) {
+	registered := map[string]bool{}
+	for _, r := range router.Routes() {
+		registered[r.Method+" "+r.Path] = true
+	}
+	for _, r := range server.API_ROUTES {
+		assert.True(t, registered[r.Method+" "+r.Path], "Route from spec is not registered: ", r.Method, " ", r.Path)
+	}
+}
+
+// recordingValidator remembers types of every struct bound by handlers.
+type recordingValidator struct {
+	binding.StructValidator
+	bound map[reflect.Type]bool
+}
+
+func (v *recordingValidator) ValidateStruct(obj interface{}) error {
+	t := reflect.TypeOf(obj)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	v.bound[t] = true
+	return v.StructValidator.ValidateStruct(obj)
+}
+
+func TestOpenApiRoutesBindDeclaredTypes(t *testing.T) {
+	fail := errors.New("unavailable")
+	rep := &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 0, fail
+		},
+		getTransactionsSortedByDateFunc: func(trxData server.TransactionsListData) (pgx.Rows, error) {
+			return nil, fail
+		},
+		getTransactionsSortedBySumFunc: func(trxData server.TransactionsListData) (pgx.Rows, error) {
+			return nil, fail
+		},
+	}
+	r := newTestRouter(testRoutes{Accounts: rep})
+
+	validator := binding.Validator
+	defer func() { binding.Validator = validator }()
+	for _, route := range server.API_ROUTES {
+		rec := &recordingValidator{StructValidator: validator, bound: map[reflect.Type]bool{}}
+		binding.Validator = rec
+		want := map[reflect.Type]bool{}
+		for _, v := range []interface{}{route.Uri, route.Query, route.Request} {
+			if v != nil {
+				want[reflect.TypeOf(v)] = true
+			}
+		}
+		req, _ := http.NewRequest(route.Method, strings.Replace(route.Path, ":id", "1", 1), bytes.NewBufferString("{}"))
+		req.Header.Set("Content-Type", server.MIME_JSON)
+		r.ServeHTTP(httptest.NewRecorder(), authorized(req))
+		assert.Equal(t, want, rec.bound, "Spec types differ from types bound by ", route.Method, " ", route.Path)
+	}
+}
@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"balance-server/server"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeProblemRequest(t *testing.T, r *gin.Engine, m string, path string, body string, accept string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	req, err := http.NewRequest(m, path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set(server.HEADER_REQUEST_ID, "test-request")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, authorized(req))
+	var result map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return rec, result
+}
+
+func TestProblemOperationError(t *testing.T) {
+	rep := &MockAccountRepository{
+		executeTransactionFunc: func(trxData server.TransactionData, oCode int) error {
+			return &server.OperationError{Code: server.ERROR_LOCK_TIMEOUT}
+		},
+	}
+	rec, p := makeProblemRequest(t, newTestRouter(testRoutes{Accounts: rep, Use: []gin.HandlerFunc{server.RequestId()}}), "POST", server.URL_TRANSACTION, `{"id": 1, "sum": -10}`, server.MIME_PROBLEM_JSON)
+	assert.Equal(t, server.MIME_PROBLEM_JSON, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "test-request", rec.Header().Get(server.HEADER_REQUEST_ID))
+	httpCode := server.AccountExpectedResult.GetHttpCode(server.ERROR_LOCK_TIMEOUT)
+	assert.Equal(t, httpCode, rec.Code)
+	assert.Equal(t, "/problems/106", p["type"])
+	assert.Equal(t, server.AccountExpectedResult.GetStatus(server.ERROR_LOCK_TIMEOUT, server.DEFAULT_LOCALE), p["title"])
+	assert.Equal(t, float64(httpCode), p["status"])
+	_, hasDetail := p["detail"]
+	assert.False(t, hasDetail, "Detail should not repeat title")
+	assert.Equal(t, "urn:request:test-request", p["instance"])
+	assert.Equal(t, float64(server.ERROR_LOCK_TIMEOUT), p["code"])
+}
+
+func TestProblemValidationError(t *testing.T) {
+	rec, p := makeProblemRequest(t, newTestRouter(testRoutes{}), "POST", server.URL_TRANSFER, `{"id": 1, "to": 1, "sum": 5}`, server.MIME_PROBLEM_JSON)
+	assert.Equal(t, 400, rec.Code)
+	assert.Equal(t, float64(server.ERROR_WRONG_REQUEST), p["code"])
+	assert.NotEmpty(t, p["detail"], "Detail should describe invalid fields")
+	assert.NotEqual(t, p["title"], p["detail"])
+	errs, ok := p["errors"].([]interface{})
+	assert.True(t, ok, "Expected errors extension member")
+	assert.Equal(t, 1, len(errs))
+}
+
+func TestProblemSuccessKeepsEnvelope(t *testing.T) {
+	rep := &MockAccountRepository{
+		executeTransactionFunc: func(trxData server.TransactionData, oCode int) error {
+			return nil
+		},
+	}
+	rec, res := makeProblemRequest(t, newTestRouter(testRoutes{Accounts: rep}), "POST", server.URL_TRANSACTION, `{"id": 1, "sum": 10}`, server.MIME_PROBLEM_JSON)
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, float64(server.STATUS_CODE_OK), res["status"])
+}
+
+func TestProblemNotRequested(t *testing.T) {
+	rec, res := makeProblemRequest(t, newTestRouter(testRoutes{}), "GET", "/accounts/-1/balance", "", "*/*")
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), server.MIME_JSON)
+	assert.Equal(t, float64(server.ERROR_WRONG_REQUEST), res["status"])
+	assert.NotNil(t, res["data"])
+}
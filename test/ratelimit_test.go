@@ -0,0 +1,190 @@
+package tests
+
+import (
+	"balance-server/pb"
+	"balance-server/server"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// recordTransfers returns repository appending executed transfers to transfers.
+func recordTransfers(transfers *[]server.TransferData) *MockAccountRepository {
+	return &MockAccountRepository{
+		executeTransferFunc: func(tData server.TransferData) error {
+			*transfers = append(*transfers, tData)
+			return nil
+		},
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := server.NewMemoryRateLimitStore()
+	limit := server.RateLimit{Rate: 1, Burst: 2}
+	now := time.Unix(1640000000, 0)
+
+	for i := 0; i < 2; i++ {
+		ok, _, err := store.Take(context.Background(), "k", limit, now)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+	ok, wait, _ := store.Take(context.Background(), "k", limit, now)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	ok, wait, _ = store.Take(context.Background(), "k", limit, now.Add(500*time.Millisecond))
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	ok, _, _ = store.Take(context.Background(), "k", limit, now.Add(time.Second))
+	assert.True(t, ok)
+	ok, _, _ = store.Take(context.Background(), "other", limit, now)
+	assert.True(t, ok)
+}
+
+func TestRateLimitedClient(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	transfers := []server.TransferData{}
+	r := newTestRouter(testRoutes{
+		Auth:     server.NewAuthenticator(keys, nil),
+		Accounts: recordTransfers(&transfers),
+		Group:    []gin.HandlerFunc{server.RateLimited(server.NewRateLimiter(server.NewMemoryRateLimitStore()), server.RateLimitPolicy{Group: "test", Client: server.RateLimit{Rate: 0.001, Burst: 2}})},
+	})
+	first := issueKey(t, keys, []string{server.SCOPE_TRANSFER}, nil)
+	second := issueKey(t, keys, []string{server.SCOPE_TRANSFER}, nil)
+	body := `{"id": 1, "to": 2, "sum": 10}`
+
+	assert.Equal(t, 200, makeAuthRequest(t, r, "POST", "/transfer", body, first))
+	assert.Equal(t, 200, makeAuthRequest(t, r, "POST", "/transfer", body, first))
+
+	req, _ := http.NewRequest("POST", "/transfer", bytes.NewBufferString(body))
+	req.Header.Set(server.HEADER_AUTHORIZATION, first)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, 429, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":118`)
+	retry, err := strconv.Atoi(rec.Header().Get(server.HEADER_RETRY_AFTER))
+	assert.Nil(t, err)
+	assert.Greater(t, retry, 900)
+
+	assert.Equal(t, 200, makeAuthRequest(t, r, "POST", "/transfer", body, second))
+	assert.Len(t, transfers, 3)
+}
+
+func TestRateLimitedAccount(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	transfers := []server.TransferData{}
+	r := newTestRouter(testRoutes{
+		Auth:     server.NewAuthenticator(keys, nil),
+		Accounts: recordTransfers(&transfers),
+		Group:    []gin.HandlerFunc{server.RateLimited(server.NewRateLimiter(server.NewMemoryRateLimitStore()), server.RateLimitPolicy{Group: "test", Account: server.RateLimit{Rate: 0.001, Burst: 1}})},
+	})
+	header := issueKey(t, keys, []string{server.SCOPE_TRANSFER}, nil)
+
+	assert.Equal(t, 200, makeAuthRequest(t, r, "POST", "/transfer", `{"id": 1, "to": 2, "sum": 10}`, header))
+	assert.Equal(t, 429, makeAuthRequest(t, r, "POST", "/transfer", `{"id": 1, "to": 3, "sum": 10}`, header))
+	assert.Equal(t, 200, makeAuthRequest(t, r, "POST", "/transfer", `{"id": 2, "to": 1, "sum": 5}`, header))
+	assert.Equal(t, []server.TransferData{{From: 1, To: 2, Sum: 10, KeyId: 1}, {From: 2, To: 1, Sum: 5, KeyId: 1}}, transfers)
+}
+
+func TestRateLimitedAccountBodyTooLarge(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	transfers := []server.TransferData{}
+	r := newTestRouter(testRoutes{
+		Auth:     server.NewAuthenticator(keys, nil),
+		Accounts: recordTransfers(&transfers),
+		Group:    []gin.HandlerFunc{server.RateLimited(server.NewRateLimiter(server.NewMemoryRateLimitStore()), server.RateLimitPolicy{Group: "test", Account: server.RateLimit{Rate: 1, Burst: 1}})},
+	})
+	header := issueKey(t, keys, []string{server.SCOPE_TRANSFER}, nil)
+
+	body := `{"id": 1, "to": 2, "sum": 10, "comment": "` + strings.Repeat("a", int(server.SIGNATURE_MAX_BODY_SIZE)) + `"}`
+	assert.Equal(t, 400, makeAuthRequest(t, r, "POST", "/transfer", body, header))
+	assert.Empty(t, transfers)
+}
+
+func TestConfigRateLimitPolicies(t *testing.T) {
+	t.Setenv("DATABASE_URL", TEST_CONFIG_DATABASE_URL)
+	t.Setenv("RATE_LIMIT_WRITE_CLIENT", "2.5,5")
+	t.Setenv("RATE_LIMIT_WRITE_ACCOUNT", "0")
+	cfg, err := server.LoadConfig([]string{"-config", writeConfigFile(t, `{"rate_limit": {"admin_client": "1,2"}}`)})
+	if assert.Nil(t, err) {
+		policies := cfg.RateLimit.Policies()
+		assert.Equal(t, server.RateLimit{Rate: 2.5, Burst: 5}, policies[server.RATE_LIMIT_GROUP_WRITE].Client)
+		assert.False(t, policies[server.RATE_LIMIT_GROUP_WRITE].Account.Enabled())
+		assert.Equal(t, server.RateLimit{Rate: 1, Burst: 2}, policies[server.RATE_LIMIT_GROUP_ADMIN].Client)
+		assert.Equal(t, server.RATE_LIMIT_POLICIES[server.RATE_LIMIT_GROUP_READ], policies[server.RATE_LIMIT_GROUP_READ])
+	}
+
+	t.Setenv("RATE_LIMIT_ADMIN_CLIENT", "fast")
+	_, err = server.LoadConfig(nil)
+	assert.NotNil(t, err)
+}
+
+func TestRateLimitJson(t *testing.T) {
+	b, err := json.Marshal(server.RateLimit{Rate: 20, Burst: 40})
+	assert.Nil(t, err)
+	assert.Equal(t, `"20,40"`, string(b))
+	b, _ = json.Marshal(server.RateLimit{})
+	assert.Equal(t, `"0"`, string(b))
+
+	var l server.RateLimit
+	assert.Nil(t, json.Unmarshal([]byte(`"2.5,5"`), &l))
+	assert.Equal(t, server.RateLimit{Rate: 2.5, Burst: 5}, l)
+	assert.NotNil(t, json.Unmarshal([]byte(`"5"`), &l))
+	assert.NotNil(t, json.Unmarshal([]byte(`10`), &l))
+}
+
+func TestGrpcRateLimited(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	rep := &MockAccountRepository{
+		executeTransferFunc: func(tData server.TransferData) error {
+			return nil
+		},
+		executeTransactionFunc: func(trxData server.TransactionData, oCode int) error {
+			return nil
+		},
+	}
+	grpcSrv := server.NewAccountGrpcServer(server.NewAccountService(rep, server.DefaultConfig(), zerolog.Nop()), server.NewAuthenticator(keys, nil), zerolog.Nop())
+	grpcSrv.LimitRates(server.NewRateLimiter(server.NewMemoryRateLimitStore()), map[string]server.RateLimitPolicy{
+		server.RATE_LIMIT_GROUP_WRITE: {
+			Group:   server.RATE_LIMIT_GROUP_WRITE,
+			Client:  server.RateLimit{Rate: 0.001, Burst: 3},
+			Account: server.RateLimit{Rate: 0.001, Burst: 1},
+		},
+	})
+	client := newGrpcServerClient(t, grpcSrv)
+	header := issueKey(t, keys, []string{server.SCOPE_TRANSFER, server.SCOPE_TRANSACTION_CREDIT}, nil)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), strings.ToLower(server.HEADER_AUTHORIZATION), header)
+
+	_, err := client.Transfer(ctx, &pb.TransferRequest{From: 1, To: 2, Sum: 10})
+	assert.Nil(t, err)
+	_, err = client.Transaction(ctx, &pb.TransactionRequest{Id: 1, Sum: 10})
+	grpcTest(t, err, codes.ResourceExhausted, server.ERROR_RATE_LIMITED)
+	st, _ := status.FromError(err)
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok {
+			assert.Greater(t, info.RetryDelay.AsDuration(), 900*time.Second)
+		}
+	}
+
+	_, err = client.Transaction(ctx, &pb.TransactionRequest{Id: 2, Sum: 10})
+	assert.Nil(t, err)
+	_, err = client.Transaction(ctx, &pb.TransactionRequest{Id: 3, Sum: 10})
+	grpcTest(t, err, codes.ResourceExhausted, server.ERROR_RATE_LIMITED)
+	_, err = client.Balance(ctx, &pb.BalanceRequest{Id: 3})
+	grpcTest(t, err, codes.PermissionDenied, server.ERROR_FORBIDDEN)
+}
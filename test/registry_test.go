@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"balance-server/server"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func TestErrorRegistryValid(t *testing.T) {
+	assert.Nil(t, server.ERROR_REGISTRY.Validate(server.Messages))
+	for _, code := range server.ERROR_REGISTRY.Codes() {
+		httpCode := server.AccountExpectedResult.GetHttpCode(code)
+		assert.True(t, httpCode >= 400 && httpCode < 600, "Code ", code, " has HTTP status ", httpCode)
+	}
+}
+
+func TestErrorRegistryUnknownCode(t *testing.T) {
+	assert.Equal(t, http.StatusInternalServerError, server.AccountExpectedResult.GetHttpCode(999))
+	assert.Equal(t, codes.Internal, server.AccountExpectedResult.GetError(999).GrpcCode)
+}
+
+func TestErrorRegistryUnexpectedError(t *testing.T) {
+	rep := &MockAccountRepository{
+		executeTransactionFunc: func(trxData server.TransactionData, oCode int) error {
+			return errors.New("connection reset")
+		},
+	}
+	rec, res := makeProblemRequest(t, newTestRouter(testRoutes{Accounts: rep}), "POST", server.URL_TRANSACTION, `{"id": 1, "sum": -10}`, server.MIME_JSON)
+	assert.Equal(t, server.ERROR_REGISTRY.Get(server.ERROR_INTERNAL).HttpCode, rec.Code, "Unexpected errors are reported as declared ERROR_INTERNAL")
+	assert.Equal(t, float64(server.ERROR_INTERNAL), res["status"])
+}
+
+func TestErrorRegistryValidateFails(t *testing.T) {
+	internal := server.ErrorCode{Code: server.ERROR_INTERNAL, HttpCode: 500, GrpcCode: codes.Internal, Retryable: false, LogLevel: server.LOG_LEVEL_ERROR}
+	cases := map[string]*server.ErrorRegistry{
+		"no internal":   server.NewErrorRegistry(),
+		"success http":  server.NewErrorRegistry(internal, server.ErrorCode{Code: server.ERROR_NO_BALANCE, HttpCode: 200, GrpcCode: codes.NotFound, Retryable: false, LogLevel: server.LOG_LEVEL_INFO}),
+		"ok grpc":       server.NewErrorRegistry(internal, server.ErrorCode{Code: server.ERROR_NO_BALANCE, HttpCode: 404, GrpcCode: codes.OK, Retryable: false, LogLevel: server.LOG_LEVEL_INFO}),
+		"log level":     server.NewErrorRegistry(internal, server.ErrorCode{Code: server.ERROR_NO_BALANCE, HttpCode: 404, GrpcCode: codes.NotFound, Retryable: false, LogLevel: "fatal"}),
+		"no message":    server.NewErrorRegistry(internal, server.ErrorCode{Code: 555, HttpCode: 400, GrpcCode: codes.InvalidArgument, Retryable: false, LogLevel: server.LOG_LEVEL_INFO}),
+		"duplicate":     server.NewErrorRegistry(internal, internal),
+		"missing codes": server.NewErrorRegistry(internal),
+	}
+	for name, r := range cases {
+		assert.NotNil(t, r.Validate(server.Messages), "Registry should be invalid: ", name)
+	}
+}
+
+func TestRetryAfterOnRetryableError(t *testing.T) {
+	rep := &MockAccountRepository{
+		executeTransactionFunc: func(trxData server.TransactionData, oCode int) error {
+			return &server.OperationError{Code: server.ERROR_LOCK_TIMEOUT}
+		},
+	}
+	rec, res := makeProblemRequest(t, newTestRouter(testRoutes{Accounts: rep}), "POST", server.URL_TRANSACTION, `{"id": 1, "sum": -10}`, server.MIME_JSON)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, float64(server.ERROR_LOCK_TIMEOUT), res["status"])
+	assert.Equal(t, strconv.Itoa(server.RETRY_AFTER_SECONDS), rec.Header().Get(server.HEADER_RETRY_AFTER))
+
+	rep.executeTransactionFunc = func(trxData server.TransactionData, oCode int) error {
+		return &server.OperationError{Code: server.ERROR_NOT_ENOUGH_MONEY}
+	}
+	rec, _ = makeProblemRequest(t, newTestRouter(testRoutes{Accounts: rep}), "POST", server.URL_TRANSACTION, `{"id": 1, "sum": -10}`, server.MIME_JSON)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Empty(t, rec.Header().Get(server.HEADER_RETRY_AFTER))
+}
@@ -3,17 +3,22 @@ package tests
 import (
 	"balance-server/server"
 	"context"
+	"errors"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
 )
 
 var (
 	testDb  = NewTestDatabase()
-	testRep = server.NewAccountRepository(testDb)
+	testRep = server.NewAccountRepository(testDb, server.DefaultConfig().Ledger, zerolog.Nop())
 )
 
 func TestConnection(t *testing.T) {
@@ -22,28 +27,80 @@ func TestConnection(t *testing.T) {
 }
 
 func TestTransactionWrongRequest(t *testing.T) {
-	_, err := testDb.ExecuteInTransaction(func(tx *pgx.Tx) (interface{}, error) {
-		return (*tx).Exec(testDb.Ctx, "SELECT FROM transaction;")
+	_, err := testDb.ExecuteInTransaction(context.Background(), func(tx *pgx.Tx) (interface{}, error) {
+		return (*tx).Exec(context.Background(), "SELECT FROM transaction;")
 	})
 	assert.NotNil(t, err, "Error expected, but hasn't been thrown")
 }
 
 func TestTransactionBalanceNotExistingUser(t *testing.T) {
-	_, err := testDb.ExecuteInTransaction(func(tx *pgx.Tx) (interface{}, error) {
+	_, err := testDb.ExecuteInTransaction(context.Background(), func(tx *pgx.Tx) (interface{}, error) {
 		var curBal *float64
-		err := (*tx).QueryRow(testDb.Ctx, server.SELECT_CURRENT_BALANCE, 123125).Scan(&curBal)
+		err := (*tx).QueryRow(context.Background(), server.SELECT_CURRENT_BALANCE, 123125).Scan(&curBal)
 		return curBal, err
 	})
 	assert.Nil(t, err)
 }
 
+func TestTransactionCanceledWaitingForLock(t *testing.T) {
+	const account = 123126
+	assert.Nil(t, testRep.ExecuteTransaction(context.Background(), server.TransactionData{Id: account, Sum: 10}, server.OPERATION_INCOME_CODE))
+	holder, err := testDb.Conn.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Rollback(context.Background())
+	_, err = holder.Exec(context.Background(), server.SELECT_ADVISORY_LOCK, account, server.OPERATION_OUTCOME_CODE)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = testRep.ExecuteTransaction(ctx, server.TransactionData{Id: account, Sum: -5}, server.OPERATION_OUTCOME_CODE)
+	assert.Equal(t, server.ERROR_REQUEST_TIMEOUT, server.ConvertError(err).Code)
+
+	bal, err := testRep.GetBalance(context.Background(), server.BalanceData{Id: account})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(10), bal)
+}
+
+func TestTransactionConstraintViolation(t *testing.T) {
+	err := testRep.ExecuteTransaction(context.Background(), server.TransactionData{Id: -1, Sum: 10}, server.OPERATION_INCOME_CODE)
+	assert.True(t, errors.Is(err, &server.OperationError{Code: server.ERROR_CONSTRAINT_VIOLATION}), err)
+	var pgErr *pgconn.PgError
+	if assert.True(t, errors.As(err, &pgErr)) {
+		assert.Equal(t, server.PG_CHECK_VIOLATION, pgErr.Code)
+	}
+}
+
+func TestReadinessDatabaseChecks(t *testing.T) {
+	report := server.NewReadiness(server.DatabaseCheck(testDb), server.SchemaCheck(testDb, server.SchemaVersion())).Report(context.Background())
+	assert.True(t, report.Ready, report)
+	report = server.NewReadiness(server.SchemaCheck(testDb, server.SchemaVersion()+1)).Report(context.Background())
+	assert.False(t, report.Ready)
+}
+
+func TestRepositorySqlSpans(t *testing.T) {
+	sr := newSpanRecorder(t)
+	testRep.GetBalance(context.Background(), server.BalanceData{Id: 123125})
+
+	spans := endedSpans(sr)
+	rep, ok := spans["AccountRepository.GetBalance"]
+	assert.True(t, ok, "Expected repository span, got: ", spans)
+	sql, ok := spans["SELECT"]
+	assert.True(t, ok, "Expected SQL span, got: ", spans)
+	if rep == nil || sql == nil {
+		t.FailNow()
+	}
+	assert.Equal(t, rep.SpanContext().SpanID(), sql.Parent().SpanID())
+	assert.Contains(t, sql.Attributes(), semconv.DBStatementKey.String(server.SELECT_CURRENT_BALANCE))
+}
+
 func NewTestDatabase() *server.Database {
 	testDb := server.Database{}
 	conn, err := pgxpool.Connect(context.Background(), os.Getenv("PGX_TEST_DATABASE"))
 	if err != nil {
 		panic(err)
 	}
-	testDb.Ctx = context.Background()
 	testDb.Conn = conn
 	return &testDb
 }
@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"balance-server/server"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+// testRoutes configures newTestRouter, zero fields get test defaults: testAuth, mock
+// repositories, default config and silent logger.
+type testRoutes struct {
+	Auth     *server.Authenticator
+	Accounts server.AccountRepositoryI
+	Admin    server.AdminRepositoryI
+	Ledger   server.LedgerRepositoryI
+	Config   *server.Config
+	Log      *zerolog.Logger
+	// Signatures are verified on write routes when set.
+	Signatures *server.SignatureVerifier
+	// Use runs before authentication, Group runs after it on every API route.
+	Use   []gin.HandlerFunc
+	Group []gin.HandlerFunc
+}
+
+// newTestRouter mounts routes of main.go, so tests go through the same paths and handlers.
+func newTestRouter(o testRoutes) *gin.Engine {
+	if o.Auth == nil {
+		o.Auth = testAuth
+	}
+	if o.Accounts == nil {
+		o.Accounts = NewMockRepository()
+	}
+	if o.Admin == nil {
+		o.Admin = NewMockAdminRepository()
+	}
+	if o.Ledger == nil {
+		o.Ledger = &MockLedgerRepository{}
+	}
+	if o.Config == nil {
+		o.Config = server.DefaultConfig()
+	}
+	log := zerolog.Nop()
+	if o.Log != nil {
+		log = *o.Log
+	}
+	acc := server.NewAccountControllerFromService(server.NewAccountService(o.Accounts, o.Config, log), log)
+	adm := server.NewAdminController(o.Admin, log)
+	ledger := server.NewLedgerController(o.Ledger, o.Config.Ledger, log)
+	write := func(h gin.HandlerFunc) []gin.HandlerFunc {
+		if o.Signatures == nil {
+			return []gin.HandlerFunc{h}
+		}
+		return []gin.HandlerFunc{server.VerifySignature(o.Signatures), h}
+	}
+
+	r := gin.New()
+	r.Use(o.Use...)
+	r.NoRoute(server.NoRoute)
+	api := r.Group("/", append([]gin.HandlerFunc{server.Authenticate(o.Auth)}, o.Group...)...)
+	api.POST(server.URL_TRANSACTION, write(acc.Transaction)...)
+	api.POST(server.URL_TRANSFER, write(acc.Transfer)...)
+	api.GET(server.URL_BALANCE, server.Deprecated(server.URL_ACCOUNT_BALANCE), acc.Balance)
+	api.GET(server.URL_TRANSACTIONS, server.Deprecated(server.URL_ACCOUNT_TRANSACTIONS), acc.Transactions)
+	api.GET(server.URL_ACCOUNT_BALANCE, acc.AccountBalance)
+	api.GET(server.URL_ACCOUNT_TRANSACTIONS, acc.AccountTransactions)
+	api.GET(server.URL_ADMIN_TRANSACTIONS, adm.SearchTransactions)
+	api.POST(server.URL_ADMIN_ADJUSTMENTS, adm.Adjust)
+	api.POST(server.URL_ADMIN_FREEZE, adm.Freeze)
+	api.POST(server.URL_ADMIN_UNFREEZE, adm.Unfreeze)
+	api.GET(server.URL_ADMIN_AUDIT, adm.AuditLog)
+	api.GET(server.URL_ADMIN_LEDGER_VERIFY, ledger.Verify)
+	api.GET(server.URL_ADMIN_CONFIG, server.ConfigHandler(o.Config))
+	r.GET(server.URL_OPENAPI, server.OpenApi)
+	r.GET(server.URL_METRICS, server.Metrics())
+	return r
+}
@@ -2,9 +2,11 @@ package tests
 
 import (
 	"balance-server/server"
+	"context"
 	"testing"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -12,6 +14,7 @@ type MockAccountRepository struct {
 	executeTransactionFunc          func(trxData server.TransactionData, oCode int) error
 	executeOperationFunc            func(trxData server.TransactionData) error
 	getBalanceFunc                  func(dt server.BalanceData) (float64, error)
+	getLastTransactionIdFunc        func(id int) (int, error)
 	executeTransferFunc             func(tData server.TransferData) error
 	getTransactionsSortedByDateFunc func(trxData server.TransactionsListData) (pgx.Rows, error)
 	getTransactionsSortedBySumFunc  func(trxData server.TransactionsListData) (pgx.Rows, error)
@@ -21,11 +24,11 @@ func NewMockRepository() *MockAccountRepository {
 	return &MockAccountRepository{}
 }
 
-func (rep *MockAccountRepository) ExecuteTransaction(trxData server.TransactionData, oCode int) error {
+func (rep *MockAccountRepository) ExecuteTransaction(ctx context.Context, trxData server.TransactionData, oCode int) error {
 	return rep.executeTransactionFunc(trxData, oCode)
 }
 
-func (rep *MockAccountRepository) ExecuteOperation(trxData server.TransactionData) error {
+func (rep *MockAccountRepository) ExecuteOperation(ctx context.Context, trxData server.TransactionData) error {
 	if trxData.Sum > 0 {
 		return rep.executeTransactionFunc(trxData, server.OPERATION_INCOME_CODE)
 	} else {
@@ -33,19 +36,27 @@ func (rep *MockAccountRepository) ExecuteOperation(trxData server.TransactionDat
 	}
 }
 
-func (rep *MockAccountRepository) GetBalance(dt server.BalanceData) (float64, error) {
+func (rep *MockAccountRepository) GetBalance(ctx context.Context, dt server.BalanceData) (float64, error) {
 	return rep.getBalanceFunc(dt)
 }
 
-func (rep *MockAccountRepository) ExecuteTransfer(tData server.TransferData) error {
+// GetLastTransactionId reports unknown ledger state unless the test sets it, so balance is always read.
+func (rep *MockAccountRepository) GetLastTransactionId(ctx context.Context, id int) (int, error) {
+	if rep.getLastTransactionIdFunc == nil {
+		return 0, nil
+	}
+	return rep.getLastTransactionIdFunc(id)
+}
+
+func (rep *MockAccountRepository) ExecuteTransfer(ctx context.Context, tData server.TransferData) error {
 	return rep.executeTransferFunc(tData)
 }
 
-func (rep *MockAccountRepository) GetTransactionsSortedByDate(trxData server.TransactionsListData) (pgx.Rows, error) {
+func (rep *MockAccountRepository) GetTransactionsSortedByDate(ctx context.Context, trxData server.TransactionsListData) (pgx.Rows, error) {
 	return rep.getTransactionsSortedByDateFunc(trxData)
 }
 
-func (rep *MockAccountRepository) GetTransactionsSortedBySum(trxData server.TransactionsListData) (pgx.Rows, error) {
+func (rep *MockAccountRepository) GetTransactionsSortedBySum(ctx context.Context, trxData server.TransactionsListData) (pgx.Rows, error) {
 	return rep.getTransactionsSortedBySumFunc(trxData)
 }
 
@@ -55,12 +66,12 @@ func TestGetBalanceWrongCurrencyCode(t *testing.T) {
 			return 0, nil
 		},
 	}
-	srv := server.NewAccountService(rep)
-	_, err := srv.GetUserBalance(&server.BalanceData{1, "WRONG"})
+	srv := server.NewAccountService(rep, server.DefaultConfig(), zerolog.Nop())
+	_, err := srv.GetUserBalance(context.Background(), &server.BalanceData{Id: 1, Cur: "WRONG"})
 	assert.NotNil(t, err, "Expected error, but hasn't been thrown")
 	switch e := (err).(type) {
 	case *server.OperationError:
-		assert.Equal(t, server.ERROR_BALANCE_WRONG_CURRENCY_CODE, e.Code, "Expected code: ", server.ACCOUNT_OPERATION_STATUS[server.ERROR_BALANCE_WRONG_CURRENCY_CODE], ", but got: ", e.Code)
+		assert.Equal(t, server.ERROR_BALANCE_WRONG_CURRENCY_CODE, e.Code, "Expected code: ", server.ERROR_BALANCE_WRONG_CURRENCY_CODE, ", but got: ", e.Code)
 	default:
 		t.Error("Expected OperationError, but got: ", e)
 	}
@@ -68,9 +79,9 @@ func TestGetBalanceWrongCurrencyCode(t *testing.T) {
 
 func TestGetUserTransactionsWrongSort(t *testing.T) {
 	rep := &MockAccountRepository{}
-	srv := server.NewAccountService(rep)
+	srv := server.NewAccountService(rep, server.DefaultConfig(), zerolog.Nop())
 	data := &server.TransactionsListData{Sort: "wrong"}
-	_, err := srv.GetUserTransactions(data)
+	_, err := srv.GetUserTransactions(context.Background(), data)
 	assert.NotNil(t, err, "Expected error, but hasn't been thrown")
 	switch e := (err).(type) {
 	case *server.OperationError:
@@ -83,12 +94,12 @@ func TestGetUserTransactionsWrongSort(t *testing.T) {
 func TestGetUserTransactionsWrongPage(t *testing.T) {
 	rep := &MockAccountRepository{
 		getTransactionsSortedByDateFunc: func(trxData server.TransactionsListData) (pgx.Rows, error) {
-			return testDb.Conn.Query(testDb.GetCtx(), "SELECT * FROM transactions WHERE account = 9999")
+			return testDb.Conn.Query(context.Background(), "SELECT * FROM transactions WHERE account = 9999")
 		},
 	}
-	srv := server.NewAccountService(rep)
+	srv := server.NewAccountService(rep, server.DefaultConfig(), zerolog.Nop())
 	data := &server.TransactionsListData{Page: 100}
-	_, err := srv.GetUserTransactions(data)
+	_, err := srv.GetUserTransactions(context.Background(), data)
 	assert.NotNil(t, err, "Expected error, but hasn't been thrown")
 	switch e := (err).(type) {
 	case *server.OperationError:
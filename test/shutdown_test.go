@@ -0,0 +1,287 @@
+package tests
+
+import (
+	"balance-server/pb"
+	"balance-server/server"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type jobFunc func(ctx context.Context)
+
+func (f jobFunc) Run(ctx context.Context) {
+	f(ctx)
+}
+
+// startHttpServer serves handler on random port, returns server and its base url.
+func startHttpServer(t *testing.T, handler http.Handler) (*server.HttpServer, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.NewHttpServer(lis.Addr().String(), handler)
+	go srv.Serve(lis)
+	return srv, "http://" + lis.Addr().String()
+}
+
+func TestHttpServerDrainsInFlightRequest(t *testing.T) {
+	started := make(chan struct{})
+	srv, url := startHttpServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(200)
+	}))
+	codes := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			codes <- 0
+			return
+		}
+		resp.Body.Close()
+		codes <- resp.StatusCode
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, srv.Shutdown(ctx))
+	assert.Equal(t, 200, <-codes)
+	_, err := http.Get(url)
+	assert.NotNil(t, err, "Server should not accept requests after shutdown")
+}
+
+func TestHttpServerCancelsRequestAfterDrainTimeout(t *testing.T) {
+	started := make(chan struct{})
+	var canceled int32
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) {
+		close(started)
+		<-c.Request.Context().Done()
+		atomic.StoreInt32(&canceled, 1)
+		err := c.Request.Context().Err()
+		server.NewResult(c).Err(&err, &server.AccountExpectedResult)
+	})
+	srv, url := startHttpServer(t, r)
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			responses <- nil
+			return
+		}
+		resp.Body.Close()
+		responses <- resp
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, srv.Shutdown(ctx))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&canceled), "Shutdown should return after canceled request finished")
+	if resp := <-responses; assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "Request canceled by shutdown should be retried, not reported as closed by client")
+		assert.NotEmpty(t, resp.Header.Get(server.HEADER_RETRY_AFTER))
+	}
+}
+
+// blockingBalanceRepository answers balance requests when their context is done.
+type blockingBalanceRepository struct {
+	MockAccountRepository
+	started chan struct{}
+}
+
+func (rep *blockingBalanceRepository) GetBalance(ctx context.Context, dt server.BalanceData) (float64, error) {
+	close(rep.started)
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestGrpcServerCancelsCallAfterDrainTimeout(t *testing.T) {
+	rep := &blockingBalanceRepository{started: make(chan struct{})}
+	grpcSrv := server.NewAccountGrpcServer(server.NewAccountService(rep, server.DefaultConfig(), zerolog.Nop()), testAuth, zerolog.Nop())
+	lis := bufconn.Listen(GRPC_BUFFER_SIZE)
+	go grpcSrv.ServeListener(lis)
+	dialer := func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.DialContext(context.Background(), "bufnet", append([]grpc.DialOption{grpc.WithContextDialer(dialer), grpc.WithInsecure()}, grpcAuthorized()...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	calls := make(chan error, 1)
+	go func() {
+		_, err := pb.NewBalanceServiceClient(conn).Balance(context.Background(), &pb.BalanceRequest{Id: 1})
+		calls <- err
+	}()
+	<-rep.started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, grpcSrv.Shutdown(ctx))
+	err = <-calls
+	grpcTest(t, err, codes.Unavailable, server.ERROR_NOT_READY)
+	st, _ := status.FromError(err)
+	var retry *errdetails.RetryInfo
+	for _, d := range st.Details() {
+		if r, ok := d.(*errdetails.RetryInfo); ok {
+			retry = r
+		}
+	}
+	assert.NotNil(t, retry, "Call canceled by shutdown should be retryable")
+}
+
+func TestSchedulerStopWaitsForRunningJob(t *testing.T) {
+	s := server.NewScheduler()
+	started := make(chan struct{})
+	var runs, finished int32
+	s.Every(time.Millisecond, jobFunc(func(ctx context.Context) {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			close(started)
+		}
+		time.Sleep(100 * time.Millisecond)
+		atomic.AddInt32(&finished, 1)
+	}))
+	s.Start()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, s.Stop(ctx))
+	assert.Equal(t, atomic.LoadInt32(&runs), atomic.LoadInt32(&finished))
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, atomic.LoadInt32(&finished), atomic.LoadInt32(&runs), "No runs expected after Stop")
+}
+
+func TestSchedulerStopCancelsJobAfterTimeout(t *testing.T) {
+	s := server.NewScheduler()
+	started := make(chan struct{})
+	var canceled int32
+	var once int32
+	s.Every(time.Millisecond, jobFunc(func(ctx context.Context) {
+		if !atomic.CompareAndSwapInt32(&once, 0, 1) {
+			return
+		}
+		close(started)
+		<-ctx.Done()
+		atomic.StoreInt32(&canceled, 1)
+	}))
+	s.Start()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Stop(ctx))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&canceled))
+}
+
+// lockHookDatabase closes locking when a transfer starts waiting for account locks.
+type lockHookDatabase struct {
+	*server.Database
+	locking chan struct{}
+}
+
+func (db *lockHookDatabase) Concurrency() server.ConcurrencyStrategy {
+	return lockHookStrategy{db.Database.Concurrency(), db.locking}
+}
+
+type lockHookStrategy struct {
+	server.ConcurrencyStrategy
+	locking chan struct{}
+}
+
+func (s lockHookStrategy) LockTransfer(ctx context.Context, tx *pgx.Tx, from int, to int) error {
+	close(s.locking)
+	return s.ConcurrencyStrategy.LockTransfer(ctx, tx, from, to)
+}
+
+// transferDuringShutdown starts transfer blocked on chain lock of receiver held by other
+// transaction and shuts the server down once the transfer waits for the lock. The lock is
+// released after release delay, zero keeps it.
+func transferDuringShutdown(t *testing.T, from int, to int, drain time.Duration, release time.Duration) (*http.Response, error) {
+	assert.Nil(t, testRep.ExecuteTransaction(context.Background(), server.TransactionData{Id: from, Sum: 100}, server.OPERATION_INCOME_CODE))
+	holder, err := testDb.Conn.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Rollback(context.Background())
+	_, err = holder.Exec(context.Background(), server.SELECT_ADVISORY_LOCK, to, server.LEDGER_CHAIN_LOCK)
+	assert.Nil(t, err)
+
+	db := &lockHookDatabase{testDb, make(chan struct{})}
+	rep := server.NewAccountRepository(db, server.DefaultConfig().Ledger, zerolog.Nop())
+	r := newTestRouter(testRoutes{Accounts: rep})
+	srv, url := startHttpServer(t, r)
+	body, _ := json.Marshal(server.SendRequest{From: from, Sum: 30, To: to})
+	type response struct {
+		resp *http.Response
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		req, _ := http.NewRequest("POST", url+server.URL_TRANSFER, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(authorized(req))
+		if err != nil {
+			responses <- response{nil, err}
+			return
+		}
+		resp.Body.Close()
+		responses <- response{resp, nil}
+	}()
+	<-db.locking
+
+	if release > 0 {
+		time.AfterFunc(release, func() {
+			holder.Rollback(context.Background())
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	srv.Shutdown(ctx)
+	res := <-responses
+	return res.resp, res.err
+}
+
+func TestTransferInterruptedByShutdownLeavesNoPartialState(t *testing.T) {
+	const from, to = 123140, 123141
+	resp, err := transferDuringShutdown(t, from, to, 200*time.Millisecond, 0)
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get(server.HEADER_RETRY_AFTER))
+	}
+
+	bal, err := testRep.GetBalance(context.Background(), server.BalanceData{Id: from})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(100), bal)
+	_, err = testRep.GetBalance(context.Background(), server.BalanceData{Id: to})
+	assert.Equal(t, server.ERROR_NO_BALANCE, server.ConvertError(err).Code, fmt.Sprint(err))
+}
+
+func TestTransferDrainedOnShutdownIsApplied(t *testing.T) {
+	const from, to = 123142, 123143
+	resp, err := transferDuringShutdown(t, from, to, 5*time.Second, 100*time.Millisecond)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+
+	bal, err := testRep.GetBalance(context.Background(), server.BalanceData{Id: from})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(70), bal)
+	bal, err = testRep.GetBalance(context.Background(), server.BalanceData{Id: to})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(30), bal)
+}
@@ -0,0 +1,177 @@
+package tests
+
+import (
+	"balance-server/pb"
+	"balance-server/server"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	SIGNATURE_TEST_SECRET string = "partner-secret"
+	SIGNATURE_TEST_BODY   string = `{"id": 1, "sum": 10}`
+)
+
+type SignedRequest struct {
+	Method    string
+	Path      string
+	Body      string
+	Timestamp string
+	Nonce     string
+	Signature string
+}
+
+func newSignedRequest(path string, body string, nonce string) SignedRequest {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	return SignedRequest{"POST", path, body, ts, nonce, server.SignRequest([]byte(SIGNATURE_TEST_SECRET), "POST", path, ts, nonce, []byte(body))}
+}
+
+func newSignatureRouter(t *testing.T) (*gin.Engine, string, string) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	partner := issueKey(t, keys, []string{server.SCOPE_TRANSACTION_CREDIT}, nil)
+	client := issueKey(t, keys, []string{server.SCOPE_TRANSACTION_CREDIT}, nil)
+	verifier := server.NewSignatureVerifier(server.PartnerSecrets{1: []byte(SIGNATURE_TEST_SECRET)}, server.NewMemoryNonceStore(server.SIGNATURE_WINDOW), server.SIGNATURE_WINDOW)
+	rep := &MockAccountRepository{
+		executeTransactionFunc: func(trxData server.TransactionData, oCode int) error {
+			return nil
+		},
+	}
+	r := newTestRouter(testRoutes{Auth: server.NewAuthenticator(keys, nil), Accounts: rep, Signatures: verifier})
+	return r, partner, client
+}
+
+func makeSignedRequest(t *testing.T, r *gin.Engine, authorization string, sr SignedRequest) (int, int) {
+	req, err := http.NewRequest(sr.Method, sr.Path, bytes.NewBufferString(sr.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(server.HEADER_AUTHORIZATION, authorization)
+	for h, v := range map[string]string{server.HEADER_SIGNATURE: sr.Signature, server.HEADER_SIGNATURE_TIMESTAMP: sr.Timestamp, server.HEADER_SIGNATURE_NONCE: sr.Nonce} {
+		if v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	var result map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, int(result["status"].(float64))
+}
+
+func TestSignatureValid(t *testing.T) {
+	r, partner, _ := newSignatureRouter(t)
+	code, status := makeSignedRequest(t, r, partner, newSignedRequest(server.URL_TRANSACTION, SIGNATURE_TEST_BODY, "n1"))
+	assert.Equal(t, 200, code)
+	assert.Equal(t, server.STATUS_CODE_OK, status)
+}
+
+func TestSignatureErrors(t *testing.T) {
+	r, partner, client := newSignatureRouter(t)
+
+	unsigned := SignedRequest{Method: "POST", Path: server.URL_TRANSACTION, Body: SIGNATURE_TEST_BODY}
+	_, status := makeSignedRequest(t, r, partner, unsigned)
+	assert.Equal(t, server.ERROR_SIGNATURE_MISSING, status)
+
+	_, status = makeSignedRequest(t, r, client, newSignedRequest(server.URL_TRANSACTION, SIGNATURE_TEST_BODY, "n2"))
+	assert.Equal(t, server.ERROR_SIGNATURE_UNKNOWN_PARTNER, status)
+
+	stale := newSignedRequest(server.URL_TRANSACTION, SIGNATURE_TEST_BODY, "n3")
+	stale.Timestamp = strconv.FormatInt(time.Now().Add(-2*server.SIGNATURE_WINDOW).Unix(), 10)
+	stale.Signature = server.SignRequest([]byte(SIGNATURE_TEST_SECRET), stale.Method, stale.Path, stale.Timestamp, stale.Nonce, []byte(stale.Body))
+	_, status = makeSignedRequest(t, r, partner, stale)
+	assert.Equal(t, server.ERROR_SIGNATURE_STALE, status)
+
+	tampered := newSignedRequest(server.URL_TRANSACTION, SIGNATURE_TEST_BODY, "n4")
+	tampered.Body = `{"id": 1, "sum": 10000}`
+	_, status = makeSignedRequest(t, r, partner, tampered)
+	assert.Equal(t, server.ERROR_SIGNATURE_INVALID, status)
+
+	replay := newSignedRequest(server.URL_TRANSACTION, SIGNATURE_TEST_BODY, "n5")
+	code, _ := makeSignedRequest(t, r, partner, replay)
+	assert.Equal(t, 200, code)
+	code, status = makeSignedRequest(t, r, partner, replay)
+	assert.Equal(t, 401, code)
+	assert.Equal(t, server.ERROR_SIGNATURE_NONCE_REUSED, status)
+}
+
+func TestSignatureNotRequired(t *testing.T) {
+	r, _, client := newSignatureRouter(t)
+	code, _ := makeSignedRequest(t, r, client, SignedRequest{Method: "POST", Path: server.URL_TRANSACTION, Body: SIGNATURE_TEST_BODY})
+	assert.Equal(t, 200, code)
+}
+
+func TestSignatureBodyTooLarge(t *testing.T) {
+	r, partner, _ := newSignatureRouter(t)
+	body := `{"id": 1, "sum": 10, "desc": "` + strings.Repeat("a", int(server.SIGNATURE_MAX_BODY_SIZE)) + `"}`
+	code, status := makeSignedRequest(t, r, partner, newSignedRequest(server.URL_TRANSACTION, body, "large"))
+	assert.Equal(t, 400, code)
+	assert.Equal(t, server.ERROR_WRONG_REQUEST, status)
+}
+
+func TestMemoryNonceStoreExpiry(t *testing.T) {
+	s := server.NewMemoryNonceStore(server.SIGNATURE_WINDOW)
+	exp := time.Now().Add(time.Minute)
+	assert.True(t, s.Use(1, "a", exp))
+	assert.False(t, s.Use(1, "a", exp))
+	assert.True(t, s.Use(2, "a", exp))
+	assert.True(t, s.Use(1, "b", time.Now().Add(-time.Second)))
+	assert.True(t, s.Use(1, "b", exp))
+}
+
+func TestLoadPartnerSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"3": "s3"}`), 0644))
+	secrets, err := server.LoadPartnerSecrets(path)
+	assert.Nil(t, err)
+	secret, ok := secrets.GetSecret(3)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("s3"), secret)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"partner": "s3"}`), 0644))
+	_, err = server.LoadPartnerSecrets(path)
+	assert.NotNil(t, err)
+}
+
+func TestGrpcSignaturePartnerRejected(t *testing.T) {
+	keys := server.NewApiKeyService(NewMockApiKeyRepository())
+	partner := issueKey(t, keys, []string{server.SCOPE_TRANSACTION_CREDIT, server.SCOPE_BALANCE_READ}, nil)
+	client := issueKey(t, keys, []string{server.SCOPE_TRANSACTION_CREDIT}, nil)
+	rep := &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 10, nil
+		},
+		executeTransactionFunc: func(trxData server.TransactionData, oCode int) error {
+			return nil
+		},
+	}
+	grpcSrv := server.NewAccountGrpcServer(server.NewAccountService(rep, server.DefaultConfig(), zerolog.Nop()), server.NewAuthenticator(keys, nil), zerolog.Nop())
+	grpcSrv.RejectPartners(server.PartnerSecrets{1: []byte(SIGNATURE_TEST_SECRET)})
+	grpcClient := newGrpcServerClient(t, grpcSrv)
+	authCtx := func(header string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), strings.ToLower(server.HEADER_AUTHORIZATION), header)
+	}
+
+	_, err := grpcClient.Transaction(authCtx(partner), &pb.TransactionRequest{Id: 1, Sum: 10})
+	grpcTest(t, err, codes.Unauthenticated, server.ERROR_SIGNATURE_MISSING)
+	_, err = grpcClient.Balance(authCtx(partner), &pb.BalanceRequest{Id: 1})
+	assert.Nil(t, err, "Partners sign write requests only")
+	_, err = grpcClient.Transaction(authCtx(client), &pb.TransactionRequest{Id: 1, Sum: 10})
+	assert.Nil(t, err)
+}
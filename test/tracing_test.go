@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"balance-server/pb"
+	"balance-server/server"
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	TEST_TRACEPARENT string = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	TEST_TRACE_ID    string = "4bf92f3577b34da6a3ce929d0e0e4736"
+	TEST_PARENT_SPAN string = "00f067aa0ba902b7"
+)
+
+// newSpanRecorder installs tracer provider recording spans in memory for the test.
+func newSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	sr := tracetest.NewSpanRecorder()
+	server.InitTracing(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	t.Cleanup(func() {
+		server.InitTracing(trace.NewNoopTracerProvider())
+	})
+	return sr
+}
+
+func endedSpans(sr *tracetest.SpanRecorder) map[string]sdktrace.ReadOnlySpan {
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range sr.Ended() {
+		spans[s.Name()] = s
+	}
+	return spans
+}
+
+func TestTracingHttpSpans(t *testing.T) {
+	sr := newSpanRecorder(t)
+	r := newTestRouter(testRoutes{Use: []gin.HandlerFunc{server.Tracing()}, Accounts: &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 10, nil
+		},
+	}})
+	req := authorized(httptest.NewRequest("GET", "/accounts/1/balance", nil))
+	req.Header.Set("traceparent", TEST_TRACEPARENT)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := endedSpans(sr)
+	root, ok := spans["GET /accounts/:id/balance"]
+	assert.True(t, ok, "Expected server span, got: ", spans)
+	ctrl := spans["AccountController.Balance"]
+	srv := spans["AccountService.GetUserBalance"]
+	if root == nil || ctrl == nil || srv == nil {
+		t.FailNow()
+	}
+	assert.Equal(t, trace.SpanKindServer, root.SpanKind())
+	assert.Equal(t, TEST_TRACE_ID, root.SpanContext().TraceID().String())
+	assert.Equal(t, TEST_PARENT_SPAN, root.Parent().SpanID().String())
+	assert.True(t, root.Parent().IsRemote())
+	assert.Equal(t, root.SpanContext().SpanID(), ctrl.Parent().SpanID())
+	assert.Equal(t, ctrl.SpanContext().SpanID(), srv.Parent().SpanID())
+	assert.Equal(t, TEST_TRACE_ID, srv.SpanContext().TraceID().String())
+}
+
+func TestTracingServiceError(t *testing.T) {
+	sr := newSpanRecorder(t)
+	r := newTestRouter(testRoutes{Use: []gin.HandlerFunc{server.Tracing()}, Accounts: &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 0, &server.OperationError{Code: server.ERROR_NO_BALANCE}
+		},
+	}})
+	r.ServeHTTP(httptest.NewRecorder(), authorized(httptest.NewRequest("GET", "/accounts/1/balance", nil)))
+
+	spans := endedSpans(sr)
+	srv := spans["AccountService.GetUserBalance"]
+	if srv == nil {
+		t.Fatal("Expected service span, got: ", spans)
+	}
+	assert.Equal(t, codes.Error, srv.Status().Code)
+	assert.Len(t, srv.Events(), 1)
+	assert.Equal(t, codes.Unset, spans["GET /accounts/:id/balance"].Status().Code)
+}
+
+func TestTracingGrpcSpans(t *testing.T) {
+	sr := newSpanRecorder(t)
+	client := newGrpcClient(t, &MockAccountRepository{
+		getBalanceFunc: func(dt server.BalanceData) (float64, error) {
+			return 10, nil
+		},
+	})
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "traceparent", TEST_TRACEPARENT)
+	_, err := client.Balance(ctx, &pb.BalanceRequest{Id: 1})
+	assert.Nil(t, err)
+
+	spans := endedSpans(sr)
+	var root sdktrace.ReadOnlySpan
+	for name, s := range spans {
+		if s.SpanKind() == trace.SpanKindServer {
+			root = spans[name]
+		}
+	}
+	if root == nil {
+		t.Fatal("Expected server span, got: ", spans)
+	}
+	assert.Equal(t, TEST_TRACE_ID, root.SpanContext().TraceID().String())
+	assert.Equal(t, TEST_PARENT_SPAN, root.Parent().SpanID().String())
+	assert.Equal(t, root.SpanContext().SpanID(), spans["AccountService.GetUserBalance"].Parent().SpanID())
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"balance-server/server"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ValidationTestCase struct {
+	Name   string
+	Method string
+	Path   string
+	Body   string
+	Field  string
+	Rule   string
+}
+
+var (
+	validationTestCases = []ValidationTestCase{
+		{"TransactionRequest id required", "POST", server.URL_TRANSACTION, `{"id": 0, "sum": 10}`, "id", server.RULE_REQUIRED},
+		{"TransactionRequest id gte", "POST", server.URL_TRANSACTION, `{"id": -1, "sum": 10}`, "id", server.RULE_GTE},
+		{"TransactionRequest sum required", "POST", server.URL_TRANSACTION, `{"id": 1, "sum": 0}`, "sum", server.RULE_REQUIRED},
+		{"TransactionRequest id type", "POST", server.URL_TRANSACTION, `{"id": "one", "sum": 10}`, "id", server.RULE_TYPE},
+		{"TransactionRequest malformed", "POST", server.URL_TRANSACTION, `{"id": 1,`, "", server.RULE_MALFORMED},
+		{"SendRequest sum gt", "POST", server.URL_TRANSFER, `{"id": 1, "to": 2, "sum": -5}`, "sum", server.RULE_GT},
+		{"SendRequest to required", "POST", server.URL_TRANSFER, `{"id": 1, "sum": 5}`, "to", server.RULE_REQUIRED},
+		{"SendRequest id gte", "POST", server.URL_TRANSFER, `{"id": -1, "to": 2, "sum": 5}`, "id", server.RULE_GTE},
+		{"SendRequest ids equal", "POST", server.URL_TRANSFER, `{"id": 2, "to": 2, "sum": 5}`, "to", server.RULE_NEFIELD},
+		{"BalanceRequest id required", "GET", server.URL_BALANCE, `{"currency": "RUB"}`, "id", server.RULE_REQUIRED},
+		{"BalanceRequest id gte", "GET", server.URL_BALANCE, `{"id": -5}`, "id", server.RULE_GTE},
+		{"TransactionsRequest id gte", "GET", server.URL_TRANSACTIONS, `{"id": -1}`, "id", server.RULE_GTE},
+		{"TransactionsRequest from gte", "GET", server.URL_TRANSACTIONS, `{"id": 1, "from": -1}`, "from", server.RULE_GTE},
+		{"TransactionsRequest start after end", "GET", server.URL_TRANSACTIONS, `{"id": 1, "start": 10, "end": 5}`, "start", server.RULE_LTEFIELD},
+		{"AccountUri id type", "GET", "/accounts/one/balance", "", "", server.RULE_TYPE},
+		{"AccountUri id gte", "GET", "/accounts/-1/transactions", "", "id", server.RULE_GTE},
+		{"TransactionsQuery cursor gte", "GET", "/accounts/1/transactions?cursor=-1", "", "cursor", server.RULE_GTE},
+		{"TransactionsQuery start type", "GET", "/accounts/1/transactions?start=today", "", "", server.RULE_TYPE},
+		{"TransactionsQuery start after end", "GET", "/accounts/1/transactions?start=10&end=5", "", "start", server.RULE_LTEFIELD},
+	}
+)
+
+func TestRequestValidation(t *testing.T) {
+	for _, tc := range validationTestCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.Method, tc.Path, bytes.NewBufferString(tc.Body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, authorized(req))
+			var result map[string]interface{}
+			if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			res := TestTable{int(result["status"].(float64)), result["data"], rec.Code}
+			httpTest(t, &res, &TestTable{server.ERROR_WRONG_REQUEST, STATUS_ANY, 400})
+			validationTest(t, &res, tc.Field, tc.Rule)
+		})
+	}
+}
+
+func TestValidationRuleCodes(t *testing.T) {
+	seen := map[int]string{}
+	for rule, code := range server.VALIDATION_RULE_CODE {
+		other, ok := seen[code]
+		assert.False(t, ok, "Rules ", rule, " and ", other, " share code ", code)
+		seen[code] = rule
+		for _, l := range server.Messages.Locales() {
+			assert.NotEmpty(t, server.Messages.Status(l, code), "Rule ", rule, " has no message in locale ", l)
+		}
+	}
+}
+
+func validationTest(t *testing.T, res *TestTable, field string, rule string) {
+	errs, ok := res.Message.([]interface{})
+	if !assert.True(t, ok, "Expected list of validation errors, but got: ", res.Message) {
+		return
+	}
+	for _, e := range errs {
+		v := e.(map[string]interface{})
+		if v["field"] == field && v["rule"] == rule {
+			assert.Equal(t, float64(server.VALIDATION_RULE_CODE[rule]), v["code"])
+			assert.NotEmpty(t, v["message"])
+			return
+		}
+	}
+	t.Error("Expected validation error for field ", field, " with rule ", rule, ", but got: ", errs)
+}